@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// archiveFormat returns the Content-Type of an archive with the name, or an
+// error if it isn't a kind of archive that can be made
+func archiveFormat(name string) (string, error) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "application/zip", nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "application/gzip", nil
+	default:
+		return "", fmt.Errorf("Invalid archive name %q, expected a name ending in .zip, .tar.gz or .tgz", name)
+	}
+}
+
+// archiveStagingSize estimates the space needed to stage the archive,
+// assuming it's no bigger than the files in it
+func archiveStagingSize(artifacts []*api.Artifact) int64 {
+	var total int64
+	for _, artifact := range artifacts {
+		total += artifact.FileSize
+	}
+	return total
+}
+
+// archiveArtifacts writes the artifacts into a single archive in dir, named
+// by ArchiveName, with each file stored at its artifact's path. The archive
+// is staged rather than streamed, as its size and checksums are needed to
+// create it on Buildkite before it's uploaded.
+func (a *ArtifactUploader) archiveArtifacts(artifacts []*api.Artifact, dir string) (*api.Artifact, error) {
+	contentType, err := archiveFormat(a.conf.ArchiveName)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.TempFile(dir, "archive-")
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	hash := sha1.New()
+	hash256 := sha256.New()
+	counter := &countingWriter{}
+	w := io.MultiWriter(out, hash, hash256, counter)
+
+	if contentType == "application/zip" {
+		err = writeZipArchive(w, artifacts)
+	} else {
+		err = writeTarGzArchive(w, artifacts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	a.logger.Info("Archived %d files into %s (%s)", len(artifacts), a.conf.ArchiveName, formatByteSize(counter.n))
+
+	return &api.Artifact{
+		Path:         a.conf.ArchiveName,
+		AbsolutePath: out.Name(),
+		FileSize:     counter.n,
+		Sha1Sum:      fmt.Sprintf("%x", hash.Sum(nil)),
+		Sha256Sum:    fmt.Sprintf("%x", hash256.Sum(nil)),
+		ContentType:  contentType,
+	}, nil
+}
+
+func writeZipArchive(w io.Writer, artifacts []*api.Artifact) error {
+	zw := zip.NewWriter(w)
+
+	for _, artifact := range artifacts {
+		info, err := os.Stat(artifact.AbsolutePath)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(artifact.Path)
+		header.Method = zip.Deflate
+
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyArtifactFile(entry, artifact); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeTarGzArchive(w io.Writer, artifacts []*api.Artifact) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, artifact := range artifacts {
+		info, err := os.Stat(artifact.AbsolutePath)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(artifact.Path)
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyArtifactFile(tw, artifact); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyArtifactFile writes the contents of the artifact's file to w
+func copyArtifactFile(w io.Writer, artifact *api.Artifact) error {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
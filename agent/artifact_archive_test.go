@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	for name, contentType := range map[string]string{
+		"coverage.zip":    "application/zip",
+		"coverage.tar.gz": "application/gzip",
+		"coverage.tgz":    "application/gzip",
+	} {
+		got, err := archiveFormat(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, contentType, got, name)
+	}
+
+	_, err := archiveFormat("coverage.rar")
+	assert.EqualError(t, err, `Invalid archive name "coverage.rar", expected a name ending in .zip, .tar.gz or .tgz`)
+}
+
+func TestArchiveArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"coverage/a.out":     "llamas",
+		"coverage/sub/b.out": "alpacas",
+	}
+	artifacts := []*api.Artifact{}
+	for path, content := range files {
+		absolutePath := filepath.Join(dir, filepath.FromSlash(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(absolutePath), 0755))
+		require.NoError(t, ioutil.WriteFile(absolutePath, []byte(content), 0600))
+		artifacts = append(artifacts, &api.Artifact{Path: path, AbsolutePath: absolutePath, FileSize: int64(len(content))})
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		read        func(t *testing.T, path string) map[string]string
+	}{
+		{"coverage.zip", "application/zip", readZipArchive},
+		{"coverage.tar.gz", "application/gzip", readTarGzArchive},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{ArchiveName: tc.name})
+
+			archive, err := uploader.archiveArtifacts(artifacts, dir)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.name, archive.Path)
+			assert.Equal(t, tc.contentType, archive.ContentType)
+
+			data, err := ioutil.ReadFile(archive.AbsolutePath)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), archive.FileSize)
+			assert.Equal(t, fmt.Sprintf("%x", sha1.Sum(data)), archive.Sha1Sum)
+
+			assert.Equal(t, files, tc.read(t, archive.AbsolutePath))
+		})
+	}
+}
+
+func readZipArchive(t *testing.T, path string) map[string]string {
+	r, err := zip.OpenReader(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func readTarGzArchive(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+
+	files := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(data)
+	}
+	return files
+}
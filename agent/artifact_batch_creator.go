@@ -17,6 +17,10 @@ type ArtifactBatchCreatorConfig struct {
 
 	// Where the artifacts are being uploaded to on the command line
 	UploadDestination string
+
+	// If set, asks Buildkite to keep the artifacts for this many days
+	// rather than the default retention
+	RetentionDays int
 }
 
 type ArtifactBatchCreator struct {
@@ -41,6 +45,8 @@ func NewArtifactBatchCreator(l logger.Logger, ac APIClient, c ArtifactBatchCreat
 func (a *ArtifactBatchCreator) Create() ([]*api.Artifact, error) {
 	length := len(a.conf.Artifacts)
 	chunks := 30
+	retentionDays := a.conf.RetentionDays
+	retentionWarned := false
 
 	// Split into the artifacts into chunks so we're not uploading a ton of
 	// files at once.
@@ -61,6 +67,7 @@ func (a *ArtifactBatchCreator) Create() ([]*api.Artifact, error) {
 			ID:                api.NewUUID(),
 			Artifacts:         theseArtifacts,
 			UploadDestination: a.conf.UploadDestination,
+			RetentionDays:     retentionDays,
 		}
 
 		a.logger.Info("Creating (%d-%d)/%d artifacts", i, j, length)
@@ -72,6 +79,16 @@ func (a *ArtifactBatchCreator) Create() ([]*api.Artifact, error) {
 		// Retry the batch upload a couple of times
 		err = retry.Do(func(s *retry.Stats) error {
 			creation, resp, err = a.apiClient.CreateArtifacts(a.conf.JobID, batch)
+
+			// The retention is a request, so create the artifacts with
+			// the default retention if it's rejected
+			if resp != nil && resp.StatusCode == 422 && batch.RetentionDays > 0 {
+				a.logger.Warn("Buildkite rejected the requested retention of %d days, using the default retention instead (%s)", batch.RetentionDays, err)
+				retentionDays = 0
+				batch.RetentionDays = 0
+				creation, resp, err = a.apiClient.CreateArtifacts(a.conf.JobID, batch)
+			}
+
 			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
 				s.Break()
 			}
@@ -87,6 +104,17 @@ func (a *ArtifactBatchCreator) Create() ([]*api.Artifact, error) {
 			return nil, err
 		}
 
+		if batch.RetentionDays > 0 && creation.RetentionDays != batch.RetentionDays && !retentionWarned {
+			if creation.RetentionDays == 0 {
+				a.logger.Warn("Buildkite didn't apply the requested retention of %d days, the artifacts will have the default retention", batch.RetentionDays)
+			} else {
+				a.logger.Warn("Buildkite applied a retention of %d days rather than the requested %d days", creation.RetentionDays, batch.RetentionDays)
+			}
+
+			// Only warn once, rather than for every batch
+			retentionWarned = true
+		}
+
 		// Save the id and instructions to each artifact
 		index := 0
 		for _, id := range creation.ArtifactIDs {
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactBatchCreatorRequestsRetention(t *testing.T) {
+	requested := []int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var batch api.ArtifactBatch
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		requested = append(requested, batch.RetentionDays)
+
+		// Reject the retention the first time
+		if batch.RetentionDays > 0 {
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+			rw.Write([]byte(`{"message":"retention_days is not allowed"}`))
+			return
+		}
+
+		json.NewEncoder(rw).Encode(api.ArtifactBatchCreateResponse{ID: batch.ID, ArtifactIDs: []string{"llama"}})
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	creator := NewArtifactBatchCreator(logger.Discard, client, ArtifactBatchCreatorConfig{
+		JobID:         "job",
+		Artifacts:     []*api.Artifact{{Path: "llamas.txt"}},
+		RetentionDays: 30,
+	})
+
+	artifacts, err := creator.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []int{30, 0}, requested)
+	assert.Equal(t, "llama", artifacts[0].ID)
+}
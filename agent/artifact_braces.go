@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"strings"
+)
+
+// uploadPatterns returns the patterns of the paths to upload, with their
+// brace alternations expanded, in the order they're given
+func (a *ArtifactUploader) uploadPatterns() []string {
+	var patterns []string
+	seen := map[string]bool{}
+
+	for _, path := range strings.Split(a.conf.Paths, ArtifactPathDelimiter) {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		for _, pattern := range expandBraces(path) {
+			if pattern == "" || seen[pattern] {
+				continue
+			}
+			seen[pattern] = true
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// expandBraces expands the brace alternations in the pattern like a shell
+// does, so build/{unit,integration}/*.xml is build/unit/*.xml and
+// build/integration/*.xml. Alternations can be nested, and can be empty, so
+// log{s,} is logs and log. Braces without a comma between them, or without
+// a match, are left as they are. Braces and commas escaped with a backslash
+// are literal.
+func expandBraces(pattern string) []string {
+	expanded := expandBraceAlternations(pattern)
+	for i, p := range expanded {
+		expanded[i] = unescapeBraces(p)
+	}
+	return expanded
+}
+
+func expandBraceAlternations(pattern string) []string {
+	for start := 0; start < len(pattern); start++ {
+		switch pattern[start] {
+		case '\\':
+			start++ // skip what's escaped
+			continue
+		case '{':
+		default:
+			continue
+		}
+
+		end, commas := matchBrace(pattern, start)
+		if end < 0 || len(commas) == 0 {
+			continue
+		}
+
+		prefix, suffix := pattern[:start], pattern[end+1:]
+
+		var expanded []string
+		from := start + 1
+		for _, to := range append(commas, end) {
+			alternative := pattern[from:to]
+			expanded = append(expanded, expandBraceAlternations(prefix+alternative+suffix)...)
+			from = to + 1
+		}
+		return expanded
+	}
+
+	return []string{pattern}
+}
+
+// matchBrace returns the index of the brace that closes the one at start, or
+// -1 if it isn't closed, along with the indexes of the commas directly within
+// them
+func matchBrace(pattern string, start int) (int, []int) {
+	depth := 0
+	var commas []int
+
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i, commas
+			}
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+// unescapeBraces removes the backslashes escaping braces and commas, leaving
+// any others, such as Windows path separators, as they are
+func unescapeBraces(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) && strings.IndexByte("{},", pattern[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandBraces(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		expected []string
+	}{
+		{"build/*.xml", []string{"build/*.xml"}},
+		{"build/{unit,integration}/**/*.xml", []string{"build/unit/**/*.xml", "build/integration/**/*.xml"}},
+		{"{a,b}/{c,d}.log", []string{"a/c.log", "a/d.log", "b/c.log", "b/d.log"}},
+		{"{a,b{c,d}}/*.log", []string{"a/*.log", "bc/*.log", "bd/*.log"}},
+		{"{a,{b,{c,d}}}", []string{"a", "b", "c", "d"}},
+		{"log{s,}/*.txt", []string{"logs/*.txt", "log/*.txt"}},
+		{"{,a}", []string{"", "a"}},
+		{`\{a,b\}/*.log`, []string{"{a,b}/*.log"}},
+		{`{a\,b,c}`, []string{"a,b", "c"}},
+		{`{a,b}/\{c\}`, []string{"a/{c}", "b/{c}"}},
+		{"{a}/*.log", []string{"{a}/*.log"}},
+		{"{a,b/*.log", []string{"{a,b/*.log"}},
+		{"a,b}/*.log", []string{"a,b}/*.log"}},
+		{`C:\build\*.log`, []string{`C:\build\*.log`}},
+	} {
+		assert.Equal(t, tc.expected, expandBraces(tc.pattern), tc.pattern)
+	}
+}
+
+func TestUploadPatterns(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths: "build/{unit,integration}/*.xml; build/unit/*.xml;log{s,}",
+	})
+	assert.Equal(t, []string{"build/unit/*.xml", "build/integration/*.xml", "logs", "log"}, uploader.uploadPatterns())
+}
+
+func TestCollectWithBraces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-braces")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{
+		"build/unit/a.xml",
+		"build/unit/skip/b.xml",
+		"build/integration/nested/c.xml",
+		"build/e2e/d.xml",
+	} {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0644))
+	}
+
+	artifacts, err := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:   "build/{unit,integration}/**/*.xml",
+		BaseDir: dir,
+		Exclude: []string{"build/{unit,e2e}/skip/**"},
+	}).Collect()
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, filepath.ToSlash(a.Path))
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"build/integration/nested/c.xml", "build/unit/a.xml"}, paths)
+}
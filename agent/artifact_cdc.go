@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/pool"
+)
+
+const (
+	// The suffix of the chunk list uploaded in place of a file in CDC mode
+	ArtifactCDCManifestSuffix = ".cdc.json"
+
+	// Where chunks are stored, relative to the upload destination
+	ArtifactCDCChunkPrefix = ".buildkite-cdc/chunks/"
+
+	cdcAlgorithm = "gear-sha256"
+	cdcMinSize   = 256 << 10
+	cdcMaxSize   = 4 << 20
+
+	// A boundary is found when the top 20 bits of the rolling hash are zero,
+	// giving chunks of about 1MiB on average
+	cdcBoundaryBits = 20
+)
+
+// The chunk list uploaded as "<path>.cdc.json" in place of a file. It's JSON
+// with these fields:
+//
+//	version       always 1
+//	algorithm     always "gear-sha256", the chunking algorithm used
+//	chunk_prefix  where chunks are stored, relative to the upload destination
+//	size          the size of the file in bytes
+//	sha1sum       the hex SHA-1 of the file
+//	chunks        the chunks of the file in order, each with the hex
+//	              "sha256" of its contents and its "size" in bytes
+//
+// Each chunk is stored at <chunk_prefix><first 2 characters of sha256>/<sha256>,
+// so the file is the concatenation of those objects.
+type cdcManifest struct {
+	Version     int        `json:"version"`
+	Algorithm   string     `json:"algorithm"`
+	ChunkPrefix string     `json:"chunk_prefix"`
+	Size        int64      `json:"size"`
+	Sha1Sum     string     `json:"sha1sum"`
+	Chunks      []cdcChunk `json:"chunks"`
+}
+
+type cdcChunk struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// The gear table for the rolling hash. Entry i is the first 8 bytes (big
+// endian) of SHA-256("buildkite-cdc-gear" || i), so it's reproducible.
+var cdcGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256(append([]byte("buildkite-cdc-gear"), byte(i)))
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return
+}()
+
+func cdcChunkFor(data []byte) cdcChunk {
+	sum := sha256.Sum256(data)
+	return cdcChunk{Sha256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
+
+// cdcChunkPath is the path of a chunk relative to the upload destination
+func cdcChunkPath(hash string) string {
+	return ArtifactCDCChunkPrefix + hash[:2] + "/" + hash
+}
+
+// chunkFile splits the file into content defined chunks, calling fn with each
+// chunk's data. Only one chunk is held in memory at a time.
+func chunkFile(path string, fn func(data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	buf := make([]byte, 0, cdcMaxSize)
+	var h uint64
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		buf = append(buf, b)
+		h = (h << 1) + cdcGear[b]
+
+		if (len(buf) >= cdcMinSize && h>>(64-cdcBoundaryBits) == 0) || len(buf) >= cdcMaxSize {
+			if err := fn(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			h = 0
+		}
+	}
+
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+	return nil
+}
+
+// cdcStagingSize is about how much space is needed to stage chunks, as each
+// file being uploaded has one chunk staged at a time
+func cdcStagingSize(artifacts []*api.Artifact) (size int64) {
+	for _, artifact := range artifacts {
+		if artifact.FileSize < cdcMaxSize {
+			size += artifact.FileSize
+		} else {
+			size += cdcMaxSize
+		}
+	}
+	return size
+}
+
+// uploadCDC uploads the chunks of each artifact that the store doesn't already
+// have, and returns artifacts for the chunk list of each file to upload in
+// their place. Chunk lists are written to dir.
+func (a *ArtifactUploader) uploadCDC(uploader Uploader, refresher *credentialRefresher, store DurableUploader, artifacts []*api.Artifact, dir string) ([]*api.Artifact, error) {
+	manifests := make([]*api.Artifact, len(artifacts))
+
+	p := pool.New(a.concurrency())
+	errs := []error{}
+
+	var chunksUploaded, chunksSkipped int
+
+	for i, artifact := range artifacts {
+		i, artifact := i, artifact
+
+		p.Spawn(func() {
+			manifest := &cdcManifest{
+				Version:     1,
+				Algorithm:   cdcAlgorithm,
+				ChunkPrefix: ArtifactCDCChunkPrefix,
+				Size:        artifact.FileSize,
+				Sha1Sum:     artifact.Sha1Sum,
+			}
+
+			err := chunkFile(artifact.AbsolutePath, func(data []byte) error {
+				chunk := cdcChunkFor(data)
+				manifest.Chunks = append(manifest.Chunks, chunk)
+
+				uploaded, err := a.uploadCDCChunk(uploader, refresher, store, artifact, chunk.Sha256, data, dir)
+
+				p.Lock()
+				if uploaded {
+					chunksUploaded++
+				} else if err == nil {
+					chunksSkipped++
+				}
+				p.Unlock()
+
+				return err
+			})
+			if err == nil {
+				manifests[i], err = a.writeCDCManifest(artifact, manifest, dir)
+			}
+
+			if err != nil {
+				a.logger.Error("Error uploading the chunks of \"%s\": %s", artifact.Path, err)
+
+				p.Lock()
+				errs = append(errs, err)
+				p.Unlock()
+			}
+		})
+	}
+
+	p.Wait()
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("There were errors with uploading the chunks of %d artifacts", len(errs))
+	}
+
+	a.logger.Info("Uploaded %d new chunks, %d chunks were already uploaded", chunksUploaded, chunksSkipped)
+
+	return manifests, nil
+}
+
+// uploadCDCChunk uploads a chunk if the store doesn't have it, returning
+// whether it was uploaded
+func (a *ArtifactUploader) uploadCDCChunk(uploader Uploader, refresher *credentialRefresher, store DurableUploader, artifact *api.Artifact, hash string, data []byte, dir string) (bool, error) {
+	chunk := &api.Artifact{
+		Path:        cdcChunkPath(hash),
+		FileSize:    int64(len(data)),
+		ContentType: ArtifactFallbackMimeType,
+	}
+
+	exists, err := store.Exists(chunk)
+	if err != nil {
+		return false, fmt.Errorf("Error checking for chunk %s: %v", hash, err)
+	} else if exists {
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "chunk-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+
+	chunk.AbsolutePath = f.Name()
+	chunk.Sha1Sum = fmt.Sprintf("%x", sha1.Sum(data))
+
+	a.logger.Debug("Uploading chunk %s of %s (%d bytes)", hash, artifact.Path, len(data))
+
+	err = a.uploadWithRetries(uploader, refresher, chunk, func() error {
+		return a.attemptUpload(uploader, refresher, chunk)
+	})
+
+	return err == nil, err
+}
+
+func (a *ArtifactUploader) writeCDCManifest(artifact *api.Artifact, manifest *cdcManifest, dir string) (*api.Artifact, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(dir, "manifest-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	m, err := a.build(artifact.Path+ArtifactCDCManifestSuffix, f.Name(), artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	m.ContentType = "application/json"
+	m.Metadata = artifact.Metadata
+
+	return m, nil
+}
+
+// reassembleCDC rebuilds the file described by the chunk list at manifestPath
+// into path, using fetch to get the path of a downloaded chunk
+func reassembleCDC(manifestPath string, path string, fetch func(chunkPath string) (string, error)) error {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var manifest cdcManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("Error parsing chunk list %s: %v", manifestPath, err)
+	}
+	if manifest.Version != 1 || manifest.Algorithm != cdcAlgorithm {
+		return fmt.Errorf("Unsupported chunk list %s (version %d, algorithm %q)", manifestPath, manifest.Version, manifest.Algorithm)
+	}
+
+	tmp := path + ".reassembling"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	hash := sha1.New()
+	w := io.MultiWriter(out, hash)
+
+	for _, chunk := range manifest.Chunks {
+		if err := copyCDCChunk(w, manifest.ChunkPrefix, chunk, fetch); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != manifest.Sha1Sum {
+		return fmt.Errorf("Reassembled %s has a SHA-1 of %s, but should be %s", path, sum, manifest.Sha1Sum)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func copyCDCChunk(w io.Writer, prefix string, chunk cdcChunk, fetch func(chunkPath string) (string, error)) error {
+	if len(chunk.Sha256) < 2 || strings.ContainsAny(chunk.Sha256, `/\.`) {
+		return fmt.Errorf("Invalid chunk hash %q", chunk.Sha256)
+	}
+
+	chunkPath, err := fetch(prefix + chunk.Sha256[:2] + "/" + chunk.Sha256)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(chunkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), f)
+	if err != nil {
+		return err
+	}
+
+	if n != chunk.Size || hex.EncodeToString(hash.Sum(nil)) != chunk.Sha256 {
+		return fmt.Errorf("Chunk %s is corrupt", chunk.Sha256)
+	}
+
+	return nil
+}
+
+// reassembleCDC rebuilds each downloaded chunk list into the file it
+// describes, downloading the chunks from where the chunk list was uploaded
+func (a *ArtifactDownloader) reassembleCDC(artifacts []*api.Artifact, downloadDestination string) error {
+	for _, artifact := range artifacts {
+		if !strings.HasSuffix(artifact.Path, ArtifactCDCManifestSuffix) {
+			continue
+		}
+
+		if artifact.UploadDestination == "" {
+			return fmt.Errorf("Can't reassemble %s, as it wasn't uploaded to a destination chunks can be downloaded from", artifact.Path)
+		}
+
+		chunkDir, err := ioutil.TempDir("", "buildkite-artifact-cdc")
+		if err != nil {
+			return err
+		}
+
+		// Chunks can repeat, so they're only downloaded once per file
+		fetched := map[string]string{}
+		fetch := func(chunkPath string) (string, error) {
+			if p, ok := fetched[chunkPath]; ok {
+				return p, nil
+			}
+
+			chunk := &api.Artifact{Path: chunkPath, UploadDestination: artifact.UploadDestination}
+			if err := a.download(chunk, chunkPath, chunkDir); err != nil {
+				return "", fmt.Errorf("Error downloading chunk %s: %v", chunkPath, err)
+			}
+
+			fetched[chunkPath] = getTargetPath(chunkPath, chunkDir)
+			return fetched[chunkPath], nil
+		}
+
+		manifestPath := getTargetPath(artifact.Path, downloadDestination)
+		path := strings.TrimSuffix(manifestPath, ArtifactCDCManifestSuffix)
+
+		err = reassembleCDC(manifestPath, path, fetch)
+		os.RemoveAll(chunkDir)
+		if err != nil {
+			return err
+		}
+
+		a.logger.Info("Reassembled %s from its chunks", strings.TrimSuffix(artifact.Path, ArtifactCDCManifestSuffix))
+		os.Remove(manifestPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chunkSizes(t *testing.T, path string) []int {
+	var sizes []int
+	require.NoError(t, chunkFile(path, func(data []byte) error {
+		sizes = append(sizes, len(data))
+		return nil
+	}))
+	return sizes
+}
+
+func TestChunkFileFindsTheSameBoundariesAfterAnInsertion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cdc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	path := filepath.Join(dir, "original.bin")
+	require.NoError(t, ioutil.WriteFile(path, original, 0600))
+
+	sizes := chunkSizes(t, path)
+	assert.True(t, len(sizes) > 2)
+
+	total := 0
+	for _, size := range sizes[:len(sizes)-1] {
+		assert.True(t, size >= cdcMinSize && size <= cdcMaxSize, "chunk of %d bytes", size)
+		total += size
+	}
+	assert.Equal(t, len(original), total+sizes[len(sizes)-1])
+
+	// Chunking is deterministic
+	assert.Equal(t, sizes, chunkSizes(t, path))
+
+	// Inserting bytes only changes the chunk they're inserted into
+	inserted := append(append(append([]byte{}, original[:100]...), []byte("inserted")...), original[100:]...)
+	insertedPath := filepath.Join(dir, "inserted.bin")
+	require.NoError(t, ioutil.WriteFile(insertedPath, inserted, 0600))
+
+	insertedSizes := chunkSizes(t, insertedPath)
+	assert.Equal(t, sizes[0]+len("inserted"), insertedSizes[0])
+	assert.Equal(t, sizes[1:], insertedSizes[1:])
+}
+
+func TestReassembleCDC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cdc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(original)
+
+	path := filepath.Join(dir, "original.bin")
+	require.NoError(t, ioutil.WriteFile(path, original, 0600))
+
+	// Store the chunks the way they'd be uploaded
+	manifest := cdcManifest{
+		Version:     1,
+		Algorithm:   cdcAlgorithm,
+		ChunkPrefix: ArtifactCDCChunkPrefix,
+		Size:        int64(len(original)),
+		Sha1Sum:     fmt.Sprintf("%x", sha1.Sum(original)),
+	}
+	store := map[string][]byte{}
+	require.NoError(t, chunkFile(path, func(data []byte) error {
+		chunk := cdcChunkFor(data)
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		store[cdcChunkPath(chunk.Sha256)] = append([]byte{}, data...)
+		return nil
+	}))
+
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestPath := filepath.Join(dir, "reassembled.bin"+ArtifactCDCManifestSuffix)
+	require.NoError(t, ioutil.WriteFile(manifestPath, data, 0600))
+
+	fetch := func(chunkPath string) (string, error) {
+		data, ok := store[chunkPath]
+		if !ok {
+			return "", fmt.Errorf("No chunk at %s", chunkPath)
+		}
+		p := filepath.Join(dir, filepath.Base(chunkPath))
+		return p, ioutil.WriteFile(p, data, 0600)
+	}
+
+	reassembledPath := filepath.Join(dir, "reassembled.bin")
+	require.NoError(t, reassembleCDC(manifestPath, reassembledPath, fetch))
+
+	reassembled, err := ioutil.ReadFile(reassembledPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(original, reassembled))
+
+	// A corrupt chunk is detected
+	store[cdcChunkPath(manifest.Chunks[0].Sha256)][0] ^= 0xff
+	require.NoError(t, os.Remove(reassembledPath))
+
+	err = reassembleCDC(manifestPath, reassembledPath, fetch)
+	assert.EqualError(t, err, fmt.Sprintf("Chunk %s is corrupt", manifest.Chunks[0].Sha256))
+
+	_, err = os.Stat(reassembledPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// How much of the start of a file is looked at to detect its charset
+const charsetSampleSize = 8 * 1024
+
+// Content-Types that aren't text/* but are text, and can have a charset
+var textContentTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/xml":        true,
+	"application/javascript": true,
+}
+
+// textContentType returns whether the Content-Type is text that can have a
+// charset, and whether it already has one
+func textContentType(contentType string) (text bool, charset bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, false
+	}
+	_, charset = params["charset"]
+	return strings.HasPrefix(mediaType, "text/") || textContentTypes[mediaType], charset
+}
+
+// detectCharset guesses the charset of text from a sample of its start, by
+// its byte order mark, or else by whether it's valid UTF-8, looks like UTF-16
+// or could only be Latin-1. It returns an empty string if it isn't confident.
+// cutOff is whether the text carries on past the sample.
+func detectCharset(sample []byte, cutOff bool) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case len(sample) == 0:
+		return ""
+	}
+
+	// Mostly ASCII UTF-16 has a zero in every other byte
+	if len(sample) >= 4 {
+		var evenZeros, oddZeros int
+		for i, b := range sample {
+			if b != 0 {
+				continue
+			}
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+
+		pairs := len(sample) / 2
+		switch {
+		case oddZeros > pairs*3/4 && evenZeros <= pairs/20:
+			return "utf-16le"
+		case evenZeros > pairs*3/4 && oddZeros <= pairs/20:
+			return "utf-16be"
+		}
+	}
+
+	// A sample that's cut off can end part way through a character
+	trimmed := sample
+	if cutOff {
+		for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(sample[i]) {
+				if !utf8.FullRune(sample[i:]) {
+					trimmed = sample[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(trimmed) && !bytes.ContainsRune(trimmed, 0) {
+		return "utf-8"
+	}
+
+	// Other text without control characters is most likely Latin-1, or its
+	// Windows superset if it uses the C1 range for punctuation
+	windows := false
+	for _, b := range sample {
+		switch {
+		case b == '\t' || b == '\n' || b == '\r' || b == '\f':
+		case b < 0x20 || b == 0x7f:
+			return ""
+		case b >= 0x80 && b < 0xa0:
+			windows = true
+		}
+	}
+	if windows {
+		return "windows-1252"
+	}
+	return "iso-8859-1"
+}
+
+// withDetectedCharset adds the charset of the file to a text Content-Type that
+// doesn't have one, if it can be detected
+func withDetectedCharset(contentType string, file io.ReaderAt) string {
+	text, charset := textContentType(contentType)
+	if !text || charset {
+		return contentType
+	}
+
+	sample := make([]byte, charsetSampleSize)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return contentType
+	}
+
+	if detected := detectCharset(sample[:n], n == len(sample)); detected != "" {
+		return contentType + "; charset=" + detected
+	}
+	return contentType
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCharset(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Sample   []byte
+		CutOff   bool
+		Expected string
+	}{
+		{"empty", []byte{}, false, ""},
+		{"utf-8 bom", []byte("\xef\xbb\xbfllamas"), false, "utf-8"},
+		{"utf-16le bom", []byte("\xff\xfel\x00l\x00"), false, "utf-16le"},
+		{"utf-16be bom", []byte("\xfe\xff\x00l\x00l"), false, "utf-16be"},
+		{"utf-16le", []byte("l\x00l\x00a\x00m\x00a\x00s\x00"), false, "utf-16le"},
+		{"utf-16be", []byte("\x00l\x00l\x00a\x00m\x00a\x00s"), false, "utf-16be"},
+		{"ascii", []byte("llamas\r\n"), false, "utf-8"},
+		{"utf-8", []byte("llamas \xe2\x9c\x93"), false, "utf-8"},
+		{"utf-8 cut off", []byte("llamas \xe2\x9c"), true, "utf-8"},
+		{"latin-1 at the end", []byte("caf\xe9"), false, "iso-8859-1"},
+		{"latin-1", []byte("caf\xe9 cr\xe8me"), false, "iso-8859-1"},
+		{"windows-1252", []byte("\x93quoted\x94 caf\xe9"), false, "windows-1252"},
+		{"binary", []byte("\x89PNG\r\n\x1a\n\x00\x00"), false, ""},
+	} {
+		assert.Equal(t, tc.Expected, detectCharset(tc.Sample, tc.CutOff), tc.Name)
+	}
+}
+
+func TestWithDetectedCharset(t *testing.T) {
+	utf16 := bytes.NewReader([]byte("\xff\xfel\x00l\x00"))
+
+	assert.Equal(t, "text/plain; charset=utf-16le", withDetectedCharset("text/plain", utf16))
+	assert.Equal(t, "application/json; charset=utf-16le", withDetectedCharset("application/json", utf16))
+	assert.Equal(t, "text/plain; charset=utf-8", withDetectedCharset("text/plain; charset=utf-8", utf16))
+	assert.Equal(t, "image/png", withDetectedCharset("image/png", utf16))
+}
+
+func TestBuildWithDetectCharset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-charset")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "build.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte("caf\xe9\n"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{DetectCharset: true})
+	artifact, err := uploader.build("build.log", path, "*.log")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=iso-8859-1", artifact.ContentType)
+
+	// An explicit Content-Type is left alone
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{DetectCharset: true, ContentType: "text/plain"})
+	artifact, err = uploader.build("build.log", path, "*.log")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", artifact.ContentType)
+}
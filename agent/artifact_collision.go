@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// A CollisionPolicy decides what happens when an artifact would be uploaded
+// to the same key as another artifact, or an object that already exists
+type CollisionPolicy string
+
+const (
+	// Upload over the top of whatever has the key, which is the default
+	CollisionOverwrite CollisionPolicy = "overwrite"
+
+	// Fail the upload before anything is uploaded
+	CollisionFail CollisionPolicy = "fail"
+
+	// Upload under a new key, with an incrementing counter appended to the
+	// file name, e.g. logs/build-1.log
+	CollisionRename CollisionPolicy = "rename"
+)
+
+func ParseCollisionPolicy(s string) (CollisionPolicy, error) {
+	switch p := CollisionPolicy(s); p {
+	case "":
+		return CollisionOverwrite, nil
+	case CollisionOverwrite, CollisionFail, CollisionRename:
+		return p, nil
+	default:
+		return "", fmt.Errorf("Invalid collision policy %q, must be one of %q, %q or %q", s, CollisionOverwrite, CollisionFail, CollisionRename)
+	}
+}
+
+// resolveCollisions applies the collision policies to the artifacts, renaming
+// them if need be. Collisions between the artifacts themselves follow
+// OnCollision, and artifacts that already exist in the store follow IfExists,
+// if the store can check for existing objects.
+func (a *ArtifactUploader) resolveCollisions(artifacts []*api.Artifact, store DurableUploader) error {
+	checkRemote := store != nil && a.conf.IfExists != "" && a.conf.IfExists != CollisionOverwrite
+
+	exists := func(artifact *api.Artifact, key string) (bool, error) {
+		if !checkRemote {
+			return false, nil
+		}
+		probe := *artifact
+		probe.Path = key
+		found, err := store.Exists(&probe)
+		if err != nil {
+			return false, fmt.Errorf("Error checking if %q already exists: %v", key, err)
+		}
+		return found, nil
+	}
+
+	// The paths in use are kept across calls, so artifacts uploaded in
+	// batches collide with those in earlier batches too
+	if a.usedPaths == nil {
+		a.usedPaths = map[string]bool{}
+	}
+	used := a.usedPaths
+	renamed := 0
+
+	for _, artifact := range artifacts {
+		policy := CollisionOverwrite
+		reason := ""
+
+		if used[artifact.Path] {
+			policy, reason = a.conf.OnCollision, "another artifact has the same path"
+		} else if found, err := exists(artifact, artifact.Path); err != nil {
+			return err
+		} else if found {
+			policy, reason = a.conf.IfExists, "it already exists at the upload destination"
+		}
+
+		switch policy {
+		case CollisionFail:
+			return fmt.Errorf("Can't upload %q, as %s", artifact.Path, reason)
+
+		case CollisionRename:
+			for n := 1; ; n++ {
+				key := renamedArtifactPath(artifact.Path, n)
+				if used[key] {
+					continue
+				}
+				found, err := exists(artifact, key)
+				if err != nil {
+					return err
+				}
+				if !found {
+					a.logger.Info("Uploading %q as %q, as %s", artifact.Path, key, reason)
+					artifact.Path = key
+					renamed++
+					break
+				}
+			}
+		}
+
+		used[artifact.Path] = true
+	}
+
+	if renamed > 0 {
+		a.logger.Info("Renamed %d artifacts to avoid collisions", renamed)
+	}
+
+	return nil
+}
+
+// renamedArtifactPath appends the counter to the file name, before any
+// extensions, so logs/build.tar.gz becomes logs/build-1.tar.gz
+func renamedArtifactPath(p string, n int) string {
+	dir, file := path.Split(p)
+
+	// Leading dots are part of the name, not an extension
+	trimmed := strings.TrimLeft(file, ".")
+	leading := file[:len(file)-len(trimmed)]
+
+	name, ext := trimmed, ""
+	if i := strings.Index(trimmed, "."); i > 0 {
+		name, ext = trimmed[:i], trimmed[i:]
+	}
+
+	return fmt.Sprintf("%s%s%s-%d%s", dir, leading, name, n, ext)
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type existingArtifacts map[string]bool
+
+func (e existingArtifacts) Exists(artifact *api.Artifact) (bool, error) {
+	return e[artifact.Path], nil
+}
+
+func TestRenamedArtifactPath(t *testing.T) {
+	for _, tc := range []struct {
+		Path     string
+		Expected string
+	}{
+		{"llamas", "llamas-2"},
+		{"llamas.txt", "llamas-2.txt"},
+		{"logs/build.tar.gz", "logs/build-2.tar.gz"},
+		{"logs/.env", "logs/.env-2"},
+		{"logs/.env.local", "logs/.env-2.local"},
+	} {
+		assert.Equal(t, tc.Expected, renamedArtifactPath(tc.Path, 2))
+	}
+}
+
+func TestResolveCollisionsRenames(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		OnCollision: CollisionRename,
+		IfExists:    CollisionRename,
+	})
+
+	artifacts := []*api.Artifact{
+		{Path: "llamas.txt"},
+		{Path: "llamas.txt"},
+		{Path: "llamas.txt"},
+		{Path: "alpacas.txt"},
+	}
+	store := existingArtifacts{"alpacas.txt": true, "alpacas-1.txt": true, "llamas-2.txt": true}
+
+	if err := uploader.resolveCollisions(artifacts, store); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, artifact := range artifacts {
+		paths = append(paths, artifact.Path)
+	}
+	assert.Equal(t, []string{"llamas.txt", "llamas-1.txt", "llamas-3.txt", "alpacas-2.txt"}, paths)
+}
+
+func TestResolveCollisionsFails(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		OnCollision: CollisionFail,
+	})
+
+	err := uploader.resolveCollisions([]*api.Artifact{{Path: "llamas.txt"}, {Path: "llamas.txt"}}, nil)
+	assert.Error(t, err)
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		IfExists: CollisionFail,
+	})
+
+	err = uploader.resolveCollisions([]*api.Artifact{{Path: "llamas.txt"}}, existingArtifacts{"llamas.txt": true})
+	assert.Error(t, err)
+}
+
+func TestResolveCollisionsOverwritesByDefault(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+
+	artifacts := []*api.Artifact{{Path: "llamas.txt"}, {Path: "llamas.txt"}}
+	if err := uploader.resolveCollisions(artifacts, existingArtifacts{"llamas.txt": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "llamas.txt", artifacts[1].Path)
+}
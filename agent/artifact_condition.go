@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"os"
+	"strconv"
+)
+
+// commandExitStatus returns the exit status of the job's command, as set by
+// the bootstrap once the command has finished for the post-command and
+// pre-artifact hooks and the automatic artifact upload. It returns false if
+// the command hasn't finished, e.g. when uploading from within the command.
+func commandExitStatus() (int, bool) {
+	status, err := strconv.Atoi(os.Getenv("BUILDKITE_COMMAND_EXIT_STATUS"))
+	if err != nil {
+		return 0, false
+	}
+	return status, true
+}
+
+// skipForOutcome returns whether the upload should be skipped, as it should
+// only happen when the job's command failed or succeeded and it didn't
+func (a *ArtifactUploader) skipForOutcome() bool {
+	if !a.conf.OnlyOnFailure && !a.conf.OnlyOnSuccess {
+		return false
+	}
+
+	status, ok := commandExitStatus()
+	if !ok {
+		a.logger.Warn("The command's exit status isn't known yet, as BUILDKITE_COMMAND_EXIT_STATUS isn't set, uploading the artifacts anyway")
+		return false
+	}
+
+	if a.conf.OnlyOnFailure && status == 0 {
+		a.logger.Info("Skipping the upload, as the command succeeded and artifacts are only uploaded when it fails")
+		return true
+	}
+	if a.conf.OnlyOnSuccess && status != 0 {
+		a.logger.Info("Skipping the upload, as the command failed with exit status %d and artifacts are only uploaded when it succeeds", status)
+		return true
+	}
+
+	return false
+}
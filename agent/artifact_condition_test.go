@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipForOutcome(t *testing.T) {
+	defer os.Setenv("BUILDKITE_COMMAND_EXIT_STATUS", os.Getenv("BUILDKITE_COMMAND_EXIT_STATUS"))
+
+	for _, tc := range []struct {
+		status    string
+		onFailure bool
+		onSuccess bool
+		skip      bool
+	}{
+		{status: "0", skip: false},
+		{status: "1", skip: false},
+		{status: "0", onFailure: true, skip: true},
+		{status: "1", onFailure: true, skip: false},
+		{status: "0", onSuccess: true, skip: false},
+		{status: "127", onSuccess: true, skip: true},
+		{status: "", onFailure: true, skip: false},
+		{status: "", onSuccess: true, skip: false},
+	} {
+		os.Setenv("BUILDKITE_COMMAND_EXIT_STATUS", tc.status)
+
+		uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+			OnlyOnFailure: tc.onFailure,
+			OnlyOnSuccess: tc.onSuccess,
+		})
+		assert.Equal(t, tc.skip, uploader.skipForOutcome(), "%+v", tc)
+	}
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// contentDispositionTemplate renders the Content-Disposition header each
+// artifact is stored with, with {{basename}} expanded to the artifact's file
+// name, e.g. attachment; filename="{{basename}}"
+type contentDispositionTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+func parseContentDispositionTemplate(text string) (*contentDispositionTemplate, error) {
+	tmpl, err := template.New("content-disposition").
+		Funcs(contentDispositionFuncs(&api.Artifact{})).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Content-Disposition template %q (%v)", text, err)
+	}
+
+	return &contentDispositionTemplate{text: text, tmpl: tmpl}, nil
+}
+
+func contentDispositionFuncs(artifact *api.Artifact) template.FuncMap {
+	return template.FuncMap{
+		"basename": func() string {
+			return path.Base(filepath.ToSlash(artifact.Path))
+		},
+	}
+}
+
+// render returns the artifact's Content-Disposition, or an error if it
+// can't be rendered or isn't a valid header value
+func (c *contentDispositionTemplate) render(artifact *api.Artifact) (string, error) {
+	tmpl, err := c.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Funcs(contentDispositionFuncs(artifact)).Execute(&b, nil); err != nil {
+		return "", fmt.Errorf("Couldn't render the Content-Disposition template %q for %s (%v)", c.text, artifact.Path, err)
+	}
+
+	value := strings.TrimSpace(b.String())
+	if value == "" {
+		return "", fmt.Errorf("The Content-Disposition template %q rendered nothing for %s", c.text, artifact.Path)
+	}
+
+	// Object stores sign their headers, so only printable ASCII is allowed.
+	// Other file names can be given with filename*=UTF-8''<url encoded>.
+	for _, r := range value {
+		if (r < ' ' && r != '\t') || r > '~' {
+			return "", fmt.Errorf("The Content-Disposition %q for %s isn't a valid header value, as it can only contain printable ASCII characters", value, artifact.Path)
+		}
+	}
+
+	return value, nil
+}
+
+// setContentDispositions renders the Content-Disposition of each artifact,
+// failing before any of them are uploaded if any can't be rendered
+func (a *ArtifactUploader) setContentDispositions(artifacts []*api.Artifact) error {
+	if a.contentDisposition == nil {
+		return nil
+	}
+
+	for _, artifact := range artifacts {
+		value, err := a.contentDisposition.render(artifact)
+		if err != nil {
+			return err
+		}
+		artifact.ContentDisposition = value
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentDispositionTemplate(t *testing.T) {
+	c, err := parseContentDispositionTemplate(`attachment; filename="{{basename}}"`)
+	require.NoError(t, err)
+
+	value, err := c.render(&api.Artifact{Path: "coverage/report.html"})
+	require.NoError(t, err)
+	assert.Equal(t, `attachment; filename="report.html"`, value)
+
+	value, err = c.render(&api.Artifact{Path: "llamas.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, `attachment; filename="llamas.txt"`, value)
+}
+
+func TestContentDispositionTemplateErrors(t *testing.T) {
+	_, err := parseContentDispositionTemplate("attachment; filename={{basename")
+	assert.Error(t, err)
+
+	_, err = parseContentDispositionTemplate("attachment; filename={{dirname}}")
+	assert.Error(t, err)
+
+	c, err := parseContentDispositionTemplate("attachment; filename={{basename}}")
+	require.NoError(t, err)
+
+	_, err = c.render(&api.Artifact{Path: "résumé.pdf"})
+	assert.EqualError(t, err, `The Content-Disposition "attachment; filename=résumé.pdf" for résumé.pdf isn't a valid header value, as it can only contain printable ASCII characters`)
+
+	_, err = c.render(&api.Artifact{Path: "bad\nname.txt"})
+	assert.Error(t, err)
+}
+
+func TestSetContentDispositions(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+
+	artifacts := []*api.Artifact{{Path: "a.txt"}}
+	require.NoError(t, uploader.setContentDispositions(artifacts))
+	assert.Empty(t, artifacts[0].ContentDisposition)
+
+	var err error
+	uploader.contentDisposition, err = parseContentDispositionTemplate("inline; filename={{basename}}")
+	require.NoError(t, err)
+
+	artifacts = []*api.Artifact{{Path: "logs/a.txt"}, {Path: "bé.txt"}}
+	err = uploader.setContentDispositions(artifacts)
+	assert.Error(t, err)
+	assert.Equal(t, "inline; filename=a.txt", artifacts[0].ContentDisposition)
+}
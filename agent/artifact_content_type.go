@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// builtinContentTypes fixes the Content-Types of developer files that the mime
+// package gets wrong, or that only some systems' mime.types know about
+var builtinContentTypes = map[string]string{
+	".ts":       "text/typescript",
+	".mts":      "text/typescript",
+	".cts":      "text/typescript",
+	".tsx":      "text/typescript",
+	".jsx":      "text/javascript",
+	".cjs":      "text/javascript",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".rs":       "text/x-rust",
+	".map":      "application/json",
+	".jsonl":    "application/x-ndjson",
+	".ndjson":   "application/x-ndjson",
+	".tf":       "text/plain",
+	".proto":    "text/plain",
+}
+
+// builtinContentType returns the built-in Content-Type for the extension, if
+// there is one
+func builtinContentType(extension string) (string, bool) {
+	contentType, ok := builtinContentTypes[strings.ToLower(extension)]
+	return contentType, ok
+}
+
+// ParseContentTypeMap parses Content-Types for extensions, given as ext=type
+// pairs that are each comma-separated, such as
+// log=text/plain,wasm=application/wasm. Extensions can have a leading dot, and
+// more than one part, such as tar.gz. The map is keyed by lowercase
+// extensions without their leading dot.
+func ParseContentTypeMap(pairs []string) (map[string]string, error) {
+	contentTypes := map[string]string{}
+
+	for _, list := range pairs {
+		for _, pair := range strings.Split(list, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid Content-Type mapping %q, expected ext=type, e.g. log=text/plain", pair)
+			}
+
+			extension := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(parts[0]), "."))
+			contentType := strings.TrimSpace(parts[1])
+			if extension == "" || strings.ContainsAny(extension, `/\`) {
+				return nil, fmt.Errorf("Invalid Content-Type mapping %q, %q isn't a file extension", pair, parts[0])
+			}
+			if _, _, err := mime.ParseMediaType(contentType); err != nil || !strings.Contains(contentType, "/") {
+				return nil, fmt.Errorf("Invalid Content-Type mapping %q, %q isn't a Content-Type", pair, contentType)
+			}
+
+			contentTypes[extension] = contentType
+		}
+	}
+
+	return contentTypes, nil
+}
+
+// mappedContentType returns the Content-Type the map has for the file's
+// extension, if there is one. The longest extension wins, so a mapping for
+// tar.gz is used for a .tar.gz file over one for gz.
+func mappedContentType(contentTypes map[string]string, path string) (string, bool) {
+	if len(contentTypes) == 0 {
+		return "", false
+	}
+
+	name := strings.ToLower(filepath.Base(path))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if contentType, ok := contentTypes[name[i+1:]]; ok {
+			return contentType, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildUsesBuiltinContentTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builtin-content-type")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ts := filepath.Join(dir, "app.ts")
+	md := filepath.Join(dir, "README.MD")
+	txt := filepath.Join(dir, "notes.txt")
+	for _, f := range []string{ts, md, txt} {
+		require.NoError(t, ioutil.WriteFile(f, []byte("hello"), 0644))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		conf   ArtifactUploaderConfig
+		file   string
+		expect string
+	}{
+		{name: "typescript", file: ts, expect: "text/typescript"},
+		{name: "uppercase", file: md, expect: "text/markdown"},
+		{name: "not overridden", file: txt, expect: "text/plain"},
+		{name: "disabled", conf: ArtifactUploaderConfig{NoBuiltinOverrides: true}, file: ts, expect: "video/mp2t"},
+		{name: "explicit", conf: ArtifactUploaderConfig{ContentType: "text/plain"}, file: ts, expect: "text/plain"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uploader := NewArtifactUploader(logger.Discard, nil, tc.conf)
+			artifact, err := uploader.build(filepath.Base(tc.file), tc.file, "*")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, artifact.ContentType)
+		})
+	}
+}
+
+func TestParseContentTypeMap(t *testing.T) {
+	contentTypes, err := ParseContentTypeMap([]string{
+		"log=text/plain, wasm=application/wasm",
+		".TAR.GZ=application/gzip",
+		"csv=text/csv; charset=utf-8",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"log":    "text/plain",
+		"wasm":   "application/wasm",
+		"tar.gz": "application/gzip",
+		"csv":    "text/csv; charset=utf-8",
+	}, contentTypes)
+}
+
+func TestParseContentTypeMapRejectsMalformedPairs(t *testing.T) {
+	for _, tc := range []struct {
+		pair, err string
+	}{
+		{"log", `Invalid Content-Type mapping "log", expected ext=type, e.g. log=text/plain`},
+		{"=text/plain", `Invalid Content-Type mapping "=text/plain", "" isn't a file extension`},
+		{"logs/a.log=text/plain", `Invalid Content-Type mapping "logs/a.log=text/plain", "logs/a.log" isn't a file extension`},
+		{"log=", `Invalid Content-Type mapping "log=", "" isn't a Content-Type`},
+		{"log=plain", `Invalid Content-Type mapping "log=plain", "plain" isn't a Content-Type`},
+	} {
+		_, err := ParseContentTypeMap([]string{tc.pair})
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestBuildUsesContentTypeMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "content-type-map")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "build.LOG")
+	tgz := filepath.Join(dir, "dist.tar.gz")
+	gz := filepath.Join(dir, "dump.gz")
+	txt := filepath.Join(dir, "notes.txt")
+	for _, f := range []string{log, tgz, gz, txt} {
+		require.NoError(t, ioutil.WriteFile(f, []byte("hello"), 0644))
+	}
+
+	contentTypes := map[string]string{
+		"log":    "text/x-log",
+		"tar.gz": "application/x-gtar",
+		"gz":     "application/x-gzip",
+	}
+
+	for _, tc := range []struct {
+		name   string
+		conf   ArtifactUploaderConfig
+		file   string
+		expect string
+	}{
+		{name: "mapped", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes}, file: log, expect: "text/x-log"},
+		{name: "longest extension", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes}, file: tgz, expect: "application/x-gtar"},
+		{name: "shorter extension", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes}, file: gz, expect: "application/x-gzip"},
+		{name: "over explicit", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes, ContentType: "text/plain"}, file: log, expect: "text/x-log"},
+		{name: "falls back to explicit", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes, ContentType: "text/html"}, file: txt, expect: "text/html"},
+		{name: "falls back to detected", conf: ArtifactUploaderConfig{ContentTypeMap: contentTypes}, file: txt, expect: "text/plain"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uploader := NewArtifactUploader(logger.Discard, nil, tc.conf)
+			artifact, err := uploader.build(filepath.Base(tc.file), tc.file, "*")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, artifact.ContentType)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// An extraDestination is another destination each artifact is uploaded to,
+// after the one it's created on Buildkite with
+type extraDestination struct {
+	destination string
+	uploader    Uploader
+	refresher   *credentialRefresher
+
+	// How many artifacts were uploaded to it, and how many failed, updated
+	// atomically
+	uploaded int64
+	failed   int64
+}
+
+// newExtraDestinations creates the uploaders for ExtraDestinations
+func (a *ArtifactUploader) newExtraDestinations() ([]*extraDestination, error) {
+	if len(a.conf.ExtraDestinations) == 0 {
+		return nil, nil
+	}
+
+	if a.conf.CDC {
+		return nil, errors.New("Content defined chunking can only be used with one upload destination")
+	}
+
+	extras := []*extraDestination{}
+	for _, destination := range a.conf.ExtraDestinations {
+		if destination == "" {
+			return nil, errors.New("Buildkite artifact storage can only be the first upload destination")
+		}
+
+		uploader, err := a.newDestinationUploader(destination)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.checkNoOverwrite(uploader); err != nil {
+			return nil, err
+		}
+
+		a.logger.Info("Also uploading to %q", destination)
+		extras = append(extras, &extraDestination{
+			destination: destination,
+			uploader:    uploader,
+			refresher:   newCredentialRefresher(a.logger, uploader),
+		})
+	}
+
+	return extras, nil
+}
+
+// uploadToExtras uploads the artifact to each of the extra destinations, as
+// it's uploaded to the first, logging how each one went. It returns an error
+// if it failed to upload to any of them.
+func (a *ArtifactUploader) uploadToExtras(extras []*extraDestination, artifact *api.Artifact) error {
+	failed := 0
+
+	for _, extra := range extras {
+		start := time.Now()
+		if err := a.uploadToExtra(extra, artifact); err != nil {
+			a.eventLogger(eventArtifactFailed, artifactEventFields(extra.destination, artifact, time.Since(start), err)...).
+				Error("Error uploading artifact \"%s\" to %q: %s", artifact.Path, extra.destination, err)
+			atomic.AddInt64(&extra.failed, 1)
+			a.failures.record(extra.destination, artifact, err)
+			failed++
+			continue
+		}
+
+		a.eventLogger(eventArtifactUploaded, artifactEventFields(extra.destination, artifact, time.Since(start), nil)...).
+			Info("Successfully uploaded artifact \"%s\" to %q", artifact.Path, extra.destination)
+		atomic.AddInt64(&extra.uploaded, 1)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to upload %q to %d of %d other destinations", artifact.Path, failed, len(extras))
+	}
+	return nil
+}
+
+// uploadToExtra uploads the artifact to the extra destination, with the same
+// retries, skipping and checks as the first destination
+func (a *ArtifactUploader) uploadToExtra(extra *extraDestination, artifact *api.Artifact) error {
+	if a.conf.SkipExisting {
+		if comparer, ok := extra.uploader.(UnchangedUploader); ok && a.isUnchanged(comparer, artifact) {
+			a.logger.Info("Skipping artifact %s, which is unchanged at %q", artifact.Path, extra.destination)
+			return nil
+		}
+	}
+
+	err := a.uploadWithRetries(extra.uploader, extra.refresher, artifact, func() error {
+		return a.attemptUpload(extra.uploader, extra.refresher, artifact)
+	})
+	if err != nil {
+		return err
+	}
+
+	if durable, ok := extra.uploader.(DurableUploader); ok && a.conf.WaitDurable {
+		if a.limiter != nil {
+			durable = rateLimitedStore{store: durable, limiter: a.limiter}
+		}
+		if err := a.waitDurable(durable, artifact); err != nil {
+			return err
+		}
+	}
+
+	if verifier, ok := extra.uploader.(VerifyingUploader); ok && a.conf.Verify {
+		return a.verify(verifier, artifact)
+	}
+	return nil
+}
+
+// logDestinations logs how many artifacts were uploaded to each destination,
+// and how many failed, if there's more than one
+func (a *ArtifactUploader) logDestinations(extras []*extraDestination, uploaded, failed int) {
+	if len(extras) == 0 {
+		return
+	}
+
+	destination := fmt.Sprintf("%q", a.conf.Destination)
+	if a.conf.Destination == "" {
+		destination = "Buildkite artifact storage"
+	}
+	a.logger.Info("Uploaded %d artifacts to %s, %d failed", uploaded, destination, failed)
+
+	for _, extra := range extras {
+		a.logger.Info("Uploaded %d artifacts to %q, %d failed",
+			atomic.LoadInt64(&extra.uploaded), extra.destination, atomic.LoadInt64(&extra.failed))
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// herdUploader records the artifacts uploaded to it, or fails to upload them
+// if its destination is in a broken herd
+type herdUploader struct {
+	destination string
+
+	mu       sync.Mutex
+	uploaded []string
+}
+
+func (u *herdUploader) URL(artifact *api.Artifact) string {
+	return u.destination + "/" + artifact.Path
+}
+
+func (u *herdUploader) Upload(artifact *api.Artifact) error {
+	if u.destination == "herd://broken" {
+		return errors.New("the herd has scattered")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uploaded = append(u.uploaded, artifact.Path)
+	return nil
+}
+
+func TestUploadToExtras(t *testing.T) {
+	herds := map[string]*herdUploader{}
+	RegisterUploader("herd", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		herds[c.Destination] = &herdUploader{destination: c.Destination}
+		return herds[c.Destination], nil
+	})
+	defer func() {
+		uploaderFactoriesMu.Lock()
+		delete(uploaderFactories, "herd")
+		uploaderFactoriesMu.Unlock()
+	}()
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Destination:       "herd://first",
+		ExtraDestinations: []string{"herd://second", "herd://broken", "herd://third"},
+	})
+
+	extras, err := uploader.newExtraDestinations()
+	require.NoError(t, err)
+	require.Len(t, extras, 3)
+
+	artifact := &api.Artifact{Path: "llamas.txt"}
+	err = uploader.uploadToExtras(extras, artifact)
+	assert.EqualError(t, err, `Failed to upload "llamas.txt" to 1 of 3 other destinations`)
+
+	assert.Equal(t, []string{"llamas.txt"}, herds["herd://second"].uploaded)
+	assert.Equal(t, []string{"llamas.txt"}, herds["herd://third"].uploaded)
+	assert.Empty(t, herds["herd://broken"].uploaded)
+
+	assert.Equal(t, int64(1), extras[0].uploaded)
+	assert.Equal(t, int64(1), extras[1].failed)
+	assert.Equal(t, int64(1), extras[2].uploaded)
+
+	require.Len(t, uploader.failures.failures, 1)
+	assert.Equal(t, "herd://broken", uploader.failures.failures[0].Destination)
+	assert.Equal(t, "llamas.txt", uploader.failures.failures[0].Path)
+}
+
+func TestNewExtraDestinationsRejectsInvalidDestinations(t *testing.T) {
+	for _, tc := range []struct {
+		conf ArtifactUploaderConfig
+		err  string
+	}{
+		{
+			ArtifactUploaderConfig{Destination: "s3://my-bucket", ExtraDestinations: []string{""}},
+			"Buildkite artifact storage can only be the first upload destination",
+		},
+		{
+			ArtifactUploaderConfig{Destination: "s3://my-bucket", ExtraDestinations: []string{"ftp://example.com"}},
+			"Invalid upload destination: 'ftp://example.com'. Only az://, gs://, rt://, s3:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?",
+		},
+		{
+			ArtifactUploaderConfig{Destination: "s3://my-bucket", ExtraDestinations: []string{"s3://other-bucket"}, CDC: true},
+			"Content defined chunking can only be used with one upload destination",
+		},
+	} {
+		_, err := NewArtifactUploader(logger.Discard, nil, tc.conf).newExtraDestinations()
+		assert.EqualError(t, err, tc.err)
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactDiff is how the artifacts being uploaded differ from those of a
+// previous build, by path and SHA-1. It's written as JSON by --diff-json.
+type artifactDiff struct {
+	Build     string             `json:"build"`
+	Added     []artifactDiffItem `json:"added"`
+	Removed   []artifactDiffItem `json:"removed"`
+	Changed   []artifactDiffItem `json:"changed"`
+	Unchanged int                `json:"unchanged"`
+}
+
+type artifactDiffItem struct {
+	Path            string `json:"path"`
+	Sha1Sum         string `json:"sha1sum,omitempty"`
+	PreviousSha1Sum string `json:"previous_sha1sum,omitempty"`
+}
+
+// diffArtifacts compares the artifacts being uploaded with the previous ones
+func diffArtifacts(build string, previous []*api.Artifact, current []*api.Artifact) *artifactDiff {
+	diff := &artifactDiff{
+		Build:   build,
+		Added:   []artifactDiffItem{},
+		Removed: []artifactDiffItem{},
+		Changed: []artifactDiffItem{},
+	}
+
+	before := map[string]string{}
+	for _, artifact := range previous {
+		before[artifact.Path] = artifact.Sha1Sum
+	}
+
+	seen := map[string]bool{}
+	for _, artifact := range current {
+		seen[artifact.Path] = true
+
+		sum, ok := before[artifact.Path]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, artifactDiffItem{Path: artifact.Path, Sha1Sum: artifact.Sha1Sum})
+		case sum != artifact.Sha1Sum:
+			diff.Changed = append(diff.Changed, artifactDiffItem{Path: artifact.Path, Sha1Sum: artifact.Sha1Sum, PreviousSha1Sum: sum})
+		default:
+			diff.Unchanged++
+		}
+	}
+
+	for path, sum := range before {
+		if !seen[path] {
+			diff.Removed = append(diff.Removed, artifactDiffItem{Path: path, PreviousSha1Sum: sum})
+		}
+	}
+
+	for _, items := range [][]artifactDiffItem{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	}
+
+	return diff
+}
+
+// previousArtifacts finds the artifacts of the build that match the paths
+// being uploaded
+func (a *ArtifactUploader) previousArtifacts(build string) ([]*api.Artifact, error) {
+	searcher := NewArtifactSearcher(a.logger, a.apiClient, build)
+
+	var artifacts []*api.Artifact
+	for _, query := range a.uploadPatterns() {
+		found, err := searcher.Search(query, "", false, false)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, found...)
+	}
+
+	return artifacts, nil
+}
+
+// reportDiff logs how the artifacts being uploaded differ from those of the
+// build being compared against, and writes the difference as JSON if
+// a.conf.DiffJSON is set. A failure to compare doesn't stop the upload.
+func (a *ArtifactUploader) reportDiff(artifacts []*api.Artifact) error {
+	previous, err := a.previousArtifacts(a.conf.DiffAgainst)
+	if err != nil {
+		a.logger.Warn("Couldn't find the artifacts of build %s to compare with (%v)", a.conf.DiffAgainst, err)
+		return nil
+	}
+
+	diff := diffArtifacts(a.conf.DiffAgainst, previous, artifacts)
+
+	a.logger.Info("Compared with build %s: %d added, %d removed, %d changed, %d unchanged",
+		diff.Build, len(diff.Added), len(diff.Removed), len(diff.Changed), diff.Unchanged)
+	for _, item := range diff.Added {
+		a.logger.Info("  + %s (%s)", item.Path, item.Sha1Sum)
+	}
+	for _, item := range diff.Removed {
+		a.logger.Info("  - %s (%s)", item.Path, item.PreviousSha1Sum)
+	}
+	for _, item := range diff.Changed {
+		a.logger.Info("  ~ %s (%s, was %s)", item.Path, item.Sha1Sum, item.PreviousSha1Sum)
+	}
+
+	if a.conf.DiffJSON == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if a.conf.DiffJSON == "-" {
+		_, err = fmt.Fprintln(os.Stdout, string(data))
+		return err
+	}
+
+	if err := ioutil.WriteFile(a.conf.DiffJSON, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the artifact diff to %s (%v)", a.conf.DiffJSON, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffArtifacts(t *testing.T) {
+	previous := []*api.Artifact{
+		{Path: "pkg/same.tar.gz", Sha1Sum: "aaa"},
+		{Path: "pkg/changed.tar.gz", Sha1Sum: "bbb"},
+		{Path: "pkg/removed.tar.gz", Sha1Sum: "ccc"},
+	}
+	current := []*api.Artifact{
+		{Path: "pkg/same.tar.gz", Sha1Sum: "aaa"},
+		{Path: "pkg/changed.tar.gz", Sha1Sum: "ddd"},
+		{Path: "pkg/added.tar.gz", Sha1Sum: "eee"},
+	}
+
+	assert.Equal(t, &artifactDiff{
+		Build:     "build-1",
+		Added:     []artifactDiffItem{{Path: "pkg/added.tar.gz", Sha1Sum: "eee"}},
+		Removed:   []artifactDiffItem{{Path: "pkg/removed.tar.gz", PreviousSha1Sum: "ccc"}},
+		Changed:   []artifactDiffItem{{Path: "pkg/changed.tar.gz", Sha1Sum: "ddd", PreviousSha1Sum: "bbb"}},
+		Unchanged: 1,
+	}, diffArtifacts("build-1", previous, current))
+}
+
+func TestDiffArtifactsWithNoChanges(t *testing.T) {
+	artifacts := []*api.Artifact{{Path: "pkg/same.tar.gz", Sha1Sum: "aaa"}}
+
+	diff := diffArtifacts("build-1", artifacts, artifacts)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Changed)
+	assert.Equal(t, 1, diff.Unchanged)
+}
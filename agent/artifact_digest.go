@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// ArtifactSetDigestPrefix prefixes the hex encoded Merkle root of a set of
+// artifacts
+const ArtifactSetDigestPrefix = "sha256:"
+
+// artifactSetDigest computes a Merkle root over the artifacts, so the whole
+// set can be represented (and signed) as a single value. It's constructed as:
+//
+//  1. The artifacts are sorted by their path, comparing bytes
+//  2. Each artifact is a leaf of SHA-256(0x00 || path || 0x00 || SHA-256(content))
+//  3. Each level pairs up nodes from the start, and each pair becomes a node
+//     of SHA-256(0x01 || left || right). A node without a pair moves up to
+//     the next level unchanged.
+//  4. The root is the node left once there's only one, or SHA-256 of
+//     nothing if there are no artifacts
+//
+// The root is hex encoded, prefixed with "sha256:".
+func artifactSetDigest(artifacts []*api.Artifact) (string, error) {
+	sorted := make([]*api.Artifact, len(artifacts))
+	copy(sorted, artifacts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	level := [][]byte{}
+	for _, artifact := range sorted {
+		content, err := artifactSha256(artifact)
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		h.Write([]byte{0x00})
+		h.Write([]byte(artifact.Path))
+		h.Write([]byte{0x00})
+		h.Write(content)
+		level = append(level, h.Sum(nil))
+	}
+
+	if len(level) == 0 {
+		empty := sha256.Sum256(nil)
+		return ArtifactSetDigestPrefix + hex.EncodeToString(empty[:]), nil
+	}
+
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			h := sha256.New()
+			h.Write([]byte{0x01})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+
+	return ArtifactSetDigestPrefix + hex.EncodeToString(level[0]), nil
+}
+
+// writeSetDigest computes the set digest of the uploaded artifacts, and logs
+// it and saves it to the build meta-data if configured to
+func (a *ArtifactUploader) writeSetDigest(uploaded []*api.Artifact) error {
+	digest, err := artifactSetDigest(uploaded)
+	if err != nil {
+		return fmt.Errorf("Error computing the digest of the uploaded artifacts: %v", err)
+	}
+
+	a.setDigest = digest
+	a.logger.Info("Digest of the %d uploaded artifacts: %s", len(uploaded), digest)
+
+	if a.conf.SetDigestMetaDataKey == "" {
+		return nil
+	}
+
+	return retry.Do(func(s *retry.Stats) error {
+		resp, err := a.apiClient.SetMetaData(a.conf.JobID, &api.MetaData{
+			Key:   a.conf.SetDigestMetaDataKey,
+			Value: digest,
+		})
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			s.Break()
+		}
+		if err != nil {
+			a.logger.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+}
+
+// artifactSha256 returns the SHA-256 of the artifact's content, from the one
+// worked out when it was built, or else by reading the file
+func artifactSha256(artifact *api.Artifact) ([]byte, error) {
+	if artifact.Sha256Sum == "" {
+		return sha256File(artifact.AbsolutePath)
+	}
+
+	sum, err := hex.DecodeString(artifact.Sha256Sum)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SHA-256 %q for %s (%v)", artifact.Sha256Sum, artifact.Path, err)
+	}
+	return sum, nil
+}
+
+func sha256File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
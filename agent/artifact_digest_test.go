@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactSetDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	artifact := func(path, content string) *api.Artifact {
+		abs := filepath.Join(dir, path)
+		if err := ioutil.WriteFile(abs, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return &api.Artifact{Path: path, AbsolutePath: abs}
+	}
+
+	hash := func(parts ...[]byte) []byte {
+		h := sha256.New()
+		for _, p := range parts {
+			h.Write(p)
+		}
+		return h.Sum(nil)
+	}
+	leaf := func(path, content string) []byte {
+		return hash([]byte{0x00}, []byte(path), []byte{0x00}, hash([]byte(content)))
+	}
+	node := func(left, right []byte) []byte {
+		return hash([]byte{0x01}, left, right)
+	}
+
+	a, b, c := artifact("a.txt", "llamas"), artifact("b.txt", "alpacas"), artifact("c.txt", "camels")
+
+	// The order the artifacts are given in doesn't matter
+	digest, err := artifactSetDigest([]*api.Artifact{c, a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := node(node(leaf("a.txt", "llamas"), leaf("b.txt", "alpacas")), leaf("c.txt", "camels"))
+	assert.Equal(t, "sha256:"+hex.EncodeToString(expected), digest)
+
+	// The SHA-256 already worked out for an artifact is used rather than
+	// reading it again
+	d := &api.Artifact{Path: "d.txt", AbsolutePath: filepath.Join(dir, "missing.txt"), Sha256Sum: hex.EncodeToString(hash([]byte("dromedaries")))}
+	digest, err = artifactSetDigest([]*api.Artifact{d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256:"+hex.EncodeToString(leaf("d.txt", "dromedaries")), digest)
+
+	empty, err := artifactSetDigest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256:"+hex.EncodeToString(hash()), empty)
+}
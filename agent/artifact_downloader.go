@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/pool"
 )
@@ -31,6 +32,18 @@ type ArtifactDownloaderConfig struct {
 
 	// Whether to show HTTP debugging
 	DebugHTTP bool
+
+	// Whether to repair downloaded artifacts using their parity companions
+	RepairFromParity bool
+
+	// Whether to reassemble files uploaded as content defined chunks
+	CDC bool
+
+	// Whether to reassemble files that were split into parts
+	Split bool
+
+	// Whether to rebuild sparse files from their data and extent lists
+	Sparse bool
 }
 
 type ArtifactDownloader struct {
@@ -87,7 +100,6 @@ func (a *ArtifactDownloader) Download() error {
 			artifact := artifact
 
 			p.Spawn(func() {
-				var err error
 				var path string = artifact.Path
 
 				// Convert windows paths to slashes, otherwise we get a literal
@@ -96,40 +108,7 @@ func (a *ArtifactDownloader) Download() error {
 					path = strings.Replace(path, `\`, `/`, -1)
 				}
 
-				// Handle downloading from S3, GS, or RT
-				if strings.HasPrefix(artifact.UploadDestination, "s3://") {
-					err = NewS3Downloader(a.logger, S3DownloaderConfig{
-						Path:        path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
-					err = NewGSDownloader(a.logger, GSDownloaderConfig{
-						Path:        path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "rt://") {
-					err = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-						Path:        path,
-						Repository:  artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else {
-					err = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-						URL:         artifact.URL,
-						Path:        path,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				}
+				err := a.download(artifact, path, downloadDestination)
 
 				// If the downloaded encountered an error, lock
 				// the pool, collect it, then unlock the pool
@@ -149,6 +128,107 @@ func (a *ArtifactDownloader) Download() error {
 		if len(errors) > 0 {
 			return fmt.Errorf("There were errors with downloading some of the artifacts")
 		}
+
+		if a.conf.CDC {
+			if err := a.reassembleCDC(artifacts, downloadDestination); err != nil {
+				return err
+			}
+		}
+
+		// Parity is generated for each part, so parts are repaired
+		// before they're reassembled
+		if a.conf.RepairFromParity {
+			if err := a.repairFromParity(artifacts, downloadDestination); err != nil {
+				return err
+			}
+		}
+
+		// The data of a sparse file may have been split, so it's
+		// reassembled before the sparse file is rebuilt
+		if a.conf.Split {
+			if err := a.reassembleSplit(artifacts, downloadDestination); err != nil {
+				return err
+			}
+		}
+
+		if a.conf.Sparse {
+			return a.unpackSparse(artifacts, downloadDestination)
+		}
+	}
+
+	return nil
+}
+
+// download downloads the artifact at path from where it was uploaded into the
+// destination directory
+func (a *ArtifactDownloader) download(artifact *api.Artifact, path string, destination string) error {
+	var err error
+
+	// Handle downloading from S3, GS, or RT
+	if strings.HasPrefix(artifact.UploadDestination, "s3://") {
+		err = NewS3Downloader(a.logger, S3DownloaderConfig{
+			Path:        path,
+			Bucket:      artifact.UploadDestination,
+			Destination: destination,
+			Retries:     5,
+			DebugHTTP:   a.conf.DebugHTTP,
+		}).Start()
+	} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
+		err = NewGSDownloader(a.logger, GSDownloaderConfig{
+			Path:        path,
+			Bucket:      artifact.UploadDestination,
+			Destination: destination,
+			Retries:     5,
+			DebugHTTP:   a.conf.DebugHTTP,
+		}).Start()
+	} else if strings.HasPrefix(artifact.UploadDestination, "rt://") {
+		err = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
+			Path:        path,
+			Repository:  artifact.UploadDestination,
+			Destination: destination,
+			Retries:     5,
+			DebugHTTP:   a.conf.DebugHTTP,
+		}).Start()
+	} else {
+		err = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
+			URL:         artifact.URL,
+			Path:        path,
+			Destination: destination,
+			Retries:     5,
+			DebugHTTP:   a.conf.DebugHTTP,
+		}).Start()
+	}
+
+	return err
+}
+
+// repairFromParity repairs any downloaded artifacts that were downloaded
+// along with their parity companions
+func (a *ArtifactDownloader) repairFromParity(artifacts []*api.Artifact, downloadDestination string) error {
+	downloaded := make(map[string]bool)
+	for _, artifact := range artifacts {
+		downloaded[artifact.Path] = true
+	}
+
+	for _, artifact := range artifacts {
+		if !downloaded[artifact.Path+ArtifactParitySuffix] || !downloaded[artifact.Path+ArtifactParityManifestSuffix] {
+			continue
+		}
+
+		path := getTargetPath(artifact.Path, downloadDestination)
+
+		repaired, err := RepairFromParity(path,
+			getTargetPath(artifact.Path+ArtifactParitySuffix, downloadDestination),
+			getTargetPath(artifact.Path+ArtifactParityManifestSuffix, downloadDestination))
+		if err != nil {
+			return err
+		}
+
+		if repaired {
+			a.logger.Warn("Repaired corrupted artifact %s using its parity", artifact.Path)
+		} else {
+			a.logger.Debug("Verified %s against its parity", artifact.Path)
+		}
 	}
 
 	return nil
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactDestination returns where the artifact is uploaded to, worked out
+// from the destination alone so no credentials are needed
+func artifactDestination(destination string, artifact *api.Artifact) string {
+	artifactPath := path.Clean(strings.Replace(artifact.Path, `\`, `/`, -1))
+	if destination == "" {
+		return "artifact://" + artifactPath
+	}
+	return strings.TrimSuffix(destination, "/") + "/" + artifactPath
+}
+
+// writeDryRun writes a line for each of the artifacts, sorted by path, with
+// its file, where it would be uploaded to, its content type and its size
+func writeDryRun(w io.Writer, destination string, artifacts []*api.Artifact) error {
+	sorted := make([]*api.Artifact, len(artifacts))
+	copy(sorted, artifacts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	for _, artifact := range sorted {
+		_, err := fmt.Fprintf(w, "%s -> %s (%s, %s)\n",
+			artifact.AbsolutePath, artifactDestination(destination, artifact),
+			artifact.ContentType, formatByteSize(artifact.FileSize))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dryRun prints what would be uploaded where, without uploading anything
+func (a *ArtifactUploader) dryRun(artifacts []*api.Artifact) error {
+	if a.conf.Destination != "" {
+		if _, ok := uploaderFactoryFor(a.conf.Destination); !ok {
+			return fmt.Errorf("Invalid upload destination: '%v'. Only %s upload destinations are allowed", a.conf.Destination, strings.Join(registeredUploaderSchemes(), ", "))
+		}
+	}
+
+	if len(artifacts) == 0 {
+		return a.noFilesMatched()
+	}
+
+	store := a.conf.Destination
+	if store == "" {
+		store = "Buildkite artifact storage"
+	}
+	a.logger.Info("Dry run, %d files that match \"%s\" would be uploaded to %s", len(artifacts), a.conf.Paths, store)
+
+	return writeDryRun(os.Stdout, a.conf.Destination, artifacts)
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactDestination(t *testing.T) {
+	artifact := &api.Artifact{Path: `pkg\llamas.tar.gz`}
+
+	for _, tc := range []struct {
+		Destination, Expected string
+	}{
+		{"", "artifact://pkg/llamas.tar.gz"},
+		{"s3://my-bucket/builds/", "s3://my-bucket/builds/pkg/llamas.tar.gz"},
+		{"gs://my-bucket", "gs://my-bucket/pkg/llamas.tar.gz"},
+		{"rt://my-repo/builds", "rt://my-repo/builds/pkg/llamas.tar.gz"},
+	} {
+		assert.Equal(t, tc.Expected, artifactDestination(tc.Destination, artifact), tc.Destination)
+	}
+}
+
+func TestWriteDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeDryRun(&buf, "s3://my-bucket", []*api.Artifact{
+		{Path: "b.txt", AbsolutePath: "/build/b.txt", ContentType: "text/plain", FileSize: 2048},
+		{Path: "a.png", AbsolutePath: "/build/a.png", ContentType: "image/png", FileSize: 12},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "/build/a.png -> s3://my-bucket/a.png (image/png, 12B)\n"+
+		"/build/b.txt -> s3://my-bucket/b.txt (text/plain, 2.0KB)\n", buf.String())
+}
+
+func TestDryRunRejectsUnknownDestinations(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Destination: "ftp://example.com", DryRun: true})
+	assert.Error(t, uploader.dryRun([]*api.Artifact{{Path: "a.txt"}}))
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// waitDurable polls the store until the artifact can be retrieved, or
+// returns an error once the timeout has elapsed
+func (a *ArtifactUploader) waitDurable(d DurableUploader, artifact *api.Artifact) error {
+	start := time.Now()
+
+	for {
+		exists, err := d.Exists(artifact)
+		if err != nil {
+			a.logger.Debug("Error checking if %q is retrievable: %v", artifact.Path, err)
+		} else if exists {
+			a.logger.Debug("Artifact %q is retrievable after %v", artifact.Path, time.Since(start))
+			return nil
+		}
+
+		if time.Since(start) >= a.conf.DurableTimeout {
+			if err != nil {
+				return fmt.Errorf("Timed out after %v waiting for %q to be retrievable: %v", a.conf.DurableTimeout, artifact.Path, err)
+			}
+			return fmt.Errorf("Timed out after %v waiting for %q to be retrievable", a.conf.DurableTimeout, artifact.Path)
+		}
+
+		time.Sleep(a.conf.DurablePollInterval)
+	}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type eventuallyDurableUploader struct {
+	checks  int
+	visible int
+}
+
+func (u *eventuallyDurableUploader) Exists(*api.Artifact) (bool, error) {
+	u.checks++
+	if u.checks == 1 {
+		return false, errors.New("llamas are busy")
+	}
+	return u.checks >= u.visible, nil
+}
+
+func TestWaitDurable(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		DurablePollInterval: time.Millisecond,
+		DurableTimeout:      time.Second,
+	})
+
+	store := &eventuallyDurableUploader{visible: 3}
+	if err := uploader.waitDurable(store, &api.Artifact{Path: "llamas.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.checks != 3 {
+		t.Errorf("Expected 3 checks, got %d", store.checks)
+	}
+}
+
+func TestWaitDurableTimesOut(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		DurablePollInterval: time.Millisecond,
+		DurableTimeout:      10 * time.Millisecond,
+	})
+
+	store := &eventuallyDurableUploader{visible: 1 << 30}
+	if err := uploader.waitDurable(store, &api.Artifact{Path: "llamas.txt"}); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
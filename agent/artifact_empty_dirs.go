@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// isEmptyDir returns whether the directory has nothing in it
+func isEmptyDir(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// uploadEmptyDirs creates placeholders for the empty directories that
+// matched, if IncludeEmptyDirs is set and the uploader can. Buildkite's
+// artifact storage, and the other destinations without directories, only
+// get a warning.
+func (a *ArtifactUploader) uploadEmptyDirs(destination string, uploader Uploader) error {
+	if len(a.emptyDirs) == 0 {
+		return nil
+	}
+
+	name := fmt.Sprintf("%q", destination)
+	if destination == "" {
+		name = "Buildkite artifact storage"
+	}
+
+	dirs, ok := uploader.(DirectoryUploader)
+	if !ok {
+		a.logger.Warn("%s has no directories, so the %d empty directories that matched aren't uploaded", name, len(a.emptyDirs))
+		return nil
+	}
+
+	paths := append([]string{}, a.emptyDirs...)
+	sort.Strings(paths)
+
+	failed := 0
+	for _, path := range paths {
+		a.limiter.Wait()
+
+		if err := dirs.UploadDirectory(path); err != nil {
+			a.logger.Error("Error creating the empty directory %q at %s: %s", path, name, err)
+			failed++
+			continue
+		}
+		a.logger.Debug("Created the empty directory %q at %s", path, name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to create %d of the %d empty directories at %s", failed, len(paths), name)
+	}
+
+	a.logger.Info("Created %d empty directories at %s", len(paths), name)
+	return nil
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectIncludesEmptyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-empty-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "SUCCESS"), nil, 0644))
+
+	artifacts, err := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:   "*",
+		BaseDir: dir,
+	}).Collect()
+	require.NoError(t, err)
+
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "SUCCESS", artifacts[0].Path)
+	assert.Equal(t, int64(0), artifacts[0].FileSize)
+	assert.Equal(t, "da39a3ee5e6b4b0d3255bfef95601890afd80709", artifacts[0].Sha1Sum)
+}
+
+func TestCollectWithIncludeEmptyDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-empty-dirs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"out/empty", "out/full", "out/skip/empty", "out/full/nested"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.FromSlash(path)), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "out", "full", "a.txt"), []byte("llamas"), 0644))
+
+	for _, tc := range []struct {
+		conf      ArtifactUploaderConfig
+		artifacts []string
+		emptyDirs []string
+	}{
+		{
+			ArtifactUploaderConfig{Paths: "out/**/*", BaseDir: dir},
+			[]string{"out/full/a.txt"},
+			nil,
+		},
+		{
+			ArtifactUploaderConfig{Paths: "out/**/*", BaseDir: dir, IncludeEmptyDirs: true, Exclude: []string{"out/skip/**"}},
+			[]string{"out/full/a.txt"},
+			[]string{"out/empty", "out/full/nested"},
+		},
+		{
+			ArtifactUploaderConfig{Paths: "out/*", BaseDir: dir, IncludeEmptyDirs: true, StripPrefix: "out"},
+			[]string{},
+			[]string{"empty"},
+		},
+	} {
+		uploader := NewArtifactUploader(logger.Discard, nil, tc.conf)
+		artifacts, err := uploader.Collect()
+		require.NoError(t, err)
+
+		paths := []string{}
+		for _, a := range artifacts {
+			paths = append(paths, filepath.ToSlash(a.Path))
+		}
+		assert.Equal(t, tc.artifacts, paths)
+
+		sort.Strings(uploader.emptyDirs)
+		assert.Equal(t, tc.emptyDirs, uploader.emptyDirs)
+	}
+}
+
+// dirUploader records the directories created with it, failing to create
+// any called broken
+type dirUploader struct {
+	herdUploader
+	dirs []string
+}
+
+func (u *dirUploader) UploadDirectory(path string) error {
+	if path == "broken" {
+		return errors.New("the herd has scattered")
+	}
+	u.dirs = append(u.dirs, path)
+	return nil
+}
+
+func TestUploadEmptyDirs(t *testing.T) {
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{})
+
+	// Nothing happens without any empty directories
+	require.NoError(t, uploader.uploadEmptyDirs("", NewFormUploader(logger.Discard, FormUploaderConfig{})))
+	assert.Empty(t, l.Messages)
+
+	uploader.emptyDirs = []string{"out/b", "out/a"}
+
+	require.NoError(t, uploader.uploadEmptyDirs("", NewFormUploader(logger.Discard, FormUploaderConfig{})))
+	assert.Equal(t, []string{"[warn] Buildkite artifact storage has no directories, so the 2 empty directories that matched aren't uploaded"}, l.Messages)
+
+	dirs := &dirUploader{}
+	require.NoError(t, uploader.uploadEmptyDirs("dirs://herd", dirs))
+	assert.Equal(t, []string{"out/a", "out/b"}, dirs.dirs)
+
+	uploader.emptyDirs = append(uploader.emptyDirs, "broken")
+	err := uploader.uploadEmptyDirs("dirs://herd", dirs)
+	assert.EqualError(t, err, `Failed to create 1 of the 3 empty directories at "dirs://herd"`)
+}
+
+func TestS3UploaderUploadsEmptyFilesAndDirectories(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %s (%d bytes)", r.Method, r.URL.Path, n))
+		mu.Unlock()
+
+		if r.Method == "GET" {
+			fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>my-bucket</Name></ListBucketResult>`)
+			return
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_S3_ACCESS_KEY_ID":     "minio",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY": "minio123",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "s3-empty")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "SUCCESS")
+	require.NoError(t, ioutil.WriteFile(absolutePath, nil, 0600))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination:    "s3://my-bucket/builds",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, uploader.Upload(&api.Artifact{Path: "SUCCESS", AbsolutePath: absolutePath, ContentType: "binary/octet-stream"}))
+	require.NoError(t, uploader.UploadDirectory("out/empty"))
+
+	assert.Equal(t, []string{
+		"GET /my-bucket (0 bytes)",
+		"PUT /my-bucket/builds/SUCCESS (0 bytes)",
+		"PUT /my-bucket/builds/out/empty/ (0 bytes)",
+	}, requests)
+}
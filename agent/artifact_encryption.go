@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// The metadata key that records the SHA-1 of an artifact before it was
+	// encrypted, so recipients can verify it once they've decrypted it
+	ArtifactPlaintextSha1MetadataKey = "buildkite-plaintext-sha1sum"
+
+	ArtifactAgeSuffix = ".age"
+	ArtifactGPGSuffix = ".gpg"
+)
+
+// An ArtifactEncryptor encrypts artifacts to either age or GPG recipients.
+// Age recipients are public keys (age1...), and are encrypted to in process.
+// Anything else is a GPG recipient (a key ID, fingerprint or email address)
+// that's looked up in the keyring by the gpg command.
+type ArtifactEncryptor struct {
+	age []age.Recipient
+	gpg []string
+}
+
+func NewArtifactEncryptor(recipients []string) (*ArtifactEncryptor, error) {
+	e := &ArtifactEncryptor{}
+
+	for _, recipient := range recipients {
+		recipient = strings.TrimSpace(recipient)
+		if recipient == "" {
+			continue
+		}
+
+		if strings.HasPrefix(recipient, "age1") {
+			r, err := age.ParseX25519Recipient(recipient)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid age recipient %q: %v", recipient, err)
+			}
+			e.age = append(e.age, r)
+		} else {
+			e.gpg = append(e.gpg, recipient)
+		}
+	}
+
+	if len(e.age) > 0 && len(e.gpg) > 0 {
+		return nil, errors.New("Artifacts can be encrypted to either age or GPG recipients, but not both")
+	}
+	if len(e.age) == 0 && len(e.gpg) == 0 {
+		return nil, errors.New("No recipients to encrypt artifacts to")
+	}
+
+	if len(e.gpg) > 0 {
+		if _, err := exec.LookPath("gpg"); err != nil {
+			return nil, fmt.Errorf("Encrypting to GPG recipients needs gpg to be installed: %v", err)
+		}
+	}
+
+	return e, nil
+}
+
+// Extension returns the suffix added to the paths of encrypted artifacts
+func (e *ArtifactEncryptor) Extension() string {
+	if len(e.gpg) > 0 {
+		return ArtifactGPGSuffix
+	}
+	return ArtifactAgeSuffix
+}
+
+func (e *ArtifactEncryptor) contentType() string {
+	if len(e.gpg) > 0 {
+		return "application/pgp-encrypted"
+	}
+	return ArtifactFallbackMimeType
+}
+
+// Encrypt streams src encrypted to the recipients into dst
+func (e *ArtifactEncryptor) Encrypt(dst io.Writer, src io.Reader) error {
+	if len(e.gpg) > 0 {
+		args := []string{"--batch", "--yes", "--no-tty", "--trust-model", "always", "--encrypt"}
+		for _, recipient := range e.gpg {
+			args = append(args, "--recipient", recipient)
+		}
+
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command("gpg", args...)
+		cmd.Stdin = src
+		cmd.Stdout = dst
+		cmd.Stderr = stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("gpg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	w, err := age.Encrypt(dst, e.age...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// encryptionStagingSize estimates the space needed to stage the encrypted
+// artifacts, which are about the same size as the originals
+func encryptionStagingSize(artifacts []*api.Artifact) int64 {
+	var total int64
+	for _, artifact := range artifacts {
+		total += artifact.FileSize
+	}
+	return total
+}
+
+// encryptArtifacts encrypts every artifact into dir. Artifacts that fail to
+// encrypt are left out of the returned artifacts, and their errors are
+// returned so the rest can still be uploaded.
+func (a *ArtifactUploader) encryptArtifacts(artifacts []*api.Artifact, dir string) ([]*api.Artifact, []error) {
+	encrypted := []*api.Artifact{}
+	errs := []error{}
+
+	for _, artifact := range artifacts {
+		if err := a.encrypt(artifact, dir); err != nil {
+			a.logger.Error("Error encrypting artifact \"%s\": %s", artifact.Path, err)
+			errs = append(errs, err)
+			continue
+		}
+		encrypted = append(encrypted, artifact)
+	}
+
+	return encrypted, errs
+}
+
+// encrypt points the artifact at an encrypted copy, with the encryption's
+// extension added to its path. The SHA-1 of the original is kept in the
+// artifact's metadata.
+func (a *ArtifactUploader) encrypt(artifact *api.Artifact, dir string) error {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(dir, "encrypt-")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	plaintextHash := sha1.New()
+	hash := sha1.New()
+	sha256Hash := sha256.New()
+	counter := &countingWriter{}
+
+	err = a.conf.Encryptor.Encrypt(io.MultiWriter(out, hash, sha256Hash, counter), io.TeeReader(in, plaintextHash))
+	if err != nil {
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	a.logger.Debug("Encrypted %s to %s", artifact.Path, out.Name())
+
+	if artifact.Metadata == nil {
+		artifact.Metadata = map[string]string{}
+	}
+	artifact.Metadata[ArtifactPlaintextSha1MetadataKey] = fmt.Sprintf("%x", plaintextHash.Sum(nil))
+
+	artifact.Path += a.conf.Encryptor.Extension()
+	artifact.AbsolutePath = out.Name()
+	artifact.FileSize = counter.n
+	artifact.Sha1Sum = fmt.Sprintf("%x", hash.Sum(nil))
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+	artifact.ContentType = a.conf.Encryptor.contentType()
+	artifact.ContentEncoding = ""
+
+	return nil
+}
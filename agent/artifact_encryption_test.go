@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewArtifactEncryptorValidatesRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewArtifactEncryptor([]string{identity.Recipient().String(), "llamas@example.com"})
+	assert.Error(t, err)
+
+	_, err = NewArtifactEncryptor([]string{"age1llamas"})
+	assert.Error(t, err)
+
+	_, err = NewArtifactEncryptor([]string{})
+	assert.Error(t, err)
+
+	encryptor, err := NewArtifactEncryptor([]string{identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ".age", encryptor.Extension())
+}
+
+func TestEncryptArtifactsToAgeRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptor, err := NewArtifactEncryptor([]string{identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Encryptor: encryptor})
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: path, FileSize: 6, ContentType: "text/plain"}
+
+	artifacts, errs := uploader.encryptArtifacts([]*api.Artifact{artifact}, dir)
+	assert.Empty(t, errs)
+	assert.Equal(t, []*api.Artifact{artifact}, artifacts)
+
+	assert.Equal(t, "llamas.txt.age", artifact.Path)
+	assert.Equal(t, fmt.Sprintf("%x", sha1.Sum([]byte("llamas"))), artifact.Metadata[ArtifactPlaintextSha1MetadataKey])
+
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stat, _ := f.Stat()
+	assert.Equal(t, stat.Size(), artifact.FileSize)
+
+	r, err := age.Decrypt(f, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "llamas", string(plaintext))
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The events in the lifecycle of an upload, logged as the "event" field so
+// they can be picked out of structured logs
+const (
+	eventUploadStarted    = "upload_started"
+	eventArtifactUploaded = "artifact_uploaded"
+	eventArtifactFailed   = "artifact_failed"
+	eventArtifactRetried  = "artifact_retried"
+	eventUploadFinished   = "upload_finished"
+)
+
+// eventLogger returns the logger with the event and its fields added. An
+// empty destination is Buildkite artifact storage.
+func (a *ArtifactUploader) eventLogger(event string, fields ...logger.Field) logger.Logger {
+	return a.logger.WithFields(append([]logger.Field{logger.StringField("event", event)}, fields...)...)
+}
+
+// artifactEventFields returns the fields of an event about uploading the
+// artifact to the destination, which took duration
+func artifactEventFields(destination string, artifact *api.Artifact, duration time.Duration, err error) []logger.Field {
+	fields := []logger.Field{
+		logger.StringField("path", artifact.Path),
+		logger.StringField("destination", destination),
+		logger.Int64Field("bytes", artifact.FileSize),
+		logger.Int64Field("duration_ms", duration.Milliseconds()),
+	}
+	if err != nil {
+		fields = append(fields, logger.StringField("error", err.Error()))
+	}
+	return fields
+}
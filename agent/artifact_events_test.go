@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLoggerLogsStructuredFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logger.NewConsoleLogger(logger.NewJSONPrinter(buf), os.Exit)
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{})
+
+	artifact := &api.Artifact{Path: "llamas.txt", FileSize: 1234}
+	uploader.eventLogger(eventArtifactFailed,
+		artifactEventFields("s3://my-bucket", artifact, 1500*time.Millisecond, errors.New("the herd has scattered"))...,
+	).Error("Error uploading artifact \"%s\"", artifact.Path)
+
+	var line map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+
+	assert.Equal(t, "artifact_failed", line["event"])
+	assert.Equal(t, "llamas.txt", line["path"])
+	assert.Equal(t, "s3://my-bucket", line["destination"])
+	assert.Equal(t, "1234", line["bytes"])
+	assert.Equal(t, "1500", line["duration_ms"])
+	assert.Equal(t, "the herd has scattered", line["error"])
+	assert.Equal(t, `Error uploading artifact "llamas.txt"`, line["msg"])
+}
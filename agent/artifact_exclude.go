@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// artifactExcludes are the glob patterns of files that shouldn't be uploaded,
+// matched like the paths being uploaded. A directory that matches a pattern,
+// or a pattern without its trailing /**, is excluded along with everything
+// in it, so node_modules/** isn't walked at all. If ignoreCase is set, the
+// patterns match paths whatever their case.
+type artifactExcludes struct {
+	patterns   []excludePattern
+	ignoreCase bool
+}
+
+type excludePattern struct {
+	pattern string
+	files   globMatcher
+	dirs    globMatcher
+}
+
+// globMatcher matches paths against a zglob pattern
+type globMatcher interface {
+	Match(name string) bool
+}
+
+// exactMatcher matches a pattern without any globs in it
+type exactMatcher string
+
+func (m exactMatcher) Match(name string) bool {
+	return string(m) == name
+}
+
+// newArtifactExcludes compiles the patterns, with relative patterns being
+// relative to wd
+func newArtifactExcludes(patterns []string, wd string, ignoreCase bool) (*artifactExcludes, error) {
+	excludes := &artifactExcludes{ignoreCase: ignoreCase}
+
+	// Brace alternations are expanded like those of the upload paths
+	var expanded []string
+	for _, pattern := range patterns {
+		expanded = append(expanded, expandBraces(strings.TrimSpace(pattern))...)
+	}
+
+	for _, pattern := range expanded {
+		if pattern == "" {
+			continue
+		}
+
+		// Like the upload paths, matching is done on absolute paths, as
+		// zglob's matching skips names no longer than its root
+		full := pattern
+		if !filepath.IsAbs(full) && !strings.HasPrefix(full, "~") {
+			full = filepath.Join(wd, full)
+		}
+		full = filepath.ToSlash(full)
+		if ignoreCase {
+			full = strings.ToLower(full)
+		}
+
+		files, err := compileGlobMatcher(full)
+		if err != nil {
+			return nil, err
+		}
+		dirs := files
+		if trimmed := strings.TrimSuffix(full, "/**"); trimmed != full {
+			if dirs, err = compileGlobMatcher(trimmed); err != nil {
+				return nil, err
+			}
+		}
+
+		excludes.patterns = append(excludes.patterns, excludePattern{pattern: pattern, files: files, dirs: dirs})
+	}
+
+	return excludes, nil
+}
+
+func compileGlobMatcher(pattern string) (globMatcher, error) {
+	if !strings.Contains(pattern, "*") {
+		return exactMatcher(filepath.ToSlash(filepath.Clean(pattern))), nil
+	}
+	return zglob.New(pattern)
+}
+
+// Excluded returns the pattern that excludes the file at absolutePath, either
+// by matching it or one of the directories it's in
+func (e *artifactExcludes) Excluded(absolutePath string) (string, bool) {
+	if pattern, ok := e.MatchedFile(absolutePath); ok {
+		return pattern, true
+	}
+
+	for dir := filepath.Dir(absolutePath); ; dir = filepath.Dir(dir) {
+		if pattern, ok := e.ExcludedDir(dir); ok {
+			return pattern, true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	return "", false
+}
+
+// MatchedFile returns the pattern that matches the file at absolutePath
+// itself, without looking at the directories it's in
+func (e *artifactExcludes) MatchedFile(absolutePath string) (string, bool) {
+	name := e.name(absolutePath)
+	for _, p := range e.patterns {
+		if p.files.Match(name) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// ExcludedDir returns the pattern that excludes the directory at absolutePath,
+// if there is one
+func (e *artifactExcludes) ExcludedDir(absolutePath string) (string, bool) {
+	name := e.name(absolutePath)
+	for _, p := range e.patterns {
+		if p.dirs.Match(name) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// name is the path as it's matched against the patterns
+func (e *artifactExcludes) name(absolutePath string) string {
+	name := filepath.ToSlash(absolutePath)
+	if e.ignoreCase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactExcludes(t *testing.T) {
+	wd := filepath.FromSlash("/build")
+
+	excludes, err := newArtifactExcludes([]string{"node_modules/**", "*.tmp", " ", "logs", "/tmp/**/*.log"}, wd, false)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		path    string
+		pattern string
+	}{
+		{path: "/build/node_modules/left-pad/index.js", pattern: "node_modules/**"},
+		{path: "/build/build.tmp", pattern: "*.tmp"},
+		{path: "/build/dist/build.tmp"},
+		{path: "/build/logs/test.log", pattern: "logs"},
+		{path: "/build/dist/logs/test.log"},
+		{path: "/tmp/a/b/test.log", pattern: "/tmp/**/*.log"},
+		{path: "/build/src/index.js"},
+	} {
+		pattern, ok := excludes.Excluded(filepath.FromSlash(tc.path))
+		assert.Equal(t, tc.pattern != "", ok, tc.path)
+		assert.Equal(t, tc.pattern, pattern, tc.path)
+	}
+
+	pattern, ok := excludes.ExcludedDir(filepath.FromSlash("/build/node_modules"))
+	assert.True(t, ok)
+	assert.Equal(t, "node_modules/**", pattern)
+
+	_, ok = excludes.ExcludedDir(filepath.FromSlash("/build/src"))
+	assert.False(t, ok)
+}
+
+func TestArtifactExcludesIgnoringCase(t *testing.T) {
+	wd := filepath.FromSlash("/build")
+
+	excludes, err := newArtifactExcludes([]string{"Node_Modules/**", "*.TMP", "Logs"}, wd, true)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		path    string
+		pattern string
+	}{
+		{path: "/build/node_modules/left-pad/index.js", pattern: "Node_Modules/**"},
+		{path: "/build/BUILD.tmp", pattern: "*.TMP"},
+		{path: "/build/build.Tmp", pattern: "*.TMP"},
+		{path: "/build/LOGS/test.log", pattern: "Logs"},
+		{path: "/build/src/Index.js"},
+	} {
+		pattern, ok := excludes.Excluded(filepath.FromSlash(tc.path))
+		assert.Equal(t, tc.pattern != "", ok, tc.path)
+		assert.Equal(t, tc.pattern, pattern, tc.path)
+	}
+}
+
+func TestCollectWithExclude(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := filepath.Join(wd, "..")
+	os.Chdir(root)
+	defer os.Chdir(wd)
+
+	for _, followSymlinks := range []bool{false, true} {
+		uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+			Paths: "test/fixtures/artifacts/**/*.jpg",
+			Exclude: []string{
+				"test/fixtures/artifacts/folder/**",
+				"test/fixtures/artifacts/links/folder-link/**",
+				"test/fixtures/artifacts/Mr Freeze.jpg",
+			},
+			FollowSymlinks: followSymlinks,
+		})
+
+		artifacts, err := uploader.Collect()
+		require.NoError(t, err)
+
+		var paths []string
+		for _, artifact := range artifacts {
+			paths = append(paths, filepath.ToSlash(artifact.Path))
+		}
+		assert.ElementsMatch(t, []string{
+			"test/fixtures/artifacts/links/terminator/terminator2.jpg",
+			"test/fixtures/artifacts/this is a folder with a space/The Terminator.jpg",
+		}, paths)
+	}
+}
+
+func TestWalkGlobDoesntWalkSkippedSymlinkedDirectories(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(filepath.Join(wd, ".."))
+	defer os.Chdir(wd)
+
+	var skipped, matched []string
+	err := walkGlob(logger.Discard, true, false, func(dir string) bool {
+		if filepath.Base(dir) == "folder-link" {
+			skipped = append(skipped, dir)
+			return true
+		}
+		return false
+	})("test/fixtures/artifacts/links/**/*", func(file string) error {
+		matched = append(matched, filepath.ToSlash(file))
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Len(t, skipped, 1)
+	for _, file := range matched {
+		assert.False(t, strings.Contains(file, "folder-link"), file)
+	}
+	assert.Contains(t, matched, "test/fixtures/artifacts/links/terminator/terminator2.jpg")
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The S3 object tag used to mark artifacts for a lifecycle expiration rule
+	ArtifactExpiryTagKey = "buildkite-expire-after-days"
+
+	// The GS custom metadata key recording when an artifact should be removed
+	ArtifactExpiryMetadataKey = "buildkite-expire-at"
+)
+
+// ParseArtifactExpiry parses an artifact expiry duration. As well as the
+// usual Go durations (e.g. 36h), days can be given with a "d" suffix (e.g. 7d)
+func ParseArtifactExpiry(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid expiry %q, expected something like 7d or 36h", s)
+		}
+		if days <= 0 {
+			return 0, fmt.Errorf("Invalid expiry %q, must be positive", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid expiry %q, expected something like 7d or 36h", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("Invalid expiry %q, must be positive", s)
+	}
+
+	return d, nil
+}
+
+// expiryDays rounds an expiry up to whole days, which is the granularity that
+// bucket lifecycle rules work in
+func expiryDays(d time.Duration) int {
+	return int(math.Ceil(d.Hours() / 24))
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArtifactExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		Input     string
+		Expected  time.Duration
+		ShouldErr bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{" 1d ", 24 * time.Hour, false},
+		{"0d", 0, true},
+		{"-2h", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	} {
+		d, err := ParseArtifactExpiry(tc.Input)
+		if tc.ShouldErr {
+			assert.Error(t, err, tc.Input)
+			continue
+		}
+		assert.NoError(t, err, tc.Input)
+		assert.Equal(t, tc.Expected, d, tc.Input)
+	}
+}
+
+func TestExpiryDaysRoundsUp(t *testing.T) {
+	assert.Equal(t, 1, expiryDays(time.Hour))
+	assert.Equal(t, 1, expiryDays(24*time.Hour))
+	assert.Equal(t, 2, expiryDays(36*time.Hour))
+}
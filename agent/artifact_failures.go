@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/buildkite/agent/v3/api"
+	"google.golang.org/api/googleapi"
+)
+
+// An ArtifactFailure is an artifact that failed to upload to a destination,
+// and why
+type ArtifactFailure struct {
+	Path string
+
+	// Where it failed to upload to, or empty for Buildkite's artifact
+	// storage
+	Destination string
+
+	// The HTTP status the store responded with, if it got that far
+	StatusCode int
+
+	Err error
+}
+
+// ArtifactUploadError is returned when some of the artifacts failed to
+// upload, with every artifact that failed and why. The artifacts that didn't
+// fail were uploaded.
+type ArtifactUploadError struct {
+	Message  string
+	Failures []ArtifactFailure
+}
+
+func (e *ArtifactUploadError) Error() string {
+	return e.Message
+}
+
+// Table returns the failures as a table, one per line, in the order they
+// failed
+func (e *ArtifactUploadError) Table() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "PATH\tDESTINATION\tSTATUS\tERROR")
+	for _, f := range e.Failures {
+		destination := f.Destination
+		if destination == "" {
+			destination = "Buildkite artifact storage"
+		}
+
+		status := "-"
+		if f.StatusCode > 0 {
+			status = fmt.Sprint(f.StatusCode)
+		}
+
+		// Keep each failure to a line, whatever the error
+		message := strings.Join(strings.Fields(f.Err.Error()), " ")
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Path, destination, status, message)
+	}
+
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// artifactFailures collects the artifacts that failed to upload, from each of
+// the uploads going at once
+type artifactFailures struct {
+	mu       sync.Mutex
+	failures []ArtifactFailure
+}
+
+// record adds the artifact that failed to upload to the destination
+func (f *artifactFailures) record(destination string, artifact *api.Artifact, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = append(f.failures, ArtifactFailure{
+		Path:        artifact.Path,
+		Destination: destination,
+		StatusCode:  uploadStatusCode(err),
+		Err:         err,
+	})
+}
+
+// wrap returns err as an ArtifactUploadError with the failures, or err as it
+// is if there weren't any
+func (f *artifactFailures) wrap(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.failures) == 0 {
+		return err
+	}
+
+	failures := make([]ArtifactFailure, len(f.failures))
+	copy(failures, f.failures)
+	return &ArtifactUploadError{Message: err.Error(), Failures: failures}
+}
+
+// uploadStatusCode returns the HTTP status the store responded to the failed
+// upload with, or 0 if it isn't known
+func uploadStatusCode(err error) int {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode()
+	}
+
+	var gsErr *googleapi.Error
+	if errors.As(err, &gsErr) {
+		return gsErr.Code
+	}
+
+	var resErr *errorResponse
+	if errors.As(err, &resErr) && resErr.Response != nil {
+		return resErr.Response.StatusCode
+	}
+
+	var formErr *formUploadError
+	if errors.As(err, &formErr) {
+		return formErr.StatusCode
+	}
+
+	return 0
+}
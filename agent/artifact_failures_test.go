@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestArtifactFailuresWrap(t *testing.T) {
+	var failures artifactFailures
+
+	err := errors.New("There were errors with uploading some of the artifacts")
+	assert.Equal(t, err, failures.wrap(err))
+
+	failures.record("", &api.Artifact{Path: "a.txt"}, &formUploadError{StatusCode: 403, Body: "Access Denied"})
+	failures.record("s3://my-bucket", &api.Artifact{Path: "logs/b.log"},
+		awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), 500, ""))
+	failures.record("gs://my-bucket", &api.Artifact{Path: "c.txt"}, &gsUploadError{path: "c.txt", err: &googleapi.Error{Code: 404}})
+	failures.record("rt://my-repo", &api.Artifact{Path: "d.txt"}, errors.New("connection reset\nby peer"))
+
+	wrapped := failures.wrap(err)
+	require.IsType(t, &ArtifactUploadError{}, wrapped)
+	assert.EqualError(t, wrapped, err.Error())
+
+	uploadErr := wrapped.(*ArtifactUploadError)
+	require.Len(t, uploadErr.Failures, 4)
+	assert.Equal(t, []int{403, 500, 404, 0}, []int{
+		uploadErr.Failures[0].StatusCode,
+		uploadErr.Failures[1].StatusCode,
+		uploadErr.Failures[2].StatusCode,
+		uploadErr.Failures[3].StatusCode,
+	})
+}
+
+func TestArtifactUploadErrorTable(t *testing.T) {
+	uploadErr := &ArtifactUploadError{
+		Message: "2 of 200 artifacts (1%) failed to upload, 198 were uploaded successfully",
+		Failures: []ArtifactFailure{
+			{Path: "a.txt", StatusCode: 403, Err: errors.New("Access Denied (403)")},
+			{Path: "logs/build.log", Destination: "s3://my-bucket", Err: errors.New("connection reset\nby peer")},
+		},
+	}
+
+	assert.Equal(t, ""+
+		"PATH            DESTINATION                 STATUS  ERROR\n"+
+		"a.txt           Buildkite artifact storage  403     Access Denied (403)\n"+
+		"logs/build.log  s3://my-bucket              -       connection reset by peer",
+		uploadErr.Table())
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The path the gallery is uploaded to
+const ArtifactGalleryPath = "index.html"
+
+const defaultGalleryTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Artifacts</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+ul { list-style: none; padding: 0; }
+li { margin: 0.5em 0; }
+img { display: block; max-width: 320px; max-height: 240px; margin-top: 0.25em; }
+.size { color: #888; }
+</style>
+</head>
+<body>
+<h1>Artifacts</h1>
+<ul>
+{{- range .Artifacts}}
+<li>
+<a href="{{.URL}}">{{.Path}}</a> <span class="size">{{.Size}}</span>
+{{- if .IsImage}}
+<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Path}}" loading="lazy"></a>
+{{- end}}
+</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`
+
+// The data a gallery template is rendered with
+type galleryData struct {
+	Artifacts []galleryArtifact
+}
+
+type galleryArtifact struct {
+	Path        string
+	URL         string
+	Size        string
+	ContentType string
+	IsImage     bool
+}
+
+// parseGalleryTemplate parses the gallery template at path, or the default
+// template if path is empty
+func parseGalleryTemplate(templatePath string) (*template.Template, error) {
+	text := defaultGalleryTemplate
+	if templatePath != "" {
+		data, err := ioutil.ReadFile(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	return template.New("gallery").Parse(text)
+}
+
+// writeGallery renders an index.html of the uploaded artifacts to dir, and
+// returns its artifact
+func (a *ArtifactUploader) writeGallery(tmpl *template.Template, artifacts []*api.Artifact, dir string) (*api.Artifact, error) {
+	data := galleryData{}
+	relative := false
+
+	for _, artifact := range artifacts {
+		url := artifact.URL
+		if url == "" {
+			// Links are relative to where the gallery is uploaded
+			url = path.Clean(strings.Replace(artifact.Path, `\`, `/`, -1))
+			relative = true
+		}
+
+		data.Artifacts = append(data.Artifacts, galleryArtifact{
+			Path:        artifact.Path,
+			URL:         url,
+			Size:        formatByteSize(artifact.FileSize),
+			ContentType: artifact.ContentType,
+			IsImage:     strings.HasPrefix(artifact.ContentType, "image/"),
+		})
+	}
+
+	sort.Slice(data.Artifacts, func(i, j int) bool {
+		return data.Artifacts[i].Path < data.Artifacts[j].Path
+	})
+
+	if relative {
+		a.logger.Warn("Some artifacts don't have URLs, so the gallery links to them relative to itself")
+	}
+
+	f, err := ioutil.TempFile(dir, "gallery-")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tmpl.Execute(f, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	galleryPath, err := a.generatedPath(ArtifactGalleryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	gallery, err := a.build(galleryPath, f.Name(), "")
+	if err != nil {
+		return nil, err
+	}
+	gallery.ContentType = "text/html"
+
+	return gallery, nil
+}
+
+// uploadGallery uploads a gallery of the artifacts that were just uploaded
+func (a *ArtifactUploader) uploadGallery(tmpl *template.Template) error {
+	dir, err := a.stagingDir("gallery", 0)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	gallery, err := a.writeGallery(tmpl, a.uploaded, dir)
+	if err != nil {
+		return fmt.Errorf("Error writing the gallery (%v)", err)
+	}
+
+	a.logger.Info("Uploading a gallery of %d artifacts to %s", len(a.uploaded), gallery.Path)
+
+	return a.standaloneUploader().upload([]*api.Artifact{gallery})
+}
+
+// generatedPath returns the path to upload a file generated from the
+// uploaded artifacts to, so that parallel jobs using a key template each get
+// their own
+func (a *ArtifactUploader) generatedPath(p string) (string, error) {
+	if a.conf.KeyTemplate == "" {
+		return p, nil
+	}
+
+	keys, err := parseKeyTemplate(a.conf.KeyTemplate, a.conf.JobID)
+	if err != nil {
+		return "", err
+	}
+	return keys.render(p)
+}
+
+// standaloneUploader returns an uploader for files generated from the
+// uploaded artifacts, which are uploaded on their own, without the options
+// that apply to the uploaded artifacts as a set
+func (a *ArtifactUploader) standaloneUploader() *ArtifactUploader {
+	conf := a.conf
+	conf.CDC = false
+	conf.InventoryManifest = false
+	conf.SetDigest = false
+	conf.AlsoPrefixes = nil
+	conf.ManifestPath = ""
+
+	return &ArtifactUploader{
+		conf:      conf,
+		logger:    a.logger,
+		apiClient: a.apiClient,
+		journal:   a.journal,
+		limiter:   a.limiter,
+		transport: a.transport,
+	}
+}
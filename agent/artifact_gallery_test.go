@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteGallery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-gallery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tmpl, err := parseGalleryTemplate("")
+	require.NoError(t, err)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	gallery, err := uploader.writeGallery(tmpl, []*api.Artifact{
+		{Path: "report.html", URL: "https://bucket.s3.amazonaws.com/report.html", ContentType: "text/html", FileSize: 2048},
+		{Path: "screenshots/<login>.png", URL: "https://bucket.s3.amazonaws.com/screenshots/%3Clogin%3E.png", ContentType: "image/png"},
+	}, dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, "index.html", gallery.Path)
+	assert.Equal(t, "text/html", gallery.ContentType)
+
+	html, err := ioutil.ReadFile(gallery.AbsolutePath)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(html), `<a href="https://bucket.s3.amazonaws.com/report.html">report.html</a> <span class="size">2.0KB</span>`)
+	assert.Contains(t, string(html), `<img src="https://bucket.s3.amazonaws.com/screenshots/%3Clogin%3E.png" alt="screenshots/&lt;login&gt;.png" loading="lazy">`)
+	assert.NotContains(t, string(html), `<img src="https://bucket.s3.amazonaws.com/report.html"`)
+}
+
+func TestWriteGalleryWithCustomTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-gallery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	templatePath := filepath.Join(dir, "gallery.tmpl")
+	require.NoError(t, ioutil.WriteFile(templatePath, []byte(`{{range .Artifacts}}{{.Path}}={{.URL}};{{end}}`), 0600))
+
+	tmpl, err := parseGalleryTemplate(templatePath)
+	require.NoError(t, err)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	gallery, err := uploader.writeGallery(tmpl, []*api.Artifact{
+		{Path: "b.txt"},
+		{Path: "a.txt"},
+	}, dir)
+	require.NoError(t, err)
+
+	html, err := ioutil.ReadFile(gallery.AbsolutePath)
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt=a.txt;b.txt=b.txt;", string(html))
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// The metadata key that records the group of an artifact, for stores and
+// tools that read it from the object rather than from Buildkite
+const ArtifactGroupMetadataKey = "buildkite-artifact-group"
+
+// artifactGroups assigns artifacts to the groups they're shown in by the
+// Buildkite UI
+type artifactGroups struct {
+	rules []artifactGroupRule
+
+	// The group of artifacts that don't match any of the rules
+	fallback string
+}
+
+type artifactGroupRule struct {
+	pattern string
+	group   string
+}
+
+// parseArtifactGroups parses groups in the form pattern=group, where pattern
+// is a glob matched against the artifact's path, or just a group for every
+// artifact that doesn't match a pattern. The first matching pattern wins.
+func parseArtifactGroups(groups []string) (*artifactGroups, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	g := &artifactGroups{}
+	for _, group := range groups {
+		i := strings.LastIndex(group, "=")
+		if i < 0 {
+			name := strings.TrimSpace(group)
+			if name == "" {
+				return nil, fmt.Errorf("Invalid artifact group %q, the group can't be empty", group)
+			}
+			if g.fallback != "" {
+				return nil, fmt.Errorf("Only one artifact group without a pattern can be given, got %q and %q", g.fallback, name)
+			}
+			g.fallback = name
+			continue
+		}
+
+		pattern, name := strings.TrimSpace(group[:i]), strings.TrimSpace(group[i+1:])
+		if pattern == "" || name == "" {
+			return nil, fmt.Errorf("Invalid artifact group %q, expected pattern=group", group)
+		}
+		if _, err := zglob.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid artifact group pattern %q (%v)", pattern, err)
+		}
+		g.rules = append(g.rules, artifactGroupRule{pattern: pattern, group: name})
+	}
+
+	return g, nil
+}
+
+// groupFor returns the group of an artifact, or an empty string if it isn't
+// in one
+func (g *artifactGroups) groupFor(artifact *api.Artifact) string {
+	for _, rule := range g.rules {
+		if matched, _ := zglob.Match(rule.pattern, artifact.Path); matched {
+			return rule.group
+		}
+	}
+	return g.fallback
+}
+
+// assign sets the group of each artifact. The group is sent to Buildkite
+// with the artifact, and also stored as metadata on the uploaded object.
+func (g *artifactGroups) assign(artifacts []*api.Artifact) {
+	for _, artifact := range artifacts {
+		group := g.groupFor(artifact)
+		if group == "" {
+			continue
+		}
+
+		artifact.Group = group
+		if artifact.Metadata == nil {
+			artifact.Metadata = map[string]string{}
+		}
+		artifact.Metadata[ArtifactGroupMetadataKey] = group
+	}
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactGroupsAssign(t *testing.T) {
+	groups, err := parseArtifactGroups([]string{"coverage/**/*=Coverage", "*.xml=Reports", "Logs"})
+	require.NoError(t, err)
+
+	artifacts := []*api.Artifact{
+		{Path: "coverage/html/index.html"},
+		{Path: "junit.xml"},
+		{Path: "log/build.log"},
+	}
+	groups.assign(artifacts)
+
+	for i, expected := range []string{"Coverage", "Reports", "Logs"} {
+		assert.Equal(t, expected, artifacts[i].Group, artifacts[i].Path)
+		assert.Equal(t, expected, artifacts[i].Metadata[ArtifactGroupMetadataKey], artifacts[i].Path)
+	}
+}
+
+func TestArtifactGroupsLeavesUnmatchedArtifacts(t *testing.T) {
+	groups, err := parseArtifactGroups([]string{"*.xml=Reports"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "build.log"}
+	groups.assign([]*api.Artifact{artifact})
+
+	assert.Equal(t, "", artifact.Group)
+	assert.Nil(t, artifact.Metadata)
+}
+
+func TestParseArtifactGroupsRejectsInvalidGroups(t *testing.T) {
+	for _, groups := range [][]string{
+		{""},
+		{"*.xml="},
+		{"=Reports"},
+		{"Logs", "Reports"},
+	} {
+		_, err := parseArtifactGroups(groups)
+		assert.Error(t, err, "%v", groups)
+	}
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The extension added to the paths of artifacts compressed with Gzip
+const gzipExtension = ".gz"
+
+// checkGzipDestination returns an error if objects uploaded to the
+// destination can't be stored with a Content-Encoding. Buildkite artifact
+// storage and Artifactory serve the compressed bytes as they are, so
+// browsers would show them compressed.
+func checkGzipDestination(destination string) error {
+	for _, scheme := range []string{"s3://", "gs://", "az://"} {
+		if strings.HasPrefix(destination, scheme) {
+			return nil
+		}
+	}
+	return errors.New("Gzip compressed artifacts can only be uploaded to s3://, gs:// and az:// destinations, which store their Content-Encoding")
+}
+
+// isGzipped returns whether the artifact is already compressed with Gzip,
+// going by its path and Content-Type
+func isGzipped(artifact *api.Artifact) bool {
+	switch artifact.ContentType {
+	case "application/gzip", "application/x-gzip":
+		return true
+	}
+	return strings.HasSuffix(artifact.Path, gzipExtension) || strings.HasSuffix(artifact.Path, ".tgz")
+}
+
+// gzipStagingSize estimates the space needed to stage the compressed
+// artifacts, assuming they're no bigger than the originals
+func gzipStagingSize(artifacts []*api.Artifact) int64 {
+	var total int64
+	for _, artifact := range artifacts {
+		if !isGzipped(artifact) {
+			total += artifact.FileSize
+		}
+	}
+	return total
+}
+
+// gzipArtifacts compresses every artifact that isn't already compressed into
+// dir. Artifacts that fail to compress are left out of the returned
+// artifacts, and their errors are returned so the rest can still be
+// uploaded.
+func (a *ArtifactUploader) gzipArtifacts(artifacts []*api.Artifact, dir string) ([]*api.Artifact, []error) {
+	compressed := []*api.Artifact{}
+	errs := []error{}
+
+	for _, artifact := range artifacts {
+		if isGzipped(artifact) {
+			a.logger.Debug("Not compressing %s, as it's already compressed", artifact.Path)
+			compressed = append(compressed, artifact)
+			continue
+		}
+
+		if err := a.gzip(artifact, dir); err != nil {
+			a.logger.Error("Error compressing artifact \"%s\": %s", artifact.Path, err)
+			errs = append(errs, err)
+			continue
+		}
+		compressed = append(compressed, artifact)
+	}
+
+	return compressed, errs
+}
+
+// gzip points the artifact at a compressed copy, with .gz added to its path.
+// Its Content-Type is still that of the uncompressed file, and its
+// Content-Encoding is set so the store serves it to be decompressed by
+// browsers.
+func (a *ArtifactUploader) gzip(artifact *api.Artifact, dir string) error {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(dir, "gzip-")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha1.New()
+	sha256Hash := sha256.New()
+	counter := &countingWriter{}
+
+	w := gzip.NewWriter(io.MultiWriter(out, hash, sha256Hash, counter))
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	a.logger.Debug("Compressed %s from %s to %s", artifact.Path, formatByteSize(artifact.FileSize), formatByteSize(counter.n))
+
+	artifact.Path += gzipExtension
+	artifact.AbsolutePath = out.Name()
+	artifact.FileSize = counter.n
+	artifact.Sha1Sum = fmt.Sprintf("%x", hash.Sum(nil))
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+	artifact.ContentEncoding = "gzip"
+
+	return nil
+}
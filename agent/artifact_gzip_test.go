@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckGzipDestination(t *testing.T) {
+	for _, destination := range []string{"s3://my-bucket", "gs://my-bucket/logs", "az://my-container"} {
+		assert.NoError(t, checkGzipDestination(destination), destination)
+	}
+	for _, destination := range []string{"", "rt://my-repo"} {
+		assert.Error(t, checkGzipDestination(destination), destination)
+	}
+}
+
+func TestGzipArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("llamas are great\n", 100)
+	logPath := filepath.Join(dir, "build.log")
+	require.NoError(t, ioutil.WriteFile(logPath, []byte(content), 0600))
+
+	tarPath := filepath.Join(dir, "app.tar.gz")
+	require.NoError(t, ioutil.WriteFile(tarPath, []byte("not really gzipped"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Gzip: true})
+	log := &api.Artifact{Path: "build.log", AbsolutePath: logPath, FileSize: int64(len(content)), ContentType: "text/plain"}
+	tar := &api.Artifact{Path: "app.tar.gz", AbsolutePath: tarPath, FileSize: 18, ContentType: "application/gzip"}
+
+	artifacts, errs := uploader.gzipArtifacts([]*api.Artifact{log, tar}, dir)
+	assert.Empty(t, errs)
+	assert.Equal(t, []*api.Artifact{log, tar}, artifacts)
+
+	assert.Equal(t, "build.log.gz", log.Path)
+	assert.Equal(t, "text/plain", log.ContentType)
+	assert.Equal(t, "gzip", log.ContentEncoding)
+	assert.Less(t, log.FileSize, int64(len(content)))
+
+	compressed, err := ioutil.ReadFile(log.AbsolutePath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(compressed)), log.FileSize)
+	assert.Equal(t, fmt.Sprintf("%x", sha1.Sum(compressed)), log.Sha1Sum)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(compressed)), log.Sha256Sum)
+
+	f, err := os.Open(log.AbsolutePath)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(decompressed))
+
+	// Already compressed files are left alone
+	assert.Equal(t, "app.tar.gz", tar.Path)
+	assert.Equal(t, tarPath, tar.AbsolutePath)
+	assert.Empty(t, tar.ContentEncoding)
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreRules are a set of .gitignore style patterns that artifacts can be
+// filtered with. The supported syntax is:
+//
+//   - blank lines and lines starting with # are ignored
+//   - a leading ! negates the pattern, re-including anything it matches
+//   - a trailing / only matches directories (and so everything in them)
+//   - a pattern containing a / is anchored to the ignore file's directory,
+//     otherwise it matches at any depth
+//   - *, ? and [a-z] match within a single path segment, and ** matches any
+//     number of segments
+//   - \ escapes the following character, e.g. \# or \!
+//
+// As with git, the last matching pattern wins, and a file can't be
+// re-included if one of its parent directories is ignored.
+type ignoreRules struct {
+	// Patterns are relative to this directory
+	base string
+
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// The ignore file that's used from the working directory with UseIgnoreFile
+const DefaultIgnoreFile = ".buildkiteignore"
+
+// ignoreFilePath returns the ignore file to filter artifacts with. That's
+// IgnoreFile if it's set, or else the .buildkiteignore in the working
+// directory if UseIgnoreFile is set and there is one.
+func (a *ArtifactUploader) ignoreFilePath(wd string) string {
+	if a.conf.IgnoreFile != "" || !a.conf.UseIgnoreFile {
+		return a.conf.IgnoreFile
+	}
+
+	path := filepath.Join(wd, DefaultIgnoreFile)
+	if _, err := os.Stat(path); err != nil {
+		a.logger.Debug("Not using an ignore file, as there's no %s in %s", DefaultIgnoreFile, wd)
+		return ""
+	}
+
+	a.logger.Debug("Using the ignore file %s", path)
+	return path
+}
+
+// loadIgnoreFile parses the ignore file at path
+func loadIgnoreFile(path string) (*ignoreRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open ignore file %q (%v)", path, err)
+	}
+	defer f.Close()
+
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := parseIgnoreRules(filepath.Dir(absolutePath), f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse ignore file %q (%v)", path, err)
+	}
+
+	return rules, nil
+}
+
+func parseIgnoreRules(base string, r io.Reader) (*ignoreRules, error) {
+	rules := &ignoreRules{base: base}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		re, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		rule.pattern = re
+
+		rules.rules = append(rules.rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// compileIgnorePattern translates a single gitignore pattern to a regexp
+// that matches slash separated paths
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			atStart := i == 0 || pattern[i-1] == '/'
+			switch {
+			case atStart && i+2 == len(pattern):
+				// a trailing /** matches everything inside
+				re.WriteString(".*")
+				i++
+			case atStart && pattern[i+2] == '/':
+				// a leading **/ or a /**/ matches zero or more directories
+				re.WriteString("(?:.*/)?")
+				i += 2
+			default:
+				// anything else is treated like a regular *
+				re.WriteString("[^/]*")
+				i++
+			}
+
+		case c == '*':
+			re.WriteString("[^/]*")
+
+		case c == '?':
+			re.WriteString("[^/]")
+
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+// Ignored returns whether the file at absolutePath is ignored by the rules.
+// Files outside of the rules' base directory are never ignored.
+func (r *ignoreRules) Ignored(absolutePath string) bool {
+	rel, err := filepath.Rel(r.base, absolutePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	// A file can't be re-included if any of its parent directories are
+	// ignored, so check them first
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return r.match(rel, false)
+}
+
+func (r *ignoreRules) match(path string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(path) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	base := filepath.FromSlash("/build")
+
+	rules, err := parseIgnoreRules(base, strings.NewReader(strings.Join([]string{
+		"# comments and blank lines are skipped",
+		"",
+		"*.tmp",
+		"!keep.tmp",
+		"node_modules/",
+		"/coverage",
+		"logs/**/debug.log",
+		"docs/*.md",
+		`\#literal`,
+		"cache?/",
+		"build-[0-9]",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Path    string
+		Ignored bool
+	}{
+		{"a.tmp", true},
+		{"deep/nested/b.tmp", true},
+		{"keep.tmp", false},
+		{"deep/keep.tmp", false},
+		{"node_modules/pkg/index.js", true},
+		{"app/node_modules/pkg/index.js", true},
+		{"node_modules", false}, // only a directory matches, not a file
+		{"coverage/index.html", true},
+		{"app/coverage/index.html", false},
+		{"logs/debug.log", true},
+		{"logs/a/b/debug.log", true},
+		{"other/logs/debug.log", false},
+		{"docs/readme.md", true},
+		{"docs/nested/readme.md", false},
+		{"#literal", true},
+		{"cache1/file", true},
+		{"cache12/file", false},
+		{"build-3", true},
+		{"build-x", false},
+		{"report.html", false},
+	} {
+		t.Run(tc.Path, func(t *testing.T) {
+			path := filepath.Join(base, filepath.FromSlash(tc.Path))
+			assert.Equal(t, tc.Ignored, rules.Ignored(path))
+		})
+	}
+}
+
+func TestIgnoreRulesCantReincludeInIgnoredDirectory(t *testing.T) {
+	base := filepath.FromSlash("/build")
+
+	rules, err := parseIgnoreRules(base, strings.NewReader("tmp/\n!tmp/keep.txt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, rules.Ignored(filepath.Join(base, "tmp", "keep.txt")))
+}
+
+func TestIgnoreRulesOutsideBaseDirectory(t *testing.T) {
+	rules, err := parseIgnoreRules(filepath.FromSlash("/build/app"), strings.NewReader("*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, rules.Ignored(filepath.FromSlash("/build/other/file.txt")))
+	assert.True(t, rules.Ignored(filepath.FromSlash("/build/app/file.txt")))
+}
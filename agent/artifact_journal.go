@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactJournal is an append-only record of the artifacts that have been
+// successfully uploaded, so that an upload that crashed part way through can
+// be resumed without starting again.
+//
+// Each line of the journal is a JSON encoded artifactJournalEntry. Every
+// write is fsync'd so that the journal survives the agent crashing.
+type artifactJournal struct {
+	// The open journal file
+	file *os.File
+
+	// Entries that were already in the journal when it was opened
+	completed map[string]bool
+
+	// Protects writes to the journal from concurrent uploads
+	mu sync.Mutex
+}
+
+type artifactJournalEntry struct {
+	Destination string `json:"destination"`
+	Path        string `json:"path"`
+	Sha1Sum     string `json:"sha1sum"`
+	ID          string `json:"id"`
+}
+
+func (e artifactJournalEntry) key() string {
+	return e.Destination + "\x00" + e.Path + "\x00" + e.Sha1Sum
+}
+
+// openArtifactJournal opens the journal at path. If resume is true, existing
+// entries are loaded so they can be skipped, otherwise the journal is
+// started afresh.
+func openArtifactJournal(path string, resume bool) (*artifactJournal, error) {
+	j := &artifactJournal{completed: make(map[string]bool)}
+
+	var end int64
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if resume {
+		var err error
+		if end, err = j.load(path); err != nil {
+			return nil, err
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open artifact journal %q (%v)", path, err)
+	}
+	j.file = f
+
+	// Drop any partially written last line, so new entries start on a line
+	// of their own
+	if resume {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to truncate artifact journal %q (%v)", path, err)
+		}
+	}
+
+	return j, nil
+}
+
+// load reads the entries already in the journal, returning the offset of the
+// end of its last complete line
+func (j *artifactJournal) load(path string) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Failed to read artifact journal %q (%v)", path, err)
+	}
+	defer f.Close()
+
+	var end int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+
+		// A crash can leave a partially written last line, which we
+		// treat as never having completed
+		if err == io.EOF {
+			return end, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("Failed to read artifact journal %q (%v)", path, err)
+		}
+		end += int64(len(line))
+
+		var entry artifactJournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+
+		j.completed[entry.key()] = true
+	}
+}
+
+// Completed returns whether the artifact was recorded as uploaded to the
+// destination in a previous run
+func (j *artifactJournal) Completed(destination string, artifact *api.Artifact) bool {
+	return j.completed[journalEntryFor(destination, artifact).key()]
+}
+
+// Record durably appends the artifact to the journal
+func (j *artifactJournal) Record(destination string, artifact *api.Artifact) error {
+	line, err := json.Marshal(journalEntryFor(destination, artifact))
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Failed to write to artifact journal (%v)", err)
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync artifact journal (%v)", err)
+	}
+
+	return nil
+}
+
+func (j *artifactJournal) Close() error {
+	return j.file.Close()
+}
+
+func journalEntryFor(destination string, artifact *api.Artifact) artifactJournalEntry {
+	return artifactJournalEntry{
+		Destination: destination,
+		Path:        artifact.Path,
+		Sha1Sum:     artifact.Sha1Sum,
+		ID:          artifact.ID,
+	}
+}
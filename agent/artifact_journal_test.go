@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	done := &api.Artifact{ID: "1", Path: "done.txt", Sha1Sum: "abc"}
+	changed := &api.Artifact{ID: "2", Path: "changed.txt", Sha1Sum: "def"}
+
+	j, err := openArtifactJournal(path, false)
+	require.NoError(t, err)
+	require.NoError(t, j.Record("s3://bucket", done))
+	require.NoError(t, j.Record("s3://bucket", changed))
+	require.NoError(t, j.Close())
+
+	// Simulate a crash part way through writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"destination":"s3://bucket","path":"par`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = openArtifactJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.True(t, j.Completed("s3://bucket", done))
+	assert.False(t, j.Completed("s3://bucket", &api.Artifact{Path: "changed.txt", Sha1Sum: "xyz"}))
+	assert.False(t, j.Completed("gs://bucket", done))
+}
+
+func TestArtifactJournalResumeTwiceAfterPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	first := &api.Artifact{ID: "1", Path: "first.txt", Sha1Sum: "abc"}
+	second := &api.Artifact{ID: "2", Path: "second.txt", Sha1Sum: "def"}
+	third := &api.Artifact{ID: "3", Path: "third.txt", Sha1Sum: "ghi"}
+
+	j, err := openArtifactJournal(path, false)
+	require.NoError(t, err)
+	require.NoError(t, j.Record("s3://bucket", first))
+	require.NoError(t, j.Close())
+
+	// Simulate a crash part way through writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"destination":"s3://bucket","path":"par`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for _, artifact := range []*api.Artifact{second, third} {
+		j, err = openArtifactJournal(path, true)
+		require.NoError(t, err)
+		require.NoError(t, j.Record("s3://bucket", artifact))
+		require.NoError(t, j.Close())
+	}
+
+	j, err = openArtifactJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.True(t, j.Completed("s3://bucket", first))
+	assert.True(t, j.Completed("s3://bucket", second))
+	assert.True(t, j.Completed("s3://bucket", third))
+}
+
+func TestArtifactJournalWithoutResumeStartsAfresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	artifact := &api.Artifact{ID: "1", Path: "done.txt", Sha1Sum: "abc"}
+
+	j, err := openArtifactJournal(path, false)
+	require.NoError(t, err)
+	require.NoError(t, j.Record("", artifact))
+	require.NoError(t, j.Close())
+
+	j, err = openArtifactJournal(path, false)
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+
+	j, err = openArtifactJournal(path, true)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.False(t, j.Completed("", artifact))
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// The fields that can be used in a key template, and the environment
+// variables they're read from
+var keyTemplateFields = map[string]string{
+	"JobID":       "BUILDKITE_JOB_ID",
+	"StepKey":     "BUILDKITE_STEP_KEY",
+	"StepID":      "BUILDKITE_STEP_ID",
+	"BuildID":     "BUILDKITE_BUILD_ID",
+	"BuildNumber": "BUILDKITE_BUILD_NUMBER",
+	"Pipeline":    "BUILDKITE_PIPELINE_SLUG",
+	"ParallelJob": "BUILDKITE_PARALLEL_JOB",
+}
+
+// keyTemplate renders the path an artifact is uploaded to from its path and
+// the job's environment, e.g. "{{.StepKey}}/{{.ParallelJob}}/{{.Path}}"
+type keyTemplate struct {
+	tmpl   *template.Template
+	fields map[string]string
+}
+
+func parseKeyTemplate(text string, jobID string) (*keyTemplate, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key template %q (%v)", text, err)
+	}
+
+	fields := map[string]string{}
+	for name, env := range keyTemplateFields {
+		fields[name] = os.Getenv(env)
+	}
+	if jobID != "" {
+		fields["JobID"] = jobID
+	}
+
+	for _, name := range templateFieldNames(tmpl.Tree.Root) {
+		if name == "Path" {
+			continue
+		}
+		env, ok := keyTemplateFields[name]
+		if !ok {
+			return nil, fmt.Errorf("The key template %q uses an unknown field .%s", text, name)
+		}
+		if fields[name] == "" {
+			return nil, fmt.Errorf("The key template %q uses .%s, but %s is empty", text, name, env)
+		}
+	}
+
+	k := &keyTemplate{tmpl: tmpl, fields: fields}
+
+	// Without the artifact's path every artifact would have the same key
+	const sentinel = "\x00path\x00"
+	rendered, err := k.render(sentinel)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(rendered, sentinel) {
+		return nil, fmt.Errorf("The key template %q must include {{.Path}}", text)
+	}
+
+	return k, nil
+}
+
+func (k *keyTemplate) render(path string) (string, error) {
+	data := map[string]string{"Path": path}
+	for name, value := range k.fields {
+		data[name] = value
+	}
+
+	var b strings.Builder
+	if err := k.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("Error rendering the key template for %s (%v)", path, err)
+	}
+	return b.String(), nil
+}
+
+// templateFieldNames returns the names of the fields a template uses
+func templateFieldNames(node parse.Node) []string {
+	seen := map[string]bool{}
+
+	var walk func(parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					walk(child)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			seen[n.Ident[0]] = true
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(node)
+
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setKeyTemplateEnv(env map[string]string) func() {
+	previous := map[string]string{}
+	for _, name := range keyTemplateFields {
+		previous[name] = os.Getenv(name)
+		os.Setenv(name, env[name])
+	}
+	return func() {
+		for name, value := range previous {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	defer setKeyTemplateEnv(map[string]string{
+		"BUILDKITE_STEP_KEY":     "tests",
+		"BUILDKITE_PARALLEL_JOB": "3",
+	})()
+
+	k, err := parseKeyTemplate("{{.StepKey}}/{{.ParallelJob}}/{{.JobID}}/{{.Path}}", "job-1")
+	require.NoError(t, err)
+
+	key, err := k.render("coverage/lcov.info")
+	require.NoError(t, err)
+	assert.Equal(t, "tests/3/job-1/coverage/lcov.info", key)
+}
+
+func TestKeyTemplateErrors(t *testing.T) {
+	defer setKeyTemplateEnv(map[string]string{
+		"BUILDKITE_STEP_KEY": "tests",
+	})()
+
+	_, err := parseKeyTemplate("{{.StepKey}}/{{.ParallelJob}}/{{.Path}}", "job-1")
+	assert.EqualError(t, err, `The key template "{{.StepKey}}/{{.ParallelJob}}/{{.Path}}" uses .ParallelJob, but BUILDKITE_PARALLEL_JOB is empty`)
+
+	_, err = parseKeyTemplate("{{if .Commit}}{{.Path}}{{end}}", "job-1")
+	assert.EqualError(t, err, `The key template "{{if .Commit}}{{.Path}}{{end}}" uses an unknown field .Commit`)
+
+	_, err = parseKeyTemplate("{{.StepKey}}/{{.JobID}}", "job-1")
+	assert.EqualError(t, err, `The key template "{{.StepKey}}/{{.JobID}}" must include {{.Path}}`)
+
+	_, err = parseKeyTemplate("{{.Path", "job-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// inlineLinksSupported returns whether the output is being shown by Buildkite,
+// which renders its inline link escape sequence in the job's log. Anywhere
+// else, the sequence would show up as junk.
+func inlineLinksSupported() bool {
+	return os.Getenv("BUILDKITE") == "true"
+}
+
+// writeArtifactLinks writes a line linking to each of the artifacts, sorted by
+// path. Inline links use Buildkite's artifact:// URLs, which link to the
+// artifact whichever destination it was uploaded to. Otherwise each line is
+// the artifact's path and the URL of where it was uploaded, if it has one.
+func writeArtifactLinks(w io.Writer, artifacts []*api.Artifact, inline bool) error {
+	sorted := make([]*api.Artifact, len(artifacts))
+	copy(sorted, artifacts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	for _, artifact := range sorted {
+		artifactPath := path.Clean(strings.Replace(artifact.Path, `\`, `/`, -1))
+
+		var line string
+		if inline && linkSafe(artifactPath) {
+			line = fmt.Sprintf("\033]1339;url='artifact://%s';content='%s'\a", artifactPath, artifactPath)
+		} else if artifact.URL != "" {
+			line = fmt.Sprintf("%s %s", artifactPath, artifact.URL)
+		} else {
+			line = artifactPath
+		}
+
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkSafe returns whether the path can go in an inline link as it is, as
+// quotes or control characters would end the escape sequence early
+func linkSafe(artifactPath string) bool {
+	for _, r := range artifactPath {
+		if r == '\'' || r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// emitLinks prints links to the artifacts that were just uploaded in the job's
+// output
+func (a *ArtifactUploader) emitLinks() error {
+	return writeArtifactLinks(os.Stdout, a.uploaded, inlineLinksSupported())
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteArtifactLinks(t *testing.T) {
+	artifacts := []*api.Artifact{
+		{Path: "logs/test.log", URL: "https://my-bucket.s3.amazonaws.com/logs/test.log"},
+		{Path: "coverage/index.html"},
+		{Path: "it's.txt"},
+	}
+
+	var inline bytes.Buffer
+	require.NoError(t, writeArtifactLinks(&inline, artifacts, true))
+	assert.Equal(t, "\033]1339;url='artifact://coverage/index.html';content='coverage/index.html'\a\n"+
+		"it's.txt\n"+
+		"\033]1339;url='artifact://logs/test.log';content='logs/test.log'\a\n", inline.String())
+
+	var plain bytes.Buffer
+	require.NoError(t, writeArtifactLinks(&plain, artifacts, false))
+	assert.Equal(t, "coverage/index.html\n"+
+		"it's.txt\n"+
+		"logs/test.log https://my-bucket.s3.amazonaws.com/logs/test.log\n", plain.String())
+
+	// The artifacts are left in the order they were uploaded
+	assert.Equal(t, "logs/test.log", artifacts[0].Path)
+}
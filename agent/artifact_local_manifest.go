@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// localManifestEntry is what happened to an artifact, for the JSON manifest
+// written to ManifestPath once the uploads finish
+type localManifestEntry struct {
+	Path        string  `json:"path"`
+	LocalPath   string  `json:"local_path"`
+	Destination string  `json:"destination"`
+	URL         string  `json:"url,omitempty"`
+	Presigned   string  `json:"presigned_url,omitempty"`
+	Size        int64   `json:"size"`
+	Sha256Sum   string  `json:"sha256sum"`
+	ContentType string  `json:"content_type"`
+	DurationMS  float64 `json:"duration_ms"`
+	Error       string  `json:"error,omitempty"`
+
+	Source *artifactSourceLink `json:"source,omitempty"`
+}
+
+// localManifest records each upload as it finishes. A nil *localManifest
+// records nothing, so it costs nothing when ManifestPath isn't set.
+type localManifest struct {
+	destination string
+
+	// Adds the source of each artifact, if SourceLink is set
+	sourceLinks *artifactSourceLinks
+
+	mu      sync.Mutex
+	entries []localManifestEntry
+}
+
+func newLocalManifest(destination string) *localManifest {
+	return &localManifest{destination: destination, entries: []localManifestEntry{}}
+}
+
+// record adds the artifact to the manifest, with its presigned download URL
+// if one was made, and the error it failed with if it did
+func (m *localManifest) record(artifact *api.Artifact, presignedURL string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	entry := localManifestEntry{
+		Path:        artifact.Path,
+		LocalPath:   artifact.AbsolutePath,
+		Destination: artifactDestination(m.destination, artifact),
+		URL:         artifact.URL,
+		Presigned:   presignedURL,
+		Size:        artifact.FileSize,
+		Sha256Sum:   artifact.Sha256Sum,
+		ContentType: artifact.ContentType,
+		DurationMS:  milliseconds(duration),
+		Source:      m.sourceLinks.linkFor(artifact),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	// Artifacts made after the files were read, such as chunk lists, don't
+	// have a SHA-256 yet
+	if entry.Sha256Sum == "" {
+		if sum, err := sha256File(artifact.AbsolutePath); err == nil {
+			entry.Sha256Sum = hex.EncodeToString(sum)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+}
+
+// write writes the entries recorded so far to path as a JSON array, sorted by
+// path
+func (m *localManifest) write(path string) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(m.entries, func(i, j int) bool {
+		return m.entries[i].Path < m.entries[j].Path
+	})
+
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Error writing the manifest to %s (%v)", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildChecksumsBothSums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-local-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	artifact, err := uploader.build("a.txt", path, "*.txt")
+	require.NoError(t, err)
+
+	assert.Equal(t, "f2e2d844b3e04d61109c4dead6e121bfbd98b0a3", artifact.Sha1Sum)
+	assert.Equal(t, "66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c", artifact.Sha256Sum)
+}
+
+func TestLocalManifestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-local-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := newLocalManifest("s3://my-bucket/builds")
+	manifest.record(&api.Artifact{
+		Path:         "pkg/b.tar.gz",
+		AbsolutePath: "/build/pkg/b.tar.gz",
+		URL:          "https://my-bucket.s3.amazonaws.com/builds/pkg/b.tar.gz",
+		FileSize:     2,
+		Sha256Sum:    "bbb",
+		ContentType:  "application/gzip",
+	}, "", 1500*time.Millisecond, nil)
+	manifest.record(&api.Artifact{
+		Path:         "pkg/a.tar.gz",
+		AbsolutePath: "/build/pkg/a.tar.gz",
+		FileSize:     1,
+		Sha256Sum:    "aaa",
+		ContentType:  "application/gzip",
+	}, "", time.Second, errors.New("Access Denied"))
+
+	path := filepath.Join(dir, "manifest.json")
+	require.NoError(t, manifest.write(path))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var entries []localManifestEntry
+	require.NoError(t, json.Unmarshal(data, &entries))
+	assert.Equal(t, []localManifestEntry{
+		{
+			Path:        "pkg/a.tar.gz",
+			LocalPath:   "/build/pkg/a.tar.gz",
+			Destination: "s3://my-bucket/builds/pkg/a.tar.gz",
+			Size:        1,
+			Sha256Sum:   "aaa",
+			ContentType: "application/gzip",
+			DurationMS:  1000,
+			Error:       "Access Denied",
+		},
+		{
+			Path:        "pkg/b.tar.gz",
+			LocalPath:   "/build/pkg/b.tar.gz",
+			Destination: "s3://my-bucket/builds/pkg/b.tar.gz",
+			URL:         "https://my-bucket.s3.amazonaws.com/builds/pkg/b.tar.gz",
+			Size:        2,
+			Sha256Sum:   "bbb",
+			ContentType: "application/gzip",
+			DurationMS:  1500,
+		},
+	}, entries)
+}
+
+func TestLocalManifestIsOffByDefault(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.Nil(t, uploader.localManifest)
+
+	// A nil *localManifest records and writes nothing
+	uploader.localManifest.record(&api.Artifact{}, "", time.Second, nil)
+	assert.NoError(t, uploader.localManifest.write(""))
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The path the manifest is uploaded to, with its signature next to it
+const ArtifactManifestPath = "artifacts.manifest.json"
+
+// The manifest of the artifacts uploaded by a job, which is signed so that
+// consumers can check what they download against it without trusting where
+// it was downloaded from, and can include presigned URLs to share the
+// artifacts with. It's JSON with these fields:
+//
+//	version         always 1
+//	job_id          the job that uploaded the artifacts
+//	build_id        the build the job is part of
+//	set_digest      the Merkle root of the artifacts, if --set-digest was used
+//	urls_expire_at  when the presigned URLs stop working, if there are any
+//	artifacts       each artifact sorted by "path", with its "size" in bytes,
+//	                its hex "sha1sum" and "sha256sum", its presigned "url",
+//	                with --timing-detail, its "timing" in milliseconds
+//	                as {"resolve_ms", "read_ms", "transfer_ms"}, and with
+//	                --source-link, its "source" as {"repository", "commit",
+//	                "paths"}
+type artifactManifest struct {
+	Version      int                     `json:"version"`
+	JobID        string                  `json:"job_id"`
+	BuildID      string                  `json:"build_id,omitempty"`
+	SetDigest    string                  `json:"set_digest,omitempty"`
+	URLsExpireAt string                  `json:"urls_expire_at,omitempty"`
+	Artifacts    []artifactManifestEntry `json:"artifacts"`
+}
+
+type artifactManifestEntry struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha1Sum   string `json:"sha1sum"`
+	Sha256Sum string `json:"sha256sum"`
+	URL       string `json:"url,omitempty"`
+
+	Timing *artifactManifestTiming `json:"timing,omitempty"`
+	Source *artifactSourceLink     `json:"source,omitempty"`
+}
+
+type artifactManifestTiming struct {
+	ResolveMS  float64 `json:"resolve_ms"`
+	ReadMS     float64 `json:"read_ms"`
+	TransferMS float64 `json:"transfer_ms"`
+}
+
+// buildManifest lists the artifacts with their checksums, and presigned URLs
+// if the presigner is set
+func (a *ArtifactUploader) buildManifest(artifacts []*api.Artifact) (*artifactManifest, error) {
+	manifest := &artifactManifest{
+		Version:   1,
+		JobID:     a.conf.JobID,
+		BuildID:   os.Getenv("BUILDKITE_BUILD_ID"),
+		SetDigest: a.setDigest,
+		Artifacts: []artifactManifestEntry{},
+	}
+
+	// The URLs are signed after this, so they last at least until then
+	if a.presigner != nil {
+		manifest.URLsExpireAt = time.Now().Add(a.conf.ManifestURLExpiry).UTC().Format(time.RFC3339)
+	}
+
+	for _, artifact := range artifacts {
+		// The SHA-256 is usually worked out along with the SHA-1
+		sha256Sum := artifact.Sha256Sum
+		if sha256Sum == "" {
+			sum, err := sha256File(artifact.AbsolutePath)
+			if err != nil {
+				return nil, err
+			}
+			sha256Sum = hex.EncodeToString(sum)
+		}
+
+		entry := artifactManifestEntry{
+			Path:      artifact.Path,
+			Size:      artifact.FileSize,
+			Sha1Sum:   artifact.Sha1Sum,
+			Sha256Sum: sha256Sum,
+			Source:    a.sourceLinks.linkFor(artifact),
+		}
+		if a.presigner != nil {
+			var err error
+			entry.URL, err = a.presigner.PresignedURL(artifact, a.conf.ManifestURLExpiry)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if timing := a.timings.get(artifact); timing != nil {
+			entry.Timing = &artifactManifestTiming{
+				ResolveMS:  milliseconds(timing.resolve),
+				ReadMS:     milliseconds(timing.readTime()),
+				TransferMS: milliseconds(timing.transfer),
+			}
+		}
+
+		manifest.Artifacts = append(manifest.Artifacts, entry)
+	}
+
+	sort.Slice(manifest.Artifacts, func(i, j int) bool {
+		return manifest.Artifacts[i].Path < manifest.Artifacts[j].Path
+	})
+
+	return manifest, nil
+}
+
+// writeManifest writes the manifest of the artifacts into dir, along with its
+// signature if there's a signer, and returns them to be uploaded
+func (a *ArtifactUploader) writeManifest(artifacts []*api.Artifact, dir string) ([]*api.Artifact, error) {
+	manifest, err := a.buildManifest(artifacts)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	manifestPath, err := a.generatedPath(ArtifactManifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	absolutePath := filepath.Join(dir, ArtifactManifestPath)
+	if err := ioutil.WriteFile(absolutePath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	m, err := a.build(manifestPath, absolutePath, "")
+	if err != nil {
+		return nil, err
+	}
+	m.ContentType = "application/json"
+
+	if a.conf.ManifestSigner == nil {
+		return []*api.Artifact{m}, nil
+	}
+
+	sig, err := a.conf.ManifestSigner.Sign(data, path.Base(manifestPath))
+	if err != nil {
+		return nil, fmt.Errorf("Error signing the manifest (%v)", err)
+	}
+
+	sigExtension := a.conf.ManifestSigner.Extension()
+	if err := ioutil.WriteFile(absolutePath+sigExtension, sig, 0600); err != nil {
+		return nil, err
+	}
+
+	s, err := a.build(manifestPath+sigExtension, absolutePath+sigExtension, "")
+	if err != nil {
+		return nil, err
+	}
+	s.ContentType = "text/plain"
+
+	return []*api.Artifact{m, s}, nil
+}
+
+// uploadManifest uploads a manifest of the artifacts that were just uploaded
+func (a *ArtifactUploader) uploadManifest() error {
+	dir, err := a.stagingDir("manifest", 0)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := a.writeManifest(a.uploaded, dir)
+	if err != nil {
+		return fmt.Errorf("Error writing the manifest (%v)", err)
+	}
+
+	a.logger.Info("Uploading a manifest of %d artifacts to %s", len(a.uploaded), artifacts[0].Path)
+	if a.presigner != nil {
+		a.logger.Info("The URLs in the manifest expire in %s, upload again to make new ones", a.conf.ManifestURLExpiry)
+	}
+
+	return a.standaloneUploader().upload(artifacts)
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSignedManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "minisign.key")
+	public := writeMinisignKey(t, keyPath, "")
+	signer, err := NewArtifactManifestSigner(keyPath, "")
+	require.NoError(t, err)
+
+	for _, name := range []string{"b.txt", "a.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:          "job-1",
+		ManifestSigner: signer,
+	})
+	var artifacts []*api.Artifact
+	for _, name := range []string{"b.txt", "a.txt"} {
+		artifact, err := uploader.build("out/"+name, filepath.Join(dir, name), "out/*")
+		require.NoError(t, err)
+		artifacts = append(artifacts, artifact)
+	}
+
+	staging := filepath.Join(dir, "staging")
+	require.NoError(t, os.Mkdir(staging, 0700))
+
+	companions, err := uploader.writeManifest(artifacts, staging)
+	require.NoError(t, err)
+	require.Len(t, companions, 2)
+	assert.Equal(t, "artifacts.manifest.json", companions[0].Path)
+	assert.Equal(t, "artifacts.manifest.json.minisig", companions[1].Path)
+
+	data, err := ioutil.ReadFile(companions[0].AbsolutePath)
+	require.NoError(t, err)
+
+	var manifest artifactManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, "job-1", manifest.JobID)
+	require.Len(t, manifest.Artifacts, 2)
+	assert.Equal(t, artifactManifestEntry{
+		Path:      "out/a.txt",
+		Size:      5,
+		Sha1Sum:   "cfc7b4885384957ae445bc14914d4588f607651c",
+		Sha256Sum: "18b7cb099a9ea3f50ba899b5ba81e0d377a5f3b16f8f6eeb8b3e58cd4692b993",
+	}, manifest.Artifacts[0])
+	assert.Equal(t, "out/b.txt", manifest.Artifacts[1].Path)
+
+	sig, err := ioutil.ReadFile(companions[1].AbsolutePath)
+	require.NoError(t, err)
+	verifyMinisign(t, public, data, sig)
+}
+
+// llamaPresigner presigns URLs to a pretend store
+type llamaPresigner struct{}
+
+func (llamaPresigner) PresignedURL(artifact *api.Artifact, expires time.Duration) (string, error) {
+	return fmt.Sprintf("https://llamas.example/%s?expires=%d", artifact.Path, int(expires.Seconds())), nil
+}
+
+func (llamaPresigner) MaxPresignedExpiry() time.Duration {
+	return 7 * 24 * time.Hour
+}
+
+func TestWriteManifestWithURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a.txt"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:             "job-1",
+		ManifestWithURLs:  true,
+		ManifestURLExpiry: time.Hour,
+	})
+	uploader.presigner = llamaPresigner{}
+
+	artifact, err := uploader.build("out/a.txt", filepath.Join(dir, "a.txt"), "out/*")
+	require.NoError(t, err)
+
+	before := time.Now().Add(time.Hour).Truncate(time.Second)
+	companions, err := uploader.writeManifest([]*api.Artifact{artifact}, dir)
+	require.NoError(t, err)
+
+	// Without a signer, there's only the manifest
+	require.Len(t, companions, 1)
+	assert.Equal(t, "artifacts.manifest.json", companions[0].Path)
+
+	data, err := ioutil.ReadFile(companions[0].AbsolutePath)
+	require.NoError(t, err)
+
+	var manifest artifactManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Len(t, manifest.Artifacts, 1)
+	assert.Equal(t, "https://llamas.example/out/a.txt?expires=3600", manifest.Artifacts[0].URL)
+
+	expiresAt, err := time.Parse(time.RFC3339, manifest.URLsExpireAt)
+	require.NoError(t, err)
+	assert.False(t, expiresAt.Before(before))
+}
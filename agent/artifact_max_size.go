@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+)
+
+// A MaxFileSizeAction decides what happens to files that are larger than
+// MaxFileSize
+type MaxFileSizeAction string
+
+const (
+	// Leave the file out of the upload with a warning, which is the default
+	MaxFileSizeSkip MaxFileSizeAction = "skip"
+
+	// Fail the upload before anything is uploaded
+	MaxFileSizeFail MaxFileSizeAction = "fail"
+)
+
+func ParseMaxFileSizeAction(s string) (MaxFileSizeAction, error) {
+	switch action := MaxFileSizeAction(s); action {
+	case "":
+		return MaxFileSizeSkip, nil
+	case MaxFileSizeSkip, MaxFileSizeFail:
+		return action, nil
+	default:
+		return "", fmt.Errorf("Invalid max file size action %q, must be one of %q or %q", s, MaxFileSizeSkip, MaxFileSizeFail)
+	}
+}
+
+// overMaxFileSize returns whether the file is larger than MaxFileSize, and so
+// should be skipped, or an error if the upload should fail because of it. The
+// file's size is checked before any of it is read.
+func (a *ArtifactUploader) overMaxFileSize(file, absolutePath string) (bool, error) {
+	if a.conf.MaxFileSize <= 0 {
+		return false, nil
+	}
+
+	info, err := os.Stat(absolutePath)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() <= a.conf.MaxFileSize {
+		return false, nil
+	}
+
+	if a.conf.MaxFileSizeAction == MaxFileSizeFail {
+		return false, fmt.Errorf("%s is %s, which is over the maximum file size of %s",
+			file, formatByteSize(info.Size()), formatByteSize(a.conf.MaxFileSize))
+	}
+
+	a.logger.Warn("Skipping %s, which is %s and over the maximum file size of %s",
+		file, formatByteSize(info.Size()), formatByteSize(a.conf.MaxFileSize))
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// Metadata keys are sent as header names by S3, so they're limited to the
+// characters that are safe in a header name everywhere
+var metadataKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ParseArtifactMetadata parses metadata for uploaded objects in the form
+// key=value. The value can be empty.
+func ParseArtifactMetadata(s string) (key string, value string, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("Invalid upload metadata %q, expected key=value", s)
+	}
+
+	key, value = strings.TrimSpace(s[:i]), s[i+1:]
+	if key == "" {
+		return "", "", fmt.Errorf("Invalid upload metadata %q, the key can't be empty", s)
+	}
+	if !metadataKeyRegexp.MatchString(key) {
+		return "", "", fmt.Errorf("Invalid upload metadata %q, the key can only contain letters, digits, '.', '_' and '-'", s)
+	}
+
+	return key, value, nil
+}
+
+// objectMetadata returns the metadata to upload the artifact with, which is
+// the configured metadata along with the artifact's own, or nil if there's
+// none. The artifact's own metadata wins, as it records how the artifact was
+// changed before it was uploaded.
+func objectMetadata(metadata map[string]string, artifact *api.Artifact) map[string]string {
+	if len(metadata) == 0 && len(artifact.Metadata) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(metadata)+len(artifact.Metadata))
+	for key, value := range metadata {
+		merged[key] = value
+	}
+	for key, value := range artifact.Metadata {
+		merged[key] = value
+	}
+	return merged
+}
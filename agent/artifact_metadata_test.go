@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArtifactMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		s, key, value string
+	}{
+		{"team=platform", "team", "platform"},
+		{"empty=", "empty", ""},
+		{"query=a=b", "query", "a=b"},
+		{" build.number =42", "build.number", "42"},
+	} {
+		key, value, err := ParseArtifactMetadata(tc.s)
+		if assert.NoError(t, err, tc.s) {
+			assert.Equal(t, tc.key, key, tc.s)
+			assert.Equal(t, tc.value, value, tc.s)
+		}
+	}
+
+	for _, s := range []string{"team", "=platform", "my team=platform", "team/name=platform"} {
+		_, _, err := ParseArtifactMetadata(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestObjectMetadata(t *testing.T) {
+	assert.Nil(t, objectMetadata(nil, &api.Artifact{}))
+
+	metadata := map[string]string{"team": "platform", ArtifactGroupMetadataKey: "mine"}
+	artifact := &api.Artifact{Metadata: map[string]string{ArtifactGroupMetadataKey: "Test reports"}}
+
+	assert.Equal(t, map[string]string{
+		"team":                   "platform",
+		ArtifactGroupMetadataKey: "Test reports",
+	}, objectMetadata(metadata, artifact))
+
+	// Neither is changed
+	assert.Equal(t, "mine", metadata[ArtifactGroupMetadataKey])
+	assert.Len(t, artifact.Metadata, 1)
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An artifactExistsError is returned when an artifact isn't uploaded because
+// an object already exists with its key, and NoOverwrite is set
+type artifactExistsError struct {
+	Key string
+}
+
+func (e *artifactExistsError) Error() string {
+	return fmt.Sprintf("Object already exists at %q, and won't be overwritten", e.Key)
+}
+
+// checkNoOverwrite returns an error if NoOverwrite is set but the uploader
+// can't refuse to overwrite existing objects
+func (a *ArtifactUploader) checkNoOverwrite(uploader Uploader) error {
+	if !a.conf.NoOverwrite {
+		return nil
+	}
+
+	switch uploader.(type) {
+	case *S3Uploader, *GSUploader:
+		return nil
+	default:
+		return errors.New("Refusing to overwrite existing objects is only supported for s3:// and gs:// upload destinations")
+	}
+}
@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNoOverwrite(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{NoOverwrite: true})
+
+	assert.NoError(t, uploader.checkNoOverwrite(&S3Uploader{}))
+	assert.NoError(t, uploader.checkNoOverwrite(&GSUploader{}))
+	assert.EqualError(t, uploader.checkNoOverwrite(NewFormUploader(logger.Discard, FormUploaderConfig{})),
+		"Refusing to overwrite existing objects is only supported for s3:// and gs:// upload destinations")
+	assert.Error(t, uploader.checkNoOverwrite(&ArtifactoryUploader{}))
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.NoError(t, uploader.checkNoOverwrite(NewFormUploader(logger.Discard, FormUploaderConfig{})))
+}
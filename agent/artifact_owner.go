@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errReadAsOwnerUnsupported = errors.New("Reading files as their owner isn't supported on this platform")
+
+// UIDMapping maps a range of user IDs in a container to the user IDs they're
+// stored as on the host, like a line of /proc/<pid>/uid_map
+type UIDMapping struct {
+	ContainerID int
+	HostID      int
+	Count       int
+}
+
+// ParseUIDMapping parses a mapping in the form <container-uid>:<host-uid>,
+// or <container-uid>:<host-uid>:<count> for a range of user IDs
+func ParseUIDMapping(s string) (UIDMapping, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return UIDMapping{}, fmt.Errorf("Invalid uid remap %q, expected <container-uid>:<host-uid>[:<count>]", s)
+	}
+
+	ids := []int{0, 0, 1}
+	for i, part := range parts {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id < 0 {
+			return UIDMapping{}, fmt.Errorf("Invalid uid remap %q, %q isn't a user ID", s, part)
+		}
+		ids[i] = id
+	}
+
+	if ids[2] == 0 {
+		return UIDMapping{}, fmt.Errorf("Invalid uid remap %q, the count must be at least 1", s)
+	}
+
+	return UIDMapping{ContainerID: ids[0], HostID: ids[1], Count: ids[2]}, nil
+}
+
+// containerUID returns the user ID in the container of a user ID on the host
+func containerUID(mappings []UIDMapping, hostUID int) (int, bool) {
+	for _, m := range mappings {
+		if hostUID >= m.HostID && hostUID < m.HostID+m.Count {
+			return m.ContainerID + hostUID - m.HostID, true
+		}
+	}
+	return 0, false
+}
+
+// openArtifact opens a file to upload. If the agent doesn't have permission to
+// read it, such as a file written by a container running as another user, it
+// tries to open it as the file's owner, which needs CAP_SETUID. The returned
+// bool is whether it was opened as its owner, as the uploaders can't read it.
+func (a *ArtifactUploader) openArtifact(path string) (*os.File, bool, error) {
+	file, err := os.Open(path)
+	if err == nil || !os.IsPermission(err) {
+		return file, false, err
+	}
+
+	file, ownerErr := openAsOwner(path)
+	if ownerErr == nil {
+		return file, true, nil
+	}
+	a.logger.Debug("Couldn't open %s as its owner (%v)", path, ownerErr)
+
+	return nil, false, a.permissionError(path)
+}
+
+// permissionError describes why an artifact couldn't be read, naming the file
+// and who owns it
+func (a *ArtifactUploader) permissionError(path string) error {
+	uid, ok := fileOwner(path)
+	if !ok {
+		return fmt.Errorf("Permission denied reading %s. Make the file readable by the user the agent is running as", path)
+	}
+
+	owner := fmt.Sprintf("uid %d", uid)
+	if cuid, ok := containerUID(a.conf.UIDRemap, uid); ok {
+		owner = fmt.Sprintf("uid %d (uid %d in the container)", uid, cuid)
+	}
+
+	return fmt.Errorf("Permission denied reading %s, which is owned by %s while the agent is running as uid %d. "+
+		"Run the agent as root or with CAP_SETUID so it can read files as their owner, or make the file readable by the agent",
+		path, owner, os.Getuid())
+}
+
+// copyOwnedArtifact copies a file that was opened as its owner to the staging
+// directory, so it can be read by the uploaders
+func (a *ArtifactUploader) copyOwnedArtifact(path string, file *os.File) (*os.File, error) {
+	if a.ownedDir == "" {
+		dir, err := a.stagingDir("owned", 0)
+		if err != nil {
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
+			return nil, err
+		}
+		a.ownedDir = dir
+	}
+
+	copied, err := ioutil.TempFile(a.ownedDir, "artifact-")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := copied.ReadFrom(file); err != nil {
+		copied.Close()
+		return nil, fmt.Errorf("Error copying %s (%v)", path, err)
+	}
+
+	if _, err := copied.Seek(0, 0); err != nil {
+		copied.Close()
+		return nil, err
+	}
+
+	a.logger.Debug("Read %s as its owner", path)
+
+	return copied, nil
+}
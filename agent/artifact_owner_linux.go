@@ -0,0 +1,56 @@
+// +build linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openAsOwner opens a file with the filesystem user ID of the file's owner.
+// The filesystem user ID is per thread, so only this goroutine is affected.
+func openAsOwner(path string) (*os.File, error) {
+	uid, ok := fileOwner(path)
+	if !ok {
+		return nil, errors.New("Couldn't find the file's owner")
+	}
+
+	runtime.LockOSThread()
+
+	prev, err := unix.SetfsuidRetUid(uid)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+
+	// Without the privilege to change it, setfsuid leaves the filesystem user
+	// ID as it was, which an invalid ID reveals without changing it
+	if current, _ := unix.SetfsuidRetUid(-1); current != uid {
+		runtime.UnlockOSThread()
+		return nil, errors.New("The agent doesn't have permission to read files as other users")
+	}
+
+	file, err := os.Open(path)
+
+	unix.Setfsuid(prev)
+	if current, _ := unix.SetfsuidRetUid(-1); current == prev {
+		runtime.UnlockOSThread()
+	}
+	// Otherwise the thread stays locked, so it exits with this goroutine
+	// rather than being reused with the wrong user ID
+
+	return file, err
+}
+
+// fileOwner returns the user ID that owns a file
+func fileOwner(path string) (int, bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
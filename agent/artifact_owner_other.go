@@ -0,0 +1,13 @@
+// +build !linux
+
+package agent
+
+import "os"
+
+func openAsOwner(path string) (*os.File, error) {
+	return nil, errReadAsOwnerUnsupported
+}
+
+func fileOwner(path string) (int, bool) {
+	return 0, false
+}
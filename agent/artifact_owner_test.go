@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUIDMapping(t *testing.T) {
+	m, err := ParseUIDMapping("0:100000:65536")
+	require.NoError(t, err)
+	assert.Equal(t, UIDMapping{ContainerID: 0, HostID: 100000, Count: 65536}, m)
+
+	m, err = ParseUIDMapping("1000:1001")
+	require.NoError(t, err)
+	assert.Equal(t, UIDMapping{ContainerID: 1000, HostID: 1001, Count: 1}, m)
+
+	for _, invalid := range []string{"", "1000", "a:b", "0:100000:0", "-1:0", "1:2:3:4"} {
+		_, err := ParseUIDMapping(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestContainerUID(t *testing.T) {
+	mappings := []UIDMapping{
+		{ContainerID: 0, HostID: 100000, Count: 65536},
+		{ContainerID: 1000, HostID: 1001, Count: 1},
+	}
+
+	uid, ok := containerUID(mappings, 101000)
+	assert.True(t, ok)
+	assert.Equal(t, 1000, uid)
+
+	uid, ok = containerUID(mappings, 1001)
+	assert.True(t, ok)
+	assert.Equal(t, 1000, uid)
+
+	_, ok = containerUID(mappings, 165536)
+	assert.False(t, ok)
+}
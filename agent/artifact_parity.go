@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// Appended to an artifact's path for the object holding its parity shards
+	ArtifactParitySuffix = ".parity"
+
+	// Appended to an artifact's path for the object describing its parity shards
+	ArtifactParityManifestSuffix = ".parity.json"
+
+	// Every artifact is split into this many data shards, so each 5% of
+	// parity allows one corrupted shard to be recovered
+	parityDataShards = 20
+)
+
+// parityManifest describes the Reed-Solomon shards generated for an artifact.
+//
+// The artifact is split into DataShards shards of ShardSize bytes, the last
+// of which is zero padded. The .parity object holds ParityShards parity
+// shards of ShardSize bytes each, one after the other. ShardSha1Sums has the
+// SHA-1 of every data shard (including its padding) followed by every parity
+// shard, so that corrupted shards can be found and rebuilt from the rest.
+type parityManifest struct {
+	Algorithm     string   `json:"algorithm"`
+	DataShards    int      `json:"data_shards"`
+	ParityShards  int      `json:"parity_shards"`
+	ShardSize     int64    `json:"shard_size"`
+	FileSize      int64    `json:"file_size"`
+	ShardSha1Sums []string `json:"shard_sha1sums"`
+}
+
+// parityShardCount returns how many parity shards give at least the
+// requested percentage of redundancy
+func parityShardCount(percent int) int {
+	return int(math.Ceil(float64(parityDataShards*percent) / 100))
+}
+
+// parityStagingSize estimates how much space the parity for the artifacts
+// will take up
+func parityStagingSize(artifacts []*api.Artifact, percent int) int64 {
+	var total int64
+	for _, artifact := range artifacts {
+		shardSize := int64(math.Ceil(float64(artifact.FileSize) / parityDataShards))
+		total += shardSize * int64(parityShardCount(percent))
+	}
+	return total
+}
+
+// writeParity generates the parity shards and manifest for the file at path
+// into dir, returning the paths of both.
+func writeParity(path string, dir string, percent int) (parityPath string, manifestPath string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+
+	manifest := parityManifest{
+		Algorithm:    "reed-solomon",
+		DataShards:   parityDataShards,
+		ParityShards: parityShardCount(percent),
+		FileSize:     info.Size(),
+		ShardSize:    int64(math.Ceil(float64(info.Size()) / parityDataShards)),
+	}
+
+	enc, err := reedsolomon.NewStream(manifest.DataShards, manifest.ParityShards)
+	if err != nil {
+		return "", "", err
+	}
+
+	base := filepath.Join(dir, filepath.Base(path))
+
+	parityFile, err := os.Create(base + ArtifactParitySuffix)
+	if err != nil {
+		return "", "", err
+	}
+	defer parityFile.Close()
+
+	dataHashes := make([]hash.Hash, manifest.DataShards)
+	data := make([]io.Reader, manifest.DataShards)
+	for i := range data {
+		dataHashes[i] = sha1.New()
+		data[i] = io.TeeReader(paddedShard(f, int64(i), manifest.ShardSize), dataHashes[i])
+	}
+
+	parityHashes := make([]hash.Hash, manifest.ParityShards)
+	parity := make([]io.Writer, manifest.ParityShards)
+	for i := range parity {
+		parityHashes[i] = sha1.New()
+		offset := int64(i) * manifest.ShardSize
+		parity[i] = io.MultiWriter(&offsetWriter{w: parityFile, offset: offset}, parityHashes[i])
+	}
+
+	if err := enc.Encode(data, parity); err != nil {
+		return "", "", fmt.Errorf("Failed to generate parity for %q (%v)", path, err)
+	}
+
+	for _, h := range append(dataHashes, parityHashes...) {
+		manifest.ShardSha1Sums = append(manifest.ShardSha1Sums, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := ioutil.WriteFile(base+ArtifactParityManifestSuffix, manifestJSON, 0600); err != nil {
+		return "", "", err
+	}
+
+	return base + ArtifactParitySuffix, base + ArtifactParityManifestSuffix, nil
+}
+
+// withParity generates parity companions into dir for each of the artifacts,
+// and returns them all to be uploaded
+func (a *ArtifactUploader) withParity(artifacts []*api.Artifact, dir string) ([]*api.Artifact, error) {
+	all := artifacts
+
+	for _, artifact := range artifacts {
+		// There's nothing to protect in an empty file
+		if artifact.FileSize == 0 {
+			continue
+		}
+
+		a.logger.Debug("Generating %d%% parity for %s", a.conf.Parity, artifact.Path)
+
+		// Artifacts from different directories can share a name, so each
+		// gets its own staging directory
+		parityDir, err := ioutil.TempDir(dir, "parity-")
+		if err != nil {
+			return nil, err
+		}
+
+		parityPath, manifestPath, err := writeParity(artifact.AbsolutePath, parityDir, a.conf.Parity)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range []struct{ suffix, path string }{
+			{ArtifactParitySuffix, parityPath},
+			{ArtifactParityManifestSuffix, manifestPath},
+		} {
+			companion, err := a.build(artifact.Path+c.suffix, c.path, artifact.GlobPath)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, companion)
+		}
+	}
+
+	return all, nil
+}
+
+// RepairFromParity checks the file at path against the parity generated when
+// it was uploaded, and rebuilds any corrupted parts of it in place. It
+// returns whether the file needed repairing.
+func RepairFromParity(path string, parityPath string, manifestPath string) (bool, error) {
+	manifestJSON, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return false, err
+	}
+
+	var manifest parityManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return false, fmt.Errorf("Failed to parse parity manifest %q (%v)", manifestPath, err)
+	}
+
+	shards := manifest.DataShards + manifest.ParityShards
+	if manifest.Algorithm != "reed-solomon" || len(manifest.ShardSha1Sums) != shards {
+		return false, fmt.Errorf("Unsupported parity manifest %q", manifestPath)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	parityFile, err := os.Open(parityPath)
+	if err != nil {
+		return false, err
+	}
+	defer parityFile.Close()
+
+	shardReader := func(i int) io.Reader {
+		if i < manifest.DataShards {
+			return paddedShard(f, int64(i), manifest.ShardSize)
+		}
+		return paddedShard(parityFile, int64(i-manifest.DataShards), manifest.ShardSize)
+	}
+
+	// Find out which shards have been corrupted
+	valid := make([]io.Reader, shards)
+	fill := make([]io.Writer, shards)
+	rebuilt := make([]*bytes.Buffer, shards)
+	corrupted := 0
+
+	for i := 0; i < shards; i++ {
+		h := sha1.New()
+		if _, err := io.Copy(h, shardReader(i)); err != nil {
+			return false, err
+		}
+
+		if fmt.Sprintf("%x", h.Sum(nil)) == manifest.ShardSha1Sums[i] {
+			valid[i] = shardReader(i)
+		} else if i < manifest.DataShards {
+			rebuilt[i] = &bytes.Buffer{}
+			fill[i] = rebuilt[i]
+			corrupted++
+		}
+	}
+
+	if corrupted == 0 {
+		return false, f.Truncate(manifest.FileSize)
+	}
+
+	enc, err := reedsolomon.NewStream(manifest.DataShards, manifest.ParityShards)
+	if err != nil {
+		return false, err
+	}
+
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		return false, fmt.Errorf("Failed to repair %q from parity (%v)", path, err)
+	}
+
+	// Write the rebuilt shards back over the corrupted parts of the file
+	for i, shard := range rebuilt {
+		if shard == nil {
+			continue
+		}
+
+		offset := int64(i) * manifest.ShardSize
+		data := shard.Bytes()
+		if remaining := manifest.FileSize - offset; remaining < int64(len(data)) {
+			if remaining < 0 {
+				remaining = 0
+			}
+			data = data[:remaining]
+		}
+
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return false, err
+		}
+	}
+
+	return true, f.Truncate(manifest.FileSize)
+}
+
+// paddedShard reads the n'th shard of size bytes from r, padding it with
+// zeros if r ends part way through it
+func paddedShard(r io.ReaderAt, n int64, size int64) io.Reader {
+	section := io.NewSectionReader(r, n*size, size)
+	return io.LimitReader(io.MultiReader(section, zeroReader{}), size)
+}
+
+// offsetWriter writes sequentially into w starting at offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParityShardCount(t *testing.T) {
+	assert.Equal(t, 1, parityShardCount(1))
+	assert.Equal(t, 1, parityShardCount(5))
+	assert.Equal(t, 2, parityShardCount(10))
+	assert.Equal(t, 20, parityShardCount(100))
+}
+
+func TestRepairFromParity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-parity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := make([]byte, 100003)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	path := filepath.Join(dir, "archive.bin")
+	require.NoError(t, ioutil.WriteFile(path, original, 0600))
+
+	parityDir := filepath.Join(dir, "parity")
+	require.NoError(t, os.Mkdir(parityDir, 0700))
+
+	parityPath, manifestPath, err := writeParity(path, parityDir, 10)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(parityDir, "archive.bin.parity"), parityPath)
+	assert.Equal(t, filepath.Join(parityDir, "archive.bin.parity.json"), manifestPath)
+
+	// An intact file doesn't need repairing
+	repaired, err := RepairFromParity(path, parityPath, manifestPath)
+	require.NoError(t, err)
+	assert.False(t, repaired)
+
+	// Corrupt two different shards, which 10% parity can recover from
+	corrupted := append([]byte{}, original...)
+	corrupted[10] ^= 0xff
+	corrupted[len(corrupted)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, corrupted, 0600))
+
+	repaired, err = RepairFromParity(path, parityPath, manifestPath)
+	require.NoError(t, err)
+	assert.True(t, repaired)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(original, data))
+
+	// Three corrupted shards is too many
+	corrupted = append([]byte{}, original...)
+	corrupted[10] ^= 0xff
+	corrupted[20000] ^= 0xff
+	corrupted[40000] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, corrupted, 0600))
+
+	_, err = RepairFromParity(path, parityPath, manifestPath)
+	assert.Error(t, err)
+}
+
+func TestRepairFromParityTruncatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-parity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := bytes.Repeat([]byte("buildkite"), 1000)
+
+	path := filepath.Join(dir, "log.txt")
+	require.NoError(t, ioutil.WriteFile(path, original, 0600))
+
+	parityDir := filepath.Join(dir, "parity")
+	require.NoError(t, os.Mkdir(parityDir, 0700))
+
+	parityPath, manifestPath, err := writeParity(path, parityDir, 5)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, original[:len(original)-100], 0600))
+
+	repaired, err := RepairFromParity(path, parityPath, manifestPath)
+	require.NoError(t, err)
+	assert.True(t, repaired)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, original, data)
+}
+
+func TestWithParitySameNamedArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-parity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Parity: 10})
+
+	var artifacts []*api.Artifact
+	for i, name := range []string{"a", "b"} {
+		content := make([]byte, 1000*(i+1))
+		rand.New(rand.NewSource(int64(i))).Read(content)
+
+		path := filepath.Join(dir, name, "log.txt")
+		require.NoError(t, os.Mkdir(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, content, 0600))
+
+		artifact, err := uploader.build(name+"/log.txt", path, "*/log.txt")
+		require.NoError(t, err)
+		artifacts = append(artifacts, artifact)
+	}
+
+	staging := filepath.Join(dir, "staging")
+	require.NoError(t, os.Mkdir(staging, 0700))
+
+	all, err := uploader.withParity(artifacts, staging)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, artifact := range all {
+		paths = append(paths, artifact.Path)
+	}
+	assert.Equal(t, []string{
+		"a/log.txt",
+		"b/log.txt",
+		"a/log.txt.parity",
+		"a/log.txt.parity.json",
+		"b/log.txt.parity",
+		"b/log.txt.parity.json",
+	}, paths)
+
+	for i, artifact := range artifacts {
+		parity, manifest := all[2+i*2], all[3+i*2]
+
+		for _, companion := range []*api.Artifact{parity, manifest} {
+			sum, err := sha1File(companion.AbsolutePath)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%x", sum), companion.Sha1Sum)
+		}
+
+		repaired, err := RepairFromParity(artifact.AbsolutePath, parity.AbsolutePath, manifest.AbsolutePath)
+		require.NoError(t, err)
+		assert.False(t, repaired)
+	}
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The states of an artifact being prefetched
+const (
+	prefetchPending = iota
+	prefetchReading
+	prefetchReady
+	prefetchDone
+)
+
+// artifactPrefetcher reads the files of upcoming artifacts into memory while
+// earlier ones upload, so uploads don't each wait on a disk seek. It never
+// holds more than max bytes of file data at a time.
+//
+// An upload never waits for a file that isn't already being read, so an
+// upload that gets ahead of the prefetcher opens the file from disk itself.
+type artifactPrefetcher struct {
+	logger    logger.Logger
+	artifacts []*api.Artifact
+	max       int64
+
+	// Guards everything below, and is signalled when a read finishes or
+	// memory is released
+	cond *sync.Cond
+
+	states  map[*api.Artifact]*prefetchState
+	used    int64
+	stopped bool
+}
+
+type prefetchState struct {
+	status int
+	data   []byte
+}
+
+func newArtifactPrefetcher(l logger.Logger, artifacts []*api.Artifact, max int64) *artifactPrefetcher {
+	p := &artifactPrefetcher{
+		logger:    l,
+		artifacts: artifacts,
+		max:       max,
+		cond:      sync.NewCond(&sync.Mutex{}),
+		states:    make(map[*api.Artifact]*prefetchState, len(artifacts)),
+	}
+	for _, artifact := range artifacts {
+		p.states[artifact] = &prefetchState{}
+	}
+
+	return p
+}
+
+// Start reads the artifacts into memory in order, in the background
+func (p *artifactPrefetcher) Start() {
+	go p.run()
+}
+
+func (p *artifactPrefetcher) run() {
+	for _, artifact := range p.artifacts {
+		// Files that could never fit are left to be read from disk
+		if artifact.FileSize > p.max {
+			continue
+		}
+
+		p.cond.L.Lock()
+		for !p.stopped && p.used+artifact.FileSize > p.max {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.cond.L.Unlock()
+			return
+		}
+
+		state := p.states[artifact]
+		if state.status != prefetchPending {
+			// Its upload has already opened it from disk
+			p.cond.L.Unlock()
+			continue
+		}
+		state.status = prefetchReading
+		p.used += artifact.FileSize
+		p.cond.L.Unlock()
+
+		data, err := ioutil.ReadFile(artifact.AbsolutePath)
+
+		p.cond.L.Lock()
+		if err != nil || p.stopped {
+			if err != nil {
+				p.logger.Debug("Couldn't prefetch %s, it will be read when it's uploaded (%v)", artifact.Path, err)
+			}
+			state.status = prefetchDone
+			p.used -= artifact.FileSize
+		} else {
+			state.status = prefetchReady
+			state.data = data
+		}
+		p.cond.Broadcast()
+		p.cond.L.Unlock()
+	}
+}
+
+// Open returns the artifact's prefetched content, or opens its file if it
+// hasn't been prefetched. The memory held by prefetched content is released
+// when it's closed, so later opens of the same artifact read it from disk.
+func (p *artifactPrefetcher) Open(artifact *api.Artifact) (ArtifactFile, error) {
+	p.cond.L.Lock()
+	state, ok := p.states[artifact]
+	for ok && state.status == prefetchReading {
+		p.cond.Wait()
+	}
+
+	if ok && state.status == prefetchReady {
+		data := state.data
+		state.status = prefetchDone
+		state.data = nil
+		p.cond.L.Unlock()
+
+		return &prefetchedFile{
+			Reader: bytes.NewReader(data),
+			release: func() {
+				p.release(artifact.FileSize)
+			},
+		}, nil
+	}
+
+	// Claim it, so the prefetcher doesn't read it as well
+	if ok {
+		state.status = prefetchDone
+	}
+	p.cond.L.Unlock()
+
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stop stops prefetching and drops any content that wasn't opened
+func (p *artifactPrefetcher) Stop() {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+
+	p.stopped = true
+	for artifact, state := range p.states {
+		if state.status == prefetchReady {
+			state.status = prefetchDone
+			state.data = nil
+			p.used -= artifact.FileSize
+		}
+	}
+	p.cond.Broadcast()
+}
+
+func (p *artifactPrefetcher) release(n int64) {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+
+	p.used -= n
+	p.cond.Broadcast()
+}
+
+// prefetchedFile is the prefetched content of an artifact
+type prefetchedFile struct {
+	*bytes.Reader
+	release func()
+	once    sync.Once
+}
+
+func (f *prefetchedFile) Close() error {
+	f.once.Do(f.release)
+	return nil
+}
+
+// openForUpload opens an artifact for its upload, from memory if it's been
+// prefetched
+func (a *ArtifactUploader) openForUpload(artifact *api.Artifact) (f ArtifactFile, err error) {
+	if a.prefetcher != nil {
+		f, err = a.prefetcher.Open(artifact)
+	} else {
+		f, err = openArtifactFile(nil, artifact)
+	}
+
+	if err == nil && a.timings != nil {
+		f = timedArtifactFile{ArtifactFile: f, timing: a.timings.get(artifact)}
+	}
+	if err == nil {
+		if read := a.progress.counter(artifact); read != nil {
+			f = progressArtifactFile{ArtifactFile: f, read: read}
+		}
+	}
+	return f, err
+}
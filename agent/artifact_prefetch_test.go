@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func prefetchTestArtifacts(t *testing.T, sizes ...int) []*api.Artifact {
+	dir, err := ioutil.TempDir("", "prefetch")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	artifacts := []*api.Artifact{}
+	for i, size := range sizes {
+		path := filepath.Join(dir, fmt.Sprintf("%d.txt", i))
+		require.NoError(t, ioutil.WriteFile(path, make([]byte, size), 0600))
+		artifacts = append(artifacts, &api.Artifact{Path: filepath.Base(path), AbsolutePath: path, FileSize: int64(size)})
+	}
+	return artifacts
+}
+
+func waitForPrefetchStatus(t *testing.T, p *artifactPrefetcher, artifact *api.Artifact, status int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.cond.L.Lock()
+		current := p.states[artifact].status
+		p.cond.L.Unlock()
+
+		if current == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has status %d, expected %d", artifact.Path, current, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestArtifactPrefetcherStaysWithinItsLimit(t *testing.T) {
+	artifacts := prefetchTestArtifacts(t, 10, 10, 10)
+
+	p := newArtifactPrefetcher(logger.Discard, artifacts, 25)
+	p.Start()
+	defer p.Stop()
+
+	waitForPrefetchStatus(t, p, artifacts[0], prefetchReady)
+	waitForPrefetchStatus(t, p, artifacts[1], prefetchReady)
+
+	p.cond.L.Lock()
+	assert.Equal(t, int64(20), p.used)
+	assert.Equal(t, prefetchPending, p.states[artifacts[2]].status)
+	p.cond.L.Unlock()
+
+	f, err := p.Open(artifacts[0])
+	require.NoError(t, err)
+	assert.IsType(t, &prefetchedFile{}, f)
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Len(t, data, 10)
+
+	// Closing it makes room for the next one
+	require.NoError(t, f.Close())
+	require.NoError(t, f.Close())
+	waitForPrefetchStatus(t, p, artifacts[2], prefetchReady)
+
+	p.cond.L.Lock()
+	assert.Equal(t, int64(20), p.used)
+	p.cond.L.Unlock()
+
+	// It's read from disk again if it's opened again, e.g. on a retry
+	f, err = p.Open(artifacts[0])
+	require.NoError(t, err)
+	assert.IsType(t, &os.File{}, f)
+	f.Close()
+}
+
+func TestArtifactPrefetcherReadsLargeArtifactsFromDisk(t *testing.T) {
+	artifacts := prefetchTestArtifacts(t, 100, 10)
+
+	p := newArtifactPrefetcher(logger.Discard, artifacts, 50)
+	p.run()
+
+	f, err := p.Open(artifacts[0])
+	require.NoError(t, err)
+	assert.IsType(t, &os.File{}, f)
+	f.Close()
+
+	f, err = p.Open(artifacts[1])
+	require.NoError(t, err)
+	assert.IsType(t, &prefetchedFile{}, f)
+	f.Close()
+}
+
+func TestArtifactPrefetcherSkipsArtifactsAlreadyOpened(t *testing.T) {
+	artifacts := prefetchTestArtifacts(t, 10, 10)
+
+	p := newArtifactPrefetcher(logger.Discard, artifacts, 50)
+
+	f, err := p.Open(artifacts[0])
+	require.NoError(t, err)
+	assert.IsType(t, &os.File{}, f)
+	f.Close()
+
+	p.run()
+
+	assert.Equal(t, prefetchDone, p.states[artifacts[0]].status)
+	assert.Equal(t, prefetchReady, p.states[artifacts[1]].status)
+	assert.Equal(t, int64(10), p.used)
+
+	p.Stop()
+	assert.Equal(t, int64(0), p.used)
+}
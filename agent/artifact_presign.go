@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// checkPresignExpiry returns the uploader to make presigned download URLs
+// with if PresignExpiry is set, or an error if the uploader can't make them
+// or they can't be valid for that long
+func (a *ArtifactUploader) checkPresignExpiry(uploader Uploader) (PresigningUploader, error) {
+	if a.conf.PresignExpiry <= 0 {
+		return nil, nil
+	}
+
+	s3Uploader, ok := uploader.(*S3Uploader)
+	if !ok {
+		return nil, errors.New("Presigned download URLs can only be made for s3:// upload destinations")
+	}
+	if max := s3Uploader.MaxPresignedExpiry(); a.conf.PresignExpiry > max {
+		return nil, fmt.Errorf("Presigned download URLs can be valid for at most %s, not %s", max, a.conf.PresignExpiry)
+	}
+	return s3Uploader, nil
+}
+
+// presignDownloadURL makes and logs a presigned URL to download the uploaded
+// artifact from, if PresignExpiry is set. The upload has already succeeded,
+// so failing to make one is only a warning.
+func (a *ArtifactUploader) presignDownloadURL(artifact *api.Artifact) string {
+	if a.downloadPresigner == nil {
+		return ""
+	}
+
+	presignedURL, err := a.downloadPresigner.PresignedURL(artifact, a.conf.PresignExpiry)
+	if err != nil {
+		a.logger.Warn("%v", err)
+		return ""
+	}
+
+	a.logger.Info("Download %q for the next %s from %s", artifact.Path, a.conf.PresignExpiry, presignedURL)
+	return presignedURL
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPresignExpiry(t *testing.T) {
+	s3Uploader := &S3Uploader{BucketName: "my-bucket"}
+
+	presigner, err := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{}).checkPresignExpiry(s3Uploader)
+	require.NoError(t, err)
+	assert.Nil(t, presigner)
+
+	presigner, err = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{PresignExpiry: 7 * 24 * time.Hour}).checkPresignExpiry(s3Uploader)
+	require.NoError(t, err)
+	assert.Equal(t, s3Uploader, presigner)
+
+	_, err = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{PresignExpiry: 8 * 24 * time.Hour}).checkPresignExpiry(s3Uploader)
+	assert.EqualError(t, err, "Presigned download URLs can be valid for at most 168h0m0s, not 192h0m0s")
+
+	_, err = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{PresignExpiry: time.Hour}).checkPresignExpiry(&GSUploader{})
+	assert.EqualError(t, err, "Presigned download URLs can only be made for s3:// upload destinations")
+}
+
+func TestPresignDownloadURL(t *testing.T) {
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{PresignExpiry: time.Hour})
+	artifact := &api.Artifact{Path: "pkg/llamas.tar.gz"}
+
+	// Without a presigner, there's nothing to make the URL with
+	assert.Equal(t, "", uploader.presignDownloadURL(artifact))
+	assert.Empty(t, l.Messages)
+
+	uploader.downloadPresigner = llamaPresigner{}
+	assert.Equal(t, "https://llamas.example/pkg/llamas.tar.gz?expires=3600", uploader.presignDownloadURL(artifact))
+	assert.Equal(t, []string{
+		`[info] Download "pkg/llamas.tar.gz" for the next 1h0m0s from https://llamas.example/pkg/llamas.tar.gz?expires=3600`,
+	}, l.Messages)
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// artifactProgress logs how far through each upload is every interval, if
+// ProgressInterval is set, and a summary of every upload once they've
+// finished. Bytes are counted as the uploaders read the artifacts' files. A
+// nil *artifactProgress records nothing, so it costs nothing when
+// ProgressInterval isn't set.
+type artifactProgress struct {
+	logger   logger.Logger
+	interval time.Duration
+
+	mu sync.Mutex
+
+	// The bytes read of each artifact being uploaded, since its current
+	// attempt started
+	active map[*api.Artifact]*int64
+
+	// The artifacts that have been uploaded, and their total size
+	files int
+	bytes int64
+
+	started time.Time
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newArtifactProgress(l logger.Logger, interval time.Duration) *artifactProgress {
+	return &artifactProgress{
+		logger:   l,
+		interval: interval,
+		active:   make(map[*api.Artifact]*int64),
+	}
+}
+
+// Start logs the progress of the uploads every interval until Stop is called
+func (p *artifactProgress) Start() {
+	if p == nil {
+		return
+	}
+
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+
+	go func() {
+		defer close(p.stopped)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.log()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops logging the progress of the uploads, and logs the summary
+func (p *artifactProgress) Stop() {
+	if p == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.stopped
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := time.Since(p.started)
+	var throughput int64
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		throughput = int64(float64(p.bytes) / seconds)
+	}
+
+	p.logger.Info("Uploaded %d artifacts (%s) in %s, averaging %s/s",
+		p.files, formatByteSize(p.bytes), elapsed.Round(time.Millisecond), formatByteSize(throughput))
+}
+
+// begin starts counting the bytes read of the artifact from zero, as an
+// attempt at uploading it starts
+func (p *artifactProgress) begin(artifact *api.Artifact) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active[artifact] = new(int64)
+}
+
+// finish stops counting the bytes read of the artifact, adding it to the
+// summary if it was uploaded
+func (p *artifactProgress) finish(artifact *api.Artifact, uploaded bool) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.active, artifact)
+	if uploaded {
+		p.files++
+		p.bytes += artifact.FileSize
+	}
+}
+
+// counter returns where the bytes read of the artifact are counted, or nil if
+// it isn't being uploaded, such as for the chunks of an artifact
+func (p *artifactProgress) counter(artifact *api.Artifact) *int64 {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.active[artifact]
+}
+
+// log logs how far through each of the artifacts being uploaded is, in the
+// order of their paths
+func (p *artifactProgress) log() {
+	p.mu.Lock()
+	artifacts := make([]*api.Artifact, 0, len(p.active))
+	read := make(map[*api.Artifact]int64, len(p.active))
+	for artifact, counter := range p.active {
+		artifacts = append(artifacts, artifact)
+		read[artifact] = atomic.LoadInt64(counter)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Path < artifacts[j].Path
+	})
+
+	for _, artifact := range artifacts {
+		// Files can be read more than once, such as when they're
+		// checksummed
+		done := read[artifact]
+		if done > artifact.FileSize {
+			done = artifact.FileSize
+		}
+
+		percent := 100
+		if artifact.FileSize > 0 {
+			percent = int(done * 100 / artifact.FileSize)
+		}
+
+		p.logger.Info("Uploading %s (%s/%s, %d%%)", artifact.Path, formatByteSize(done), formatByteSize(artifact.FileSize), percent)
+	}
+}
+
+// progressArtifactFile counts the bytes read of the file towards its
+// artifact's progress
+type progressArtifactFile struct {
+	ArtifactFile
+	read *int64
+}
+
+func (f progressArtifactFile) Read(p []byte) (int, error) {
+	n, err := f.ArtifactFile.Read(p)
+	atomic.AddInt64(f.read, int64(n))
+	return n, err
+}
+
+func (f progressArtifactFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.ArtifactFile.ReadAt(p, off)
+	atomic.AddInt64(f.read, int64(n))
+	return n, err
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenForUploadCountsProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{ProgressInterval: time.Hour})
+	artifact := &api.Artifact{Path: "a.txt", AbsolutePath: path, FileSize: 12}
+
+	uploader.progress.begin(artifact)
+
+	f, err := uploader.openForUpload(artifact)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "llamas", string(data))
+
+	uploader.progress.log()
+	assert.Equal(t, []string{"[info] Uploading a.txt (6B/12B, 50%)"}, l.Messages)
+}
+
+func TestOpenForUploadDoesntCountProgressWithoutAnInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	artifact := &api.Artifact{Path: "a.txt", AbsolutePath: path}
+
+	uploader.progress.begin(artifact)
+
+	f, err := uploader.openForUpload(artifact)
+	require.NoError(t, err)
+	defer f.Close()
+
+	assert.Nil(t, uploader.progress)
+	assert.IsType(t, &os.File{}, f)
+}
+
+func TestArtifactProgressLogsActiveUploadsAndSummary(t *testing.T) {
+	l := logger.NewBuffer()
+	p := newArtifactProgress(l, time.Hour)
+	p.Start()
+
+	big := &api.Artifact{Path: "big.tar", FileSize: 512 * 1024 * 1024}
+	small := &api.Artifact{Path: "a.txt", FileSize: 100}
+	failed := &api.Artifact{Path: "failed.txt", FileSize: 100}
+
+	p.begin(big)
+	p.begin(small)
+	p.begin(failed)
+
+	*p.counter(big) = 234 * 1024 * 1024
+	*p.counter(small) = 250 // read again to checksum it
+	assert.Nil(t, p.counter(&api.Artifact{Path: "chunk"}))
+
+	p.log()
+	assert.Equal(t, []string{
+		"[info] Uploading a.txt (100B/100B, 100%)",
+		"[info] Uploading big.tar (234.0MB/512.0MB, 45%)",
+		"[info] Uploading failed.txt (0B/100B, 0%)",
+	}, l.Messages)
+
+	p.finish(big, true)
+	p.finish(small, true)
+	p.finish(failed, false)
+
+	l.Messages = nil
+	p.log()
+	assert.Empty(t, l.Messages)
+
+	p.Stop()
+	require.Len(t, l.Messages, 1)
+	assert.True(t, strings.HasPrefix(l.Messages[0], "[info] Uploaded 2 artifacts (512.0MB) in "), l.Messages[0])
+	assert.Contains(t, l.Messages[0], "/s")
+}
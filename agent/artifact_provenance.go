@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// The suffix of the attestation uploaded alongside each artifact
+	ArtifactProvenanceSuffix = ".intoto.json"
+
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+
+	// Identifies how the artifacts were built in the attestation's buildType
+	provenanceBuildType = "https://buildkite.com/buildkite-agent/artifact-upload@v1"
+)
+
+// An in-toto statement with a SLSA provenance predicate, following
+// https://slsa.dev/provenance/v0.2. The subject is the artifact, named by its
+// path in Buildkite and identified by the checksums of what was uploaded.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	Builder    provenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation provenanceInvocation `json:"invocation"`
+	Metadata   provenanceMetadata   `json:"metadata"`
+	Materials  []provenanceMaterial `json:"materials,omitempty"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceInvocation struct {
+	ConfigSource provenanceMaterial `json:"configSource"`
+	Environment  map[string]string  `json:"environment"`
+}
+
+type provenanceMetadata struct {
+	BuildInvocationID string `json:"buildInvocationId"`
+	BuildFinishedOn   string `json:"buildFinishedOn"`
+}
+
+type provenanceMaterial struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+// The build context shared by the attestations of every artifact in an upload
+type buildProvenance struct {
+	Builder      string
+	Repository   string
+	Commit       string
+	Pipeline     string
+	Environment  map[string]string
+	InvocationID string
+	FinishedOn   time.Time
+}
+
+// provenanceFromEnv reads the build context from the job's environment
+func provenanceFromEnv(jobID string) buildProvenance {
+	env := map[string]string{}
+	for _, name := range []string{
+		"BUILDKITE_ORGANIZATION_SLUG",
+		"BUILDKITE_PIPELINE_SLUG",
+		"BUILDKITE_BUILD_ID",
+		"BUILDKITE_BUILD_NUMBER",
+		"BUILDKITE_BUILD_URL",
+		"BUILDKITE_BRANCH",
+		"BUILDKITE_STEP_KEY",
+		"BUILDKITE_AGENT_NAME",
+	} {
+		if value := os.Getenv(name); value != "" {
+			env[name] = value
+		}
+	}
+	env["BUILDKITE_JOB_ID"] = jobID
+
+	repository, commit := gitSourceFromEnv()
+
+	return buildProvenance{
+		Builder:      os.Getenv("BUILDKITE_AGENT_NAME"),
+		Repository:   repository,
+		Commit:       commit,
+		Pipeline:     os.Getenv("BUILDKITE_PIPELINE_SLUG"),
+		Environment:  env,
+		InvocationID: jobID,
+		FinishedOn:   time.Now().UTC(),
+	}
+}
+
+// statement returns the attestation for an artifact with the given SHA-256.
+// If the artifact has a source link with paths, each of them is a material
+// too, as an SPDX download location.
+func (p buildProvenance) statement(artifact *api.Artifact, sha256sum string, link *artifactSourceLink) provenanceStatement {
+	source := provenanceMaterial{URI: p.Repository, EntryPoint: p.Pipeline}
+	var materials []provenanceMaterial
+	if p.Commit != "" {
+		source.Digest = map[string]string{"sha1": p.Commit}
+		materials = append(materials, provenanceMaterial{URI: p.Repository, Digest: source.Digest})
+	}
+	if link != nil && len(link.Paths) > 0 {
+		for _, location := range link.spdxLocations() {
+			materials = append(materials, provenanceMaterial{URI: location, Digest: source.Digest})
+		}
+	}
+
+	return provenanceStatement{
+		Type: inTotoStatementType,
+		Subject: []provenanceSubject{{
+			Name: artifact.Path,
+			Digest: map[string]string{
+				"sha256": sha256sum,
+				"sha1":   artifact.Sha1Sum,
+			},
+		}},
+		PredicateType: slsaProvenanceType,
+		Predicate: provenancePredicate{
+			Builder:   provenanceBuilder{ID: p.Builder},
+			BuildType: provenanceBuildType,
+			Invocation: provenanceInvocation{
+				ConfigSource: source,
+				Environment:  p.Environment,
+			},
+			Metadata: provenanceMetadata{
+				BuildInvocationID: p.InvocationID,
+				BuildFinishedOn:   p.FinishedOn.Format(time.RFC3339),
+			},
+			Materials: materials,
+		},
+	}
+}
+
+// withProvenance adds an attestation companion for each artifact, written
+// to dir
+func (a *ArtifactUploader) withProvenance(artifacts []*api.Artifact, dir string) ([]*api.Artifact, error) {
+	all := artifacts
+	provenance := provenanceFromEnv(a.conf.JobID)
+
+	for _, artifact := range artifacts {
+		sum, err := sha256File(artifact.AbsolutePath)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.MarshalIndent(provenance.statement(artifact, hex.EncodeToString(sum), a.sourceLinks.linkFor(artifact)), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := ioutil.TempFile(dir, "provenance-")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+
+		companion, err := a.build(artifact.Path+ArtifactProvenanceSuffix, f.Name(), artifact.GlobPath)
+		if err != nil {
+			return nil, err
+		}
+		companion.ContentType = "application/vnd.in-toto+json"
+
+		a.logger.Debug("Attesting to the provenance of %s", artifact.Path)
+		all = append(all, companion)
+	}
+
+	return all, nil
+}
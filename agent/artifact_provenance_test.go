@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-provenance")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_NAME":    "agent-1",
+		"BUILDKITE_REPO":          "git@github.com:buildkite/agent.git",
+		"BUILDKITE_COMMIT":        "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3",
+		"BUILDKITE_PIPELINE_SLUG": "agent",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	path := filepath.Join(dir, "app.tar.gz")
+	require.NoError(t, ioutil.WriteFile(path, []byte("hello"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{JobID: "job-1"})
+	artifact, err := uploader.build("pkg/app.tar.gz", path, "pkg/*")
+	require.NoError(t, err)
+
+	artifacts, err := uploader.withProvenance([]*api.Artifact{artifact}, dir)
+	require.NoError(t, err)
+	require.Len(t, artifacts, 2)
+
+	companion := artifacts[1]
+	assert.Equal(t, "pkg/app.tar.gz.intoto.json", companion.Path)
+	assert.Equal(t, "application/vnd.in-toto+json", companion.ContentType)
+
+	data, err := ioutil.ReadFile(companion.AbsolutePath)
+	require.NoError(t, err)
+
+	var statement provenanceStatement
+	require.NoError(t, json.Unmarshal(data, &statement))
+
+	assert.Equal(t, inTotoStatementType, statement.Type)
+	assert.Equal(t, slsaProvenanceType, statement.PredicateType)
+	assert.Equal(t, []provenanceSubject{{
+		Name: "pkg/app.tar.gz",
+		Digest: map[string]string{
+			"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"sha1":   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		},
+	}}, statement.Subject)
+
+	assert.Equal(t, "agent-1", statement.Predicate.Builder.ID)
+	assert.Equal(t, "job-1", statement.Predicate.Metadata.BuildInvocationID)
+	assert.Equal(t, "job-1", statement.Predicate.Invocation.Environment["BUILDKITE_JOB_ID"])
+	assert.Equal(t, provenanceMaterial{
+		URI:        "git@github.com:buildkite/agent.git",
+		Digest:     map[string]string{"sha1": "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3"},
+		EntryPoint: "agent",
+	}, statement.Predicate.Invocation.ConfigSource)
+}
+
+func TestProvenanceWithSourceLink(t *testing.T) {
+	provenance := buildProvenance{
+		Repository: "https://github.com/buildkite/agent.git",
+		Commit:     "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3",
+	}
+	link := &artifactSourceLink{
+		Repository: provenance.Repository,
+		Commit:     provenance.Commit,
+		Paths:      []string{"cmd/server"},
+	}
+
+	statement := provenance.statement(&api.Artifact{Path: "bin/server"}, "abc", link)
+
+	digest := map[string]string{"sha1": "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3"}
+	assert.Equal(t, []provenanceMaterial{
+		{URI: "https://github.com/buildkite/agent.git", Digest: digest},
+		{URI: "git+https://github.com/buildkite/agent.git@a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3#cmd/server", Digest: digest},
+	}, statement.Predicate.Materials)
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+	"google.golang.org/api/googleapi"
+)
+
+// A RetryClass is how a failed upload is tried again
+type RetryClass int
+
+const (
+	// Tried again after backing off, from 5 seconds doubling up to 30
+	// seconds, plus jitter. Errors that aren't classified as anything else
+	// are transient.
+	RetryTransient RetryClass = iota
+
+	// The store is rate limiting uploads, so tried again after about a
+	// second
+	RetryThrottled
+
+	// The credentials have expired, so tried again straight away once
+	// they've been refreshed. Stores that can't refresh their credentials
+	// don't try again.
+	RetryExpired
+
+	// Not tried again
+	RetryPermanent
+)
+
+func (c RetryClass) String() string {
+	switch c {
+	case RetryTransient:
+		return "transient"
+	case RetryThrottled:
+		return "throttled"
+	case RetryExpired:
+		return "credentials expired"
+	case RetryPermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+var (
+	// The first interval between transient failures, which doubles each time
+	// up to transientRetryMaxInterval
+	transientRetryInterval    = 5 * time.Second
+	transientRetryMaxInterval = 30 * time.Second
+
+	// The interval between throttled uploads
+	throttledRetryInterval = time.Second
+
+	// Up to this much is added to each interval, so uploads that failed
+	// together don't all try again at once
+	retryJitter = time.Second
+)
+
+// The S3 error codes that are throttling, on top of those the AWS SDK knows
+var s3ThrottleCodes = map[string]bool{
+	"SlowDown": true,
+}
+
+// The GS error reasons that are throttling, which GS gives with a 403
+var gsThrottleReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// DefaultRetryClassifier is how failed uploads are classified when
+// ArtifactUploaderConfig.RetryClassifier isn't set. Before any classifier is
+// asked, uploads rejected because their credentials expired (as decided by
+// the store's CredentialsExpired) have already been tried again with
+// refreshed credentials.
+//
+// For s3:// destinations, the AWS SDK's throttling codes and SlowDown are
+// throttled, the expired token codes are expired, and RequestTimeout is
+// transient. For gs:// destinations, the rateLimitExceeded and
+// userRateLimitExceeded reasons are throttled. Otherwise, for every
+// destination, it goes by the HTTP status:
+//
+//	429, 503             throttled
+//	401                  expired
+//	408, other 5xx       transient
+//	other 4xx            permanent
+//
+// Files that no longer exist, and objects that already exist when
+// NoOverwrite is set, are permanent. Everything else, such as network errors
+// and attempts that took longer than UploadTimeout, is transient.
+//
+// Classifiers that only want to classify some errors differently can call
+// DefaultRetryClassifier for the rest.
+func DefaultRetryClassifier(err error) RetryClass {
+	if errors.Is(err, os.ErrNotExist) {
+		return RetryPermanent
+	}
+
+	var existsErr *artifactExistsError
+	if errors.As(err, &existsErr) {
+		return RetryPermanent
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return classifyS3Error(awsErr)
+	}
+
+	var gsErr *googleapi.Error
+	if errors.As(err, &gsErr) {
+		for _, item := range gsErr.Errors {
+			if gsThrottleReasons[item.Reason] {
+				return RetryThrottled
+			}
+		}
+		return classifyHTTPStatus(gsErr.Code)
+	}
+
+	var resErr *errorResponse
+	if errors.As(err, &resErr) && resErr.Response != nil {
+		return classifyHTTPStatus(resErr.Response.StatusCode)
+	}
+
+	var formErr *formUploadError
+	if errors.As(err, &formErr) {
+		return classifyHTTPStatus(formErr.StatusCode)
+	}
+
+	return RetryTransient
+}
+
+// classifyS3Error classifies an error from the AWS SDK by its code, then its
+// HTTP status, then the error it wraps if it has neither
+func classifyS3Error(err awserr.Error) RetryClass {
+	switch {
+	case request.IsErrorThrottle(err) || s3ThrottleCodes[err.Code()]:
+		return RetryThrottled
+	case request.IsErrorExpiredCreds(err) || s3ExpiredCredentialsCodes[err.Code()]:
+		return RetryExpired
+	case err.Code() == "RequestTimeout":
+		return RetryTransient
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() > 0 {
+		return classifyHTTPStatus(reqErr.StatusCode())
+	}
+
+	// Multipart uploads wrap the error of the part that failed
+	if orig := err.OrigErr(); orig != nil {
+		return DefaultRetryClassifier(orig)
+	}
+	return RetryTransient
+}
+
+// classifyHTTPStatus classifies a failed upload by the HTTP status the store
+// responded with
+func classifyHTTPStatus(status int) RetryClass {
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return RetryThrottled
+	case status == http.StatusUnauthorized:
+		return RetryExpired
+	case status == http.StatusRequestTimeout || status >= 500:
+		return RetryTransient
+	case status >= 400:
+		return RetryPermanent
+	}
+	return RetryTransient
+}
+
+// classify returns the class of the failed upload, using the configured
+// classifier or else the default one. Errors the store itself says are from
+// expired credentials are always expired.
+func (a *ArtifactUploader) classify(uploader Uploader, err error) RetryClass {
+	if refreshable, ok := uploader.(RefreshableUploader); ok && refreshable.CredentialsExpired(err) {
+		return RetryExpired
+	}
+	if a.conf.RetryClassifier != nil {
+		return a.conf.RetryClassifier(err)
+	}
+	return DefaultRetryClassifier(err)
+}
+
+// uploadWithRetries makes attempts at uploading the artifact until one
+// succeeds, one fails permanently, it's been retried UploadMaxRetries times,
+// or retrying would take it past UploadRetryTimeout. Each failure is tried
+// again as its class says to.
+func (a *ArtifactUploader) uploadWithRetries(uploader Uploader, refresher *credentialRefresher, artifact *api.Artifact, attempt func() error) error {
+	start := time.Now()
+
+	return retry.Do(func(s *retry.Stats) error {
+		a.limiter.Wait()
+
+		refreshes := refresher.count()
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+
+		class := a.classify(uploader, err)
+		if class != RetryPermanent && s.Attempt > a.conf.UploadMaxRetries {
+			if a.conf.UploadMaxRetries > 0 {
+				a.logger.Warn("%s (%s, giving up after %d retries)", err, class, a.conf.UploadMaxRetries)
+			}
+			s.Break()
+			return err
+		}
+
+		switch class {
+		case RetryPermanent:
+			a.logger.Warn("%s (not retrying)", err)
+			s.Break()
+			return err
+
+		case RetryExpired:
+			if refresher == nil {
+				a.logger.Warn("%s (the credentials have expired and can't be refreshed, not retrying)", err)
+				s.Break()
+				return err
+			}
+
+			// The store already tried again with refreshed
+			// credentials if it knew they'd expired, so doing it
+			// again straight away won't help
+			if refreshable, ok := uploader.(RefreshableUploader); ok && refreshable.CredentialsExpired(err) {
+				s.Interval = transientInterval(s.Attempt)
+				break
+			}
+
+			if refreshErr := refresher.refresh(refreshes, artifact); refreshErr != nil {
+				a.logger.Warn("%s, and the credentials couldn't be refreshed (%v) (not retrying)", err, refreshErr)
+				s.Break()
+				return err
+			}
+			s.Interval = 0
+
+		case RetryThrottled:
+			s.Interval = withJitter(throttledRetryInterval)
+
+		default:
+			s.Interval = withJitter(transientInterval(s.Attempt))
+		}
+
+		if a.conf.UploadRetryTimeout > 0 && time.Since(start)+s.Interval > a.conf.UploadRetryTimeout {
+			a.logger.Warn("%s (%s, giving up as retrying would take longer than %s)", err, class, a.conf.UploadRetryTimeout)
+			s.Break()
+			return err
+		}
+
+		atomic.AddInt64(&a.retries, 1)
+		a.eventLogger(eventArtifactRetried,
+			logger.StringField("path", artifact.Path),
+			logger.StringField("error", err.Error()),
+		).Warn("%s (%s, %s)", err, class, s)
+		return err
+	}, &retry.Config{Maximum: a.conf.UploadMaxRetries + 1, Interval: transientRetryInterval})
+}
+
+// transientInterval is how long to wait after the attempt failed with a
+// transient error
+func transientInterval(attempt int) time.Duration {
+	interval := transientRetryInterval
+	for i := 1; i < attempt && interval < transientRetryMaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > transientRetryMaxInterval {
+		interval = transientRetryMaxInterval
+	}
+	return interval
+}
+
+// withJitter adds up to retryJitter to the interval
+func withJitter(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Int63n(int64(retryJitter)))
+}
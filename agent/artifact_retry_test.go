@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func TestDefaultRetryClassifier(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Err      error
+		Expected RetryClass
+	}{
+		{"s3 slow down", awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, ""), RetryThrottled},
+		{"s3 throttling", awserr.New("Throttling", "Rate exceeded", nil), RetryThrottled},
+		{"s3 expired token", awserr.New("ExpiredToken", "The provided token has expired.", nil), RetryExpired},
+		{"s3 request timeout", awserr.NewRequestFailure(awserr.New("RequestTimeout", "", nil), 400, ""), RetryTransient},
+		{"s3 no such bucket", awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), 404, ""), RetryPermanent},
+		{"s3 internal error", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), RetryTransient},
+		{"s3 multipart", awserr.New("MultipartUpload", "upload multipart failed",
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "")), RetryPermanent},
+		{"gs rate limit", &gsUploadError{path: "a.txt", err: &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}}, RetryThrottled},
+		{"gs too many requests", &gsUploadError{path: "a.txt", err: &googleapi.Error{Code: 429}}, RetryThrottled},
+		{"gs unauthorized", &gsUploadError{path: "a.txt", err: &googleapi.Error{Code: 401}}, RetryExpired},
+		{"gs not found", &gsUploadError{path: "a.txt", err: &googleapi.Error{Code: 404}}, RetryPermanent},
+		{"object already exists", &artifactExistsError{Key: "a.txt"}, RetryPermanent},
+		{"artifactory unavailable", &errorResponse{Response: &http.Response{StatusCode: 503}}, RetryThrottled},
+		{"artifactory bad gateway", &errorResponse{Response: &http.Response{StatusCode: 502}}, RetryTransient},
+		{"artifactory bad request", &errorResponse{Response: &http.Response{StatusCode: 400}}, RetryPermanent},
+		{"buildkite forbidden", &formUploadError{StatusCode: 403, Body: "Access Denied"}, RetryPermanent},
+		{"buildkite internal error", &formUploadError{StatusCode: 500}, RetryTransient},
+		{"missing file", fmt.Errorf("failed to open file (%w)", os.ErrNotExist), RetryPermanent},
+		{"network error", errors.New("connection reset by peer"), RetryTransient},
+	} {
+		assert.Equal(t, tc.Expected, DefaultRetryClassifier(tc.Err), tc.Name)
+	}
+}
+
+func TestArtifactUploaderClassify(t *testing.T) {
+	forbidden := errors.New("403 Forbidden")
+	timeout := errors.New("i/o timeout")
+
+	// Without a classifier, unknown errors are transient
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.Equal(t, RetryTransient, uploader.classify(&FormUploader{}, forbidden))
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		RetryClassifier: func(err error) RetryClass {
+			if err == forbidden {
+				return RetryPermanent
+			}
+			return DefaultRetryClassifier(err)
+		},
+	})
+	assert.Equal(t, RetryPermanent, uploader.classify(&FormUploader{}, forbidden))
+	assert.Equal(t, RetryTransient, uploader.classify(&FormUploader{}, timeout))
+
+	// The store knowing the credentials expired wins over the classifier
+	assert.Equal(t, RetryExpired, uploader.classify(&rotatingUploader{}, errExpiredCredentials))
+}
+
+// failingUploader fails with each of the errors in turn, then succeeds
+type failingUploader struct {
+	errs     []error
+	attempts int
+}
+
+func (u *failingUploader) URL(*api.Artifact) string { return "" }
+
+func (u *failingUploader) Upload(*api.Artifact) error {
+	u.attempts++
+	if len(u.errs) == 0 {
+		return nil
+	}
+	err := u.errs[0]
+	u.errs = u.errs[1:]
+	return err
+}
+
+func TestUploadWithRetries(t *testing.T) {
+	defer func(transient, throttled, jitter time.Duration) {
+		transientRetryInterval, throttledRetryInterval, retryJitter = transient, throttled, jitter
+	}(transientRetryInterval, throttledRetryInterval, retryJitter)
+	transientRetryInterval, throttledRetryInterval, retryJitter = time.Millisecond, time.Millisecond, time.Millisecond
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{UploadMaxRetries: 3})
+	artifact := &api.Artifact{Path: "a.txt"}
+
+	upload := func(u Uploader, refresher *credentialRefresher) error {
+		return uploader.uploadWithRetries(u, refresher, artifact, func() error {
+			return refresher.upload(context.Background(), u, artifact)
+		})
+	}
+
+	// Permanent failures aren't tried again
+	store := &failingUploader{errs: []error{&formUploadError{StatusCode: 404}}}
+	assert.Error(t, upload(store, nil))
+	assert.Equal(t, 1, store.attempts)
+
+	// Throttled and transient failures are
+	store = &failingUploader{errs: []error{&formUploadError{StatusCode: 429}, &formUploadError{StatusCode: 500}}}
+	assert.NoError(t, upload(store, nil))
+	assert.Equal(t, 3, store.attempts)
+	assert.Equal(t, int64(2), uploader.retries)
+
+	// Up to UploadMaxRetries times
+	store = &failingUploader{}
+	for i := 0; i < 5; i++ {
+		store.errs = append(store.errs, errors.New("connection reset by peer"))
+	}
+	assert.Error(t, upload(store, nil))
+	assert.Equal(t, 4, store.attempts)
+
+	// Expired credentials can only be tried again if they can be refreshed
+	store = &failingUploader{errs: []error{&formUploadError{StatusCode: 401}}}
+	assert.Error(t, upload(store, nil))
+	assert.Equal(t, 1, store.attempts)
+}
+
+func TestUploadWithRetriesLimits(t *testing.T) {
+	defer func(transient, jitter time.Duration) {
+		transientRetryInterval, retryJitter = transient, jitter
+	}(transientRetryInterval, retryJitter)
+	transientRetryInterval, retryJitter = 20*time.Millisecond, time.Millisecond
+
+	artifact := &api.Artifact{Path: "a.txt"}
+	failing := func() *failingUploader {
+		store := &failingUploader{}
+		for i := 0; i < 5; i++ {
+			store.errs = append(store.errs, &formUploadError{StatusCode: 500})
+		}
+		return store
+	}
+
+	// Failed uploads aren't retried without UploadMaxRetries
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	store := failing()
+	assert.Error(t, uploader.uploadWithRetries(store, nil, artifact, func() error { return store.Upload(artifact) }))
+	assert.Equal(t, 1, store.attempts)
+
+	// Or once retrying would take longer than UploadRetryTimeout, which
+	// the second retry's 40ms would
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		UploadMaxRetries:   3,
+		UploadRetryTimeout: 50 * time.Millisecond,
+	})
+	store = failing()
+	assert.Error(t, uploader.uploadWithRetries(store, nil, artifact, func() error { return store.Upload(artifact) }))
+	assert.Equal(t, 2, store.attempts)
+	assert.Equal(t, int64(1), uploader.retries)
+}
+
+func TestUploadWithRetriesRefreshesCredentials(t *testing.T) {
+	rotating := &rotatingUploader{current: 1}
+	refresher := newCredentialRefresher(logger.Discard, rotating)
+
+	// The classifier says the credentials expired, though the store doesn't
+	// know it
+	unauthorized := errors.New("401 Unauthorized")
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		UploadMaxRetries: 3,
+		RetryClassifier: func(err error) RetryClass {
+			if err == unauthorized {
+				return RetryExpired
+			}
+			return DefaultRetryClassifier(err)
+		},
+	})
+
+	attempts := 0
+	err := uploader.uploadWithRetries(rotating, refresher, &api.Artifact{Path: "a.txt"}, func() error {
+		attempts++
+		if attempts == 1 {
+			return unauthorized
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 1, rotating.refreshes)
+}
+
+func TestTransientInterval(t *testing.T) {
+	assert.Equal(t, 5*time.Second, transientInterval(1))
+	assert.Equal(t, 10*time.Second, transientInterval(2))
+	assert.Equal(t, 20*time.Second, transientInterval(3))
+	assert.Equal(t, 30*time.Second, transientInterval(4))
+	assert.Equal(t, 30*time.Second, transientInterval(9))
+}
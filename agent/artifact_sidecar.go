@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ArtifactSidecarSuffix is appended to an artifact's path to find its
+// companion metadata file, e.g. report.html.meta.json
+const ArtifactSidecarSuffix = ".meta.json"
+
+// artifactSidecar is the metadata that can be declared about an artifact in
+// its companion file
+type artifactSidecar struct {
+	// The Content-Type the artifact was originally stored with
+	ContentType string `json:"content_type"`
+}
+
+// readArtifactSidecar reads the companion metadata file for the file at path.
+// A nil sidecar is returned if there isn't one.
+func readArtifactSidecar(path string) (*artifactSidecar, error) {
+	data, err := ioutil.ReadFile(path + ArtifactSidecarSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sidecar artifactSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s%s (%v)", path, ArtifactSidecarSuffix, err)
+	}
+
+	return &sidecar, nil
+}
+
+// sidecarFilter finds companion metadata files that only matched the upload
+// paths alongside their data files, so they aren't uploaded as artifacts of
+// their own
+type sidecarFilter struct {
+	// The upload paths, compiled like exclude patterns
+	paths *artifactExcludes
+
+	excludes *artifactExcludes
+	ignore   *ignoreRules
+}
+
+// companion returns whether the file at absolutePath is the metadata file of
+// a data file that's also being uploaded
+func (f *sidecarFilter) companion(absolutePath string) bool {
+	if !strings.HasSuffix(absolutePath, ArtifactSidecarSuffix) {
+		return false
+	}
+
+	data := strings.TrimSuffix(absolutePath, ArtifactSidecarSuffix)
+	if info, err := os.Stat(data); err != nil || info.IsDir() {
+		return false
+	}
+
+	if _, ok := f.paths.MatchedFile(data); !ok {
+		return false
+	}
+	if f.excludes != nil {
+		if _, ok := f.excludes.Excluded(data); ok {
+			return false
+		}
+	}
+	if f.ignore != nil && f.ignore.Ignored(data) {
+		return false
+	}
+
+	return true
+}
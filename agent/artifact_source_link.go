@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// artifactSourceLink is where an artifact came from, recorded in the manifests
+// and provenance when SourceLink is set. It's JSON with these fields:
+//
+//	repository  the repository being built
+//	commit      the full SHA of the commit being built
+//	paths       the source paths the artifact was built from, if it matches
+//	            one of the SourceMap patterns
+type artifactSourceLink struct {
+	Repository string   `json:"repository,omitempty"`
+	Commit     string   `json:"commit,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+}
+
+// spdxLocations returns each of the source paths as an SPDX download
+// location (git+<repository>@<commit>#<path>), or just the repository at the
+// commit if there aren't any
+func (l *artifactSourceLink) spdxLocations() []string {
+	location := "git+" + l.Repository
+	if l.Commit != "" {
+		location += "@" + l.Commit
+	}
+	if len(l.Paths) == 0 {
+		return []string{location}
+	}
+
+	locations := make([]string, 0, len(l.Paths))
+	for _, path := range l.Paths {
+		locations = append(locations, location+"#"+path)
+	}
+	return locations
+}
+
+// artifactSourceLinks links artifacts back to the commit, and the source
+// paths they were built from
+type artifactSourceLinks struct {
+	repository string
+	commit     string
+	rules      []sourceMapRule
+}
+
+type sourceMapRule struct {
+	pattern string
+	paths   []string
+}
+
+// parseArtifactSourceLinks reads the repository and commit being built, and
+// parses the source map in the form pattern=path[,path...], where pattern is
+// a glob matched against the artifact's path. The first matching pattern
+// wins.
+func parseArtifactSourceLinks(sourceMap []string) (*artifactSourceLinks, error) {
+	links := &artifactSourceLinks{}
+	links.repository, links.commit = gitSourceFromEnv()
+
+	for _, mapping := range sourceMap {
+		i := strings.LastIndex(mapping, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid source map %q, expected pattern=path", mapping)
+		}
+
+		rule := sourceMapRule{pattern: strings.TrimSpace(mapping[:i])}
+		for _, path := range strings.Split(mapping[i+1:], ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				rule.paths = append(rule.paths, path)
+			}
+		}
+		if rule.pattern == "" || len(rule.paths) == 0 {
+			return nil, fmt.Errorf("Invalid source map %q, expected pattern=path", mapping)
+		}
+		if _, err := zglob.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid source map pattern %q (%v)", rule.pattern, err)
+		}
+		links.rules = append(links.rules, rule)
+	}
+
+	return links, nil
+}
+
+// linkFor returns the source link of an artifact, or nil if source links
+// aren't being recorded
+func (s *artifactSourceLinks) linkFor(artifact *api.Artifact) *artifactSourceLink {
+	if s == nil {
+		return nil
+	}
+
+	link := &artifactSourceLink{Repository: s.repository, Commit: s.commit}
+	for _, rule := range s.rules {
+		if matched, _ := zglob.Match(rule.pattern, artifact.Path); matched {
+			link.Paths = rule.paths
+			break
+		}
+	}
+	return link
+}
+
+var fullCommitRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// gitSourceFromEnv returns the repository and commit being built. They're
+// read from the job's environment, falling back to the git checkout in the
+// working directory, and a commit that isn't a full SHA (such as HEAD) is
+// resolved to one if it can be.
+func gitSourceFromEnv() (repository string, commit string) {
+	repository = os.Getenv("BUILDKITE_REPO")
+	if repository == "" {
+		repository = gitOutput("config", "--get", "remote.origin.url")
+	}
+
+	commit = os.Getenv("BUILDKITE_COMMIT")
+	if commit == "" {
+		commit = "HEAD"
+	}
+	if !fullCommitRegexp.MatchString(commit) {
+		if resolved := gitOutput("rev-parse", "--verify", "--quiet", commit+"^{commit}"); resolved != "" {
+			commit = resolved
+		} else if commit == "HEAD" {
+			commit = ""
+		}
+	}
+
+	return repository, commit
+}
+
+// gitOutput runs git in the working directory, and returns what it printed,
+// or an empty string if it failed
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
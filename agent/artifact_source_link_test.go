@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactSourceLinks(t *testing.T) {
+	for name, value := range map[string]string{
+		"BUILDKITE_REPO":   "https://github.com/buildkite/agent.git",
+		"BUILDKITE_COMMIT": "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	links, err := parseArtifactSourceLinks([]string{
+		"bin/server=cmd/server, internal",
+		"bin/*=cmd",
+	})
+	require.NoError(t, err)
+
+	link := links.linkFor(&api.Artifact{Path: "bin/server"})
+	assert.Equal(t, &artifactSourceLink{
+		Repository: "https://github.com/buildkite/agent.git",
+		Commit:     "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3",
+		Paths:      []string{"cmd/server", "internal"},
+	}, link)
+	assert.Equal(t, []string{
+		"git+https://github.com/buildkite/agent.git@a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3#cmd/server",
+		"git+https://github.com/buildkite/agent.git@a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3#internal",
+	}, link.spdxLocations())
+
+	assert.Equal(t, []string{"cmd"}, links.linkFor(&api.Artifact{Path: "bin/worker"}).Paths)
+
+	// Artifacts matching no pattern still link to the commit
+	link = links.linkFor(&api.Artifact{Path: "README.md"})
+	assert.Empty(t, link.Paths)
+	assert.Equal(t, "a0c2bd8f9e3eb8c5ed9ad9ba8c947d31a606d1a3", link.Commit)
+
+	// Nothing is linked when source links aren't enabled
+	var disabled *artifactSourceLinks
+	assert.Nil(t, disabled.linkFor(&api.Artifact{Path: "bin/server"}))
+}
+
+func TestParseArtifactSourceLinksErrors(t *testing.T) {
+	for _, mapping := range []string{"bin/server", "=cmd", "bin/*=", "bin/*= , "} {
+		_, err := parseArtifactSourceLinks([]string{mapping})
+		assert.Error(t, err, mapping)
+	}
+}
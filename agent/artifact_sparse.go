@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// The suffix of the data of a sparse file, uploaded in place of it
+	ArtifactSparseDataSuffix = ".sparse"
+
+	// The suffix of the extent list uploaded along with a sparse file's data
+	ArtifactSparseManifestSuffix = ".sparse.json"
+
+	// Files with less than this much in holes are uploaded as they are
+	sparseMinHoleSize = 1 << 20
+)
+
+var errSparseUnsupported = errors.New("Sparse files can't be detected on this platform")
+
+// dataExtent is a part of a sparse file that holds data
+type dataExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// The extent list uploaded as "<path>.sparse.json" in place of a sparse file,
+// along with "<path>.sparse", which holds only the file's data extents one
+// after the other. It's JSON with these fields:
+//
+//	version  always 1
+//	size     the logical size of the file in bytes, including holes
+//	sha1sum  the hex SHA-1 of the file, including holes as zeros
+//	extents  the data extents of the file in order, each with its "offset"
+//	         in the file and its "length" in bytes
+//
+// The file is rebuilt by creating it with the logical size, and writing each
+// extent from the data at its offset, so everything else is a hole.
+type sparseManifest struct {
+	Version int          `json:"version"`
+	Size    int64        `json:"size"`
+	Sha1Sum string       `json:"sha1sum"`
+	Extents []dataExtent `json:"extents"`
+}
+
+// sparseStagingSize estimates how much space the data of sparse artifacts
+// will take up, which is at most the size of the artifacts
+func sparseStagingSize(artifacts []*api.Artifact) (total int64) {
+	for _, artifact := range artifacts {
+		total += artifact.FileSize
+	}
+	return total
+}
+
+// packSparseArtifacts replaces each sparse artifact with its data and an
+// extent list written into dir, so that its holes aren't uploaded
+func (a *ArtifactUploader) packSparseArtifacts(artifacts []*api.Artifact, dir string) ([]*api.Artifact, error) {
+	var all []*api.Artifact
+
+	for _, artifact := range artifacts {
+		packed, err := a.packSparseArtifact(artifact, dir)
+		if err == errSparseUnsupported {
+			a.logger.Warn("%s, uploading artifacts as they are", err)
+			return artifacts, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error checking whether %s is sparse: %v", artifact.Path, err)
+		}
+
+		if packed == nil {
+			all = append(all, artifact)
+		} else {
+			all = append(all, packed...)
+		}
+	}
+
+	return all, nil
+}
+
+// packSparseArtifact returns the data and extent list of the artifact if it's
+// sparse, or nil if it isn't
+func (a *ArtifactUploader) packSparseArtifact(artifact *api.Artifact, dir string) ([]*api.Artifact, error) {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	extents, err := dataExtents(f, artifact.FileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataSize int64
+	for _, extent := range extents {
+		dataSize += extent.Length
+	}
+	if artifact.FileSize-dataSize < sparseMinHoleSize {
+		return nil, nil
+	}
+
+	a.logger.Warn("%s is a sparse file of %s with only %s of data, uploading its data as %s",
+		artifact.Path, formatByteSize(artifact.FileSize), formatByteSize(dataSize), artifact.Path+ArtifactSparseDataSuffix)
+
+	packDir, err := ioutil.TempDir(dir, "sparse-")
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(packDir, filepath.Base(artifact.Path))
+
+	out, err := os.Create(base + ArtifactSparseDataSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, extent := range extents {
+		if _, err := io.Copy(out, io.NewSectionReader(f, extent.Offset, extent.Length)); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(sparseManifest{
+		Version: 1,
+		Size:    artifact.FileSize,
+		Sha1Sum: artifact.Sha1Sum,
+		Extents: extents,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(base+ArtifactSparseManifestSuffix, data, 0600); err != nil {
+		return nil, err
+	}
+
+	packed, err := a.build(artifact.Path+ArtifactSparseDataSuffix, base+ArtifactSparseDataSuffix, artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	packed.ContentType = ArtifactFallbackMimeType
+	packed.Metadata = artifact.Metadata
+
+	m, err := a.build(artifact.Path+ArtifactSparseManifestSuffix, base+ArtifactSparseManifestSuffix, artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	m.ContentType = "application/json"
+	m.Metadata = artifact.Metadata
+
+	return []*api.Artifact{packed, m}, nil
+}
+
+// UnpackSparse rebuilds the sparse file described by the extent list at
+// manifestPath from its data, which must have been downloaded alongside it,
+// leaving holes where the original file had them. The rebuilt file is checked
+// against its SHA-1. It returns the path of the rebuilt file.
+func UnpackSparse(manifestPath string) (string, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest sparseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("Error parsing extent list %s: %v", manifestPath, err)
+	}
+	if manifest.Version != 1 {
+		return "", fmt.Errorf("Unsupported extent list %s (version %d)", manifestPath, manifest.Version)
+	}
+
+	path := strings.TrimSuffix(manifestPath, ArtifactSparseManifestSuffix)
+	dataPath := path + ArtifactSparseDataSuffix
+
+	in, err := os.Open(dataPath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("The data of %s wasn't downloaded", filepath.Base(path))
+	} else if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := path + ".unpacking"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	// Truncating to the full size first leaves everything that isn't
+	// written as a hole
+	if err := out.Truncate(manifest.Size); err != nil {
+		out.Close()
+		return "", err
+	}
+	for _, extent := range manifest.Extents {
+		if extent.Offset < 0 || extent.Length < 0 || extent.Offset+extent.Length > manifest.Size {
+			out.Close()
+			return "", fmt.Errorf("Invalid extent at %d of %d bytes in %s", extent.Offset, extent.Length, manifestPath)
+		}
+		if _, err := io.CopyN(&offsetWriter{w: out, offset: extent.Offset}, in, extent.Length); err != nil {
+			out.Close()
+			return "", fmt.Errorf("The data of %s is truncated (%v)", filepath.Base(path), err)
+		}
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return "", err
+	}
+	hash := sha1.New()
+	if _, err := io.Copy(hash, out); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != manifest.Sha1Sum {
+		return "", fmt.Errorf("Unpacked %s has a SHA-1 of %s, but should be %s", path, sum, manifest.Sha1Sum)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	os.Remove(dataPath)
+	os.Remove(manifestPath)
+
+	return path, nil
+}
+
+// unpackSparse rebuilds each downloaded extent list into the sparse file it
+// describes
+func (a *ArtifactDownloader) unpackSparse(artifacts []*api.Artifact, downloadDestination string) error {
+	for _, artifact := range artifacts {
+		if !strings.HasSuffix(artifact.Path, ArtifactSparseManifestSuffix) {
+			continue
+		}
+
+		if _, err := UnpackSparse(getTargetPath(artifact.Path, downloadDestination)); err != nil {
+			return err
+		}
+
+		a.logger.Info("Unpacked sparse file %s", strings.TrimSuffix(artifact.Path, ArtifactSparseManifestSuffix))
+	}
+
+	return nil
+}
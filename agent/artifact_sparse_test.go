@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSparseFile writes a file of 8MiB with data only at its start and
+// middle, skipping the test if the filesystem doesn't track holes
+func writeSparseFile(t *testing.T, path string) []byte {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	size := int64(8 << 20)
+	require.NoError(t, f.Truncate(size))
+	_, err = f.WriteAt(bytes.Repeat([]byte("start"), 1000), 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte("middle"), 1000), 4<<20)
+	require.NoError(t, err)
+
+	extents, err := dataExtents(f, size)
+	if err == errSparseUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	if len(extents) == 1 && extents[0].Length == size {
+		t.Skip("The filesystem doesn't track holes")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+func TestPackAndUnpackSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.img")
+	original := writeSparseFile(t, path)
+
+	dense := filepath.Join(dir, "dense.txt")
+	require.NoError(t, ioutil.WriteFile(dense, []byte("dense"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	artifact, err := uploader.build("images/disk.img", path, "images/*")
+	require.NoError(t, err)
+	denseArtifact, err := uploader.build("images/dense.txt", dense, "images/*")
+	require.NoError(t, err)
+
+	staging := filepath.Join(dir, "staging")
+	require.NoError(t, os.Mkdir(staging, 0700))
+
+	artifacts, err := uploader.packSparseArtifacts([]*api.Artifact{artifact, denseArtifact}, staging)
+	require.NoError(t, err)
+	require.Len(t, artifacts, 3)
+	assert.Equal(t, "images/disk.img.sparse", artifacts[0].Path)
+	assert.Equal(t, "images/disk.img.sparse.json", artifacts[1].Path)
+	assert.Equal(t, "images/dense.txt", artifacts[2].Path)
+	assert.True(t, artifacts[0].FileSize < 1<<20)
+
+	downloads := filepath.Join(dir, "downloads")
+	for _, a := range artifacts {
+		data, err := ioutil.ReadFile(a.AbsolutePath)
+		require.NoError(t, err)
+
+		target := getTargetPath(a.Path, downloads)
+		require.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+		require.NoError(t, ioutil.WriteFile(target, data, 0600))
+	}
+
+	downloader := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{})
+	require.NoError(t, downloader.unpackSparse(artifacts, downloads))
+
+	unpacked, err := ioutil.ReadFile(filepath.Join(downloads, "images", "disk.img"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(original, unpacked))
+
+	_, err = os.Stat(filepath.Join(downloads, "images", "disk.img.sparse"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(downloads, "images", "disk.img.sparse.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnpackSparseDetectsCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.img")
+	require.NoError(t, ioutil.WriteFile(path+".sparse", []byte("datx"), 0600))
+	require.NoError(t, ioutil.WriteFile(path+".sparse.json", []byte(`{
+		"version": 1,
+		"size": 10,
+		"sha1sum": "0000000000000000000000000000000000000000",
+		"extents": [{"offset": 2, "length": 4}]
+	}`), 0600))
+
+	_, err = UnpackSparse(path + ".sparse.json")
+	assert.Error(t, err)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
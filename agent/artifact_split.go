@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The suffix of the part list uploaded along with the parts of a file that
+// was split
+const ArtifactSplitManifestSuffix = ".split.json"
+
+// The part list uploaded as "<path>.split.json" in place of a file that was
+// too big, along with the parts "<path>.part001", "<path>.part002" and so on.
+// It's JSON with these fields:
+//
+//	version  always 1
+//	size     the size of the file in bytes
+//	sha1sum  the hex SHA-1 of the file
+//	parts    the parts of the file in order, each with its artifact "path",
+//	         its "size" in bytes and the hex "sha1sum" of its contents
+//
+// The file is the concatenation of the parts, e.g. with
+// cat <path>.part* > <path>, as the part numbers are zero padded so they sort
+// in order.
+type splitManifest struct {
+	Version int         `json:"version"`
+	Size    int64       `json:"size"`
+	Sha1Sum string      `json:"sha1sum"`
+	Parts   []splitPart `json:"parts"`
+}
+
+type splitPart struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Sha1Sum string `json:"sha1sum"`
+}
+
+// splitPartPath returns the path of the nth part (from 1) of an artifact
+// split into count parts
+func splitPartPath(path string, n int, count int) string {
+	width := len(fmt.Sprint(count))
+	if width < 3 {
+		width = 3
+	}
+	return fmt.Sprintf("%s.part%0*d", path, width, n)
+}
+
+// splitStagingSize returns how much space the parts of the artifacts larger
+// than size take up
+func splitStagingSize(artifacts []*api.Artifact, size int64) (total int64) {
+	for _, artifact := range artifacts {
+		if artifact.FileSize > size {
+			total += artifact.FileSize
+		}
+	}
+	return total
+}
+
+// splitArtifacts replaces each artifact larger than size with its parts,
+// written into dir, and a part list describing how to put them back together
+func (a *ArtifactUploader) splitArtifacts(artifacts []*api.Artifact, size int64, dir string) ([]*api.Artifact, error) {
+	var all []*api.Artifact
+
+	for _, artifact := range artifacts {
+		if artifact.FileSize <= size {
+			all = append(all, artifact)
+			continue
+		}
+
+		parts, err := a.splitArtifact(artifact, size, dir)
+		if err != nil {
+			return nil, fmt.Errorf("Error splitting %s: %v", artifact.Path, err)
+		}
+
+		a.logger.Info("Split %s into %d parts of up to %d bytes", artifact.Path, len(parts)-1, size)
+		all = append(all, parts...)
+	}
+
+	return all, nil
+}
+
+// splitArtifact writes the parts of an artifact into dir, and returns them
+// followed by the part list
+func (a *ArtifactUploader) splitArtifact(artifact *api.Artifact, size int64, dir string) ([]*api.Artifact, error) {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	partDir, err := ioutil.TempDir(dir, "parts-")
+	if err != nil {
+		return nil, err
+	}
+
+	count := int((artifact.FileSize + size - 1) / size)
+	manifest := &splitManifest{
+		Version: 1,
+		Size:    artifact.FileSize,
+		Sha1Sum: artifact.Sha1Sum,
+	}
+
+	var parts []*api.Artifact
+	for n := 1; n <= count; n++ {
+		partPath := splitPartPath(artifact.Path, n, count)
+		absolutePath := filepath.Join(partDir, filepath.Base(partPath))
+
+		if err := copyPart(in, absolutePath, size); err != nil {
+			return nil, err
+		}
+
+		part, err := a.build(partPath, absolutePath, artifact.GlobPath)
+		if err != nil {
+			return nil, err
+		}
+		part.ContentType = ArtifactFallbackMimeType
+		part.Metadata = artifact.Metadata
+
+		manifest.Parts = append(manifest.Parts, splitPart{
+			Path:    part.Path,
+			Size:    part.FileSize,
+			Sha1Sum: part.Sha1Sum,
+		})
+		parts = append(parts, part)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	manifestPath := filepath.Join(partDir, filepath.Base(artifact.Path)+ArtifactSplitManifestSuffix)
+	if err := ioutil.WriteFile(manifestPath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	m, err := a.build(artifact.Path+ArtifactSplitManifestSuffix, manifestPath, artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	m.ContentType = "application/json"
+	m.Metadata = artifact.Metadata
+
+	return append(parts, m), nil
+}
+
+// copyPart copies up to size bytes from r into a new file at path
+func copyPart(r io.Reader, path string, size int64) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(out, r, size); err != nil && err != io.EOF {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// ReassembleSplit rebuilds the file described by the part list at
+// manifestPath from its parts, which must have been downloaded alongside it.
+// Each part and the rebuilt file are checked against their SHA-1s. It
+// returns the path of the rebuilt file.
+func ReassembleSplit(manifestPath string) (string, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest splitManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("Error parsing part list %s: %v", manifestPath, err)
+	}
+	if manifest.Version != 1 {
+		return "", fmt.Errorf("Unsupported part list %s (version %d)", manifestPath, manifest.Version)
+	}
+
+	path := strings.TrimSuffix(manifestPath, ArtifactSplitManifestSuffix)
+	dir := filepath.Dir(manifestPath)
+
+	tmp := path + ".reassembling"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	hash := sha1.New()
+	w := io.MultiWriter(out, hash)
+
+	var partPaths []string
+	for _, part := range manifest.Parts {
+		// Parts are always next to the part list
+		partPath := filepath.Join(dir, filepath.Base(filepath.FromSlash(part.Path)))
+		if err := copySplitPart(w, partPath, part); err != nil {
+			out.Close()
+			return "", err
+		}
+		partPaths = append(partPaths, partPath)
+	}
+
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != manifest.Sha1Sum {
+		return "", fmt.Errorf("Reassembled %s has a SHA-1 of %s, but should be %s", path, sum, manifest.Sha1Sum)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+
+	for _, partPath := range partPaths {
+		os.Remove(partPath)
+	}
+	os.Remove(manifestPath)
+
+	return path, nil
+}
+
+func copySplitPart(w io.Writer, path string, part splitPart) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Part %s wasn't downloaded", part.Path)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), f)
+	if err != nil {
+		return err
+	}
+
+	if n != part.Size || fmt.Sprintf("%x", hash.Sum(nil)) != part.Sha1Sum {
+		return fmt.Errorf("Part %s is corrupt", part.Path)
+	}
+
+	return nil
+}
+
+// reassembleSplit rebuilds each downloaded part list into the file it
+// describes
+func (a *ArtifactDownloader) reassembleSplit(artifacts []*api.Artifact, downloadDestination string) error {
+	for _, artifact := range artifacts {
+		if !strings.HasSuffix(artifact.Path, ArtifactSplitManifestSuffix) {
+			continue
+		}
+
+		if _, err := ReassembleSplit(getTargetPath(artifact.Path, downloadDestination)); err != nil {
+			return err
+		}
+
+		a.logger.Info("Reassembled %s from its parts", strings.TrimSuffix(artifact.Path, ArtifactSplitManifestSuffix))
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPartPath(t *testing.T) {
+	assert.Equal(t, "pkg/app.tar.part001", splitPartPath("pkg/app.tar", 1, 3))
+	assert.Equal(t, "pkg/app.tar.part0042", splitPartPath("pkg/app.tar", 42, 1200))
+}
+
+// splitAndDownload splits the file at path as the artifact "pkg/app.tar",
+// and copies everything uploaded into a download directory
+func splitAndDownload(t *testing.T, dir string, path string, size int64) ([]*api.Artifact, string) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	artifact, err := uploader.build("pkg/app.tar", path, "pkg/*")
+	require.NoError(t, err)
+
+	small := filepath.Join(dir, "small.txt")
+	require.NoError(t, ioutil.WriteFile(small, []byte("small"), 0600))
+	smallArtifact, err := uploader.build("pkg/small.txt", small, "pkg/*")
+	require.NoError(t, err)
+
+	staging := filepath.Join(dir, "staging")
+	require.NoError(t, os.Mkdir(staging, 0700))
+
+	artifacts, err := uploader.splitArtifacts([]*api.Artifact{artifact, smallArtifact}, size, staging)
+	require.NoError(t, err)
+
+	downloads := filepath.Join(dir, "downloads")
+	for _, a := range artifacts {
+		data, err := ioutil.ReadFile(a.AbsolutePath)
+		require.NoError(t, err)
+
+		target := getTargetPath(a.Path, downloads)
+		require.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+		require.NoError(t, ioutil.WriteFile(target, data, 0600))
+	}
+
+	return artifacts, downloads
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-split")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	original := make([]byte, 250)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	path := filepath.Join(dir, "app.tar")
+	require.NoError(t, ioutil.WriteFile(path, original, 0600))
+
+	artifacts, downloads := splitAndDownload(t, dir, path, 100)
+
+	var paths []string
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.Equal(t, []string{
+		"pkg/app.tar.part001",
+		"pkg/app.tar.part002",
+		"pkg/app.tar.part003",
+		"pkg/app.tar.split.json",
+		"pkg/small.txt",
+	}, paths)
+	assert.Equal(t, int64(50), artifacts[2].FileSize)
+
+	reassembled, err := ReassembleSplit(filepath.Join(downloads, "pkg", "app.tar.split.json"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(downloads, "pkg", "app.tar"), reassembled)
+
+	data, err := ioutil.ReadFile(reassembled)
+	require.NoError(t, err)
+	assert.Equal(t, original, data)
+
+	_, err = os.Stat(filepath.Join(downloads, "pkg", "app.tar.part001"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReassembleSplitDetectsCorruptParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-split")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.tar")
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, 250), 0600))
+
+	_, downloads := splitAndDownload(t, dir, path, 100)
+
+	part := filepath.Join(downloads, "pkg", "app.tar.part002")
+	require.NoError(t, ioutil.WriteFile(part, []byte("corrupt"), 0600))
+
+	_, err = ReassembleSplit(filepath.Join(downloads, "pkg", "app.tar.split.json"))
+	assert.EqualError(t, err, "Part pkg/app.tar.part002 is corrupt")
+
+	require.NoError(t, os.Remove(part))
+
+	_, err = ReassembleSplit(filepath.Join(downloads, "pkg", "app.tar.split.json"))
+	assert.EqualError(t, err, "Part pkg/app.tar.part002 wasn't downloaded")
+}
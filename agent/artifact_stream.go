@@ -0,0 +1,431 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	zglob "github.com/mattn/go-zglob"
+)
+
+const (
+	// Streamed artifacts are created on Buildkite as many at a time as the
+	// batch creator sends at once, or as many as have been found once the
+	// first of them has waited streamBatchWait
+	streamBatchSize = 30
+	streamBatchWait = 250 * time.Millisecond
+)
+
+var errStreamStopped = errors.New("The upload was stopped")
+
+// streamConflict returns what in the config needs every artifact to be found
+// before any are uploaded, if anything does
+func (a *ArtifactUploader) streamConflict() string {
+	switch {
+	case a.conf.Head > 0 || a.conf.Tail > 0:
+		return "truncating artifacts"
+	case len(a.conf.Transforms) > 0:
+		return "transforming artifacts"
+	case a.conf.Gzip:
+		return "compressing artifacts"
+	case a.conf.Encryptor != nil:
+		return "encrypting artifacts"
+	case a.conf.Sparse:
+		return "uploading sparse files"
+	case a.conf.Provenance:
+		return "uploading provenance"
+	case a.conf.SplitSize > 0:
+		return "splitting artifacts"
+	case a.conf.Parity > 0:
+		return "uploading parity"
+	case a.conf.DiffAgainst != "":
+		return "diffing against another build"
+	case a.conf.Prefetch:
+		return "prefetching artifacts"
+	}
+	return ""
+}
+
+// uploadStream uploads files as they're found, a batch at a time, rather
+// than searching every path before uploading any of them
+func (a *ArtifactUploader) uploadStream(galleryTemplate *template.Template, triggerPayload *texttemplate.Template) error {
+	if conflict := a.streamConflict(); conflict != "" {
+		return fmt.Errorf("Artifacts can't be streamed when %s, which needs every artifact to be found first", conflict)
+	}
+
+	if a.conf.JournalPath != "" {
+		journal, err := openArtifactJournal(a.conf.JournalPath, a.conf.Resume)
+		if err != nil {
+			return err
+		}
+		a.journal = journal
+		defer a.journal.Close()
+	}
+
+	defer func() {
+		if a.ownedDir != "" {
+			os.RemoveAll(a.ownedDir)
+		}
+	}()
+
+	found := make(chan *api.Artifact)
+	stop := make(chan struct{})
+	collected := make(chan error, 1)
+
+	var matched, skipped int
+	go func() {
+		defer close(found)
+
+		collected <- a.collect(streamGlob, func(artifact *api.Artifact) error {
+			if a.conf.Resume && a.journal != nil && a.journal.Completed(a.conf.Destination, artifact) {
+				a.logger.Debug("Skipping %s, which the journal records as already uploaded", artifact.Path)
+				skipped++
+				return nil
+			}
+
+			select {
+			case found <- artifact:
+				matched++
+				return nil
+			case <-stop:
+				return errStreamStopped
+			}
+		})
+	}()
+
+	err := a.uploadBatches(batchArtifacts(found, stop, streamBatchSize, streamBatchWait))
+	close(stop)
+	collectErr := <-collected
+
+	if err != nil {
+		return err
+	}
+	if collectErr != nil {
+		return collectErr
+	}
+
+	if skipped > 0 {
+		a.logger.Info("Resuming upload, skipped %d artifacts already uploaded according to %s", skipped, a.conf.JournalPath)
+	}
+
+	// Files that were all uploaded already still matched
+	if matched == 0 {
+		if skipped == 0 {
+			return a.noFilesMatched()
+		}
+		return nil
+	}
+
+	a.logger.Info("Uploaded %d of the %d files that match \"%s\"", len(a.uploaded), matched, a.conf.Paths)
+
+	if a.conf.Gallery {
+		if err := a.uploadGallery(galleryTemplate); err != nil {
+			return err
+		}
+	}
+
+	if a.conf.ManifestSigner != nil || a.conf.ManifestWithURLs {
+		if err := a.uploadManifest(); err != nil {
+			return err
+		}
+	}
+
+	if a.conf.EmitLinks {
+		if err := a.emitLinks(); err != nil {
+			return err
+		}
+	}
+
+	if a.conf.TriggerPipeline != "" {
+		if err := a.triggerPipeline(triggerPayload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchArtifacts groups the artifacts that are found into batches of at most
+// size, sending a smaller batch if no more are found within wait of the first
+// of it. The batches are closed once found is, or stop is.
+func batchArtifacts(found <-chan *api.Artifact, stop <-chan struct{}, size int, wait time.Duration) <-chan []*api.Artifact {
+	batches := make(chan []*api.Artifact)
+
+	go func() {
+		defer close(batches)
+
+		var batch []*api.Artifact
+		var timeout <-chan time.Time
+
+		for {
+			select {
+			case artifact, ok := <-found:
+				if !ok {
+					if len(batch) > 0 {
+						select {
+						case batches <- batch:
+						case <-stop:
+						}
+					}
+					return
+				}
+
+				batch = append(batch, artifact)
+				if len(batch) == 1 {
+					timeout = time.After(wait)
+				}
+				if len(batch) < size {
+					continue
+				}
+			case <-timeout:
+			case <-stop:
+				return
+			}
+
+			select {
+			case batches <- batch:
+			case <-stop:
+				return
+			}
+			batch, timeout = nil, nil
+		}
+	}()
+
+	return batches
+}
+
+// streamGlob is a globFunc that calls match with each file as the walk finds
+// it, rather than once the whole tree has been walked. Patterns starting with
+// ~ or using environment variables are left to zglob, which expands them.
+func streamGlob(pattern string, match func(file string) error) error {
+	return walkGlob(logger.Discard, false, false, nil)(pattern, match)
+}
+
+// walkGlob returns a globFunc like streamGlob, that also walks into symlinked
+// directories if follow is set, and doesn't walk into directories that skip
+// returns true for. Only the walk is pruned, so with zglob the matches of
+// skipped directories still need to be filtered out. Symlinks that loop back
+// to a directory being walked are logged to l and skipped. If ignoreCase is
+// set, paths match the pattern whatever their case, and the files matched are
+// still passed to match with the case they have on disk.
+func walkGlob(l logger.Logger, follow bool, ignoreCase bool, skip func(dir string) bool) globFunc {
+	return func(pattern string, match func(file string) error) error {
+		if strings.HasPrefix(pattern, "~") || strings.Contains(pattern, "$") {
+			if follow {
+				return globAll(zglob.GlobFollowSymlinks)(pattern, match)
+			}
+			return globAll(zglob.Glob)(pattern, match)
+		}
+
+		// Like zglob, only * is special. Without any, the pattern is a path
+		// that's only looked for if it isn't there exactly as it's given.
+		literal := !strings.Contains(pattern, "*")
+		if literal {
+			if _, err := os.Stat(pattern); err == nil {
+				return match(pattern)
+			}
+			if !ignoreCase {
+				return os.ErrNotExist
+			}
+		}
+
+		// Relative patterns are matched as absolute paths, as zglob's matching
+		// skips names no longer than the directory the walk starts from
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		relative := !filepath.IsAbs(pattern)
+		if relative {
+			pattern = filepath.Join(wd, pattern)
+		}
+		pattern = filepath.ToSlash(pattern)
+
+		matchPattern := pattern
+		if ignoreCase {
+			matchPattern = strings.ToLower(pattern)
+		}
+		z, err := zglob.New(matchPattern)
+		if err != nil {
+			return err
+		}
+
+		// The walk starts from the directory before the first segment with a
+		// glob in it. Without a ** in the pattern, it only matches so many
+		// directories below that, so there's no need to walk any further.
+		segments := strings.Split(pattern, "/")
+		first := 0
+		for first < len(segments)-1 && !strings.Contains(segments[first], "*") {
+			first++
+		}
+
+		// Ignoring case, the directories before it might be there with a
+		// different case, so it starts from the closest one that's there
+		// as it's given
+		if ignoreCase {
+			for first > 1 && !isDir(filepath.FromSlash(strings.Join(segments[:first], "/"))) {
+				first--
+			}
+		}
+		root := filepath.Dir(filepath.FromSlash(strings.Join(segments[:first+1], "/")))
+
+		depth := 0
+		if !strings.Contains(pattern, "**") {
+			depth = len(segments) - first
+		}
+
+		matches := func(path string) bool {
+			path = filepath.ToSlash(path)
+			if ignoreCase {
+				path = strings.ToLower(path)
+			}
+			return z.Match(path)
+		}
+
+		// Relative patterns match paths relative to the working directory
+		relativePath := func(path string) string {
+			if relative {
+				if rel, err := filepath.Rel(wd, path); err == nil {
+					return rel
+				}
+			}
+			return path
+		}
+
+		matched := false
+		err = walk(l, root, follow, func(path string, info os.FileInfo, err error) error {
+			// Like zglob, skip whatever can't be read
+			if err != nil {
+				if info != nil && info.IsDir() && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() && skip != nil && skip(path) {
+				return filepath.SkipDir
+			}
+			if path == root {
+				return nil
+			}
+
+			if info.IsDir() {
+				// Unlike zglob, only empty directories are matched, for
+				// IncludeEmptyDirs, as the others are skipped anyway
+				if matches(path) && isEmptyDir(path) {
+					matched = true
+					if err := match(relativePath(path)); err != nil {
+						return err
+					}
+				}
+				if depth > 0 {
+					if rel, err := filepath.Rel(root, path); err == nil && len(strings.Split(filepath.ToSlash(rel), "/")) >= depth {
+						return filepath.SkipDir
+					}
+				}
+				return nil
+			}
+
+			if !matches(path) {
+				return nil
+			}
+
+			matched = true
+			return match(relativePath(path))
+		})
+		if err == nil && literal && !matched {
+			return os.ErrNotExist
+		}
+		return err
+	}
+}
+
+// walk is filepath.Walk, but if follow is set it also walks into symlinked
+// directories, except for links back to a directory that's already being
+// walked, which would loop forever. Directories are compared by their real
+// path, so a loop is found however many links it goes through. Links that are
+// broken are passed to walkFn with their error.
+func walk(l logger.Logger, root string, follow bool, walkFn filepath.WalkFunc) error {
+	if !follow {
+		return filepath.Walk(root, walkFn)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+
+	// The real paths of the directories being walked, and the paths they were
+	// walked by, so a link back to one of them is skipped
+	walking := make(map[string]string)
+
+	var walkDir func(path string, info os.FileInfo) error
+	walkDir = func(path string, info os.FileInfo) error {
+		err := walkFn(path, info, nil)
+		if err != nil || !info.IsDir() {
+			if err == filepath.SkipDir && info.IsDir() {
+				return nil
+			}
+			return err
+		}
+
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			if ancestor, ok := walking[real]; ok {
+				l.Debug("Skipping %s, a symlink loop back to %s", path, ancestor)
+				return nil
+			}
+			walking[real] = path
+			defer delete(walking, real)
+		}
+
+		names, err := readDirNames(path)
+		if err != nil {
+			if err := walkFn(path, info, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			return nil
+		}
+
+		for _, name := range names {
+			child := filepath.Join(path, name)
+
+			childInfo, err := os.Stat(child)
+			if err != nil {
+				if err := walkFn(child, nil, err); err != nil && err != filepath.SkipDir {
+					return err
+				}
+				continue
+			}
+
+			if err := walkDir(child, childInfo); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walkDir(root, info)
+}
+
+// readDirNames returns the sorted names of the entries in the directory
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	zglob "github.com/mattn/go-zglob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamGlobMatchesLikeZglob(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := filepath.Join(wd, "..")
+	os.Chdir(root)
+	defer os.Chdir(wd)
+
+	for _, pattern := range []string{
+		"test/fixtures/artifacts/**/*.jpg",
+		"test/fixtures/artifacts/*",
+		"test/fixtures/artifacts/*/*.jpg",
+		"test/fixtures/*/folder/*",
+		"test/fixtures/artifacts/Mr Freeze.jpg",
+		filepath.Join(root, "test", "fixtures", "artifacts", "**", "*.jpg"),
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			expected, err := zglob.Glob(pattern)
+			require.NoError(t, err)
+
+			var streamed []string
+			require.NoError(t, streamGlob(pattern, func(file string) error {
+				streamed = append(streamed, filepath.ToSlash(file))
+				return nil
+			}))
+
+			// zglob also matches directories, which are skipped anyway
+			var files []string
+			for _, file := range expected {
+				if !isDir(file) {
+					files = append(files, filepath.ToSlash(file))
+				}
+			}
+			assert.NotEmpty(t, streamed)
+			assert.ElementsMatch(t, files, streamed)
+		})
+	}
+
+	assert.Equal(t, os.ErrNotExist, streamGlob("dontmatchanything.zip", func(string) error { return nil }))
+}
+
+func TestBatchArtifacts(t *testing.T) {
+	found := make(chan *api.Artifact)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	batches := batchArtifacts(found, stop, 2, 10*time.Millisecond)
+
+	// Full batches are sent straight away
+	found <- &api.Artifact{Path: "a"}
+	found <- &api.Artifact{Path: "b"}
+	assert.Len(t, <-batches, 2)
+
+	// Otherwise they're sent after waiting for more
+	found <- &api.Artifact{Path: "c"}
+	assert.Len(t, <-batches, 1)
+
+	// And whatever's left is sent once everything's been found
+	found <- &api.Artifact{Path: "d"}
+	close(found)
+	batch := <-batches
+	require.Len(t, batch, 1)
+	assert.Equal(t, "d", batch[0].Path)
+
+	_, ok := <-batches
+	assert.False(t, ok)
+}
+
+func TestBatchArtifactsStops(t *testing.T) {
+	found := make(chan *api.Artifact)
+	stop := make(chan struct{})
+
+	batches := batchArtifacts(found, stop, 1, time.Hour)
+	found <- &api.Artifact{Path: "a"}
+	close(stop)
+
+	// The batches are closed once the upload stops, whether or not the
+	// waiting batch was sent
+	for range batches {
+	}
+}
+
+func TestUploadStreamRejectsOptionsThatNeedEveryArtifact(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Stream: true, SplitSize: 1024})
+	err := uploader.uploadStream(nil, nil)
+	assert.EqualError(t, err, "Artifacts can't be streamed when splitting artifacts, which needs every artifact to be found first")
+}
+
+func TestWalkGlobFollowingSymlinksMatchesLikeZglob(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(filepath.Join(wd, ".."))
+	defer os.Chdir(wd)
+
+	pattern := "test/fixtures/artifacts/**/*.jpg"
+	expected, err := zglob.GlobFollowSymlinks(pattern)
+	require.NoError(t, err)
+
+	var walked []string
+	require.NoError(t, walkGlob(logger.Discard, true, false, nil)(pattern, func(file string) error {
+		walked = append(walked, filepath.ToSlash(file))
+		return nil
+	}))
+
+	var files []string
+	for _, file := range expected {
+		files = append(files, filepath.ToSlash(file))
+	}
+	assert.Contains(t, walked, "test/fixtures/artifacts/links/folder-link/terminator2.jpg")
+	assert.ElementsMatch(t, files, walked)
+}
+
+func TestWalkGlobFollowingSymlinksStopsAtLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk-glob-loop")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "file.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.Symlink(dir, filepath.Join(dir, "a", "loop")))
+
+	var walked []string
+	require.NoError(t, walkGlob(logger.Discard, true, false, nil)(filepath.Join(dir, "**", "*.txt"), func(file string) error {
+		walked = append(walked, file)
+		return nil
+	}))
+	assert.Equal(t, []string{filepath.Join(dir, "a", "file.txt")}, walked)
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// An uploadTimeoutError is returned when an attempt at uploading an artifact
+// took longer than UploadTimeout, and was aborted
+type uploadTimeoutError struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (e *uploadTimeoutError) Error() string {
+	return fmt.Sprintf("Uploading %q timed out after %s", e.Path, e.Timeout)
+}
+
+// attemptUpload makes a single attempt at uploading the artifact, aborting
+// it if it takes longer than UploadTimeout. Each attempt gets the whole
+// timeout, so an attempt that timed out can be retried.
+func (a *ArtifactUploader) attemptUpload(uploader Uploader, refresher *credentialRefresher, artifact *api.Artifact) error {
+	if a.conf.UploadTimeout <= 0 {
+		return refresher.upload(context.Background(), uploader, artifact)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.conf.UploadTimeout)
+	defer cancel()
+
+	err := refresher.upload(ctx, uploader, artifact)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &uploadTimeoutError{Path: artifact.Path, Timeout: a.conf.UploadTimeout}
+	}
+	return err
+}
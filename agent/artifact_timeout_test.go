@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttemptUploadAbortsHungUploads(t *testing.T) {
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the connection closing once it's read
+		// the body
+		ioutil.ReadAll(r.Body)
+
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL + "/artifactory",
+		"BUILDKITE_ARTIFACTORY_USER":     "carol-danvers",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "xxx",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "upload-timeout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{Destination: "rt://my-repo/builds"})
+	require.NoError(t, err)
+
+	a := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{UploadTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	err = a.attemptUpload(uploader, nil, &api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath})
+	assert.EqualError(t, err, `Uploading "llamas.txt" timed out after 50ms`)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Equal(t, RetryTransient, DefaultRetryClassifier(err))
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request to the server wasn't aborted")
+	}
+}
+
+func TestUploadersCanBeAborted(t *testing.T) {
+	for _, uploader := range []Uploader{&S3Uploader{}, &GSUploader{}, &ArtifactoryUploader{}, &FormUploader{}, &AzureBlobUploader{}} {
+		_, ok := uploader.(ContextUploader)
+		assert.True(t, ok, "%T can't abort uploads", uploader)
+	}
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// artifactTiming is where the time went for an artifact, if TimingDetail is
+// set. Resolving is finding and stat'ing the file, from when the previous
+// file was found (or the search started, so for globs that find every file
+// before returning any, the first file of each path carries the search).
+// Reading is reading the file from disk, when checksumming it and while it's
+// uploaded. Transferring is the rest of each upload attempt, which is mostly
+// sending it over the network.
+type artifactTiming struct {
+	resolve  time.Duration
+	transfer time.Duration
+
+	// Nanoseconds, as the parts of an upload can be read concurrently
+	read int64
+}
+
+func (t *artifactTiming) addRead(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.read, int64(d))
+	}
+}
+
+func (t *artifactTiming) readTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.read))
+}
+
+// artifactTimings are the timings of each of the artifacts. A nil
+// *artifactTimings records nothing, so it costs nothing when TimingDetail
+// isn't set.
+type artifactTimings struct {
+	mu      sync.Mutex
+	timings map[*api.Artifact]*artifactTiming
+}
+
+func newArtifactTimings() *artifactTimings {
+	return &artifactTimings{timings: make(map[*api.Artifact]*artifactTiming)}
+}
+
+// get returns the artifact's timing, or nil if timings aren't being recorded
+func (t *artifactTimings) get(artifact *api.Artifact) *artifactTiming {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timing, ok := t.timings[artifact]
+	if !ok {
+		timing = &artifactTiming{}
+		t.timings[artifact] = timing
+	}
+	return timing
+}
+
+// timedArtifactFile adds the time spent reading the file to its timing
+type timedArtifactFile struct {
+	ArtifactFile
+	timing *artifactTiming
+}
+
+func (f timedArtifactFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.ArtifactFile.Read(p)
+	f.timing.addRead(time.Since(start))
+	return n, err
+}
+
+func (f timedArtifactFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.ArtifactFile.ReadAt(p, off)
+	f.timing.addRead(time.Since(start))
+	return n, err
+}
+
+// logTiming logs the artifact's timing, with each part as a field of the
+// structured log
+func (a *ArtifactUploader) logTiming(artifact *api.Artifact) {
+	timing := a.timings.get(artifact)
+	if timing == nil {
+		return
+	}
+
+	a.logger.WithFields(
+		logger.StringField("artifact", artifact.Path),
+		logger.DurationField("resolve", timing.resolve),
+		logger.DurationField("read", timing.readTime()),
+		logger.DurationField("transfer", timing.transfer),
+	).Info("Timing for \"%s\": %s resolving, %s reading, %s transferring",
+		artifact.Path, timing.resolve, timing.readTime(), timing.transfer)
+}
+
+// logTimingSummary logs the total of each part of the artifacts' timings, so
+// it's clear whether the upload was bound by the disk or the network. The
+// totals are summed across concurrent uploads, so they can be longer than
+// the upload took.
+func (a *ArtifactUploader) logTimingSummary(artifacts []*api.Artifact) {
+	if a.timings == nil {
+		return
+	}
+
+	var resolve, read, transfer time.Duration
+	for _, artifact := range artifacts {
+		timing := a.timings.get(artifact)
+		resolve += timing.resolve
+		read += timing.readTime()
+		transfer += timing.transfer
+	}
+
+	a.logger.Info("Spent %s resolving, %s reading and %s transferring %d artifacts in total", resolve, read, transfer, len(artifacts))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactTimingsAreOffByDefault(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.Nil(t, uploader.timings)
+
+	// A nil *artifactTimings records nothing
+	timing := uploader.timings.get(&api.Artifact{})
+	assert.Nil(t, timing)
+	timing.addRead(time.Second)
+}
+
+func TestCollectRecordsTimings(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(filepath.Join(wd, ".."))
+	defer os.Chdir(wd)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:        "test/fixtures/artifacts/**/*.jpg",
+		TimingDetail: true,
+	})
+
+	artifacts, err := uploader.Collect()
+	require.NoError(t, err)
+	require.NotEmpty(t, artifacts)
+
+	for _, artifact := range artifacts {
+		timing := uploader.timings.get(artifact)
+		assert.True(t, timing.resolve > 0, artifact.Path)
+		assert.True(t, timing.readTime() > 0, artifact.Path)
+	}
+}
+
+func TestOpenForUploadRecordsReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-timing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{TimingDetail: true})
+	artifact := &api.Artifact{Path: "a.txt", AbsolutePath: path}
+
+	f, err := uploader.openForUpload(artifact)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "llamas", string(data))
+	assert.True(t, uploader.timings.get(artifact).readTime() > 0)
+}
+
+func TestWriteManifestWithTimings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a.txt"), 0600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:        "job-1",
+		TimingDetail: true,
+	})
+
+	artifact, err := uploader.build("out/a.txt", filepath.Join(dir, "a.txt"), "out/*")
+	require.NoError(t, err)
+
+	timing := uploader.timings.get(artifact)
+	timing.resolve = 1500 * time.Microsecond
+	timing.transfer = 2 * time.Second
+
+	companions, err := uploader.writeManifest([]*api.Artifact{artifact}, dir)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(companions[0].AbsolutePath)
+	require.NoError(t, err)
+
+	var manifest artifactManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Len(t, manifest.Artifacts, 1)
+	require.NotNil(t, manifest.Artifacts[0].Timing)
+	assert.Equal(t, 1.5, manifest.Artifacts[0].Timing.ResolveMS)
+	assert.Equal(t, 2000.0, manifest.Artifacts[0].Timing.TransferMS)
+	assert.True(t, manifest.Artifacts[0].Timing.ReadMS > 0)
+}
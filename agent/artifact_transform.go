@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/shellwords"
+)
+
+// An ArtifactTransform pipes artifacts of a Content-Type through a command
+// before they're uploaded, uploading the command's output instead
+type ArtifactTransform struct {
+	// The Content-Type to match, which can end with /* to match any subtype
+	ContentType string
+
+	// The command and its arguments
+	Command []string
+}
+
+// ParseArtifactTransform parses a transform in the form
+// <content-type>=<command>
+func ParseArtifactTransform(s string) (ArtifactTransform, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return ArtifactTransform{}, fmt.Errorf("Invalid transform %q, expected <content-type>=<command>", s)
+	}
+
+	command, err := shellwords.Split(parts[1])
+	if err != nil {
+		return ArtifactTransform{}, fmt.Errorf("Invalid transform command %q: %v", parts[1], err)
+	}
+	if len(command) == 0 {
+		return ArtifactTransform{}, fmt.Errorf("Invalid transform %q, the command is empty", s)
+	}
+
+	return ArtifactTransform{
+		ContentType: strings.ToLower(strings.TrimSpace(parts[0])),
+		Command:     command,
+	}, nil
+}
+
+// Matches returns whether the transform applies to the Content-Type, ignoring
+// any parameters like the charset
+func (t ArtifactTransform) Matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+
+	if strings.HasSuffix(t.ContentType, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(t.ContentType, "*"))
+	}
+	return mediaType == t.ContentType
+}
+
+func (a *ArtifactUploader) transformFor(artifact *api.Artifact) *ArtifactTransform {
+	for i := range a.conf.Transforms {
+		if a.conf.Transforms[i].Matches(artifact.ContentType) {
+			return &a.conf.Transforms[i]
+		}
+	}
+	return nil
+}
+
+// transformStagingSize estimates the space needed to stage transformed
+// artifacts, assuming the output is no bigger than the input
+func (a *ArtifactUploader) transformStagingSize(artifacts []*api.Artifact) int64 {
+	var total int64
+	for _, artifact := range artifacts {
+		if a.transformFor(artifact) != nil {
+			total += artifact.FileSize
+		}
+	}
+	return total
+}
+
+// applyTransforms runs every artifact with a matching transform through its
+// command, staging the output in dir. Artifacts that fail to transform are
+// left out of the returned artifacts, and their errors are returned so the
+// rest can still be uploaded.
+func (a *ArtifactUploader) applyTransforms(artifacts []*api.Artifact, dir string) ([]*api.Artifact, []error) {
+	transformed := []*api.Artifact{}
+	errs := []error{}
+
+	for _, artifact := range artifacts {
+		transform := a.transformFor(artifact)
+		if transform == nil {
+			transformed = append(transformed, artifact)
+			continue
+		}
+
+		a.logger.Debug("Transforming %s with `%s`", artifact.Path, strings.Join(transform.Command, " "))
+
+		if err := a.transform(artifact, transform, dir); err != nil {
+			a.logger.Error("Error transforming artifact \"%s\": %s", artifact.Path, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		transformed = append(transformed, artifact)
+	}
+
+	return transformed, errs
+}
+
+// transform pipes the artifact through the command, and points the artifact
+// at the output with its new size and checksum
+func (a *ArtifactUploader) transform(artifact *api.Artifact, transform *ArtifactTransform, dir string) error {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(dir, "transform-")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha1.New()
+	sha256Hash := sha256.New()
+	counter := &countingWriter{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.Command(transform.Command[0], transform.Command[1:]...)
+	cmd.Stdin = in
+	cmd.Stdout = io.MultiWriter(out, hash, sha256Hash, counter)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("`%s` failed: %v: %s", strings.Join(transform.Command, " "), err, msg)
+		}
+		return fmt.Errorf("`%s` failed: %v", strings.Join(transform.Command, " "), err)
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	a.logger.Debug("Transformed %s from %d to %d bytes", artifact.Path, artifact.FileSize, counter.n)
+
+	artifact.AbsolutePath = out.Name()
+	artifact.FileSize = counter.n
+	artifact.Sha1Sum = fmt.Sprintf("%x", hash.Sum(nil))
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
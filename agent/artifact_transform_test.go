@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArtifactTransform(t *testing.T) {
+	transform, err := ParseArtifactTransform(`text/CSS=csso --comments "none"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "text/css", transform.ContentType)
+	assert.Equal(t, []string{"csso", "--comments", "none"}, transform.Command)
+
+	for _, invalid := range []string{"", "text/css", "=csso", "text/css="} {
+		if _, err := ParseArtifactTransform(invalid); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestArtifactTransformMatches(t *testing.T) {
+	css := ArtifactTransform{ContentType: "text/css"}
+	assert.True(t, css.Matches("text/css"))
+	assert.True(t, css.Matches("text/css; charset=utf-8"))
+	assert.False(t, css.Matches("text/html"))
+
+	text := ArtifactTransform{ContentType: "text/*"}
+	assert.True(t, text.Matches("text/css"))
+	assert.True(t, text.Matches("text/html"))
+	assert.False(t, text.Matches("application/json"))
+}
+
+func TestApplyTransforms(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Transform commands in this test need a unix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Transforms: []ArtifactTransform{
+			{ContentType: "text/plain", Command: []string{"tr", "a-z", "A-Z"}},
+			{ContentType: "text/css", Command: []string{"sh", "-c", "echo broken >&2; exit 1"}},
+		},
+	})
+
+	llamas := &api.Artifact{Path: "llamas.txt", AbsolutePath: write("llamas.txt", "llamas"), FileSize: 6, ContentType: "text/plain"}
+	alpacas := &api.Artifact{Path: "alpacas.css", AbsolutePath: write("alpacas.css", "alpacas"), FileSize: 7, ContentType: "text/css"}
+	camels := &api.Artifact{Path: "camels.json", AbsolutePath: write("camels.json", "{}"), FileSize: 2, ContentType: "application/json"}
+
+	artifacts, errs := uploader.applyTransforms([]*api.Artifact{llamas, alpacas, camels}, dir)
+
+	assert.Equal(t, []*api.Artifact{llamas, camels}, artifacts)
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "broken")
+	}
+
+	content, err := ioutil.ReadFile(llamas.AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "LLAMAS", string(content))
+	assert.Equal(t, int64(6), llamas.FileSize)
+	assert.Equal(t, fmt.Sprintf("%x", sha1.Sum(content)), llamas.Sha1Sum)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), llamas.Sha256Sum)
+	assert.Equal(t, "text/plain", llamas.ContentType)
+	assert.Equal(t, "llamas.txt", llamas.Path)
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// The build attributes a pipeline is triggered with when there's no payload
+// template. The artifacts are passed as JSON in both the environment and the
+// meta-data.
+const defaultTriggerPayload = `{
+  "message": "Artifacts uploaded by job {{ .JobID }}",
+  "env": {
+    "UPLOADED_ARTIFACTS": {{ json .ArtifactsJSON }},
+    "UPLOADED_ARTIFACTS_JOB_ID": {{ json .JobID }}
+  },
+  "meta_data": {
+    "uploaded-artifacts": {{ json .ArtifactsJSON }}
+  }
+}`
+
+// PipelineTriggerError is returned when the artifacts were uploaded, but the
+// pipeline couldn't be triggered with them
+type PipelineTriggerError struct {
+	Pipeline string
+	Err      error
+}
+
+func (e *PipelineTriggerError) Error() string {
+	return fmt.Sprintf("Error triggering pipeline %q: %v", e.Pipeline, e.Err)
+}
+
+type triggerArtifact struct {
+	Path    string `json:"path"`
+	URL     string `json:"url,omitempty"`
+	Sha1Sum string `json:"sha1sum"`
+	Size    int64  `json:"size"`
+}
+
+// triggerData is what the payload template is rendered with
+type triggerData struct {
+	JobID     string
+	Pipeline  string
+	Artifacts []triggerArtifact
+
+	// The artifacts as a JSON array, for passing as a single value
+	ArtifactsJSON string
+}
+
+// parseTriggerPayload parses the payload template at path, or the default
+// template if path is empty
+func parseTriggerPayload(templatePath string) (*template.Template, error) {
+	text := defaultTriggerPayload
+	if templatePath != "" {
+		data, err := ioutil.ReadFile(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	return template.New("trigger").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+// triggerStep renders the payload template for the uploaded artifacts, and
+// returns a pipeline with a trigger step that creates a build with it
+func (a *ArtifactUploader) triggerStep(tmpl *template.Template, artifacts []*api.Artifact) (map[string]interface{}, error) {
+	data := triggerData{
+		JobID:     a.conf.JobID,
+		Pipeline:  a.conf.TriggerPipeline,
+		Artifacts: []triggerArtifact{},
+	}
+	for _, artifact := range artifacts {
+		data.Artifacts = append(data.Artifacts, triggerArtifact{
+			Path:    artifact.Path,
+			URL:     artifact.URL,
+			Sha1Sum: artifact.Sha1Sum,
+			Size:    artifact.FileSize,
+		})
+	}
+	sort.Slice(data.Artifacts, func(i, j int) bool {
+		return data.Artifacts[i].Path < data.Artifacts[j].Path
+	})
+
+	artifactsJSON, err := json.Marshal(data.Artifacts)
+	if err != nil {
+		return nil, err
+	}
+	data.ArtifactsJSON = string(artifactsJSON)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("Error rendering the payload (%v)", err)
+	}
+
+	var build map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &build); err != nil {
+		return nil, fmt.Errorf("The payload isn't a JSON object (%v)", err)
+	}
+
+	return map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{
+				"label":   fmt.Sprintf("Trigger %s", a.conf.TriggerPipeline),
+				"trigger": a.conf.TriggerPipeline,
+				"build":   build,
+			},
+		},
+	}, nil
+}
+
+// triggerPipeline adds a step to the build that triggers a build of the
+// configured pipeline with the artifacts that were just uploaded
+func (a *ArtifactUploader) triggerPipeline(tmpl *template.Template) error {
+	pipeline, err := a.triggerStep(tmpl, a.uploaded)
+	if err != nil {
+		return &PipelineTriggerError{Pipeline: a.conf.TriggerPipeline, Err: err}
+	}
+
+	a.logger.Info("Triggering pipeline %q with %d artifacts", a.conf.TriggerPipeline, len(a.uploaded))
+
+	// The UUID is the same for each attempt, so the step is only added once
+	uuid := api.NewUUID()
+
+	err = retry.Do(func(s *retry.Stats) error {
+		_, err := a.apiClient.UploadPipeline(a.conf.JobID, &api.Pipeline{UUID: uuid, Pipeline: pipeline})
+		if err != nil {
+			a.logger.Warn("%s (%s)", err, s)
+
+			// The pipeline won't be accepted however many times it's tried
+			if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode == 422 {
+				s.Break()
+			}
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		return &PipelineTriggerError{Pipeline: a.conf.TriggerPipeline, Err: err}
+	}
+
+	return nil
+}
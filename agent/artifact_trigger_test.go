@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggerStepWithDefaultPayload(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{JobID: "job-1", TriggerPipeline: "deploy"})
+
+	tmpl, err := parseTriggerPayload("")
+	require.NoError(t, err)
+
+	pipeline, err := uploader.triggerStep(tmpl, []*api.Artifact{
+		{Path: "pkg/b.tar.gz", URL: "https://example.com/b", Sha1Sum: "bbb", FileSize: 2},
+		{Path: "pkg/a.tar.gz", Sha1Sum: "aaa", FileSize: 1},
+	})
+	require.NoError(t, err)
+
+	step := pipeline["steps"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "deploy", step["trigger"])
+
+	build := step["build"].(map[string]interface{})
+	assert.Equal(t, "Artifacts uploaded by job job-1", build["message"])
+
+	env := build["env"].(map[string]interface{})
+	assert.Equal(t, "job-1", env["UPLOADED_ARTIFACTS_JOB_ID"])
+	assert.JSONEq(t, `[
+		{"path": "pkg/a.tar.gz", "sha1sum": "aaa", "size": 1},
+		{"path": "pkg/b.tar.gz", "url": "https://example.com/b", "sha1sum": "bbb", "size": 2}
+	]`, env["UPLOADED_ARTIFACTS"].(string))
+
+	metaData := build["meta_data"].(map[string]interface{})
+	assert.Equal(t, env["UPLOADED_ARTIFACTS"], metaData["uploaded-artifacts"])
+}
+
+func TestTriggerStepWithPayloadTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-trigger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	payload := filepath.Join(dir, "payload.json")
+	require.NoError(t, ioutil.WriteFile(payload, []byte(`{
+		"message": {{ json (printf "Deploy %d artifacts" (len .Artifacts)) }},
+		"env": {"PACKAGE_URL": {{ json (index .Artifacts 0).URL }}}
+	}`), 0600))
+
+	tmpl, err := parseTriggerPayload(payload)
+	require.NoError(t, err)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{TriggerPipeline: "deploy"})
+	pipeline, err := uploader.triggerStep(tmpl, []*api.Artifact{{Path: "pkg.tar.gz", URL: "https://example.com/pkg"}})
+	require.NoError(t, err)
+
+	build := pipeline["steps"].([]interface{})[0].(map[string]interface{})["build"]
+	assert.Equal(t, map[string]interface{}{
+		"message": "Deploy 1 artifacts",
+		"env":     map[string]interface{}{"PACKAGE_URL": "https://example.com/pkg"},
+	}, build)
+}
+
+func TestTriggerPipelineFailureIsDistinct(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		rw.Write([]byte(`{"message":"pipeline not found"}`))
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	uploader := NewArtifactUploader(logger.Discard, client, ArtifactUploaderConfig{JobID: "job-1", TriggerPipeline: "deploy"})
+	uploader.uploaded = []*api.Artifact{{Path: "pkg.tar.gz"}}
+
+	tmpl, err := parseTriggerPayload("")
+	require.NoError(t, err)
+
+	err = uploader.triggerPipeline(tmpl)
+	triggerErr, ok := err.(*PipelineTriggerError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, "deploy", triggerErr.Pipeline)
+}
+
+func TestTriggerPipelineUploadsTriggerStep(t *testing.T) {
+	var uploaded api.Pipeline
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/jobs/job-1/pipelines", req.URL.Path)
+		if err := json.NewDecoder(req.Body).Decode(&uploaded); err != nil {
+			t.Error(err)
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	uploader := NewArtifactUploader(logger.Discard, client, ArtifactUploaderConfig{JobID: "job-1", TriggerPipeline: "deploy"})
+	uploader.uploaded = []*api.Artifact{{Path: "pkg.tar.gz"}}
+
+	tmpl, err := parseTriggerPayload("")
+	require.NoError(t, err)
+	require.NoError(t, uploader.triggerPipeline(tmpl))
+
+	assert.NotEmpty(t, uploaded.UUID)
+	steps := uploaded.Pipeline.(map[string]interface{})["steps"].([]interface{})
+	require.Len(t, steps, 1)
+	assert.Equal(t, "deploy", steps[0].(map[string]interface{})["trigger"])
+}
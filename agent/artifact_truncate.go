@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// The metadata keys that record the size and SHA-1 of a file that was
+	// truncated before it was uploaded
+	ArtifactTruncatedSizeMetadataKey = "buildkite-truncated-from-size"
+	ArtifactTruncatedSha1MetadataKey = "buildkite-truncated-from-sha1sum"
+)
+
+// truncatedPath annotates the path of a truncated artifact by adding the
+// part that was kept before its extension, e.g. build.log becomes
+// build.tail.log, so the extension and Content-Type stay the same
+func truncatedPath(p string, head, tail int64) string {
+	label := "head"
+	switch {
+	case head > 0 && tail > 0:
+		label = "head-and-tail"
+	case tail > 0:
+		label = "tail"
+	}
+
+	ext := path.Ext(path.Base(p))
+	if ext == path.Base(p) {
+		ext = ""
+	}
+	return strings.TrimSuffix(p, ext) + "." + label + ext
+}
+
+// truncationStagingSize returns how much space the truncated copies of the
+// artifacts take up
+func truncationStagingSize(artifacts []*api.Artifact, head, tail int64) (total int64) {
+	for _, artifact := range artifacts {
+		if artifact.FileSize > head+tail {
+			total += head + tail
+		}
+	}
+	return total
+}
+
+// truncateArtifacts replaces each artifact larger than head+tail bytes with a
+// copy of only its first head and last tail bytes, written into dir. The
+// files themselves are never modified.
+func (a *ArtifactUploader) truncateArtifacts(artifacts []*api.Artifact, head, tail int64, dir string) error {
+	for _, artifact := range artifacts {
+		if artifact.FileSize <= head+tail {
+			continue
+		}
+
+		if err := a.truncate(artifact, head, tail, dir); err != nil {
+			return fmt.Errorf("Error truncating %s: %v", artifact.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// truncate points the artifact at a copy of its head and tail, with the
+// annotated path and its new size and checksum. When both are kept, a line
+// between them says how much was left out.
+func (a *ArtifactUploader) truncate(artifact *api.Artifact, head, tail int64, dir string) error {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(dir, "truncated-")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha1.New()
+	sha256Hash := sha256.New()
+	counter := &countingWriter{}
+	w := io.MultiWriter(out, hash, sha256Hash, counter)
+
+	if head > 0 {
+		if _, err := io.Copy(w, io.NewSectionReader(in, 0, head)); err != nil {
+			return err
+		}
+	}
+	if head > 0 && tail > 0 {
+		if _, err := fmt.Fprintf(w, "\n[... %d bytes truncated by buildkite-agent ...]\n", artifact.FileSize-head-tail); err != nil {
+			return err
+		}
+	}
+	if tail > 0 {
+		if _, err := io.Copy(w, io.NewSectionReader(in, artifact.FileSize-tail, tail)); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	truncated := truncatedPath(artifact.Path, head, tail)
+	a.logger.Info("Uploading %s as %s, truncated from %s to %s",
+		artifact.Path, truncated, formatByteSize(artifact.FileSize), formatByteSize(counter.n))
+
+	if artifact.Metadata == nil {
+		artifact.Metadata = map[string]string{}
+	}
+	artifact.Metadata[ArtifactTruncatedSizeMetadataKey] = strconv.FormatInt(artifact.FileSize, 10)
+	artifact.Metadata[ArtifactTruncatedSha1MetadataKey] = artifact.Sha1Sum
+
+	artifact.Path = truncated
+	artifact.AbsolutePath = out.Name()
+	artifact.FileSize = counter.n
+	artifact.Sha1Sum = fmt.Sprintf("%x", hash.Sum(nil))
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+
+	return nil
+}
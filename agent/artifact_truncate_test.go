@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncatedPath(t *testing.T) {
+	assert.Equal(t, "logs/build.head.log", truncatedPath("logs/build.log", 10, 0))
+	assert.Equal(t, "logs/build.tail.log", truncatedPath("logs/build.log", 0, 10))
+	assert.Equal(t, "logs/build.head-and-tail.log", truncatedPath("logs/build.log", 10, 10))
+	assert.Equal(t, "logs.d/output.tail", truncatedPath("logs.d/output", 0, 10))
+	assert.Equal(t, "logs/.env.tail", truncatedPath("logs/.env", 0, 10))
+}
+
+func TestTruncateArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-truncate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	big := filepath.Join(dir, "build.log")
+	require.NoError(t, ioutil.WriteFile(big, []byte("first line\nmiddle\nlast line\n"), 0600))
+	small := filepath.Join(dir, "small.log")
+	require.NoError(t, ioutil.WriteFile(small, []byte("small\n"), 0600))
+
+	for _, tc := range []struct {
+		head, tail int64
+		path       string
+		content    string
+	}{
+		{head: 11, path: "logs/build.head.log", content: "first line\n"},
+		{tail: 10, path: "logs/build.tail.log", content: "last line\n"},
+		{head: 11, tail: 10, path: "logs/build.head-and-tail.log", content: "first line\n\n[... 7 bytes truncated by buildkite-agent ...]\nlast line\n"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			staging, err := ioutil.TempDir(dir, "staging-")
+			require.NoError(t, err)
+
+			uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+			bigArtifact, err := uploader.build("logs/build.log", big, "logs/*")
+			require.NoError(t, err)
+			smallArtifact, err := uploader.build("logs/small.log", small, "logs/*")
+			require.NoError(t, err)
+			originalSha1 := bigArtifact.Sha1Sum
+
+			require.NoError(t, uploader.truncateArtifacts([]*api.Artifact{bigArtifact, smallArtifact}, tc.head, tc.tail, staging))
+
+			assert.Equal(t, tc.path, bigArtifact.Path)
+			assert.Equal(t, int64(len(tc.content)), bigArtifact.FileSize)
+			assert.Equal(t, fmt.Sprintf("%x", sha1.Sum([]byte(tc.content))), bigArtifact.Sha1Sum)
+			assert.Equal(t, "28", bigArtifact.Metadata[ArtifactTruncatedSizeMetadataKey])
+			assert.Equal(t, originalSha1, bigArtifact.Metadata[ArtifactTruncatedSha1MetadataKey])
+
+			data, err := ioutil.ReadFile(bigArtifact.AbsolutePath)
+			require.NoError(t, err)
+			assert.Equal(t, tc.content, string(data))
+
+			// Files that are small enough are uploaded as they are
+			assert.Equal(t, "logs/small.log", smallArtifact.Path)
+			assert.Equal(t, small, smallArtifact.AbsolutePath)
+		})
+	}
+
+	// The file itself is left alone
+	data, err := ioutil.ReadFile(big)
+	require.NoError(t, err)
+	assert.Equal(t, "first line\nmiddle\nlast line\n", string(data))
+}
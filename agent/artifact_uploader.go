@@ -2,14 +2,21 @@ package agent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
@@ -39,11 +46,383 @@ type ArtifactUploaderConfig struct {
 	// A specific Content-Type to use for all artifacts
 	ContentType string
 
+	// Content-Types to use for artifacts by their extension, as parsed by
+	// ParseContentTypeMap, over ContentType and the detected Content-Type
+	ContentTypeMap map[string]string
+
+	// Whether to use the Content-Type declared in an artifact's companion
+	// .meta.json file instead of detecting it
+	DeclaredContentType bool
+
+	// Whether to detect Content-Types only by the mime package, without the
+	// built-in corrections for commonly misdetected extensions
+	NoBuiltinOverrides bool
+
+	// Whether to add the charset of text files to their detected
+	// Content-Type, when it can be told from their content
+	DetectCharset bool
+
 	// Whether to show HTTP debugging
 	DebugHTTP bool
 
+	// Whether to leave credentials, such as Authorization headers and the
+	// signatures of presigned URLs, in the HTTP debugging rather than
+	// redacting them
+	DebugHTTPUnsafe bool
+
 	// Whether to follow symbolic links when resolving globs
 	FollowSymlinks bool
+
+	// Whether to fail the upload if none of the paths match any files,
+	// rather than only warning about it
+	FailOnEmpty bool
+
+	// Whether the paths and Exclude patterns match files whatever their
+	// case. The files are uploaded with the case they have on disk.
+	IgnoreCase bool
+
+	// Glob patterns of files that shouldn't be uploaded, relative to the
+	// working directory like the paths being uploaded
+	Exclude []string
+
+	// A .gitignore style file of patterns for files that shouldn't be uploaded
+	IgnoreFile string
+
+	// Whether to use the .buildkiteignore in the working directory (or
+	// BaseDir) as the IgnoreFile, if there is one and IgnoreFile isn't set
+	UseIgnoreFile bool
+
+	// If set, files larger than this many bytes are skipped, or fail the
+	// upload, depending on MaxFileSizeAction
+	MaxFileSize       int64
+	MaxFileSizeAction MaxFileSizeAction
+
+	// Mark uploaded objects so they can be removed after this long
+	ExpireAfter time.Duration
+
+	// A file to durably record completed uploads in
+	JournalPath string
+
+	// Whether to skip artifacts that the journal records as uploaded
+	Resume bool
+
+	// The percentage of Reed-Solomon parity to upload alongside each artifact
+	Parity int
+
+	// If set, artifacts larger than this many bytes are uploaded as parts of
+	// at most this size, along with a part list
+	SplitSize int64
+
+	// Whether to upload only the data of sparse files, along with a list of
+	// where it goes
+	Sparse bool
+
+	// Where to stage files generated during the upload, defaults to the
+	// system's temporary directory
+	TempDir string
+
+	// Whether to write an S3 Inventory of the uploaded objects to the bucket
+	InventoryManifest bool
+
+	// Whether to refuse S3 ACLs that grant public access
+	DenyPublicACL bool
+
+	// If set, the form uploader sends files in chunks of this many bytes
+	UploadChunkSize int64
+
+	// The header to send each chunk's checksum in
+	ChunkChecksumHeader string
+
+	// Whether to wait for each artifact to be retrievable from the store
+	// before marking it as finished
+	WaitDurable         bool
+	DurablePollInterval time.Duration
+	DurableTimeout      time.Duration
+
+	// Whether to check each uploaded artifact against the checksum the store
+	// has for it, failing the artifact's upload if they don't match
+	Verify bool
+
+	// Other destinations that each artifact is also uploaded to, once it's
+	// been uploaded to Destination. Artifacts are created on Buildkite with
+	// Destination, which can be Buildkite's artifact storage, but these
+	// can't be.
+	ExtraDestinations []string
+
+	// Whether to skip uploading artifacts that are already at the
+	// destination with the same size and checksum, such as when a job is
+	// retried. They're still marked as uploaded.
+	SkipExisting bool
+
+	// If set, artifacts larger than Head+Tail bytes are uploaded as only
+	// their first Head and last Tail bytes
+	Head int64
+	Tail int64
+
+	// Commands to pipe artifacts through before uploading, by Content-Type
+	Transforms []ArtifactTransform
+
+	// If set, the destination and storage credentials are read from Vault
+	Vault *VaultClient
+
+	// What to do with artifacts that have the same path as another artifact
+	OnCollision CollisionPolicy
+
+	// What to do with artifacts that already exist at the destination
+	IfExists CollisionPolicy
+
+	// If set, sent as a header with every upload request and included in
+	// the logs, so uploads can be traced across systems
+	CorrelationID string
+
+	// If set, artifacts are encrypted before they're uploaded
+	Encryptor *ArtifactEncryptor
+
+	// If set, asks Buildkite to keep artifacts uploaded to its artifact
+	// storage for this long, rather than the default retention
+	Retention time.Duration
+
+	// Whether to compute a Merkle root over all the uploaded artifacts
+	SetDigest bool
+
+	// If set, the set digest is also saved to this build meta-data key
+	SetDigestMetaDataKey string
+
+	// Other prefixes in the S3 bucket to also upload artifacts to
+	AlsoPrefixes []string
+
+	// Explicit grants to put on objects uploaded to s3:// destinations
+	// instead of a canned ACL, in the form permission=type=grantee
+	S3Grants []string
+
+	// The server-side encryption for objects uploaded to s3:// destinations,
+	// either AES256 or aws:kms, and the KMS key to use for aws:kms
+	S3ServerSideEncryption string
+	S3KMSKeyID             string
+
+	// If set, objects uploaded to s3:// destinations in parts always use
+	// parts of exactly this size, so the same content has the same ETag
+	S3PartSize int64
+
+	// If set, the storage class for objects uploaded to s3:// destinations,
+	// such as STANDARD_IA or GLACIER_IR
+	S3StorageClass string
+
+	// If set, the region the s3:// destination's bucket is in, instead of
+	// the one in BUILDKITE_S3_DEFAULT_REGION
+	S3Region string
+
+	// If set, s3:// destinations are uploaded to this S3-compatible endpoint
+	// (such as MinIO) instead of AWS, with path-style addressing if
+	// S3ForcePathStyle is set
+	S3Endpoint       string
+	S3ForcePathStyle bool
+
+	// If set, the IAM role to assume for s3:// destinations, such as to
+	// upload to a bucket in another account, with an optional session name
+	// and external ID
+	S3AssumeRoleARN         string
+	S3AssumeRoleSessionName string
+	S3ExternalID            string
+
+	// If set, the Cache-Control header of objects uploaded to s3:// and
+	// gs:// destinations
+	S3CacheControl string
+	GSCacheControl string
+
+	// If set, a template of the Content-Disposition header of objects
+	// uploaded to s3:// and gs:// destinations, with {{basename}} expanded
+	// to each artifact's file name
+	ContentDisposition string
+
+	// Metadata to put on every object uploaded to s3:// and gs://
+	// destinations
+	UploadMetadata map[string]string
+
+	// Tags to put on every object uploaded to s3:// destinations
+	S3Tags map[string]string
+
+	// If set, the service account key file to upload to gs:// destinations
+	// with, and a service account to impersonate with the credentials
+	GSCredentialsFile string
+	GSImpersonate     string
+
+	// Whether to try deploying artifacts to rt:// destinations by their
+	// checksums, without uploading their files if Artifactory already has them
+	RTChecksumDeploy bool
+
+	// Whether to run fewer uploads at once while the system load per CPU is
+	// over LoadThreshold, with at most LoadMaxConcurrency at once
+	LoadAware          bool
+	LoadThreshold      float64
+	LoadMaxConcurrency int
+
+	// Whether to upload an index.html linking to the uploaded artifacts, and
+	// a html/template file to render it with instead of the default
+	Gallery         bool
+	GalleryTemplate string
+
+	// Whether to print a link to each uploaded artifact in the job's output,
+	// as Buildkite inline links when run by Buildkite, or as plain text
+	EmitLinks bool
+
+	// Whether to upload an in-toto provenance attestation with each artifact
+	Provenance bool
+
+	// Whether to compress artifacts with Gzip, uploading them with .gz added
+	// to their paths and a Content-Encoding of gzip
+	Gzip bool
+
+	// If set, the matched files are uploaded as a single .zip, .tar.gz or
+	// .tgz archive with this name, holding them at their artifact paths
+	ArchiveName string
+
+	// Whether to record the commit each artifact was built from in the
+	// manifests and provenance, along with the source paths it was built from
+	// if it matches a SourceMap pattern, as pattern=path[,path...]
+	SourceLink bool
+	SourceMap  []string
+
+	// If set, a manifest of the uploaded artifacts is signed and uploaded
+	// along with its signature
+	ManifestSigner *ArtifactManifestSigner
+
+	// Whether to upload a manifest with a presigned URL for each artifact,
+	// valid for ManifestURLExpiry, for s3:// and gs:// destinations
+	ManifestWithURLs  bool
+	ManifestURLExpiry time.Duration
+
+	// If set, a presigned URL to download each artifact uploaded to an s3://
+	// destination is made, valid for this long, and logged and added to the
+	// manifest at ManifestPath
+	PresignExpiry time.Duration
+
+	// If set, the ID of a build to compare the artifacts being uploaded with,
+	// and a file (or - for stdout) to also write the difference to as JSON
+	DiffAgainst string
+	DiffJSON    string
+
+	// If set, limits how fast artifacts are uploaded, either as a rate or a
+	// schedule of rates for times of day, e.g. business=09:00-17:00=5MB,50MB
+	BandwidthLimit string
+
+	// Whether to only upload when the job's command failed, or only when
+	// it succeeded
+	OnlyOnFailure bool
+	OnlyOnSuccess bool
+
+	// The groups artifacts are shown in by the Buildkite UI, as
+	// pattern=group, or just a group for artifacts matching no pattern
+	Groups []string
+
+	// If set, the most upload requests to make per second, across all the
+	// artifacts being uploaded at once
+	UploadMaxQPS int
+
+	// A leading path to remove from the paths of artifacts. It's relative to
+	// the working directory (or BaseDir), unless it's absolute. Every
+	// artifact must be under it.
+	StripPrefix string
+
+	// If set, the directory relative paths and Exclude patterns are resolved
+	// against instead of the working directory, and that artifact paths are
+	// relative to
+	BaseDir string
+
+	// If set, a text/template that the paths of artifacts are rendered with,
+	// using fields from the job's environment
+	KeyTemplate string
+
+	// How user IDs in the container that wrote the artifacts map to user IDs
+	// on the host, to explain who owns files the agent can't read
+	UIDRemap []UIDMapping
+
+	// Local addresses to make upload connections from in turn, to spread
+	// them across network interfaces
+	SourceIPs []net.IP
+
+	// If set, upload requests are sent through this caching proxy
+	CacheProxy *url.URL
+
+	// If set, upload connections are made through this SOCKS5 proxy, with
+	// the username and password in the URL if it has them
+	SOCKS5Proxy *url.URL
+
+	// If set, upload connections are made through this HTTP or SOCKS5
+	// proxy, instead of the one from the environment, if any
+	UploadProxy *url.URL
+
+	// Whether to place a legal hold on uploaded objects, for s3:// and gs://
+	// destinations
+	LegalHold bool
+
+	// Whether to fail the upload of artifacts that already exist at s3://
+	// and gs:// destinations, rather than overwrite them
+	NoOverwrite bool
+
+	// Whether to create placeholders for the empty directories that match
+	// the paths, at destinations that can
+	IncludeEmptyDirs bool
+
+	// Whether to upload files as content defined chunks that are only
+	// uploaded once per destination, along with a chunk list per file
+	CDC bool
+
+	// Whether to read upcoming artifacts into memory while others upload,
+	// holding at most PrefetchSize bytes at a time
+	Prefetch     bool
+	PrefetchSize int64
+
+	// Whether to start uploading files as soon as they're found, rather than
+	// after every path has been searched
+	Stream bool
+
+	// If set, decides how an upload that failed with the error should be
+	// tried again, if at all, instead of DefaultRetryClassifier
+	RetryClassifier func(error) RetryClass
+
+	// Whether to record how long each artifact spent being resolved, read
+	// and transferred, for the log and the manifest
+	TimingDetail bool
+
+	// If set, how far through each artifact being uploaded is, is logged
+	// this often, along with a summary once they've all been uploaded
+	ProgressInterval time.Duration
+
+	// How many artifacts are uploaded at once, or one per CPU if it's 0
+	Concurrency int
+
+	// If set, once the artifacts are uploaded a step is added to the build
+	// that triggers a build of this pipeline with them
+	TriggerPipeline string
+
+	// A Go text/template file rendering the build attributes the pipeline is
+	// triggered with as JSON, instead of the default
+	TriggerPayload string
+
+	// Whether to only print what would be uploaded where, without creating
+	// or uploading any artifacts
+	DryRun bool
+
+	// If set, a JSON manifest of what happened to each artifact is written
+	// to this path once the uploads finish, whether or not they succeeded
+	ManifestPath string
+
+	// The percentage of artifacts that can fail to upload without the
+	// upload failing, 0 for any failure to fail it
+	FailThreshold float64
+
+	// How many times a failed upload is retried, 0 for never. Uploads that
+	// fail permanently, such as with a 403 or 404, aren't retried.
+	UploadMaxRetries int
+
+	// If set, failed uploads aren't retried once retrying would take longer
+	// than this since the first attempt
+	UploadRetryTimeout time.Duration
+
+	// If set, an attempt at uploading a file is aborted once it's taken
+	// longer than this, and fails like any other upload
+	UploadTimeout time.Duration
 }
 
 type ArtifactUploader struct {
@@ -55,25 +434,388 @@ type ArtifactUploader struct {
 
 	// The APIClient that will be used when uploading jobs
 	apiClient APIClient
+
+	// The journal of completed uploads, if one is being kept
+	journal *artifactJournal
+
+	// The Merkle root of the uploaded artifacts, if SetDigest is set
+	setDigest string
+
+	// Where copies of files that could only be read as their owner are kept
+	ownedDir string
+
+	// Limits the rate of upload requests, if UploadMaxQPS is set
+	limiter *rateLimiter
+
+	// The artifacts that were uploaded successfully
+	uploaded []*api.Artifact
+
+	// Used for upload requests if SourceIPs is set, shared by all the
+	// uploads so connections are reused
+	transport http.RoundTripper
+
+	// Reads upcoming artifacts into memory, if Prefetch is set
+	prefetcher *artifactPrefetcher
+
+	// Assigns artifacts to groups, if Groups is set
+	groups *artifactGroups
+
+	// The paths artifacts are being uploaded to, for resolving collisions
+	usedPaths map[string]bool
+
+	// Makes the URLs in the manifest, if ManifestWithURLs is set
+	presigner PresigningUploader
+
+	// Makes download URLs for the uploaded artifacts, if PresignExpiry is set
+	downloadPresigner PresigningUploader
+
+	// Where the time went for each artifact, if TimingDetail is set
+	timings *artifactTimings
+
+	// Logs the progress of the uploads, if ProgressInterval is set
+	progress *artifactProgress
+
+	// Records each upload for the manifest, if ManifestPath is set
+	localManifest *localManifest
+
+	// Links artifacts back to their source, if SourceLink is set
+	sourceLinks *artifactSourceLinks
+
+	// Renders each artifact's Content-Disposition, if ContentDisposition is
+	// set
+	contentDisposition *contentDispositionTemplate
+
+	// The artifacts that failed to upload, to any destination
+	failures artifactFailures
+
+	// The paths of the empty directories that matched, if IncludeEmptyDirs
+	// is set
+	emptyDirs []string
+
+	// How many times failed uploads have been retried, updated atomically
+	retries int64
+
+	// How many artifacts weren't uploaded as they were unchanged at the
+	// destination, updated atomically
+	unchanged int64
 }
 
 func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig) *ArtifactUploader {
-	return &ArtifactUploader{
+	if c.CorrelationID != "" {
+		l = l.WithFields(logger.StringField("correlation_id", c.CorrelationID))
+	}
+
+	a := &ArtifactUploader{
 		logger:    l,
 		apiClient: ac,
 		conf:      c,
 	}
+	if c.UploadMaxQPS > 0 {
+		a.limiter = newRateLimiter(c.UploadMaxQPS)
+	}
+	if c.TimingDetail {
+		a.timings = newArtifactTimings()
+	}
+	if c.ProgressInterval > 0 {
+		a.progress = newArtifactProgress(l, c.ProgressInterval)
+	}
+	if c.ManifestPath != "" {
+		a.localManifest = newLocalManifest(c.Destination)
+	}
+	a.transport = newSourceIPTransport(c.SourceIPs)
+	if c.CacheProxy != nil {
+		a.transport = withCacheProxy(a.transport, c.CacheProxy)
+	}
+
+	return a
 }
 
 func (a *ArtifactUploader) Upload() error {
+	if a.skipForOutcome() {
+		return nil
+	}
+
+	if a.conf.Destination == "" && a.conf.Vault != nil {
+		destination, err := a.conf.Vault.Get(VaultDestinationKey)
+		if err != nil {
+			return err
+		}
+		if destination != "" {
+			a.logger.Debug("Using the upload destination from Vault")
+			a.conf.Destination = destination
+		}
+	}
+
+	// Parse the groups, bandwidth limit and gallery template first, so
+	// broken ones fail the upload before anything is uploaded
+	groups, err := parseArtifactGroups(a.conf.Groups)
+	if err != nil {
+		return err
+	}
+	a.groups = groups
+
+	if a.conf.ContentDisposition != "" {
+		a.contentDisposition, err = parseContentDispositionTemplate(a.conf.ContentDisposition)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.Gzip {
+		if err := checkGzipDestination(a.conf.Destination); err != nil {
+			return err
+		}
+	}
+
+	if a.conf.ArchiveName != "" {
+		if _, err := archiveFormat(a.conf.ArchiveName); err != nil {
+			return err
+		}
+		if a.conf.Stream {
+			return errors.New("Artifacts can't be archived while streaming, as every file has to be found first")
+		}
+	}
+
+	if a.conf.SourceLink {
+		a.sourceLinks, err = parseArtifactSourceLinks(a.conf.SourceMap)
+		if err != nil {
+			return err
+		}
+		if a.localManifest != nil {
+			a.localManifest.sourceLinks = a.sourceLinks
+		}
+	}
+
+	if a.conf.SOCKS5Proxy != nil {
+		a.transport, err = withSOCKS5Proxy(a.transport, a.conf.SOCKS5Proxy)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.UploadProxy != nil {
+		a.transport, err = withUploadProxy(a.transport, a.conf.UploadProxy)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.BandwidthLimit != "" {
+		schedule, err := parseBandwidthLimit(a.conf.BandwidthLimit)
+		if err != nil {
+			return err
+		}
+		a.transport = &bandwidthLimitedTransport{
+			base:    a.transport,
+			limiter: newBandwidthLimiter(a.logger, schedule),
+		}
+	}
+
+	var galleryTemplate *template.Template
+	if a.conf.Gallery {
+		galleryTemplate, err = parseGalleryTemplate(a.conf.GalleryTemplate)
+		if err != nil {
+			return fmt.Errorf("Error parsing the gallery template (%v)", err)
+		}
+	}
+
+	var triggerPayload *texttemplate.Template
+	if a.conf.TriggerPipeline != "" {
+		triggerPayload, err = parseTriggerPayload(a.conf.TriggerPayload)
+		if err != nil {
+			return fmt.Errorf("Error parsing the trigger payload template (%v)", err)
+		}
+	}
+
+	if a.conf.Stream && !a.conf.DryRun {
+		return a.uploadStream(galleryTemplate, triggerPayload)
+	}
+
 	// Create artifact structs for all the files we need to upload
 	artifacts, err := a.Collect()
+	if a.ownedDir != "" {
+		defer os.RemoveAll(a.ownedDir)
+	}
 	if err != nil {
 		return err
 	}
 
+	if a.conf.DryRun {
+		return a.dryRun(artifacts)
+	}
+
+	if len(artifacts) == 0 {
+		return a.noFilesMatched()
+	}
+
+	// Truncate before anything else, so transforms and encryption only
+	// have to deal with what's kept
+	if a.conf.Head > 0 || a.conf.Tail > 0 {
+		dir, err := a.stagingDir("truncate", truncationStagingSize(artifacts, a.conf.Head, a.conf.Tail))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := a.truncateArtifacts(artifacts, a.conf.Head, a.conf.Tail, dir); err != nil {
+			return err
+		}
+	}
+
+	// Archive before the files are transformed, so the archive is
+	// transformed, compressed or encrypted as a whole
+	if a.conf.ArchiveName != "" {
+		dir, err := a.stagingDir("archive", archiveStagingSize(artifacts))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		archive, err := a.archiveArtifacts(artifacts, dir)
+		if err != nil {
+			return fmt.Errorf("Error archiving artifacts into %s (%v)", a.conf.ArchiveName, err)
+		}
+		artifacts = []*api.Artifact{archive}
+	}
+
+	// Artifacts that fail to transform or encrypt aren't uploaded, but don't
+	// stop the others from being uploaded
+	var prepareErrs []error
+	if len(a.conf.Transforms) > 0 {
+		dir, err := a.stagingDir("transform", a.transformStagingSize(artifacts))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		artifacts, errs = a.applyTransforms(artifacts, dir)
+		prepareErrs = append(prepareErrs, errs...)
+	}
+
+	if a.conf.Gzip {
+		dir, err := a.stagingDir("gzip", gzipStagingSize(artifacts))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		artifacts, errs = a.gzipArtifacts(artifacts, dir)
+		prepareErrs = append(prepareErrs, errs...)
+	}
+
+	if a.conf.Encryptor != nil {
+		dir, err := a.stagingDir("encrypt", encryptionStagingSize(artifacts))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		artifacts, errs = a.encryptArtifacts(artifacts, dir)
+		prepareErrs = append(prepareErrs, errs...)
+	}
+
+	if a.conf.Sparse {
+		dir, err := a.stagingDir("sparse", sparseStagingSize(artifacts))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		artifacts, err = a.packSparseArtifacts(artifacts, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.Provenance {
+		dir, err := a.stagingDir("provenance", 0)
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		artifacts, err = a.withProvenance(artifacts, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.SplitSize > 0 {
+		dir, err := a.stagingDir("split", splitStagingSize(artifacts, a.conf.SplitSize))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		artifacts, err = a.splitArtifacts(artifacts, a.conf.SplitSize, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.conf.Parity > 0 {
+		dir, err := a.stagingDir("parity", parityStagingSize(artifacts, a.conf.Parity))
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		artifacts, err = a.withParity(artifacts, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The whole set is compared, including any that are skipped as already
+	// uploaded when resuming
+	if a.conf.DiffAgainst != "" {
+		if err := a.reportDiff(artifacts); err != nil {
+			return err
+		}
+	}
+
+	if a.conf.JournalPath != "" {
+		a.journal, err = openArtifactJournal(a.conf.JournalPath, a.conf.Resume)
+		if err != nil {
+			return err
+		}
+		defer a.journal.Close()
+
+		if a.conf.Resume {
+			artifacts = a.skipJournaled(artifacts)
+		}
+	}
+
+	// Render every Content-Disposition now, so an invalid one fails the
+	// upload before any of the artifacts are uploaded
+	if err := a.setContentDispositions(artifacts); err != nil {
+		return err
+	}
+
+	// Every file could have been uploaded already, or failed to prepare
 	if len(artifacts) == 0 {
-		a.logger.Info("No files matched paths: %s", a.conf.Paths)
+		a.logger.Info("No files left to upload")
 	} else {
 		a.logger.Info("Found %d files that match \"%s\"", len(artifacts), a.conf.Paths)
 
@@ -81,11 +823,101 @@ func (a *ArtifactUploader) Upload() error {
 		if err != nil {
 			return err
 		}
+
+		if a.conf.Gallery {
+			if err := a.uploadGallery(galleryTemplate); err != nil {
+				return err
+			}
+		}
+
+		if a.conf.ManifestSigner != nil || a.conf.ManifestWithURLs {
+			if err := a.uploadManifest(); err != nil {
+				return err
+			}
+		}
+
+		if a.conf.EmitLinks {
+			if err := a.emitLinks(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(prepareErrs) > 0 {
+		return fmt.Errorf("There were errors with preparing %d of the artifacts for upload", len(prepareErrs))
+	}
+
+	if a.conf.TriggerPipeline != "" && len(artifacts) > 0 {
+		if err := a.triggerPipeline(triggerPayload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// noFilesMatched warns that none of the paths matched any files, which is
+// usually a mistake in the paths, or returns an error if FailOnEmpty is set
+func (a *ArtifactUploader) noFilesMatched() error {
+	if a.conf.FailOnEmpty {
+		return fmt.Errorf("No files matched paths: %s", a.conf.Paths)
+	}
+
+	a.logger.Warn("No files matched paths: %s, so there's nothing to upload", a.conf.Paths)
+	return nil
+}
+
+// checkArtifactSizes returns an error if any of the artifacts are larger than
+// the upload destination can store
+func (a *ArtifactUploader) checkArtifactSizes(artifacts []*api.Artifact, max int64) error {
+	store := a.conf.Destination
+	if store == "" {
+		store = "Buildkite artifact storage"
+	}
+
+	oversized := 0
+	for _, artifact := range artifacts {
+		if artifact.FileSize > max {
+			a.logger.Error("%s is %s, which is larger than the most %s can store in one artifact (%s)",
+				artifact.Path, formatByteSize(artifact.FileSize), store, formatByteSize(max))
+			oversized++
+		}
+	}
+
+	if oversized > 0 {
+		return fmt.Errorf("%d artifacts are too large to upload to %s, which can store at most %s per artifact", oversized, store, formatByteSize(max))
 	}
 
 	return nil
 }
 
+// skipJournaled removes artifacts that a previous run recorded as uploaded
+func (a *ArtifactUploader) skipJournaled(artifacts []*api.Artifact) []*api.Artifact {
+	remaining := []*api.Artifact{}
+
+	for _, artifact := range artifacts {
+		if a.journal.Completed(a.conf.Destination, artifact) {
+			a.logger.Debug("Skipping %s, which the journal records as already uploaded", artifact.Path)
+			continue
+		}
+		remaining = append(remaining, artifact)
+	}
+
+	if skipped := len(artifacts) - len(remaining); skipped > 0 {
+		a.logger.Info("Resuming upload, skipping %d artifacts already uploaded according to %s", skipped, a.conf.JournalPath)
+	}
+
+	return remaining
+}
+
+// concurrency returns how many uploads the pool runs at once
+func (a *ArtifactUploader) concurrency() int {
+	if a.conf.Concurrency > 0 {
+		return a.conf.Concurrency
+	}
+	return pool.MaxConcurrencyLimit
+}
+
 func isDir(path string) bool {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -95,55 +927,192 @@ func isDir(path string) bool {
 }
 
 func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
-	wd, err := os.Getwd()
+	err = a.collect(globAll(zglob.Glob), func(artifact *api.Artifact) error {
+		artifacts = append(artifacts, artifact)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return artifacts, nil
+}
+
+// A globFunc calls match with each file that matches pattern, stopping at the
+// first error. It returns os.ErrNotExist if a pattern without globs in it
+// doesn't exist.
+type globFunc func(pattern string, match func(file string) error) error
+
+// globAll turns a glob that resolves every match up front into a globFunc
+func globAll(glob func(string) ([]string, error)) globFunc {
+	return func(pattern string, match func(string) error) error {
+		files, err := glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if err := match(file); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// collect resolves the paths to upload with glob, and calls found with each
+// of the artifacts as it's built
+func (a *ArtifactUploader) collect(glob globFunc, found func(*api.Artifact) error) error {
+	wd, err := a.baseDir()
+	if err != nil {
+		return err
+	}
+
 	// file paths are deduplicated after resolving globs etc
 	seenPaths := make(map[string]bool)
 
-	for _, globPath := range strings.Split(a.conf.Paths, ArtifactPathDelimiter) {
-		globPath = strings.TrimSpace(globPath)
-		if globPath == "" {
-			continue
+	// The files skipped for being over MaxFileSize
+	var oversized []string
+	defer func() {
+		if len(oversized) > 0 {
+			a.logger.Warn("Skipped %d files over the maximum file size of %s: %s",
+				len(oversized), formatByteSize(a.conf.MaxFileSize), strings.Join(oversized, ", "))
+		}
+	}()
+
+	var keys *keyTemplate
+	if a.conf.KeyTemplate != "" {
+		keys, err = parseKeyTemplate(a.conf.KeyTemplate, a.conf.JobID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ignore *ignoreRules
+	ignoreFile := a.ignoreFilePath(wd)
+	if ignoreFile != "" {
+		ignore, err = loadIgnoreFile(ignoreFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var excludes *artifactExcludes
+	if len(a.conf.Exclude) > 0 {
+		excludes, err = newArtifactExcludes(a.conf.Exclude, wd, a.conf.IgnoreCase)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Declared metadata files are read along with their data files, rather
+	// than uploaded themselves
+	var sidecars *sidecarFilter
+	if a.conf.DeclaredContentType {
+		paths, err := newArtifactExcludes(strings.Split(a.conf.Paths, ArtifactPathDelimiter), wd, a.conf.IgnoreCase)
+		if err != nil {
+			return err
 		}
+		sidecars = &sidecarFilter{paths: paths, excludes: excludes, ignore: ignore}
+	}
 
+	// Brace alternations are expanded into patterns of their own up front,
+	// as zglob only knows about *
+	for _, globPath := range a.uploadPatterns() {
 		a.logger.Debug("Searching for %s", globPath)
 
 		// Resolve the globs (with * and ** in them), if it's a non-globbed path and doesn't exists
 		// then we will get the ErrNotExist that is handled below
-		globfunc := zglob.Glob
-		if a.conf.FollowSymlinks {
-			// Follow symbolic links for files & directories while expanding globs
-			globfunc = zglob.GlobFollowSymlinks
+		globfunc := glob
+		if a.conf.FollowSymlinks || a.conf.IgnoreCase {
+			// Follow symbolic links for files & directories while expanding
+			// globs. zglob follows links that loop back to a directory
+			// it's already in until the path gets too long, and only
+			// matches the case of the pattern, so walk the tree ourselves.
+			globfunc = walkGlob(a.logger, a.conf.FollowSymlinks, a.conf.IgnoreCase, nil)
 		}
-		files, err := globfunc(globPath)
-		if err == os.ErrNotExist {
-			a.logger.Info("File not found: %s", globPath)
-			continue
-		} else if err != nil {
-			return nil, err
+
+		// Walk the tree without going into excluded directories, rather than
+		// only filtering them out of the matches
+		if excludes != nil {
+			globfunc = walkGlob(a.logger, a.conf.FollowSymlinks, a.conf.IgnoreCase, func(dir string) bool {
+				absoluteDir, err := filepath.Abs(dir)
+				if err != nil {
+					return false
+				}
+				if pattern, ok := excludes.ExcludedDir(absoluteDir); ok {
+					a.logger.Debug("Skipping directory %s, which matches the exclude pattern %s", dir, pattern)
+					return true
+				}
+				return false
+			})
+		}
+
+		// Relative patterns are resolved against the base directory, rather
+		// than the process's working directory
+		pattern := globPath
+		if a.conf.BaseDir != "" && !filepath.IsAbs(globPath) {
+			pattern = filepath.Join(wd, globPath)
+		}
+
+		// Files are resolved from when the previous file was found
+		var resolveStart time.Time
+		if a.timings != nil {
+			resolveStart = time.Now()
 		}
 
 		// Process each glob match into an api.Artifact
-		for _, file := range files {
+		err := globfunc(pattern, func(file string) error {
 			absolutePath, err := filepath.Abs(file)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			// dedupe based on resolved absolutePath
 			if _, ok := seenPaths[absolutePath]; ok {
 				a.logger.Debug("Skipping duplicate path %s", file)
-				continue
+				return nil
 			}
 			seenPaths[absolutePath] = true
 
-			// Ignore directories, we only want files
+			// Ignore directories, we only want files, unless they're
+			// empty and their placeholders are wanted
+			emptyDir := false
 			if isDir(absolutePath) {
-				a.logger.Debug("Skipping directory %s", file)
-				continue
+				if !a.conf.IncludeEmptyDirs || !isEmptyDir(absolutePath) {
+					a.logger.Debug("Skipping directory %s", file)
+					return nil
+				}
+				emptyDir = true
+			}
+
+			if excludes != nil {
+				if pattern, ok := excludes.Excluded(absolutePath); ok {
+					a.logger.Debug("Skipping %s, which matches the exclude pattern %s", file, pattern)
+					return nil
+				}
+			}
+
+			if ignore != nil && ignore.Ignored(absolutePath) {
+				a.logger.Debug("Skipping %s, which matches %s", file, ignoreFile)
+				return nil
+			}
+
+			if sidecars != nil && sidecars.companion(absolutePath) {
+				a.logger.Debug("Skipping %s, which declares the metadata of %s", file, strings.TrimSuffix(file, ArtifactSidecarSuffix))
+				return nil
+			}
+
+			if !emptyDir {
+				skip, err := a.overMaxFileSize(file, absolutePath)
+				if err != nil {
+					return err
+				}
+				if skip {
+					oversized = append(oversized, file)
+					return nil
+				}
 			}
 
 			// If a glob is absolute, we need to make it relative to the root so that
@@ -151,17 +1120,33 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 			// This is possibly weird and crazy, this logic dates back to
 			// https://github.com/buildkite/agent/commit/8ae46d975aa60d1ae0e2cc0bff7a43d3bf960935
 			// from 2014, so I'm replicating it here to avoid breaking things
+			relativeTo := wd
 			if filepath.IsAbs(globPath) {
 				if runtime.GOOS == "windows" {
-					wd = filepath.VolumeName(absolutePath) + "/"
+					relativeTo = filepath.VolumeName(absolutePath) + "/"
 				} else {
-					wd = "/"
+					relativeTo = "/"
 				}
 			}
 
-			path, err := filepath.Rel(wd, absolutePath)
+			path, err := filepath.Rel(relativeTo, absolutePath)
 			if err != nil {
-				return nil, err
+				return err
+			}
+
+			if a.conf.StripPrefix != "" {
+				// An absolute prefix is stripped from the absolute path,
+				// whatever the glob was relative to
+				stripFrom := path
+				if filepath.IsAbs(a.conf.StripPrefix) {
+					stripFrom = absolutePath
+				}
+
+				stripped, ok := stripPathPrefix(stripFrom, a.conf.StripPrefix)
+				if !ok {
+					return fmt.Errorf("%s isn't under the prefix to strip %q", file, a.conf.StripPrefix)
+				}
+				path = stripped
 			}
 
 			if experiments.IsEnabled(`normalised-upload-paths`) {
@@ -169,138 +1154,529 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 				path = filepath.ToSlash(path)
 			}
 
+			if keys != nil {
+				path, err = keys.render(path)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Empty directories aren't artifacts, their placeholders
+			// are created along with the uploads
+			if emptyDir {
+				a.logger.Debug("Found empty directory %s", file)
+				a.emptyDirs = append(a.emptyDirs, filepath.ToSlash(path))
+				return nil
+			}
+
+			var resolved time.Duration
+			if a.timings != nil {
+				resolved = time.Since(resolveStart)
+			}
+
 			// Build an artifact object using the paths we have.
 			artifact, err := a.build(path, absolutePath, globPath)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
-			artifacts = append(artifacts, artifact)
+			if a.timings != nil {
+				a.timings.get(artifact).resolve = resolved
+				defer func() { resolveStart = time.Now() }()
+			}
+
+			return found(artifact)
+		})
+		if err == os.ErrNotExist {
+			a.logger.Info("File not found: %s", globPath)
+			continue
+		} else if err != nil {
+			return err
 		}
 	}
 
-	return artifacts, nil
+	return nil
+}
+
+// baseDir returns the absolute directory relative paths are resolved against,
+// which is BaseDir if it's set, or else the working directory
+func (a *ArtifactUploader) baseDir() (string, error) {
+	if a.conf.BaseDir == "" {
+		return os.Getwd()
+	}
+
+	dir, err := filepath.Abs(a.conf.BaseDir)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("The base directory %q doesn't exist", a.conf.BaseDir)
+	} else if err != nil {
+		return "", fmt.Errorf("Couldn't use the base directory %q (%v)", a.conf.BaseDir, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("The base directory %q isn't a directory", a.conf.BaseDir)
+	}
+
+	return dir, nil
+}
+
+// stripPathPrefix removes the leading path segments in prefix from path,
+// returning false if path isn't under prefix
+func stripPathPrefix(path string, prefix string) (string, bool) {
+	prefix = filepath.Clean(filepath.FromSlash(prefix))
+	if prefix == "." {
+		return path, true
+	}
+
+	// Only the root ends in a separator once cleaned
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+
+	if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+		return path[len(prefix):], true
+	}
+
+	return path, false
 }
 
 func (a *ArtifactUploader) build(path string, absolutePath string, globPath string) (*api.Artifact, error) {
 	// Temporarily open the file to get its size
-	file, err := os.Open(absolutePath)
+	file, asOwner, err := a.openArtifact(absolutePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	// The uploaders can't read files that were opened as their owner, so
+	// they're uploaded from a copy
+	uploadPath := absolutePath
+	if asOwner {
+		copied, err := a.copyOwnedArtifact(absolutePath, file)
+		if err != nil {
+			return nil, err
+		}
+		defer copied.Close()
+
+		file = copied
+		uploadPath = copied.Name()
+	}
+
 	// Grab its file info (which includes its file size)
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate a sha1 checksum for the file
+	// Generate sha1 and sha256 checksums for the file in one read
+	var readStart time.Time
+	if a.timings != nil {
+		readStart = time.Now()
+	}
 	hash := sha1.New()
-	io.Copy(hash, file)
+	hash256 := sha256.New()
+	io.Copy(io.MultiWriter(hash, hash256), file)
 	checksum := fmt.Sprintf("%x", hash.Sum(nil))
+	checksum256 := fmt.Sprintf("%x", hash256.Sum(nil))
+	read := time.Since(readStart)
+
+	// Determine the Content-Type to send, from the map by extension, then
+	// the one given for every artifact, then the declared one, and otherwise
+	// the detected one
+	contentType, mapped := mappedContentType(a.conf.ContentTypeMap, absolutePath)
+	if mapped {
+		a.logger.Debug("Using mapped Content-Type %q for %s", contentType, path)
+	} else {
+		contentType = a.conf.ContentType
+	}
 
-	// Determine the Content-Type to send
-	contentType := a.conf.ContentType
+	if contentType == "" && a.conf.DeclaredContentType {
+		sidecar, err := readArtifactSidecar(absolutePath)
+		if err != nil {
+			return nil, err
+		}
+		if sidecar != nil && sidecar.ContentType != "" {
+			a.logger.Debug("Using declared Content-Type %q for %s", sidecar.ContentType, path)
+			contentType = sidecar.ContentType
+		}
+	}
 
 	if contentType == "" {
 		extension := filepath.Ext(absolutePath)
-		contentType = mime.TypeByExtension(extension)
+		if builtin, ok := builtinContentType(extension); ok && !a.conf.NoBuiltinOverrides {
+			contentType = builtin
+		} else {
+			contentType = mime.TypeByExtension(extension)
+		}
 
 		if contentType == "" {
 			contentType = ArtifactFallbackMimeType
 		}
+
+		if a.conf.DetectCharset {
+			contentType = withDetectedCharset(contentType, file)
+		}
 	}
 
 	// Create our new artifact data structure
 	artifact := &api.Artifact{
 		Path:         path,
-		AbsolutePath: absolutePath,
+		AbsolutePath: uploadPath,
 		GlobPath:     globPath,
 		FileSize:     fileInfo.Size(),
 		Sha1Sum:      checksum,
+		Sha256Sum:    checksum256,
 		ContentType:  contentType,
 	}
 
+	if a.timings != nil {
+		a.timings.get(artifact).addRead(read)
+	}
+
 	return artifact, nil
 }
 
 func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
+	batches := make(chan []*api.Artifact, 1)
+	batches <- artifacts
+	close(batches)
+
+	return a.uploadBatches(batches)
+}
+
+// newDestinationUploader creates the uploader for an s3://, gs://, rt:// (or
+// other registered) destination
+func (a *ArtifactUploader) newDestinationUploader(destination string) (Uploader, error) {
+	factory, ok := uploaderFactoryFor(destination)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only %s upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", destination, strings.Join(registeredUploaderSchemes(), ", ")))
+	}
+
+	uploader, err := factory(a.logger, UploaderConfig{
+		Destination:   destination,
+		DebugHTTP:     a.conf.DebugHTTP,
+		ExpireAfter:   a.conf.ExpireAfter,
+		DenyPublicACL: a.conf.DenyPublicACL,
+		Vault:         a.conf.Vault,
+		CorrelationID: a.conf.CorrelationID,
+		AlsoPrefixes:  a.conf.AlsoPrefixes,
+		S3Grants:      a.conf.S3Grants,
+		Transport:     a.transport,
+		LegalHold:     a.conf.LegalHold,
+		NoOverwrite:   a.conf.NoOverwrite,
+		Open:          a.openForUpload,
+
+		S3ServerSideEncryption: a.conf.S3ServerSideEncryption,
+		S3KMSKeyID:             a.conf.S3KMSKeyID,
+		S3PartSize:             a.conf.S3PartSize,
+		S3StorageClass:         a.conf.S3StorageClass,
+		S3Endpoint:             a.conf.S3Endpoint,
+		S3ForcePathStyle:       a.conf.S3ForcePathStyle,
+		S3CacheControl:         a.conf.S3CacheControl,
+		GSCacheControl:         a.conf.GSCacheControl,
+		Metadata:               a.conf.UploadMetadata,
+		S3Tags:                 a.conf.S3Tags,
+
+		S3AssumeRoleARN:         a.conf.S3AssumeRoleARN,
+		S3AssumeRoleSessionName: a.conf.S3AssumeRoleSessionName,
+		S3ExternalID:            a.conf.S3ExternalID,
+
+		S3Region: a.conf.S3Region,
+
+		GSCredentialsFile: a.conf.GSCredentialsFile,
+		GSImpersonate:     a.conf.GSImpersonate,
+
+		RTChecksumDeploy: a.conf.RTChecksumDeploy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating uploader: %v", err)
+	}
+	return uploader, nil
+}
+
+// uploadBatches uploads the artifacts in each batch as it's received, until
+// batches is closed. The artifacts are created on Buildkite a batch at a
+// time, so the first can be uploading while later ones are still being found.
+func (a *ArtifactUploader) uploadBatches(batches <-chan []*api.Artifact) error {
+	start := time.Now()
+
 	var uploader Uploader
-	var err error
 
 	// Determine what uploader to use
 	if a.conf.Destination != "" {
-		if strings.HasPrefix(a.conf.Destination, "s3://") {
-			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "gs://") {
-			uploader, err = NewGSUploader(a.logger, GSUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "rt://") {
-			uploader, err = NewArtifactoryUploader(a.logger, ArtifactoryUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else {
-			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
+		var err error
+		uploader, err = a.newDestinationUploader(a.conf.Destination)
+		if err != nil {
+			return err
+		}
+
+		if a.conf.UploadChunkSize > 0 {
+			a.logger.Warn("Chunked uploads are only supported by the form uploader, ignoring the upload chunk size")
 		}
 
-		a.logger.Info("Uploading to %q, using your agent configuration", a.conf.Destination)
+		a.eventLogger(eventUploadStarted, logger.StringField("destination", a.conf.Destination)).
+			Info("Uploading to %q, using your agent configuration", a.conf.Destination)
 	} else {
+		if a.conf.ExpireAfter > 0 {
+			a.logger.Warn("Buildkite artifact storage doesn't support expiring artifacts, ignoring the artifact expiry")
+		}
+
 		uploader = NewFormUploader(a.logger, FormUploaderConfig{
-			DebugHTTP: a.conf.DebugHTTP,
+			DebugHTTP:           a.conf.DebugHTTP,
+			DebugHTTPUnsafe:     a.conf.DebugHTTPUnsafe,
+			ChunkSize:           a.conf.UploadChunkSize,
+			ChunkChecksumHeader: a.conf.ChunkChecksumHeader,
+			CorrelationID:       a.conf.CorrelationID,
+			Transport:           a.transport,
+			Open:                a.openForUpload,
 		})
 
-		a.logger.Info("Uploading to default Buildkite artifact storage")
+		a.eventLogger(eventUploadStarted, logger.StringField("destination", "")).
+			Info("Uploading to default Buildkite artifact storage")
 	}
 
-	// Check if creation caused an error
+	// Each artifact is fanned out to the other destinations once it's been
+	// uploaded to the first
+	extras, err := a.newExtraDestinations()
 	if err != nil {
-		return fmt.Errorf("Error creating uploader: %v", err)
+		return err
 	}
 
-	// Set the URLs of the artifacts based on the uploader
-	for _, artifact := range artifacts {
-		artifact.URL = uploader.URL(artifact)
+	if a.conf.Encryptor != nil {
+		switch uploader.(type) {
+		case *S3Uploader, *GSUploader:
+		default:
+			a.logger.Warn("The upload destination can't store metadata, so the checksums of artifacts before they were encrypted won't be recorded")
+		}
 	}
 
-	// Create the artifacts on Buildkite
-	batchCreator := NewArtifactBatchCreator(a.logger, a.apiClient, ArtifactBatchCreatorConfig{
-		JobID:             a.conf.JobID,
-		Artifacts:         artifacts,
-		UploadDestination: a.conf.Destination,
-	})
+	if _, ok := uploader.(ContextUploader); !ok && a.conf.UploadTimeout > 0 {
+		a.logger.Warn("The upload destination can't abort uploads part way through, so uploads to it won't time out")
+	}
 
-	artifacts, err = batchCreator.Create()
+	s3Uploader, isS3 := uploader.(*S3Uploader)
+	if a.conf.InventoryManifest && !isS3 {
+		return errors.New("An inventory manifest can only be written for s3:// upload destinations")
+	}
+	if a.conf.LegalHold {
+		switch uploader.(type) {
+		case *S3Uploader, *GSUploader:
+		default:
+			return errors.New("Legal holds can only be placed on artifacts uploaded to s3:// and gs:// destinations")
+		}
+	}
+	if a.conf.ContentDisposition != "" {
+		switch uploader.(type) {
+		case *S3Uploader, *GSUploader:
+		default:
+			return errors.New("A Content-Disposition can only be set for s3:// and gs:// upload destinations")
+		}
+	}
+	if err := a.checkNoOverwrite(uploader); err != nil {
+		return err
+	}
+	if len(a.conf.AlsoPrefixes) > 0 && !isS3 {
+		return errors.New("Artifacts can only be uploaded to other prefixes for s3:// upload destinations")
+	}
+	if len(a.conf.S3Grants) > 0 && !isS3 {
+		return errors.New("S3 grants can only be given for s3:// upload destinations")
+	}
+	if (a.conf.S3ServerSideEncryption != "" || a.conf.S3KMSKeyID != "") && !isS3 {
+		return errors.New("S3 server-side encryption can only be used for s3:// upload destinations")
+	}
+	if a.conf.S3PartSize > 0 && !isS3 {
+		return errors.New("Deterministic ETags can only be used for s3:// upload destinations")
+	}
+	if a.conf.S3StorageClass != "" && !isS3 {
+		return errors.New("An S3 storage class can only be set for s3:// upload destinations")
+	}
+	if (a.conf.S3Endpoint != "" || a.conf.S3ForcePathStyle) && !isS3 {
+		return errors.New("An S3 endpoint can only be set for s3:// upload destinations")
+	}
+	if a.conf.S3Region != "" && !isS3 {
+		return errors.New("An S3 region can only be set for s3:// upload destinations")
+	}
+	if a.conf.ManifestWithURLs {
+		presigner, ok := uploader.(PresigningUploader)
+		if !ok {
+			return errors.New("Presigned URLs can only be put in the manifest for s3:// and gs:// upload destinations")
+		}
+		if a.conf.ManifestURLExpiry <= 0 {
+			return errors.New("Presigned URLs need an expiry")
+		}
+		if max := presigner.MaxPresignedExpiry(); a.conf.ManifestURLExpiry > max {
+			return fmt.Errorf("Presigned URLs can be valid for at most %s, not %s", max, a.conf.ManifestURLExpiry)
+		}
+		a.presigner = presigner
+	}
+	a.downloadPresigner, err = a.checkPresignExpiry(uploader)
 	if err != nil {
 		return err
 	}
 
+	// Credentials that expire part way through are read again, for the
+	// stores that support it
+	refresher := newCredentialRefresher(a.logger, uploader)
+
+	durable, isDurable := uploader.(DurableUploader)
+	if isDurable && a.limiter != nil {
+		durable = rateLimitedStore{store: durable, limiter: a.limiter}
+	}
+	if a.conf.WaitDurable && !isDurable {
+		a.logger.Debug("The upload destination is strongly consistent, not waiting for artifacts to be retrievable")
+	}
+
+	var store DurableUploader
+	if isDurable {
+		store = durable
+	} else if a.conf.IfExists != "" && a.conf.IfExists != CollisionOverwrite {
+		a.logger.Warn("The upload destination can't be checked for existing artifacts, ignoring the if exists policy")
+	}
+
+	if a.conf.CDC && !isDurable {
+		return errors.New("Content defined chunking needs an upload destination that can be checked for existing chunks, such as s3:// or rt://")
+	}
+
+	verifier, canVerify := uploader.(VerifyingUploader)
+	if a.conf.Verify && !canVerify {
+		return errors.New("Verifying uploads needs an upload destination that has checksums of uploaded objects, such as s3://, gs:// or rt://")
+	}
+
+	comparer, canCompare := uploader.(UnchangedUploader)
+	if a.conf.SkipExisting && !canCompare {
+		a.logger.Warn("The upload destination can't be checked for unchanged artifacts, uploading every artifact")
+	}
+
+	var retentionDays int
+	if a.conf.Retention > 0 {
+		if a.conf.Destination == "" {
+			retentionDays = expiryDays(a.conf.Retention)
+		} else {
+			a.logger.Warn("A retention can only be requested for Buildkite artifact storage, ignoring it")
+		}
+	}
+
+	// The staging directories of the chunk lists, which are uploaded along
+	// with everything else
+	var stagingDirs []string
+	defer func() {
+		for _, dir := range stagingDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// create gets a batch of artifacts ready to upload and creates them on
+	// Buildkite
+	create := func(artifacts []*api.Artifact) ([]*api.Artifact, error) {
+		// Streamed artifacts are only known as they're created
+		if err := a.setContentDispositions(artifacts); err != nil {
+			return nil, err
+		}
+
+		// Chunks are much smaller than any limit, but otherwise check every
+		// artifact in the batch fits before uploading any of them
+		if limited, ok := uploader.(SizeLimitedUploader); ok && !a.conf.CDC {
+			if err := a.checkArtifactSizes(artifacts, limited.MaxArtifactSize()); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := a.resolveCollisions(artifacts, store); err != nil {
+			return nil, err
+		}
+
+		if a.conf.CDC {
+			dir, err := a.stagingDir("cdc", cdcStagingSize(artifacts))
+			if dir != "" {
+				stagingDirs = append(stagingDirs, dir)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			artifacts, err = a.uploadCDC(uploader, refresher, durable, artifacts, dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if a.groups != nil {
+			a.groups.assign(artifacts)
+		}
+
+		// Set the URLs of the artifacts based on the uploader
+		for _, artifact := range artifacts {
+			artifact.URL = uploader.URL(artifact)
+		}
+
+		// Create the artifacts on Buildkite
+		batchCreator := NewArtifactBatchCreator(a.logger, a.apiClient, ArtifactBatchCreatorConfig{
+			JobID:             a.conf.JobID,
+			Artifacts:         artifacts,
+			UploadDestination: a.conf.Destination,
+			RetentionDays:     retentionDays,
+		})
+
+		return batchCreator.Create()
+	}
+
+	defer func() {
+		if a.prefetcher != nil {
+			a.prefetcher.Stop()
+			a.prefetcher = nil
+		}
+	}()
+
 	// Prepare a concurrency pool to upload the artifacts
-	p := pool.New(pool.MaxConcurrencyLimit)
+	p := pool.New(a.concurrency())
+
+	var throttle *loadThrottle
+	if a.conf.LoadAware {
+		throttle = newLoadThrottle(a.logger, a.conf.LoadMaxConcurrency, a.conf.LoadThreshold)
+		throttle.Start()
+		defer throttle.Stop()
+	}
 	errors := []error{}
 	var errorsMutex sync.Mutex
 
+	// The artifacts that were uploaded successfully, and how many weren't
+	uploaded := []*api.Artifact{}
+	failed := 0
+	var uploadedMutex sync.Mutex
+
 	// Create a wait group so we can make sure the uploader waits for all
 	// the artifact states to upload before finishing
 	var stateUploaderWaitGroup sync.WaitGroup
 	stateUploaderWaitGroup.Add(1)
 
-	// A map to keep track of artifact states and how many we've uploaded
+	// A map to keep track of artifact states, how many we've uploaded and
+	// how many artifacts have been created so far
 	artifactStates := make(map[string]string)
 	artifactStatesUploaded := 0
+	artifactsCreated := 0
 	var artifactStatesMutex sync.Mutex
 
+	// Closed once every upload has finished, so no more states are coming
+	uploadsDone := make(chan struct{})
+
 	// Spin up a gourtine that'll uploading artifact statuses every few
 	// seconds in batches
 	go func() {
-		for artifactStatesUploaded < len(artifacts) {
+		defer stateUploaderWaitGroup.Done()
+
+		for {
+			// Check whether the uploads have finished before grabbing the
+			// states, so the last of them are always sent
+			finished := false
+			select {
+			case <-uploadsDone:
+				finished = true
+			default:
+			}
+
 			statesToUpload := make(map[string]string)
 
 			// Grab all the states we need to upload, and remove
@@ -314,6 +1690,7 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				statesToUpload[id] = state
 				delete(artifactStates, id)
 			}
+			created := artifactsCreated
 			artifactStatesMutex.Unlock()
 
 			if len(statesToUpload) > 0 {
@@ -323,8 +1700,8 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				}
 
 				// Update the states of the artifacts in bulk.
-				err = retry.Do(func(s *retry.Stats) error {
-					_, err = a.apiClient.UpdateArtifacts(a.conf.JobID, statesToUpload)
+				err := retry.Do(func(s *retry.Stats) error {
+					_, err := a.apiClient.UpdateArtifacts(a.conf.JobID, statesToUpload)
 					if err != nil {
 						a.logger.Warn("%s (%s)", err, s)
 					}
@@ -343,80 +1720,265 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 					errorsMutex.Unlock()
 				}
 
-				a.logger.Debug("Uploaded %d artifact states (%d/%d)", len(statesToUpload), artifactStatesUploaded, len(artifacts))
+				a.logger.Debug("Uploaded %d artifact states (%d/%d)", len(statesToUpload), artifactStatesUploaded, created)
+			}
+
+			if finished {
+				return
 			}
 
 			// Check again for states to upload in a few seconds
-			time.Sleep(1 * time.Second)
+			select {
+			case <-uploadsDone:
+			case <-time.After(1 * time.Second):
+			}
 		}
-
-		stateUploaderWaitGroup.Done()
 	}()
 
-	for _, artifact := range artifacts {
-		// Create new instance of the artifact for the goroutine
-		// See: http://golang.org/doc/effective_go.html#channels
-		artifact := artifact
-
-		p.Spawn(func() {
-			// Show a nice message that we're starting to upload the file
-			a.logger.Info("Uploading artifact %s %s (%d bytes)", artifact.ID, artifact.Path, artifact.FileSize)
-
-			// Upload the artifact and then set the state depending
-			// on whether or not it passed. We'll retry the upload
-			// a couple of times before giving up.
-			err = retry.Do(func(s *retry.Stats) error {
-				err := uploader.Upload(artifact)
-				if err != nil {
-					a.logger.Warn("%s (%s)", err, s)
+	// Stop at the first batch that can't be created, but still wait for
+	// the uploads from earlier batches
+	var batchErr error
+	a.progress.Start()
+	for batch := range batches {
+		artifacts, err := create(batch)
+		if err != nil {
+			batchErr = err
+			break
+		}
+
+		artifactStatesMutex.Lock()
+		artifactsCreated += len(artifacts)
+		artifactStatesMutex.Unlock()
+
+		if a.conf.Prefetch && a.prefetcher == nil {
+			a.prefetcher = newArtifactPrefetcher(a.logger, artifacts, a.conf.PrefetchSize)
+			a.prefetcher.Start()
+		}
+
+		for _, artifact := range artifacts {
+			// Create new instance of the artifact for the goroutine
+			// See: http://golang.org/doc/effective_go.html#channels
+			artifact := artifact
+
+			p.Spawn(func() {
+				throttle.Acquire()
+				defer throttle.Release()
+
+				uploadStart := time.Now()
+
+				// Artifacts already at the destination as they are
+				// don't need uploading again
+				var err error
+				unchanged := a.conf.SkipExisting && canCompare && a.isUnchanged(comparer, artifact)
+				if unchanged {
+					a.logger.Info("Skipping artifact %s %s (%d bytes), which is unchanged at the upload destination", artifact.ID, artifact.Path, artifact.FileSize)
+				} else {
+					// Show a nice message that we're starting to upload the file
+					a.logger.Info("Uploading artifact %s %s (%d bytes)", artifact.ID, artifact.Path, artifact.FileSize)
+
+					// Upload the artifact and then set the state depending
+					// on whether or not it passed. Failed uploads are
+					// retried as the retry policy says to before giving up.
+					timing := a.timings.get(artifact)
+					err = a.uploadWithRetries(uploader, refresher, artifact, func() error {
+						// The transfer is the attempt, less reading the file
+						var attemptStart time.Time
+						var readBefore time.Duration
+						if timing != nil {
+							attemptStart, readBefore = time.Now(), timing.readTime()
+						}
+						a.progress.begin(artifact)
+
+						err := a.attemptUpload(uploader, refresher, artifact)
+
+						if timing != nil {
+							if transfer := time.Since(attemptStart) - (timing.readTime() - readBefore); transfer > 0 {
+								timing.transfer += transfer
+							}
+						}
+
+						return err
+					})
+
+					// Some stores take a while before an upload can be read
+					if err == nil && a.conf.WaitDurable && isDurable {
+						err = a.waitDurable(durable, artifact)
+					}
+
+					// Catch artifacts corrupted on the way to the store
+					if err == nil && a.conf.Verify {
+						err = a.verify(verifier, artifact)
+					}
 				}
 
-				return err
-			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+				// Then fan it out to the other destinations, whether
+				// or not it made it to the first
+				if len(extras) > 0 {
+					if extrasErr := a.uploadToExtras(extras, artifact); extrasErr != nil {
+						errorsMutex.Lock()
+						errors = append(errors, extrasErr)
+						errorsMutex.Unlock()
+					}
+				}
 
-			var state string
+				a.progress.finish(artifact, err == nil && !unchanged)
 
-			// Did the upload eventually fail?
-			if err != nil {
-				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
-
-				// Track the error that was raised. We need to
-				// acquire a lock since we mutate the errors
-				// slice in multiple routines.
-				errorsMutex.Lock()
-				errors = append(errors, err)
-				errorsMutex.Unlock()
-
-				state = "error"
-			} else {
-				a.logger.Info("Successfully uploaded artifact \"%s\"", artifact.Path)
-				state = "finished"
-			}
+				var presignedURL string
+				if err == nil {
+					presignedURL = a.presignDownloadURL(artifact)
+				}
+				a.localManifest.record(artifact, presignedURL, time.Since(uploadStart), err)
 
-			// Since we mutate the artifactStates variable in
-			// multiple routines, we need to lock it to make sure
-			// nothing else is changing it at the same time.
-			artifactStatesMutex.Lock()
-			artifactStates[artifact.ID] = state
-			artifactStatesMutex.Unlock()
-		})
+				var state string
+
+				// Did the upload eventually fail?
+				if err != nil {
+					a.eventLogger(eventArtifactFailed, artifactEventFields(a.conf.Destination, artifact, time.Since(uploadStart), err)...).
+						Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
+
+					// Failed uploads are counted rather than
+					// tracked as errors, so they can be checked
+					// against the failure threshold
+					a.failures.record(a.conf.Destination, artifact, err)
+					uploadedMutex.Lock()
+					failed++
+					uploadedMutex.Unlock()
+
+					state = "error"
+				} else {
+					if !unchanged {
+						a.eventLogger(eventArtifactUploaded, artifactEventFields(a.conf.Destination, artifact, time.Since(uploadStart), nil)...).
+							Info("Successfully uploaded artifact \"%s\"", artifact.Path)
+						a.logTiming(artifact)
+					}
+					state = "finished"
+
+					uploadedMutex.Lock()
+					uploaded = append(uploaded, artifact)
+					uploadedMutex.Unlock()
+
+					if a.journal != nil {
+						if err := a.journal.Record(a.conf.Destination, artifact); err != nil {
+							a.logger.Error("%s", err)
+
+							errorsMutex.Lock()
+							errors = append(errors, err)
+							errorsMutex.Unlock()
+						}
+					}
+				}
+
+				// Since we mutate the artifactStates variable in
+				// multiple routines, we need to lock it to make sure
+				// nothing else is changing it at the same time.
+				artifactStatesMutex.Lock()
+				artifactStates[artifact.ID] = state
+				artifactStatesMutex.Unlock()
+			})
+		}
 	}
 
 	a.logger.Debug("Waiting for uploads to complete...")
 
 	// Wait for the pool to finish
 	p.Wait()
+	close(uploadsDone)
+	a.progress.Stop()
 
 	a.logger.Debug("Uploads complete, waiting for upload status to be sent to buildkite...")
 
 	// Wait for the statuses to finish uploading
 	stateUploaderWaitGroup.Wait()
 
+	// The manifest includes the uploads that failed, so it's written whether
+	// or not they all succeeded
+	if err := a.localManifest.write(a.conf.ManifestPath); err != nil {
+		a.logger.Error("%s", err)
+		errors = append(errors, err)
+	}
+
+	if batchErr != nil {
+		return batchErr
+	}
+
+	// Empty directories aren't artifacts, so their placeholders are created
+	// once the files have been uploaded
+	if err := a.uploadEmptyDirs(a.conf.Destination, uploader); err != nil {
+		errors = append(errors, err)
+	}
+	for _, extra := range extras {
+		if err := a.uploadEmptyDirs(extra.destination, extra.uploader); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if a.conf.InventoryManifest {
+		if err := s3Uploader.WriteInventory(); err != nil {
+			a.logger.Error("%s", err)
+			errors = append(errors, err)
+		}
+	}
+
+	if a.conf.SetDigest && len(errors) == 0 && failed == 0 {
+		if err := a.writeSetDigest(uploaded); err != nil {
+			a.logger.Error("%s", err)
+			errors = append(errors, err)
+		}
+	}
+
+	a.logDestinations(extras, len(uploaded), failed)
+
+	var uploadedBytes int64
+	for _, artifact := range uploaded {
+		uploadedBytes += artifact.FileSize
+	}
+	a.eventLogger(eventUploadFinished,
+		logger.StringField("destination", a.conf.Destination),
+		logger.IntField("uploaded", len(uploaded)),
+		logger.IntField("failed", failed),
+		logger.Int64Field("bytes", uploadedBytes),
+		logger.Int64Field("duration_ms", time.Since(start).Milliseconds()),
+	).Info("Uploaded %d artifacts (%s) in %s, %d failed", len(uploaded), formatByteSize(uploadedBytes), time.Since(start).Round(time.Millisecond), failed)
+
+	if retries := atomic.LoadInt64(&a.retries); retries > 0 {
+		a.logger.Info("Retried failed uploads %d times", retries)
+	}
+	if unchanged := atomic.LoadInt64(&a.unchanged); unchanged > 0 {
+		a.logger.Info("Skipped uploading %d artifacts that were unchanged at the upload destination", unchanged)
+	}
+
+	// Which artifacts failed, and why, are kept with the error, as their
+	// own errors are long gone from the logs by the time the upload ends
+	if err := a.checkFailThreshold(failed, len(uploaded)); err != nil {
+		return a.failures.wrap(err)
+	}
 	if len(errors) > 0 {
-		return fmt.Errorf("There were errors with uploading some of the artifacts")
+		return a.failures.wrap(fmt.Errorf("There were errors with uploading some of the artifacts"))
+	}
+
+	a.uploaded = uploaded
+
+	a.logTimingSummary(uploaded)
+	if failed == 0 {
+		a.logger.Info("Artifact uploads completed successfully")
+	}
+
+	return nil
+}
+
+// checkFailThreshold returns an error if a larger percentage of the artifacts
+// failed to upload than FailThreshold allows
+func (a *ArtifactUploader) checkFailThreshold(failed int, succeeded int) error {
+	if failed == 0 {
+		return nil
 	}
 
-	a.logger.Info("Artifact uploads completed successfully")
+	total := failed + succeeded
+	percent := float64(failed) * 100 / float64(total)
+	if percent > a.conf.FailThreshold {
+		return fmt.Errorf("%d of %d artifacts (%.3g%%) failed to upload, %d were uploaded successfully", failed, total, percent, succeeded)
+	}
 
+	a.logger.Warn("%d of %d artifacts (%.3g%%) failed to upload, which is within the failure threshold of %g%%", failed, total, percent, a.conf.FailThreshold)
 	return nil
 }
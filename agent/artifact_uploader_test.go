@@ -2,15 +2,20 @@ package agent
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/pool"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func findArtifact(artifacts []*api.Artifact, search string) *api.Artifact {
@@ -302,3 +307,540 @@ func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 		paths,
 	)
 }
+
+func TestCollectFollowingSymlinksSkipsLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-symlink-loops")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a and b link to each other, c links to a sibling, and loop links back
+	// to the top of the tree
+	for _, sub := range []string{"a", "b"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, sub, sub+".txt"), []byte(sub), 0644))
+	}
+	require.NoError(t, os.Symlink(filepath.Join(dir, "b"), filepath.Join(dir, "a", "to-b")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "b", "to-a")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "c")))
+	require.NoError(t, os.Symlink(dir, filepath.Join(dir, "b", "loop")))
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:          filepath.Join("**", "*.txt"),
+		FollowSymlinks: true,
+	})
+
+	type result struct {
+		artifacts []*api.Artifact
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		artifacts, err := uploader.Collect()
+		done <- result{artifacts, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Collecting artifacts didn't finish")
+	}
+	require.NoError(t, res.err)
+
+	paths := []string{}
+	for _, a := range res.artifacts {
+		paths = append(paths, filepath.ToSlash(a.Path))
+	}
+	assert.ElementsMatch(t, []string{
+		"a/a.txt",
+		"a/to-b/b.txt",
+		"b/b.txt",
+		"b/to-a/a.txt",
+		"c/a.txt",
+		"c/to-b/b.txt",
+	}, paths)
+}
+
+func TestCollectIgnoringCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-ignore-case")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Reports"), 0755))
+	for _, name := range []string{"Report.HTML", "summary.html", "Draft.Html", "Notes.TXT"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Reports", name), []byte(name), 0644))
+	}
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	for _, tc := range []struct {
+		paths      string
+		ignoreCase bool
+		exclude    []string
+		expected   []string
+	}{
+		{
+			paths:    "Reports/*.html",
+			expected: []string{"Reports/summary.html"},
+		},
+		{
+			paths:      "reports/*.html",
+			ignoreCase: true,
+			expected:   []string{"Reports/Draft.Html", "Reports/Report.HTML", "Reports/summary.html"},
+		},
+		{
+			paths:      "REPORTS/*.HTML",
+			ignoreCase: true,
+			exclude:    []string{"reports/draft.*"},
+			expected:   []string{"Reports/Report.HTML", "Reports/summary.html"},
+		},
+		{
+			paths:      "**/*.HTML",
+			ignoreCase: true,
+			exclude:    []string{"**/SUMMARY.HTML"},
+			expected:   []string{"Reports/Draft.Html", "Reports/Report.HTML"},
+		},
+		{
+			paths:      "reports/notes.txt",
+			ignoreCase: true,
+			expected:   []string{"Reports/Notes.TXT"},
+		},
+	} {
+		uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+			Paths:      tc.paths,
+			IgnoreCase: tc.ignoreCase,
+			Exclude:    tc.exclude,
+		})
+
+		artifacts, err := uploader.Collect()
+		require.NoError(t, err, tc.paths)
+
+		paths := []string{}
+		for _, a := range artifacts {
+			paths = append(paths, filepath.ToSlash(a.Path))
+		}
+		assert.ElementsMatch(t, tc.expected, paths, tc.paths)
+	}
+}
+
+func TestCollectWithMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-max-file-size")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, size := range map[string]int{"small.txt": 10, "exact.txt": 100, "core.dump": 101} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644))
+	}
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{
+		Paths:       "*",
+		MaxFileSize: 100,
+	})
+
+	artifacts, err := uploader.Collect()
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.ElementsMatch(t, []string{"small.txt", "exact.txt"}, paths)
+	assert.Equal(t, []string{
+		"[debug] Searching for *",
+		"[warn] Skipping core.dump, which is 101B and over the maximum file size of 100B",
+		"[warn] Skipped 1 files over the maximum file size of 100B: core.dump",
+	}, l.Messages)
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:             "*",
+		MaxFileSize:       100,
+		MaxFileSizeAction: MaxFileSizeFail,
+	})
+
+	_, err = uploader.Collect()
+	assert.EqualError(t, err, "core.dump is 101B, which is over the maximum file size of 100B")
+}
+
+func TestUploadWithNoMatchingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-no-matches")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	paths := "reports/*.xml;coverage.txt"
+
+	// By default, it's only a warning
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{Paths: paths})
+	require.NoError(t, uploader.Upload())
+	assert.Contains(t, l.Messages, "[warn] No files matched paths: reports/*.xml;coverage.txt, so there's nothing to upload")
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Paths: paths, FailOnEmpty: true})
+	assert.EqualError(t, uploader.Upload(), "No files matched paths: reports/*.xml;coverage.txt")
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Paths: paths, FailOnEmpty: true, DryRun: true})
+	assert.EqualError(t, uploader.Upload(), "No files matched paths: reports/*.xml;coverage.txt")
+}
+
+func TestNoFilesMatchedOnlyWhenEveryPathMatchesNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-some-matches")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "coverage.txt"), []byte("100%"), 0644))
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	l := logger.NewBuffer()
+	uploader := NewArtifactUploader(l, nil, ArtifactUploaderConfig{
+		Paths:       "reports/*.xml;coverage.txt",
+		FailOnEmpty: true,
+		DryRun:      true,
+	})
+
+	assert.NoError(t, uploader.Upload())
+	assert.Contains(t, l.Messages, `[info] Dry run, 1 files that match "reports/*.xml;coverage.txt" would be uploaded to Buildkite artifact storage`)
+}
+
+func TestBuildUsesDeclaredContentType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "declared-content-type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	declared := filepath.Join(dir, "report.bin")
+	undeclared := filepath.Join(dir, "other.html")
+	for _, f := range []string{declared, undeclared} {
+		if err := ioutil.WriteFile(f, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(declared+ArtifactSidecarSuffix, []byte(`{"content_type":"text/html"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		DeclaredContentType: true,
+	})
+
+	a, err := uploader.build("report.bin", declared, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/html", a.ContentType)
+
+	a, err = uploader.build("other.html", undeclared, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/html", a.ContentType)
+}
+
+func TestCollectSkipsDeclaredMetadataFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "declared-content-type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for f, content := range map[string]string{
+		"report.bin":                             "hello",
+		"report.bin" + ArtifactSidecarSuffix:     `{"content_type":"text/html"}`,
+		"excluded.bin":                           "hello",
+		"excluded.bin" + ArtifactSidecarSuffix:   `{"content_type":"text/html"}`,
+		"standalone.bin" + ArtifactSidecarSuffix: `{"content_type":"text/html"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:               filepath.Join(dir, "*"),
+		Exclude:             []string{filepath.Join(dir, "excluded.bin")},
+		DeclaredContentType: true,
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, artifact := range artifacts {
+		paths = append(paths, filepath.Base(artifact.Path))
+	}
+	sort.Strings(paths)
+
+	assert.Equal(t, []string{
+		"excluded.bin" + ArtifactSidecarSuffix,
+		"report.bin",
+		"standalone.bin" + ArtifactSidecarSuffix,
+	}, paths)
+}
+
+func TestCollectWithIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-ignore-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"keep.log", "skip.tmp", filepath.Join("cache", "blob")} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignoreFile := filepath.Join(dir, ".artifactignore")
+	if err := ioutil.WriteFile(ignoreFile, []byte("*.tmp\ncache/\n.artifactignore\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:      filepath.Join(dir, "**", "*"),
+		IgnoreFile: ignoreFile,
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Equal(t, 1, len(artifacts)) {
+		assert.Equal(t, "keep.log", filepath.Base(artifacts[0].Path))
+	}
+}
+
+func TestCollectWithBuildkiteIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-buildkiteignore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"keep.log", "skip.tmp", "important.tmp", "debug.log"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, f), []byte("hello"), 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, DefaultIgnoreFile), []byte("*.tmp\n!important.tmp\n.buildkiteignore\n"), 0644))
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	for _, tc := range []struct {
+		name     string
+		conf     ArtifactUploaderConfig
+		expected []string
+	}{
+		{
+			name:     "off by default",
+			conf:     ArtifactUploaderConfig{Paths: "*"},
+			expected: []string{".buildkiteignore", "debug.log", "important.tmp", "keep.log", "skip.tmp"},
+		},
+		{
+			name:     "used",
+			conf:     ArtifactUploaderConfig{Paths: "*", UseIgnoreFile: true},
+			expected: []string{"debug.log", "important.tmp", "keep.log"},
+		},
+		{
+			name:     "with excludes taking precedence",
+			conf:     ArtifactUploaderConfig{Paths: "*", UseIgnoreFile: true, Exclude: []string{"*.tmp", "debug.log"}},
+			expected: []string{"keep.log"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			artifacts, err := NewArtifactUploader(logger.Discard, nil, tc.conf).Collect()
+			require.NoError(t, err)
+
+			paths := []string{}
+			for _, a := range artifacts {
+				paths = append(paths, a.Path)
+			}
+			assert.ElementsMatch(t, tc.expected, paths)
+		})
+	}
+
+	// Without a .buildkiteignore, nothing is ignored
+	require.NoError(t, os.Remove(filepath.Join(dir, DefaultIgnoreFile)))
+	artifacts, err := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Paths: "*", UseIgnoreFile: true}).Collect()
+	require.NoError(t, err)
+	assert.Len(t, artifacts, 4)
+}
+
+func TestCollectWithBaseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-base-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "build")
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "reports"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(base, "reports", "x.html"), []byte("llamas"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(base, "reports", "y.tmp"), []byte("alpacas"), 0644))
+
+	for _, tc := range []struct {
+		conf     ArtifactUploaderConfig
+		expected []string
+	}{
+		{
+			ArtifactUploaderConfig{Paths: "reports/*", BaseDir: base, Exclude: []string{"**/*.tmp"}},
+			[]string{"reports/x.html"},
+		},
+		{
+			ArtifactUploaderConfig{Paths: "reports/*.html", BaseDir: base, StripPrefix: "reports"},
+			[]string{"x.html"},
+		},
+		{
+			ArtifactUploaderConfig{Paths: filepath.Join(base, "reports", "*.html"), BaseDir: base, FollowSymlinks: true},
+			[]string{filepath.ToSlash(strings.TrimPrefix(filepath.Join(base, "reports", "x.html"), string(filepath.Separator)))},
+		},
+	} {
+		artifacts, err := NewArtifactUploader(logger.Discard, nil, tc.conf).Collect()
+		require.NoError(t, err, tc.conf.Paths)
+
+		paths := []string{}
+		for _, a := range artifacts {
+			paths = append(paths, filepath.ToSlash(a.Path))
+		}
+		assert.Equal(t, tc.expected, paths, tc.conf.Paths)
+	}
+
+	_, err = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Paths: "*", BaseDir: filepath.Join(dir, "missing")}).Collect()
+	assert.EqualError(t, err, fmt.Sprintf("The base directory %q doesn't exist", filepath.Join(dir, "missing")))
+
+	_, err = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Paths: "*", BaseDir: filepath.Join(base, "reports", "x.html")}).Collect()
+	assert.EqualError(t, err, fmt.Sprintf("The base directory %q isn't a directory", filepath.Join(base, "reports", "x.html")))
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix, expected string
+		ok                     bool
+	}{
+		{filepath.Join("build", "output", "app.js"), "build/output", "app.js", true},
+		{filepath.Join("build", "output", "js", "app.js"), "build/output/", filepath.Join("js", "app.js"), true},
+		{filepath.Join("build", "output", "app.js"), "./build", filepath.Join("output", "app.js"), true},
+		{filepath.Join("build", "outputs", "app.js"), "build/output", filepath.Join("build", "outputs", "app.js"), false},
+		{filepath.Join("build", "output"), "build/output", filepath.Join("build", "output"), false},
+		{"app.js", "build", "app.js", false},
+		{filepath.Join(string(filepath.Separator), "tmp", "build-output", "reports", "foo.html"), filepath.Join(string(filepath.Separator), "tmp", "build-output"), filepath.Join("reports", "foo.html"), true},
+		{filepath.Join(string(filepath.Separator), "tmp", "app.js"), string(filepath.Separator), filepath.Join("tmp", "app.js"), true},
+	} {
+		stripped, ok := stripPathPrefix(tc.path, tc.prefix)
+		assert.Equal(t, tc.expected, stripped, tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+	}
+}
+
+func TestCollectWithStripPrefix(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := filepath.Join(wd, "..")
+	os.Chdir(root)
+	defer os.Chdir(wd)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths: strings.Join([]string{
+			filepath.Join("test", "fixtures", "artifacts", "folder", "Commando.jpg"),
+			filepath.Join("test", "fixtures", "artifacts", "Mr Freeze.jpg"),
+		}, ";"),
+		StripPrefix: "test/fixtures/artifacts",
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.ElementsMatch(
+		t,
+		[]string{
+			filepath.Join("folder", "Commando.jpg"),
+			"Mr Freeze.jpg",
+		},
+		paths,
+	)
+
+	// An absolute prefix is stripped from an absolute glob
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:       filepath.Join(root, "test", "fixtures", "artifacts", "folder", "*.jpg"),
+		StripPrefix: filepath.Join(root, "test", "fixtures", "artifacts"),
+	})
+
+	artifacts, err = uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, len(artifacts)) {
+		assert.Equal(t, filepath.Join("folder", "Commando.jpg"), artifacts[0].Path)
+	}
+
+	// Files that aren't under the prefix fail the upload
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths: strings.Join([]string{
+			filepath.Join("test", "fixtures", "artifacts", "folder", "Commando.jpg"),
+			filepath.Join("test", "fixtures", "artifacts", "Mr Freeze.jpg"),
+		}, ";"),
+		StripPrefix: "test/fixtures/artifacts/folder",
+	})
+
+	_, err = uploader.Collect()
+	assert.EqualError(t, err, fmt.Sprintf("%s isn't under the prefix to strip %q",
+		filepath.Join("test", "fixtures", "artifacts", "Mr Freeze.jpg"), "test/fixtures/artifacts/folder"))
+}
+
+func TestCheckArtifactSizes(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+
+	artifacts := []*api.Artifact{
+		{Path: "small.bin", FileSize: 1024},
+		{Path: "exact.bin", FileSize: 4096},
+	}
+	assert.NoError(t, uploader.checkArtifactSizes(artifacts, 4096))
+
+	artifacts = append(artifacts, &api.Artifact{Path: "huge.bin", FileSize: 4097})
+	assert.EqualError(t, uploader.checkArtifactSizes(artifacts, 4096),
+		"1 artifacts are too large to upload to Buildkite artifact storage, which can store at most 4.0KB per artifact")
+}
+
+func TestConcurrency(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.Equal(t, pool.MaxConcurrencyLimit, uploader.concurrency())
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{Concurrency: 3})
+	assert.Equal(t, 3, uploader.concurrency())
+}
+
+func TestCheckFailThreshold(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{})
+	assert.NoError(t, uploader.checkFailThreshold(0, 10))
+	assert.EqualError(t, uploader.checkFailThreshold(1, 9999),
+		"1 of 10000 artifacts (0.01%) failed to upload, 9999 were uploaded successfully")
+
+	uploader = NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{FailThreshold: 10})
+	assert.NoError(t, uploader.checkFailThreshold(1, 9))
+	assert.EqualError(t, uploader.checkFailThreshold(2, 8),
+		"2 of 10 artifacts (20%) failed to upload, 8 were uploaded successfully")
+}
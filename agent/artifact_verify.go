@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// An artifactVerifyError is returned when the checksum the store has for an
+// uploaded artifact doesn't match the artifact's file
+type artifactVerifyError struct {
+	Path     string
+	Checksum string
+	Local    string
+	Remote   string
+}
+
+func (e *artifactVerifyError) Error() string {
+	return fmt.Sprintf("%q was corrupted while uploading, as its %s is %s but the uploaded object's is %s", e.Path, e.Checksum, e.Local, e.Remote)
+}
+
+// verify checks the uploaded artifact against its file, returning an
+// artifactVerifyError if they don't match
+func (a *ArtifactUploader) verify(v VerifyingUploader, artifact *api.Artifact) error {
+	a.limiter.Wait()
+
+	if err := v.Verify(artifact); err != nil {
+		return err
+	}
+
+	a.logger.Debug("Verified the checksum of the uploaded %q", artifact.Path)
+	return nil
+}
+
+// isUnchanged returns whether the artifact is already at the destination with
+// the same size and checksum. If that can't be checked, the artifact is
+// uploaded again, as if it had changed.
+func (a *ArtifactUploader) isUnchanged(c UnchangedUploader, artifact *api.Artifact) bool {
+	a.limiter.Wait()
+
+	unchanged, err := c.Unchanged(artifact)
+	if err != nil {
+		a.logger.Warn("Couldn't check if %q is unchanged at the upload destination, uploading it anyway (%v)", artifact.Path, err)
+		return false
+	}
+
+	if unchanged {
+		atomic.AddInt64(&a.unchanged, 1)
+	}
+	return unchanged
+}
@@ -1,13 +1,13 @@
 package agent
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -15,7 +15,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -28,6 +30,31 @@ type ArtifactoryUploaderConfig struct {
 
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
+
+	// If set, credentials are read from Vault before the environment
+	Vault *VaultClient
+
+	// If set, sent as a header with every request
+	CorrelationID string
+
+	// If set, used to make requests instead of the default transport
+	Transport http.RoundTripper
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
+
+	// If set, requests are authenticated with this Artifactory API key,
+	// sent as the X-JFrog-Art-Api header, instead of a username and password
+	APIKey string
+
+	// If set, requests are authenticated with this Artifactory access token,
+	// sent as a bearer token, instead of a username and password
+	AccessToken string
+
+	// Whether to first try deploying each artifact by its checksums alone,
+	// without sending its file, which Artifactory accepts if it already
+	// stores a file with the same checksums
+	ChecksumDeploy bool
 }
 
 type ArtifactoryUploader struct {
@@ -49,21 +76,56 @@ type ArtifactoryUploader struct {
 	// The logger instance to use
 	logger logger.Logger
 
-	// Artifactory username
-	user string
+	// Artifactory credentials, replaced when they're refreshed
+	auth          artifactoryAuth
+	credentialsMu sync.RWMutex
+}
+
+// artifactoryAuth is how requests to Artifactory are authenticated: with an
+// access token, an API key, or a username and password
+type artifactoryAuth struct {
+	user        string
+	password    string
+	apiKey      string
+	accessToken string
+}
+
+// set authenticates the request with the credentials
+func (a artifactoryAuth) set(req *http.Request) {
+	switch {
+	case a.accessToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.accessToken)
+	case a.apiKey != "":
+		req.Header.Set("X-JFrog-Art-Api", a.apiKey)
+	default:
+		req.SetBasicAuth(a.user, a.password)
+	}
+}
+
+func init() {
+	RegisterUploader("rt", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		if c.ExpireAfter > 0 {
+			l.Warn("Artifactory doesn't support expiring artifacts, ignoring the artifact expiry")
+		}
 
-	// Artifactory password
-	password string
+		return NewArtifactoryUploader(l, ArtifactoryUploaderConfig{
+			Destination:   c.Destination,
+			DebugHTTP:     c.DebugHTTP,
+			Vault:         c.Vault,
+			CorrelationID: c.CorrelationID,
+			Transport:     c.Transport,
+			Open:          c.Open,
+
+			ChecksumDeploy: c.RTChecksumDeploy,
+		})
+	})
 }
 
 func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*ArtifactoryUploader, error) {
 	repo, path := ParseArtifactoryDestination(c.Destination)
-	stringURL := os.Getenv("BUILDKITE_ARTIFACTORY_URL")
-	username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
-	password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
-	// authentication is not set
-	if stringURL == "" || username == "" || password == "" {
-		return nil, errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	stringURL, auth, err := artifactoryCredentials(c)
+	if err != nil {
+		return nil, err
 	}
 
 	parsedURL, err := url.Parse(stringURL)
@@ -73,15 +135,104 @@ func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*Arti
 	return &ArtifactoryUploader{
 		logger:     l,
 		conf:       c,
-		client:     &http.Client{},
+		client:     withCorrelationID(&http.Client{Transport: c.Transport}, c.CorrelationID),
 		iURL:       parsedURL,
 		Path:       path,
 		Repository: repo,
-		user:       username,
-		password:   password,
+		auth:       auth,
 	}, nil
 }
 
+// artifactoryCredentials reads the Artifactory URL and credentials from
+// Vault, or else from the environment. The API key and access token in the
+// config take precedence over both. Only one kind of credentials can be used:
+// an access token, an API key, or a username and password.
+func artifactoryCredentials(c ArtifactoryUploaderConfig) (stringURL string, auth artifactoryAuth, err error) {
+	stringURL = os.Getenv("BUILDKITE_ARTIFACTORY_URL")
+	auth.user = os.Getenv("BUILDKITE_ARTIFACTORY_USER")
+	auth.password = os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
+	auth.apiKey = os.Getenv("BUILDKITE_ARTIFACTORY_API_KEY")
+	auth.accessToken = os.Getenv("BUILDKITE_ARTIFACTORY_ACCESS_TOKEN")
+	if c.Vault != nil {
+		for key, value := range map[string]*string{
+			"BUILDKITE_ARTIFACTORY_URL":          &stringURL,
+			"BUILDKITE_ARTIFACTORY_USER":         &auth.user,
+			"BUILDKITE_ARTIFACTORY_PASSWORD":     &auth.password,
+			"BUILDKITE_ARTIFACTORY_API_KEY":      &auth.apiKey,
+			"BUILDKITE_ARTIFACTORY_ACCESS_TOKEN": &auth.accessToken,
+		} {
+			secret, err := c.Vault.Get(key)
+			if err != nil {
+				return "", artifactoryAuth{}, err
+			}
+			if secret != "" {
+				*value = secret
+			}
+		}
+	}
+	if c.APIKey != "" {
+		auth.apiKey = c.APIKey
+	}
+	if c.AccessToken != "" {
+		auth.accessToken = c.AccessToken
+	}
+
+	kinds := []string{}
+	if auth.accessToken != "" {
+		kinds = append(kinds, "BUILDKITE_ARTIFACTORY_ACCESS_TOKEN")
+	}
+	if auth.apiKey != "" {
+		kinds = append(kinds, "BUILDKITE_ARTIFACTORY_API_KEY")
+	}
+	if auth.user != "" || auth.password != "" {
+		kinds = append(kinds, "BUILDKITE_ARTIFACTORY_USER and BUILDKITE_ARTIFACTORY_PASSWORD")
+	}
+	if len(kinds) > 1 {
+		return "", artifactoryAuth{}, fmt.Errorf("Only one kind of Artifactory credentials can be set, but %s are. "+
+			"Set an access token, an API key, or a username and password, and unset the others", strings.Join(kinds, ", "))
+	}
+
+	// authentication is not set
+	if stringURL == "" || (auth.accessToken == "" && auth.apiKey == "" && (auth.user == "" || auth.password == "")) {
+		return "", artifactoryAuth{}, errors.New("Must set BUILDKITE_ARTIFACTORY_URL, and BUILDKITE_ARTIFACTORY_ACCESS_TOKEN, BUILDKITE_ARTIFACTORY_API_KEY, " +
+			"or BUILDKITE_ARTIFACTORY_USER and BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	}
+	return stringURL, auth, nil
+}
+
+// CredentialsExpired returns whether Artifactory rejected the credentials an
+// upload was made with
+func (u *ArtifactoryUploader) CredentialsExpired(err error) bool {
+	res, ok := err.(*errorResponse)
+	return ok && res.Response.StatusCode == http.StatusUnauthorized
+}
+
+// RefreshCredentials reads the credentials again from Vault or the
+// environment
+func (u *ArtifactoryUploader) RefreshCredentials() error {
+	if u.conf.Vault != nil {
+		u.conf.Vault.Invalidate()
+	}
+
+	_, auth, err := artifactoryCredentials(u.conf)
+	if err != nil {
+		return err
+	}
+
+	u.credentialsMu.Lock()
+	u.auth = auth
+	u.credentialsMu.Unlock()
+	return nil
+}
+
+// setAuth authenticates the request with the current credentials
+func (u *ArtifactoryUploader) setAuth(req *http.Request) {
+	u.credentialsMu.RLock()
+	defer u.credentialsMu.RUnlock()
+
+	u.auth.set(req)
+}
+
 func ParseArtifactoryDestination(destination string) (repo string, path string) {
 	parts := strings.Split(strings.TrimPrefix(string(destination), "rt://"), "/")
 	path = strings.Join(parts[1:len(parts)], "/")
@@ -100,62 +251,212 @@ func (u *ArtifactoryUploader) URL(artifact *api.Artifact) string {
 }
 
 func (u *ArtifactoryUploader) Upload(artifact *api.Artifact) error {
+	return u.UploadWithContext(context.Background(), artifact)
+}
+
+// UploadWithContext uploads the artifact, aborting the request to
+// Artifactory if the context is done before it's finished
+func (u *ArtifactoryUploader) UploadWithContext(ctx context.Context, artifact *api.Artifact) error {
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifactFile(u.conf.Open, artifact)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
 
+	// Checksum the file in a single pass before it's sent, as the
+	// checksums have to be sent as headers
+	md5Hash, sha1Hash, sha256Hash := md5.New(), sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha1Hash, sha256Hash), f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	checksums := http.Header{}
+	checksums.Add(`X-Checksum-MD5`, fmt.Sprintf("%x", md5Hash.Sum(nil)))
+	checksums.Add(`X-Checksum-SHA1`, fmt.Sprintf("%x", sha1Hash.Sum(nil)))
+	checksums.Add(`X-Checksum-SHA256`, fmt.Sprintf("%x", sha256Hash.Sum(nil)))
+
+	if u.conf.ChecksumDeploy {
+		deployed, err := u.checksumDeploy(ctx, artifact, checksums)
+		if err != nil || deployed {
+			f.Close()
+			return err
+		}
+	}
+
 	// Upload the file to Artifactory.
 	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
 
-	req, err := http.NewRequest("PUT", u.URL(artifact), f)
-	req.SetBasicAuth(u.user, u.password)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.URL(artifact), f)
 	if err != nil {
 		return err
 	}
+	u.setAuth(req)
 
-	md5Checksum, err := checksumFile(md5.New(), artifact.AbsolutePath)
+	for key, values := range checksums {
+		req.Header[key] = values
+	}
+
+	res, err := u.client.Do(req)
 	if err != nil {
 		return err
 	}
-	req.Header.Add(`X-Checksum-MD5`, md5Checksum)
+	if err := checkResponse(res); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checksumDeploy deploys the artifact by its checksums alone, returning false
+// if Artifactory doesn't already store a file with the same checksums, so the
+// file has to be uploaded
+func (u *ArtifactoryUploader) checksumDeploy(ctx context.Context, artifact *api.Artifact, checksums http.Header) (bool, error) {
+	u.logger.Debug("Deploying \"%s\" to `%s` by its checksums", artifact.Path, u.URL(artifact))
 
-	sha1Checksum, err := checksumFile(sha1.New(), artifact.AbsolutePath)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.URL(artifact), nil)
 	if err != nil {
-		return err
+		return false, err
+	}
+	u.setAuth(req)
+
+	for key, values := range checksums {
+		req.Header[key] = values
 	}
-	req.Header.Add(`X-Checksum-SHA1`, sha1Checksum)
+	req.Header.Set("X-Checksum-Deploy", "true")
 
-	sha256Checksum, err := checksumFile(sha256.New(), artifact.AbsolutePath)
+	res, err := u.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		u.logger.Debug("Artifactory doesn't have a file with the checksums of \"%s\", uploading it", artifact.Path)
+		return false, nil
+	}
+	if err := checkResponse(res); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (u *ArtifactoryUploader) Exists(artifact *api.Artifact) (bool, error) {
+	req, err := http.NewRequest("HEAD", u.URL(artifact), nil)
+	if err != nil {
+		return false, err
+	}
+	u.setAuth(req)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkResponse(res); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Verify compares the SHA-256 Artifactory has for the uploaded artifact with
+// that of the artifact's file, or its SHA-1 if it doesn't have a SHA-256
+func (u *ArtifactoryUploader) Verify(artifact *api.Artifact) error {
+	req, err := http.NewRequest("HEAD", u.URL(artifact), nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Add(`X-Checksum-SHA256`, sha256Checksum)
+	u.setAuth(req)
 
 	res, err := u.client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+
 	if err := checkResponse(res); err != nil {
 		return err
 	}
 
-	return nil
+	return u.compareChecksum(artifact, res, false)
 }
 
-func checksumFile(hasher hash.Hash, path string) (string, error) {
-	f, err := os.Open(path)
+// Unchanged returns whether the artifact in Artifactory is the same size as
+// the artifact's file and has the same checksum. Artifacts Artifactory
+// doesn't return a checksum for are never unchanged.
+func (u *ArtifactoryUploader) Unchanged(artifact *api.Artifact) (bool, error) {
+	req, err := http.NewRequest("HEAD", u.URL(artifact), nil)
+	if err != nil {
+		return false, err
+	}
+	u.setAuth(req)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkResponse(res); err != nil {
+		return false, err
+	}
+	if res.Header.Get("X-Checksum-Sha256") == "" && res.Header.Get("X-Checksum-Sha1") == "" {
+		return false, nil
+	}
+
+	err = u.compareChecksum(artifact, res, true)
+	if _, ok := err.(*artifactVerifyError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// compareChecksum returns an artifactVerifyError if the SHA-256 in the
+// response to a HEAD of the artifact, or its SHA-1 if there's no SHA-256,
+// (and its size, if checkSize is set) doesn't match the artifact's file
+func (u *ArtifactoryUploader) compareChecksum(artifact *api.Artifact, res *http.Response, checkSize bool) error {
+	checksum, remote, hash := "SHA-256", res.Header.Get("X-Checksum-Sha256"), sha256.New()
+	if remote == "" {
+		checksum, remote, hash = "SHA-1", res.Header.Get("X-Checksum-Sha1"), sha1.New()
+	}
+	if remote == "" {
+		return fmt.Errorf("Artifactory didn't return a checksum for %q to verify it with", artifact.Path)
+	}
+
+	f, err := openArtifactFile(u.conf.Open, artifact)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
 	defer f.Close()
-	if _, err := io.Copy(hasher, f); err != nil {
-		return "", err
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q (%v)", artifact.AbsolutePath, err)
 	}
 
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	// A partial upload of the file is never the same size as it
+	if checkSize && res.ContentLength != size {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: "size", Local: strconv.FormatInt(size, 10), Remote: strconv.FormatInt(res.ContentLength, 10)}
+	}
+
+	if local := fmt.Sprintf("%x", hash.Sum(nil)); local != strings.ToLower(remote) {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: checksum, Local: local, Remote: remote}
+	}
+	return nil
 }
 
 func sha1File(path string) ([]byte, error) {
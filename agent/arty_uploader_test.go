@@ -1,7 +1,18 @@
 package agent
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseArtifactoryDestinationBucketPath(t *testing.T) {
@@ -31,3 +42,236 @@ func TestParseArtifactoryDestinationBucketName(t *testing.T) {
 		}
 	}
 }
+
+func TestArtifactoryUploaderVerify(t *testing.T) {
+	headers := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		require.Equal(t, "/artifactory/my-repo/builds/llamas.txt", r.URL.Path)
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL + "/artifactory",
+		"BUILDKITE_ARTIFACTORY_USER":     "carol-danvers",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "xxx",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "rt-verify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{Destination: "rt://my-repo/builds"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath}
+
+	headers["X-Checksum-Sha256"] = fmt.Sprintf("%X", sha256.Sum256([]byte("llamas")))
+	require.NoError(t, uploader.Verify(artifact))
+
+	headers["X-Checksum-Sha256"] = fmt.Sprintf("%x", sha256.Sum256([]byte("alpacas")))
+	require.IsType(t, &artifactVerifyError{}, uploader.Verify(artifact))
+
+	// Without any checksums, it can't be verified
+	delete(headers, "X-Checksum-Sha256")
+	require.Error(t, uploader.Verify(artifact))
+}
+
+func TestArtifactoryUploaderUnchanged(t *testing.T) {
+	var headers map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		if headers == nil {
+			http.NotFound(w, r)
+			return
+		}
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL + "/artifactory",
+		"BUILDKITE_ARTIFACTORY_USER":     "carol-danvers",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "xxx",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "rt-unchanged")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{Destination: "rt://my-repo/builds"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath}
+
+	for _, tc := range []struct {
+		name      string
+		headers   map[string]string
+		unchanged bool
+	}{
+		{"missing", nil, false},
+		{"same", map[string]string{"Content-Length": "6", "X-Checksum-Sha256": fmt.Sprintf("%x", sha256.Sum256([]byte("llamas")))}, true},
+		{"different", map[string]string{"Content-Length": "7", "X-Checksum-Sha256": fmt.Sprintf("%x", sha256.Sum256([]byte("alpacas")))}, false},
+		{"partial", map[string]string{"Content-Length": "3", "X-Checksum-Sha256": fmt.Sprintf("%x", sha256.Sum256([]byte("lla")))}, false},
+		{"no checksum", map[string]string{"Content-Length": "6"}, false},
+	} {
+		headers = tc.headers
+		unchanged, err := uploader.Unchanged(artifact)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.unchanged, unchanged, tc.name)
+	}
+}
+
+func TestArtifactoryUploaderAuthenticates(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_ARTIFACTORY_URL", server.URL+"/artifactory")
+	defer os.Unsetenv("BUILDKITE_ARTIFACTORY_URL")
+
+	for _, tc := range []struct {
+		name   string
+		env    map[string]string
+		conf   ArtifactoryUploaderConfig
+		header string
+		value  string
+	}{
+		{
+			name:   "password",
+			env:    map[string]string{"BUILDKITE_ARTIFACTORY_USER": "carol-danvers", "BUILDKITE_ARTIFACTORY_PASSWORD": "xxx"},
+			header: "Authorization",
+			value:  "Basic Y2Fyb2wtZGFudmVyczp4eHg=",
+		},
+		{
+			name:   "api key",
+			env:    map[string]string{"BUILDKITE_ARTIFACTORY_API_KEY": "llamas"},
+			header: "X-JFrog-Art-Api",
+			value:  "llamas",
+		},
+		{
+			name:   "access token",
+			env:    map[string]string{"BUILDKITE_ARTIFACTORY_ACCESS_TOKEN": "alpacas"},
+			header: "Authorization",
+			value:  "Bearer alpacas",
+		},
+		{
+			name:   "access token in config",
+			conf:   ArtifactoryUploaderConfig{AccessToken: "alpacas"},
+			header: "Authorization",
+			value:  "Bearer alpacas",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			tc.conf.Destination = "rt://my-repo/builds"
+			uploader, err := NewArtifactoryUploader(logger.Discard, tc.conf)
+			require.NoError(t, err)
+
+			_, err = uploader.Exists(&api.Artifact{Path: "llamas.txt"})
+			require.NoError(t, err)
+			require.Equal(t, tc.value, got.Get(tc.header))
+		})
+	}
+}
+
+func TestNewArtifactoryUploaderRejectsMoreThanOneKindOfCredentials(t *testing.T) {
+	for key, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      "http://my-artifactory-instance.com/artifactory",
+		"BUILDKITE_ARTIFACTORY_USER":     "carol-danvers",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "xxx",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	_, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{
+		Destination: "rt://my-repo/builds",
+		APIKey:      "llamas",
+	})
+	require.EqualError(t, err, "Only one kind of Artifactory credentials can be set, but BUILDKITE_ARTIFACTORY_API_KEY, "+
+		"BUILDKITE_ARTIFACTORY_USER and BUILDKITE_ARTIFACTORY_PASSWORD are. Set an access token, an API key, or a username and password, and unset the others")
+
+	os.Unsetenv("BUILDKITE_ARTIFACTORY_PASSWORD")
+	os.Unsetenv("BUILDKITE_ARTIFACTORY_USER")
+	_, err = NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{Destination: "rt://my-repo/builds"})
+	require.Error(t, err)
+}
+
+func TestArtifactoryUploaderChecksumDeploy(t *testing.T) {
+	stored := map[string]bool{}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "PUT", r.Method)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		checksum := r.Header.Get("X-Checksum-Sha256")
+		if r.Header.Get("X-Checksum-Deploy") == "true" {
+			requests = append(requests, "checksum "+r.URL.Path)
+			require.Empty(t, body)
+			if !stored[checksum] {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[{"status":404,"message":"Checksum deploy failed"}]}`))
+				return
+			}
+		} else {
+			requests = append(requests, "upload "+r.URL.Path)
+			require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(body)), checksum)
+			stored[checksum] = true
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL + "/artifactory",
+		"BUILDKITE_ARTIFACTORY_USER":     "carol-danvers",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "xxx",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "rt-checksum-deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{
+		Destination:    "rt://my-repo/builds",
+		ChecksumDeploy: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, uploader.Upload(&api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath}))
+	require.NoError(t, uploader.Upload(&api.Artifact{Path: "again/llamas.txt", AbsolutePath: absolutePath}))
+
+	require.Equal(t, []string{
+		"checksum /artifactory/my-repo/builds/llamas.txt",
+		"upload /artifactory/my-repo/builds/llamas.txt",
+		"checksum /artifactory/my-repo/builds/again/llamas.txt",
+	}, requests)
+}
@@ -0,0 +1,430 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The version of the Blob service REST API requests are made with
+const azureBlobAPIVersion = "2020-10-02"
+
+// The largest blob that can be uploaded with a single Put Blob request
+var maxAzureBlobSize = int64(5000 * 1024 * 1024)
+
+type AzureBlobUploaderConfig struct {
+	// The destination which includes the container name and the path.
+	// For example, az://my-container/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// If set, credentials are read from Vault before the environment
+	Vault *VaultClient
+
+	// If set, sent as a header with every request
+	CorrelationID string
+
+	// If set, used to make requests instead of the default transport
+	Transport http.RoundTripper
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
+}
+
+type AzureBlobUploader struct {
+	// The storage account blobs are uploaded to
+	Account string
+
+	// The container and path set from the destination
+	Container string
+	Path      string
+
+	// The blob service endpoint of the storage account
+	endpoint *url.URL
+
+	// The HTTP client to use
+	client *http.Client
+
+	// The configuration
+	conf AzureBlobUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The access key or SAS token requests are authenticated with, replaced
+	// when the credentials are refreshed
+	credentials   azureCredentials
+	credentialsMu sync.RWMutex
+}
+
+// azureCredentials are a storage account's name, and either its access key or
+// a SAS token
+type azureCredentials struct {
+	account   string
+	accessKey []byte
+	sasToken  url.Values
+}
+
+func init() {
+	RegisterUploader("az", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		if c.ExpireAfter > 0 {
+			l.Warn("Azure Blob Storage doesn't support expiring artifacts, ignoring the artifact expiry")
+		}
+
+		return NewAzureBlobUploader(l, AzureBlobUploaderConfig{
+			Destination:   c.Destination,
+			DebugHTTP:     c.DebugHTTP,
+			Vault:         c.Vault,
+			CorrelationID: c.CorrelationID,
+			Transport:     c.Transport,
+			Open:          c.Open,
+		})
+	})
+}
+
+func NewAzureBlobUploader(l logger.Logger, c AzureBlobUploaderConfig) (*AzureBlobUploader, error) {
+	container, path := ParseAzureBlobDestination(c.Destination)
+	if container == "" {
+		return nil, fmt.Errorf("Invalid Azure Blob Storage destination %q, expected az://container/path", c.Destination)
+	}
+
+	// Fail before doing anything if the access tier isn't valid
+	if _, err := azureBlobAccessTier(); err != nil {
+		return nil, err
+	}
+
+	credentials, err := readAzureCredentials(c.Vault)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := azureBlobEndpoint(credentials.account)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobUploader{
+		logger:      l,
+		conf:        c,
+		client:      withCorrelationID(&http.Client{Transport: c.Transport}, c.CorrelationID),
+		Account:     credentials.account,
+		Container:   container,
+		Path:        path,
+		endpoint:    endpoint,
+		credentials: credentials,
+	}, nil
+}
+
+// readAzureCredentials reads the storage account and its access key or SAS
+// token from Vault, or else from the environment
+func readAzureCredentials(vault *VaultClient) (azureCredentials, error) {
+	values := map[string]string{}
+	for _, key := range []string{
+		"BUILDKITE_AZURE_STORAGE_ACCOUNT",
+		"BUILDKITE_AZURE_STORAGE_ACCESS_KEY",
+		"BUILDKITE_AZURE_STORAGE_SAS_TOKEN",
+	} {
+		values[key] = os.Getenv(key)
+		if vault != nil {
+			secret, err := vault.Get(key)
+			if err != nil {
+				return azureCredentials{}, err
+			}
+			if secret != "" {
+				values[key] = secret
+			}
+		}
+	}
+
+	credentials := azureCredentials{account: values["BUILDKITE_AZURE_STORAGE_ACCOUNT"]}
+	if credentials.account == "" {
+		return azureCredentials{}, errors.New("Must set BUILDKITE_AZURE_STORAGE_ACCOUNT when using az:// path")
+	}
+
+	switch {
+	case values["BUILDKITE_AZURE_STORAGE_ACCESS_KEY"] != "":
+		key, err := base64.StdEncoding.DecodeString(values["BUILDKITE_AZURE_STORAGE_ACCESS_KEY"])
+		if err != nil {
+			return azureCredentials{}, fmt.Errorf("BUILDKITE_AZURE_STORAGE_ACCESS_KEY isn't a base64 encoded access key (%v)", err)
+		}
+		credentials.accessKey = key
+
+	case values["BUILDKITE_AZURE_STORAGE_SAS_TOKEN"] != "":
+		token, err := url.ParseQuery(strings.TrimPrefix(values["BUILDKITE_AZURE_STORAGE_SAS_TOKEN"], "?"))
+		if err != nil {
+			return azureCredentials{}, fmt.Errorf("BUILDKITE_AZURE_STORAGE_SAS_TOKEN isn't a valid SAS token (%v)", err)
+		}
+		credentials.sasToken = token
+
+	default:
+		return azureCredentials{}, errors.New("Must set BUILDKITE_AZURE_STORAGE_ACCESS_KEY or BUILDKITE_AZURE_STORAGE_SAS_TOKEN when using az:// path")
+	}
+
+	return credentials, nil
+}
+
+// azureBlobEndpoint returns the blob service endpoint of the account, which
+// can be changed with BUILDKITE_AZURE_BLOB_ENDPOINT for other clouds or an
+// emulator
+func azureBlobEndpoint(account string) (*url.URL, error) {
+	endpoint := "https://" + account + ".blob.core.windows.net"
+	if os.Getenv("BUILDKITE_AZURE_BLOB_ENDPOINT") != "" {
+		endpoint = os.Getenv("BUILDKITE_AZURE_BLOB_ENDPOINT")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Azure Blob Storage endpoint %q (%v)", endpoint, err)
+	}
+	return u, nil
+}
+
+// azureBlobAccessTier returns the access tier to upload blobs with from
+// BUILDKITE_AZURE_BLOB_ACCESS_TIER, or an empty string for the account's
+// default tier
+func azureBlobAccessTier() (string, error) {
+	tier := os.Getenv("BUILDKITE_AZURE_BLOB_ACCESS_TIER")
+
+	switch strings.ToLower(tier) {
+	case "":
+		return "", nil
+	case "hot":
+		return "Hot", nil
+	case "cool":
+		return "Cool", nil
+	case "cold":
+		return "Cold", nil
+	case "archive":
+		return "Archive", nil
+	default:
+		return "", fmt.Errorf("Invalid Azure Blob Storage access tier: `%s`, expected Hot, Cool, Cold or Archive", tier)
+	}
+}
+
+// CredentialsExpired returns whether Azure rejected the credentials an upload
+// was made with, such as when a SAS token has expired
+func (u *AzureBlobUploader) CredentialsExpired(err error) bool {
+	res, ok := err.(*errorResponse)
+	return ok && res.Response.StatusCode == http.StatusForbidden
+}
+
+// RefreshCredentials reads the access key or SAS token again from Vault or
+// the environment
+func (u *AzureBlobUploader) RefreshCredentials() error {
+	if u.conf.Vault != nil {
+		u.conf.Vault.Invalidate()
+	}
+
+	credentials, err := readAzureCredentials(u.conf.Vault)
+	if err != nil {
+		return err
+	}
+
+	u.credentialsMu.Lock()
+	u.credentials = credentials
+	u.credentialsMu.Unlock()
+	return nil
+}
+
+func ParseAzureBlobDestination(destination string) (container string, path string) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(destination, "az://"), "/"), "/")
+	path = strings.Join(parts[1:], "/")
+	container = parts[0]
+	return
+}
+
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	blobURL := *u.endpoint
+	blobURL.Path = strings.TrimSuffix(blobURL.Path, "/") + "/" + u.Container + "/" + u.artifactPath(artifact)
+	return blobURL.String()
+}
+
+func (u *AzureBlobUploader) MaxArtifactSize() int64 {
+	return maxAzureBlobSize
+}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	return u.UploadWithContext(context.Background(), artifact)
+}
+
+// UploadWithContext uploads the artifact, aborting the request to Azure if
+// the context is done before it's finished
+func (u *AzureBlobUploader) UploadWithContext(ctx context.Context, artifact *api.Artifact) error {
+	tier, err := azureBlobAccessTier()
+	if err != nil {
+		return err
+	}
+
+	// Open file from filesystem
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := openArtifactFile(u.conf.Open, artifact)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	size, err := artifactFileSize(f)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	// Azure checks the upload against its MD5, so it has to be read first
+	md5Hash := md5.New()
+	if _, err := io.Copy(md5Hash, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Upload the file to Azure Blob Storage
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.URL(artifact), io.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)))
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-blob-content-type", artifact.ContentType)
+	if artifact.ContentEncoding != "" {
+		req.Header.Set("x-ms-blob-content-encoding", artifact.ContentEncoding)
+	}
+	if tier != "" {
+		req.Header.Set("x-ms-access-tier", tier)
+	}
+	for key, value := range artifact.Metadata {
+		req.Header.Set("x-ms-meta-"+azureMetadataName(key), value)
+	}
+
+	if err := u.authorize(req); err != nil {
+		return err
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkResponse(res)
+}
+
+func (u *AzureBlobUploader) artifactPath(artifact *api.Artifact) string {
+	if u.Path == "" {
+		return artifact.Path
+	}
+	return u.Path + "/" + artifact.Path
+}
+
+// azureMetadataName makes a metadata key a valid C# identifier, as Azure
+// requires, by replacing anything else with underscores
+func azureMetadataName(key string) string {
+	name := []rune(key)
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !valid {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// authorize authenticates the request with the SAS token, or else signs it
+// with the access key
+func (u *AzureBlobUploader) authorize(req *http.Request) error {
+	u.credentialsMu.RLock()
+	defer u.credentialsMu.RUnlock()
+
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+	if u.credentials.sasToken != nil {
+		query := req.URL.Query()
+		for key, values := range u.credentials.sasToken {
+			query[key] = values
+		}
+		req.URL.RawQuery = query.Encode()
+		return nil
+	}
+
+	signature := azureSharedKeySignature(u.credentials.accessKey, u.credentials.account, req)
+	req.Header.Set("Authorization", "SharedKey "+u.credentials.account+":"+signature)
+	return nil
+}
+
+// azureSharedKeySignature signs the request with the storage account's access
+// key, as described in
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func azureSharedKeySignature(key []byte, account string, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	// Each of the x-ms- headers, lowercased and sorted
+	var msHeaders []string
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	// The account and path, then each query parameter, lowercased and sorted
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name, values := range query {
+		sorted := append([]string{}, values...)
+		sort.Strings(sorted)
+		params = append(params, strings.ToLower(name)+":"+strings.Join(sorted, ","))
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		resource += "\n" + param
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, as x-ms-date is sent instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + resource
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAzureBlobDestination(t *testing.T) {
+	for _, tc := range []struct {
+		Destination, Container, Path string
+	}{
+		{"az://my-container/foo/bar", "my-container", "foo/bar"},
+		{"az://my-container/foo/bar/", "my-container", "foo/bar"},
+		{"az://my-container", "my-container", ""},
+	} {
+		container, path := ParseAzureBlobDestination(tc.Destination)
+		assert.Equal(t, tc.Container, container, tc.Destination)
+		assert.Equal(t, tc.Path, path, tc.Destination)
+	}
+}
+
+func TestAzureBlobAccessTier(t *testing.T) {
+	defer os.Unsetenv("BUILDKITE_AZURE_BLOB_ACCESS_TIER")
+
+	for _, tc := range []struct {
+		Tier, Expected string
+	}{
+		{"", ""},
+		{"cool", "Cool"},
+		{"Archive", "Archive"},
+	} {
+		os.Setenv("BUILDKITE_AZURE_BLOB_ACCESS_TIER", tc.Tier)
+		tier, err := azureBlobAccessTier()
+		require.NoError(t, err)
+		assert.Equal(t, tc.Expected, tier)
+	}
+
+	os.Setenv("BUILDKITE_AZURE_BLOB_ACCESS_TIER", "Lukewarm")
+	_, err := azureBlobAccessTier()
+	assert.Error(t, err)
+}
+
+func TestAzureMetadataName(t *testing.T) {
+	assert.Equal(t, "build_number", azureMetadataName("build-number"))
+	assert.Equal(t, "_1st", azureMetadataName("1st"))
+	assert.Equal(t, "commit", azureMetadataName("commit"))
+}
+
+func TestAzureSharedKeySignature(t *testing.T) {
+	req, err := http.NewRequest("PUT", "https://myaccount.blob.core.windows.net/mycontainer/llamas.txt?timeout=30", nil)
+	require.NoError(t, err)
+	req.ContentLength = 11
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	// The string to sign is worked out by hand from the documented format
+	stringToSign := "PUT\n\n\n11\n\n\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\n" +
+		"x-ms-version:" + azureBlobAPIVersion + "\n" +
+		"/myaccount/mycontainer/llamas.txt\ntimeout:30"
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(stringToSign))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	assert.Equal(t, expected, azureSharedKeySignature([]byte("secret"), "myaccount", req))
+}
+
+func TestAzureBlobUploaderUpload(t *testing.T) {
+	var gotReq *http.Request
+	var gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotReq, gotBody = r, string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_AZURE_STORAGE_ACCOUNT":    "myaccount",
+		"BUILDKITE_AZURE_STORAGE_ACCESS_KEY": base64.StdEncoding.EncodeToString([]byte("secret")),
+		"BUILDKITE_AZURE_BLOB_ENDPOINT":      server.URL,
+		"BUILDKITE_AZURE_BLOB_ACCESS_TIER":   "cool",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "azure-blob-uploader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("hello llama"), 0600))
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{Destination: "az://my-container/builds"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{
+		Path:            "llamas.txt",
+		AbsolutePath:    absolutePath,
+		ContentType:     "text/plain",
+		ContentEncoding: "gzip",
+		Metadata:        map[string]string{"build-number": "42"},
+	}
+	assert.Equal(t, server.URL+"/my-container/builds/llamas.txt", uploader.URL(artifact))
+	require.NoError(t, uploader.Upload(artifact))
+
+	require.NotNil(t, gotReq)
+	assert.Equal(t, "PUT", gotReq.Method)
+	assert.Equal(t, "/my-container/builds/llamas.txt", gotReq.URL.Path)
+	assert.Equal(t, "hello llama", gotBody)
+	assert.Equal(t, "BlockBlob", gotReq.Header.Get("x-ms-blob-type"))
+	assert.Equal(t, "text/plain", gotReq.Header.Get("x-ms-blob-content-type"))
+	assert.Equal(t, "gzip", gotReq.Header.Get("x-ms-blob-content-encoding"))
+	assert.Equal(t, "Cool", gotReq.Header.Get("x-ms-access-tier"))
+	assert.Equal(t, "42", gotReq.Header.Get("x-ms-meta-build_number"))
+	assert.True(t, strings.HasPrefix(gotReq.Header.Get("Authorization"), "SharedKey myaccount:"))
+}
+
+func TestAzureBlobUploaderSASToken(t *testing.T) {
+	for key, value := range map[string]string{
+		"BUILDKITE_AZURE_STORAGE_ACCOUNT":   "myaccount",
+		"BUILDKITE_AZURE_STORAGE_SAS_TOKEN": "?sv=2020-10-02&sig=abc",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{Destination: "az://my-container"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("PUT", uploader.URL(&api.Artifact{Path: "llamas.txt"}), nil)
+	require.NoError(t, err)
+	require.NoError(t, uploader.authorize(req))
+
+	assert.Equal(t, "https://myaccount.blob.core.windows.net/my-container/llamas.txt?sig=abc&sv=2020-10-02", req.URL.String())
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestAzureBlobUploaderRequiresCredentials(t *testing.T) {
+	os.Setenv("BUILDKITE_AZURE_STORAGE_ACCOUNT", "myaccount")
+	defer os.Unsetenv("BUILDKITE_AZURE_STORAGE_ACCOUNT")
+
+	_, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{Destination: "az://my-container"})
+	assert.Error(t, err)
+}
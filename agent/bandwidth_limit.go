@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// bandwidthSchedule is the upload bandwidth limit at each time of day
+type bandwidthSchedule struct {
+	periods []bandwidthPeriod
+
+	// The limit outside of all the periods, 0 for unlimited
+	fallback int64
+}
+
+// bandwidthPeriod is a limit that applies between two times of day, which
+// wraps past midnight if end is before start
+type bandwidthPeriod struct {
+	name       string
+	start, end time.Duration
+	rate       int64
+}
+
+// parseBandwidthLimit parses a bandwidth limit, which is either a single
+// rate, e.g. 5MB, or a comma separated schedule of rates for times of day,
+// e.g. business=09:00-17:00=5MB,50MB. Each period is [name=]HH:MM-HH:MM=rate
+// in local time, and a rate on its own applies outside of all of them. Rates
+// are bytes per second, with an optional KB, MB or GB suffix, or bits per
+// second with a bps, Kbps, Mbps or Gbps suffix, and 0 is unlimited.
+func parseBandwidthLimit(limit string) (*bandwidthSchedule, error) {
+	s := &bandwidthSchedule{}
+	fallbackSet := false
+
+	for _, entry := range strings.Split(limit, ",") {
+		entry = strings.TrimSpace(entry)
+		parts := strings.Split(entry, "=")
+
+		if len(parts) == 1 {
+			if fallbackSet {
+				return nil, fmt.Errorf("Invalid bandwidth limit %q, only one rate without a time range can be given", limit)
+			}
+			rate, err := parseBandwidthRate(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			s.fallback = rate
+			fallbackSet = true
+			continue
+		}
+
+		var period bandwidthPeriod
+		switch len(parts) {
+		case 2:
+		case 3:
+			period.name = parts[0]
+			parts = parts[1:]
+		default:
+			return nil, fmt.Errorf("Invalid bandwidth limit period %q, expected [name=]HH:MM-HH:MM=rate", entry)
+		}
+
+		times := strings.Split(parts[0], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Invalid bandwidth limit period %q, expected [name=]HH:MM-HH:MM=rate", entry)
+		}
+
+		var err error
+		if period.start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if period.end, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		if period.start == period.end {
+			return nil, fmt.Errorf("Invalid bandwidth limit period %q, it starts and ends at the same time", entry)
+		}
+		if period.rate, err = parseBandwidthRate(parts[1]); err != nil {
+			return nil, err
+		}
+		if period.name == "" {
+			period.name = parts[0]
+		}
+
+		s.periods = append(s.periods, period)
+	}
+
+	return s, nil
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseBandwidthRate parses a number of bytes per second, e.g. 512KB, or of
+// bits per second, e.g. 2Mbps
+func parseBandwidthRate(rate string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSpace(rate), "/s")
+
+	if strings.HasSuffix(strings.ToLower(value), "bps") {
+		return parseBitRate(rate, value[:len(value)-len("bps")])
+	}
+
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(strings.ToUpper(value), suffix) {
+			multiplier = m
+			value = value[:len(value)-len(suffix)]
+			break
+		}
+	}
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "b")
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid bandwidth rate %q, expected bytes per second, e.g. 5MB", rate)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseBitRate parses a number of bits per second with an optional K, M or G
+// prefix into bytes per second. Like network speeds, the prefixes are powers
+// of 1000 rather than 1024.
+func parseBitRate(rate string, value string) (int64, error) {
+	multiplier := 1.0
+	for prefix, m := range map[string]float64{"K": 1e3, "M": 1e6, "G": 1e9} {
+		if strings.HasSuffix(strings.ToUpper(value), prefix) {
+			multiplier = m
+			value = value[:len(value)-len(prefix)]
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid bandwidth rate %q, expected bits per second, e.g. 2Mbps", rate)
+	}
+	return int64(n * multiplier / 8), nil
+}
+
+// rateAt returns the limit in bytes per second at a time, and the name of
+// the period it's from
+func (s *bandwidthSchedule) rateAt(t time.Time) (int64, string) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+
+	for _, p := range s.periods {
+		if p.start < p.end && now >= p.start && now < p.end {
+			return p.rate, p.name
+		}
+		if p.start > p.end && (now >= p.start || now < p.end) {
+			return p.rate, p.name
+		}
+	}
+	return s.fallback, ""
+}
+
+// bandwidthLimiter is a token bucket of bytes, with the rate taken from a
+// schedule each time it's used so it changes as periods start and end. It's
+// shared by all uploads, so the limit applies to all of them together.
+type bandwidthLimiter struct {
+	logger   logger.Logger
+	schedule *bandwidthSchedule
+
+	rate   int64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+
+	// Replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newBandwidthLimiter(l logger.Logger, schedule *bandwidthSchedule) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		logger:   l,
+		schedule: schedule,
+		rate:     -1,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// The most bytes read from a request body at once, so that waits are short
+// and frequent rather than long and bursty
+const bandwidthLimitReadSize = 32 << 10
+
+// Wait blocks until n more bytes can be sent
+func (b *bandwidthLimiter) Wait(n int) {
+	b.mu.Lock()
+	now := b.now()
+
+	rate, name := b.schedule.rateAt(now)
+	if rate != b.rate {
+		if rate == 0 {
+			b.logger.Info("Upload bandwidth is now unlimited%s", b.schedule.describe(name))
+		} else {
+			b.logger.Info("Upload bandwidth is now limited to %s/s%s", formatByteSize(rate), b.schedule.describe(name))
+		}
+		b.rate = rate
+		b.tokens = float64(rate)
+		b.last = now
+	}
+
+	if rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	// Allow a second's worth of bytes to be sent at once
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// describe returns which part of the schedule a limit came from, for logging
+func (s *bandwidthSchedule) describe(name string) string {
+	switch {
+	case len(s.periods) == 0:
+		return ""
+	case name == "":
+		return " (outside of the scheduled periods)"
+	default:
+		return fmt.Sprintf(" (%s)", name)
+	}
+}
+
+// bandwidthLimitedTransport limits how fast request bodies are sent
+type bandwidthLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *bandwidthLimiter
+}
+
+func (t *bandwidthLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return base.RoundTrip(req)
+	}
+
+	// A RoundTripper mustn't modify the request, so send a copy with the
+	// limited body
+	limited := new(http.Request)
+	*limited = *req
+	limited.Body = &bandwidthLimitedBody{body: req.Body, limiter: t.limiter}
+
+	return base.RoundTrip(limited)
+}
+
+type bandwidthLimitedBody struct {
+	body    io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (b *bandwidthLimitedBody) Read(p []byte) (int, error) {
+	if len(p) > bandwidthLimitReadSize {
+		p = p[:bandwidthLimitReadSize]
+	}
+
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.limiter.Wait(n)
+	}
+	return n, err
+}
+
+func (b *bandwidthLimitedBody) Close() error {
+	return b.body.Close()
+}
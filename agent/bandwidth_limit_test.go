@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2021, 3, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseBandwidthLimit(t *testing.T) {
+	s, err := parseBandwidthLimit("5MB")
+	require.NoError(t, err)
+	rate, _ := s.rateAt(at(12, 0))
+	assert.Equal(t, int64(5<<20), rate)
+
+	s, err = parseBandwidthLimit("business=09:00-17:00=5MB, 22:00-06:00=0, 50MB/s")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		time time.Time
+		rate int64
+		name string
+	}{
+		{at(8, 59), 50 << 20, ""},
+		{at(9, 0), 5 << 20, "business"},
+		{at(16, 59), 5 << 20, "business"},
+		{at(17, 0), 50 << 20, ""},
+		{at(23, 30), 0, "22:00-06:00"},
+		{at(5, 59), 0, "22:00-06:00"},
+	} {
+		rate, name := s.rateAt(tc.time)
+		assert.Equal(t, tc.rate, rate, tc.time.String())
+		assert.Equal(t, tc.name, name, tc.time.String())
+	}
+}
+
+func TestParseBandwidthRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate     string
+		expected int64
+	}{
+		{"1024", 1024},
+		{"512KB", 512 << 10},
+		{"10MB", 10 << 20},
+		{"1.5GB/s", 3 << 29},
+		{"800bps", 100},
+		{"2Mbps", 250000},
+		{"100 kbps", 12500},
+		{"1Gbps", 125000000},
+	} {
+		rate, err := parseBandwidthRate(tc.rate)
+		if assert.NoError(t, err, tc.rate) {
+			assert.Equal(t, tc.expected, rate, tc.rate)
+		}
+	}
+}
+
+func TestParseBandwidthLimitRejectsInvalidLimits(t *testing.T) {
+	for _, limit := range []string{
+		"fast",
+		"-5MB",
+		"fastbps",
+		"-2Mbps",
+		"5MB,10MB",
+		"09:00=5MB",
+		"09:00-25:00=5MB",
+		"09:00-09:00=5MB",
+		"a=b=09:00-17:00=5MB",
+	} {
+		_, err := parseBandwidthLimit(limit)
+		assert.Error(t, err, limit)
+	}
+}
+
+func TestBandwidthLimiterFollowsTheSchedule(t *testing.T) {
+	s, err := parseBandwidthLimit("09:00-17:00=100,1000")
+	require.NoError(t, err)
+
+	now := at(8, 59)
+	var waits []time.Duration
+
+	b := newBandwidthLimiter(logger.Discard, s)
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	// Before 9:00 a second's worth is allowed straight away
+	b.Wait(1000)
+	b.Wait(500)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, waits)
+
+	// Crossing into the period lowers the rate
+	waits = nil
+	now = at(9, 0)
+	b.Wait(100)
+	b.Wait(50)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, waits)
+}
+
+func TestBandwidthLimitedTransportLimitsRequestBodies(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	s, err := parseBandwidthLimit("100")
+	require.NoError(t, err)
+
+	var waited time.Duration
+	limiter := newBandwidthLimiter(logger.Discard, s)
+	limiter.sleep = func(d time.Duration) { waited += d }
+
+	client := &http.Client{Transport: &bandwidthLimitedTransport{limiter: limiter}}
+	body := bytes.Repeat([]byte("x"), 300)
+
+	res, err := client.Post(server.URL, "text/plain", bytes.NewReader(body))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, body, received)
+	assert.InDelta(t, float64(2*time.Second), float64(waited), float64(100*time.Millisecond))
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// formatByteSize formats a number of bytes for humans, e.g. 1.5GB
+func formatByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseByteSize parses a number of bytes written for humans, like 500MB or
+// 1.5GiB, in the same powers of 1024 as formatByteSize. A number without a
+// unit is a number of bytes.
+func ParseByteSize(s string) (int64, error) {
+	number := strings.TrimSpace(s)
+	unit := strings.TrimLeft(number, "0123456789.")
+	number = strings.TrimSpace(strings.TrimSuffix(number, unit))
+
+	multiplier := int64(1)
+	switch strings.ToUpper(strings.TrimSpace(unit)) {
+	case "", "B":
+	case "K", "KB", "KIB":
+		multiplier = 1 << 10
+	case "M", "MB", "MIB":
+		multiplier = 1 << 20
+	case "G", "GB", "GIB":
+		multiplier = 1 << 30
+	case "T", "TB", "TIB":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("Invalid size %q, expected a number of bytes like 500MB", s)
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q, expected a number of bytes like 500MB", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
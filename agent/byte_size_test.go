@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatByteSize(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:                      "0B",
+		1023:                   "1023B",
+		1024:                   "1.0KB",
+		1536:                   "1.5KB",
+		5 * 1024 * 1024:        "5.0MB",
+		3 * 1024 * 1024 * 1024: "3.0GB",
+	} {
+		assert.Equal(t, expected, formatByteSize(n))
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"0":      0,
+		"1023":   1023,
+		"100B":   100,
+		"1KB":    1024,
+		"1.5kb":  1536,
+		"500MB":  500 * 1024 * 1024,
+		"500 MB": 500 * 1024 * 1024,
+		"2GiB":   2 * 1024 * 1024 * 1024,
+		"1T":     1024 * 1024 * 1024 * 1024,
+	} {
+		n, err := ParseByteSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, n, s)
+	}
+
+	for _, s := range []string{"", "MB", "500PB", "-5MB", "five"} {
+		_, err := ParseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// withCacheProxy returns a transport that sends requests through the proxy,
+// based on the transport if there is one, or the default transport if not.
+// Unlike HTTP_PROXY and HTTPS_PROXY, it only applies to uploads rather than
+// to everything the agent requests.
+func withCacheProxy(transport http.RoundTripper, proxy *url.URL) http.RoundTripper {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	t.Proxy = http.ProxyURL(proxy)
+	return t
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCacheProxySendsRequestsThroughTheProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Method+" "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: withCacheProxy(nil, proxyURL)}
+
+	req, err := http.NewRequest("PUT", "http://artifacts.example.com/pkg/app.tar.gz", strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, []string{"PUT http://artifacts.example.com/pkg/app.tar.gz"}, proxied)
+}
+
+func TestWithCacheProxyKeepsTheSourceIPs(t *testing.T) {
+	transport := newSourceIPTransport([]net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")})
+
+	proxied := withCacheProxy(transport, &url.URL{Scheme: "http", Host: "cache.local:3128"})
+	assert.Same(t, transport, proxied)
+	assert.NotNil(t, proxied.(*http.Transport).DialContext)
+
+	// The default transport isn't changed
+	assert.NotSame(t, http.DefaultTransport, withCacheProxy(nil, &url.URL{Scheme: "http", Host: "cache.local:3128"}))
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// correlationTransport adds a correlation ID header to every request
+type correlationTransport struct {
+	// The correlation ID to send
+	ID string
+
+	// Delegate is the underlying HTTP transport
+	Delegate http.RoundTripper
+}
+
+func (t *correlationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers shouldn't modify the request they were given
+	req = req.Clone(req.Context())
+	req.Header.Set(api.CorrelationIDHeader, t.ID)
+
+	return t.Delegate.RoundTrip(req)
+}
+
+// withCorrelationID wraps the client's transport so requests carry the
+// correlation ID, if there is one
+func withCorrelationID(client *http.Client, id string) *http.Client {
+	if id == "" {
+		return client
+	}
+
+	delegate := client.Transport
+	if delegate == nil {
+		delegate = http.DefaultTransport
+	}
+
+	wrapped := *client
+	wrapped.Transport = &correlationTransport{ID: id, Delegate: delegate}
+	return &wrapped
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+func TestWithCorrelationID(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header.Get(api.CorrelationIDHeader)
+	}))
+	defer server.Close()
+
+	client := &http.Client{}
+	res, err := withCorrelationID(client, "llamas").Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if received != "llamas" {
+		t.Errorf("Expected the correlation ID header to be %q, got %q", "llamas", received)
+	}
+
+	if client.Transport != nil {
+		t.Errorf("Expected the original client to be left alone")
+	}
+
+	if withCorrelationID(client, "") != client {
+		t.Errorf("Expected the client to be unchanged without a correlation ID")
+	}
+}
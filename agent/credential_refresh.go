@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// credentialRefresher reads an uploader's credentials again when an upload
+// fails because they've expired, and retries the upload straight away rather
+// than waiting out a retry interval. Uploads running at the same time fail
+// together when credentials rotate, so they share a single refresh.
+type credentialRefresher struct {
+	logger   logger.Logger
+	uploader RefreshableUploader
+
+	// The number of times the credentials have been refreshed
+	refreshes int
+	mu        sync.Mutex
+}
+
+// newCredentialRefresher returns a refresher for the uploader, or nil if the
+// uploader can't refresh its credentials
+func newCredentialRefresher(l logger.Logger, uploader Uploader) *credentialRefresher {
+	refreshable, ok := uploader.(RefreshableUploader)
+	if !ok {
+		return nil
+	}
+	return &credentialRefresher{logger: l, uploader: refreshable}
+}
+
+// upload uploads the artifact, refreshing the credentials and trying once
+// more if they'd expired
+func (r *credentialRefresher) upload(ctx context.Context, uploader Uploader, artifact *api.Artifact) error {
+	if r == nil {
+		return uploadWithContext(ctx, uploader, artifact)
+	}
+
+	r.mu.Lock()
+	refreshes := r.refreshes
+	r.mu.Unlock()
+
+	err := uploadWithContext(ctx, uploader, artifact)
+	if err == nil || !r.uploader.CredentialsExpired(err) {
+		return err
+	}
+
+	if refreshErr := r.refresh(refreshes, artifact); refreshErr != nil {
+		return fmt.Errorf("%v, and the credentials couldn't be refreshed (%v)", err, refreshErr)
+	}
+
+	return uploadWithContext(ctx, uploader, artifact)
+}
+
+// count returns the number of times the credentials have been refreshed, to
+// pass to refresh after an attempt fails
+func (r *credentialRefresher) count() int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refreshes
+}
+
+// refresh reads the credentials again, unless another upload has already
+// refreshed them since this one started
+func (r *credentialRefresher) refresh(refreshes int, artifact *api.Artifact) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.refreshes != refreshes {
+		return nil
+	}
+
+	r.logger.Info("The upload credentials were rejected as expired while uploading %s, reading them again", artifact.Path)
+	if err := r.uploader.RefreshCredentials(); err != nil {
+		return err
+	}
+
+	r.refreshes++
+	r.logger.Info("Refreshed the upload credentials (%d times so far)", r.refreshes)
+	return nil
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+var errExpiredCredentials = errors.New("expired credentials")
+
+// rotatingUploader rejects uploads made with credentials older than the
+// current ones
+type rotatingUploader struct {
+	mu         sync.Mutex
+	current    int
+	using      int
+	refreshes  int
+	refreshErr error
+	uploaded   []string
+}
+
+func (u *rotatingUploader) URL(*api.Artifact) string { return "" }
+
+func (u *rotatingUploader) Upload(artifact *api.Artifact) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.using != u.current {
+		return errExpiredCredentials
+	}
+	u.uploaded = append(u.uploaded, artifact.Path)
+	return nil
+}
+
+func (u *rotatingUploader) CredentialsExpired(err error) bool {
+	return err == errExpiredCredentials
+}
+
+func (u *rotatingUploader) RefreshCredentials() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.refreshErr != nil {
+		return u.refreshErr
+	}
+	u.refreshes++
+	u.using = u.current
+	return nil
+}
+
+func TestCredentialRefresherRetriesWithRefreshedCredentials(t *testing.T) {
+	uploader := &rotatingUploader{current: 1}
+	refresher := newCredentialRefresher(logger.Discard, uploader)
+
+	var wg sync.WaitGroup
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			assert.NoError(t, refresher.upload(context.Background(), uploader, &api.Artifact{Path: path}))
+		}(path)
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []string{"a.txt", "b.txt", "c.txt"}, uploader.uploaded)
+	assert.Equal(t, 1, uploader.refreshes)
+}
+
+func TestCredentialRefresherReportsRefreshErrors(t *testing.T) {
+	uploader := &rotatingUploader{current: 1, refreshErr: errors.New("vault is sealed")}
+	refresher := newCredentialRefresher(logger.Discard, uploader)
+
+	err := refresher.upload(context.Background(), uploader, &api.Artifact{Path: "a.txt"})
+	assert.EqualError(t, err, "expired credentials, and the credentials couldn't be refreshed (vault is sealed)")
+}
+
+func TestCredentialRefresherIgnoresUploadersThatCantRefresh(t *testing.T) {
+	assert.Nil(t, newCredentialRefresher(logger.Discard, &FormUploader{}))
+
+	var refresher *credentialRefresher
+	uploader := &rotatingUploader{}
+	assert.NoError(t, refresher.upload(context.Background(), uploader, &api.Artifact{Path: "a.txt"}))
+}
+
+func TestCredentialRefresherRefreshesArtifactoryCredentials(t *testing.T) {
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if user, password, _ := req.BasicAuth(); user != "llama" || password != "rotated" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(rw, `{"errors":[{"status":401,"message":"Bad credentials"}]}`)
+			return
+		}
+		uploaded = append(uploaded, req.URL.Path)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL,
+		"BUILDKITE_ARTIFACTORY_USER":     "llama",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "expired",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	uploader, err := NewArtifactoryUploader(logger.Discard, ArtifactoryUploaderConfig{Destination: "rt://my-repo/builds"})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "credential-refresh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("llamas"), 0600))
+
+	os.Setenv("BUILDKITE_ARTIFACTORY_PASSWORD", "rotated")
+
+	refresher := newCredentialRefresher(logger.Discard, uploader)
+	require.NotNil(t, refresher)
+	assert.NoError(t, refresher.upload(context.Background(), uploader, &api.Artifact{Path: "a.txt", AbsolutePath: path}))
+
+	assert.Equal(t, []string{"/my-repo/builds/a.txt"}, uploaded)
+	assert.Equal(t, 1, refresher.refreshes)
+}
+
+func TestUploadersDetectExpiredCredentials(t *testing.T) {
+	s3 := &S3Uploader{}
+	assert.True(t, s3.CredentialsExpired(awserr.New("ExpiredToken", "The provided token has expired.", nil)))
+	assert.False(t, s3.CredentialsExpired(awserr.New("NoSuchBucket", "The specified bucket does not exist", nil)))
+
+	gs := &GSUploader{}
+	assert.True(t, gs.CredentialsExpired(&gsUploadError{path: "a.txt", err: &googleapi.Error{Code: http.StatusUnauthorized}}))
+	assert.False(t, gs.CredentialsExpired(&gsUploadError{path: "a.txt", err: &googleapi.Error{Code: http.StatusNotFound}}))
+
+	rt := &ArtifactoryUploader{}
+	assert.True(t, rt.CredentialsExpired(&errorResponse{Response: &http.Response{StatusCode: http.StatusUnauthorized}}))
+	assert.False(t, rt.CredentialsExpired(errors.New("connection reset")))
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// errFreeSpaceUnsupported is returned by freeDiskSpace on platforms where
+// free space can't be measured
+var errFreeSpaceUnsupported = errors.New("Measuring free disk space isn't supported on this platform")
+
+// stagingDir creates a temporary directory for files generated as part of the
+// upload, after checking there's room for at least required bytes in it. The
+// caller is responsible for removing it.
+func (a *ArtifactUploader) stagingDir(purpose string, required int64) (string, error) {
+	dir, err := ioutil.TempDir(a.conf.TempDir, "buildkite-artifact-"+purpose)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create a temporary directory for %s (%v)", purpose, err)
+	}
+
+	free, err := freeDiskSpace(dir)
+	if err == errFreeSpaceUnsupported {
+		a.logger.Debug("%s, not checking for room for %s", err, purpose)
+		return dir, nil
+	} else if err != nil {
+		a.logger.Warn("Couldn't check for free space in %s (%v)", dir, err)
+		return dir, nil
+	}
+
+	if required > 0 && uint64(required) > free {
+		return dir, fmt.Errorf("Not enough free space in %s for %s, which needs about %s but only %s is available. Free up some space, or use --tmp-dir to use a different temporary directory",
+			dir, purpose, formatByteSize(required), formatByteSize(int64(free)))
+	}
+
+	a.logger.Debug("Using %s for %s (needs about %s, %s free)", dir, purpose, formatByteSize(required), formatByteSize(int64(free)))
+
+	return dir, nil
+}
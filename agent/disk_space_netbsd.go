@@ -0,0 +1,17 @@
+// +build netbsd
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem containing dir. NetBSD only has statvfs, which counts blocks in
+// fragments.
+func freeDiskSpace(dir string) (uint64, error) {
+	var stat unix.Statvfs_t
+	if err := unix.Statvfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Frsize), nil
+}
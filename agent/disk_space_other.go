@@ -0,0 +1,7 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly,!windows
+
+package agent
+
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
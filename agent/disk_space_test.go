@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagingDirChecksFreeSpace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "staging-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{TempDir: tmp})
+
+	dir, err := uploader.stagingDir("testing", 1024)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(dir, tmp))
+
+	if _, err := freeDiskSpace(tmp); err == errFreeSpaceUnsupported {
+		t.Skip(err)
+	}
+
+	_, err = uploader.stagingDir("testing", 1<<62)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--tmp-dir")
+	}
+}
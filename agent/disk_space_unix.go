@@ -0,0 +1,16 @@
+// +build linux darwin freebsd dragonfly
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem containing dir
+func freeDiskSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
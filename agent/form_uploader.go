@@ -2,20 +2,21 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "crypto/sha512" // import sha512 to make sha512 ssl certs work
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptrace"
-	"net/http/httputil"
 	"regexp"
 	"strings"
 
 	// "net/http/httputil"
 	"errors"
 	"net/url"
-	"os"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -26,9 +27,33 @@ var ArtifactPathVariableRegex = regexp.MustCompile("\\$\\{artifact\\:path\\}")
 // FormUploader uploads to S3 as a single signed POST, which have a hard limit of 5Gb.
 var maxFormUploadedArtifactSize = int64(5368709120)
 
+// The header that carries each chunk's SHA-256 checksum when uploading in chunks
+const DefaultChunkChecksumHeader = "X-Chunk-Checksum"
+
 type FormUploaderConfig struct {
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
+
+	// Whether to leave credentials in the HTTP debug output, rather than
+	// redacting them
+	DebugHTTPUnsafe bool
+
+	// If set, files are sent as a series of requests of at most this many
+	// bytes, rather than in a single request
+	ChunkSize int64
+
+	// The header each chunk's checksum is sent in, defaults to
+	// DefaultChunkChecksumHeader
+	ChunkChecksumHeader string
+
+	// If set, sent as a header with every request
+	CorrelationID string
+
+	// If set, used to make requests instead of the default transport
+	Transport http.RoundTripper
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
 }
 
 type FormUploader struct {
@@ -52,34 +77,86 @@ func (u *FormUploader) URL(artifact *api.Artifact) string {
 	return ""
 }
 
+func (u *FormUploader) MaxArtifactSize() int64 {
+	return maxFormUploadedArtifactSize
+}
+
 func (u *FormUploader) Upload(artifact *api.Artifact) error {
+	return u.UploadWithContext(context.Background(), artifact)
+}
+
+// UploadWithContext uploads the artifact, aborting the request if the context
+// is done before it's finished
+func (u *FormUploader) UploadWithContext(ctx context.Context, artifact *api.Artifact) error {
+	if u.conf.ChunkSize > 0 {
+		return u.uploadChunks(ctx, artifact)
+	}
+
 	if artifact.FileSize > maxFormUploadedArtifactSize {
 		return errors.New(fmt.Sprintf("File size (%d bytes) exceeds the maximum supported by Buildkite's default artifact storage (5Gb). Alternative artifact storage options may support larger files.", artifact.FileSize))
 	}
 
 	// Create a HTTP request for uploading the file
-	request, err := createUploadRequest(u.logger, artifact)
+	request, err := createUploadRequest(u.logger, artifact, u.conf.Open)
 	if err != nil {
 		return err
 	}
 
+	return u.do(ctx, artifact, request)
+}
+
+// uploadChunks sends the file as a series of requests, each with the same
+// form fields as a single upload and a file part of at most ChunkSize bytes.
+// Each request carries a Content-Range header with the chunk's position in
+// the file, and the hex encoded SHA-256 of the chunk in the checksum header
+// so the receiving service can validate it before accepting the next one.
+func (u *FormUploader) uploadChunks(ctx context.Context, artifact *api.Artifact) error {
+	header := u.conf.ChunkChecksumHeader
+	if header == "" {
+		header = DefaultChunkChecksumHeader
+	}
+
+	chunks := (artifact.FileSize + u.conf.ChunkSize - 1) / u.conf.ChunkSize
+	if chunks == 0 {
+		// An empty file is still sent, as a single empty chunk
+		chunks = 1
+	}
+
+	for i := int64(0); i < chunks; i++ {
+		offset := i * u.conf.ChunkSize
+		size := u.conf.ChunkSize
+		if offset+size > artifact.FileSize {
+			size = artifact.FileSize - offset
+		}
+
+		request, err := createChunkUploadRequest(artifact, u.conf.Open, offset, size, header)
+		if err != nil {
+			return err
+		}
+
+		u.logger.Debug("Uploading chunk %d/%d of %s (%d bytes)", i+1, chunks, artifact.Path, size)
+
+		if err := u.do(ctx, artifact, request); err != nil {
+			return fmt.Errorf("Error uploading chunk %d/%d: %v", i+1, chunks, err)
+		}
+	}
+
+	return nil
+}
+
+func (u *FormUploader) do(ctx context.Context, artifact *api.Artifact, request *http.Request) error {
+	var err error
+
+	request = request.WithContext(ctx)
+
+	debugger := httpDebugger{logger: u.logger, unsafe: u.conf.DebugHTTPUnsafe}
+
 	if u.conf.DebugHTTP {
 		// If the request is a multi-part form, then it's probably a
 		// file upload, in which case we don't want to spewing out the
 		// file contents into the debug log (especially if it's been
 		// gzipped)
-		var requestDump []byte
-		if strings.Contains(request.Header.Get("Content-Type"), "multipart/form-data") {
-			requestDump, err = httputil.DumpRequestOut(request, false)
-		} else {
-			requestDump, err = httputil.DumpRequestOut(request, true)
-		}
-
-		if err != nil {
-			u.logger.Debug("\nERR: %s\n%s", err, string(requestDump))
-		} else {
-			u.logger.Debug("\n%s", string(requestDump))
-		}
+		debugger.dumpRequest(request, !strings.Contains(request.Header.Get("Content-Type"), "multipart/form-data"))
 
 		// configure the HTTP request to log the server IP. The IPs for s3.amazonaws.com
 		// rotate every 5 seconds, and if one of them is misbehaving it may be helpful to
@@ -93,10 +170,10 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	}
 
 	// Create the client
-	client := &http.Client{}
+	client := withCorrelationID(&http.Client{Transport: u.conf.Transport}, u.conf.CorrelationID)
 
 	// Perform the request
-	u.logger.Debug("%s %s", request.Method, request.URL)
+	u.logger.Debug("%s %s", request.Method, debugger.url(request.URL))
 	response, err := client.Do(request)
 
 	// Check for errors
@@ -108,12 +185,7 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 		defer response.Body.Close()
 
 		if u.conf.DebugHTTP {
-			responseDump, err := httputil.DumpResponse(response, true)
-			if err != nil {
-				u.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
-			} else {
-				u.logger.Debug("\n%s", string(responseDump))
-			}
+			debugger.dumpResponse(response)
 		}
 
 		if response.StatusCode/100 != 2 {
@@ -124,8 +196,7 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 			}
 
 			// Return a custom error with the response body from the page
-			message := fmt.Sprintf("%s (%d)", body, response.StatusCode)
-			return errors.New(message)
+			return &formUploadError{StatusCode: response.StatusCode, Body: body.String()}
 		}
 	}
 
@@ -133,7 +204,7 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 }
 
 // Creates a new file upload http request with optional extra params
-func createUploadRequest(l logger.Logger, artifact *api.Artifact) (*http.Request, error) {
+func createUploadRequest(l logger.Logger, artifact *api.Artifact, open ArtifactOpener) (*http.Request, error) {
 	streamer := newMultipartStreamer()
 
 	// Set the post data for the request
@@ -148,15 +219,21 @@ func createUploadRequest(l logger.Logger, artifact *api.Artifact) (*http.Request
 		}
 	}
 
-	fh, err := os.Open(artifact.AbsolutePath)
+	fh, err := openArtifactFile(open, artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := artifactFileSize(fh)
 	if err != nil {
+		fh.Close()
 		return nil, err
 	}
 
 	// It's important that we add the form field last because when
 	// uploading to an S3 form, they are really nit-picky about the field
 	// order, and the file needs to be the last one other it doesn't work.
-	if err := streamer.WriteFile(artifact.UploadInstructions.Action.FileInput, artifact.Path, fh); err != nil {
+	if err := streamer.WriteReader(artifact.UploadInstructions.Action.FileInput, artifact.Path, fh, size, fh); err != nil {
 		fh.Close()
 		return nil, err
 	}
@@ -184,6 +261,61 @@ func createUploadRequest(l logger.Logger, artifact *api.Artifact) (*http.Request
 	return req, nil
 }
 
+// Creates a file upload http request for a single chunk of the artifact
+func createChunkUploadRequest(artifact *api.Artifact, open ArtifactOpener, offset, size int64, checksumHeader string) (*http.Request, error) {
+	fh, err := openArtifactFile(open, artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checksum the chunk first, as the header has to be sent before the body
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(fh, offset, size)); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	streamer := newMultipartStreamer()
+
+	for key, val := range artifact.UploadInstructions.Data {
+		newVal := ArtifactPathVariableRegex.ReplaceAllLiteralString(val, artifact.Path)
+		if err := streamer.WriteField(key, newVal); err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+
+	if err := streamer.WriteReader(artifact.UploadInstructions.Action.FileInput, artifact.Path, io.NewSectionReader(fh, offset, size), size, fh); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	uri, err := url.Parse(artifact.UploadInstructions.Action.URL)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	uri.Path = artifact.UploadInstructions.Action.Path
+
+	req, err := http.NewRequest(artifact.UploadInstructions.Action.Method, uri.String(), streamer.Reader())
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", streamer.ContentType)
+	if size > 0 {
+		req.Header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+size-1, artifact.FileSize))
+	} else {
+		req.Header.Add("Content-Range", fmt.Sprintf("bytes */%d", artifact.FileSize))
+	}
+	req.Header.Add(checksumHeader, hex.EncodeToString(hash.Sum(nil)))
+	req.ContentLength = streamer.Len()
+
+	return req, nil
+}
+
 // A wrapper around the complexities of streaming a multipart file and fields to
 // an http endpoint that infuriatingly requires a Content-Length
 // Derived from https://github.com/technoweenie/multipartstreamer
@@ -217,27 +349,23 @@ func (m *multipartStreamer) WriteField(key, value string) error {
 	return m.bodyWriter.WriteField(key, value)
 }
 
-// WriteFile writes the multi-part preamble which will be followed by file data
+// WriteReader writes the multi-part preamble which will be followed by size
+// bytes of file data read from r. The closer is closed along with the Reader.
 // This can only be called once and must be the last thing written to the streamer
-func (m *multipartStreamer) WriteFile(key, artifactPath string, fh http.File) error {
+func (m *multipartStreamer) WriteReader(key, artifactPath string, r io.Reader, size int64, closer io.Closer) error {
 	if m.reader != nil {
-		return errors.New("WriteFile can't be called multiple times")
+		return errors.New("WriteReader can't be called multiple times")
 	}
 
 	// Set up a reader that combines the body, the file and the closer in a stream
 	m.reader = &multipartReadCloser{
-		Reader: io.MultiReader(m.bodyBuffer, fh, m.closeBuffer),
-		fh:     fh,
-	}
-
-	stat, err := fh.Stat()
-	if err != nil {
-		return err
+		Reader: io.MultiReader(m.bodyBuffer, r, m.closeBuffer),
+		fh:     closer,
 	}
 
-	m.contentLength = stat.Size()
+	m.contentLength = size
 
-	_, err = m.bodyWriter.CreateFormFile(key, artifactPath)
+	_, err := m.bodyWriter.CreateFormFile(key, artifactPath)
 	return err
 }
 
@@ -253,9 +381,20 @@ func (m *multipartStreamer) Reader() io.ReadCloser {
 
 type multipartReadCloser struct {
 	io.Reader
-	fh http.File
+	fh io.Closer
 }
 
 func (mrc *multipartReadCloser) Close() error {
 	return mrc.fh.Close()
 }
+
+// formUploadError is an error response from Buildkite artifact storage,
+// keeping its status so the upload can be retried accordingly
+type formUploadError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *formUploadError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Body, e.StatusCode)
+}
@@ -2,6 +2,8 @@ package agent
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -186,3 +188,91 @@ func TestFormUploadTooBig(t *testing.T) {
 		t.Errorf("Expected polite error message when uploading a file over 5Gb")
 	}
 }
+
+func TestFormUploadingInChunks(t *testing.T) {
+	content := []byte("llamas are better than alpacas")
+
+	var received bytes.Buffer
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		file, _, err := req.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		chunk, _ := ioutil.ReadAll(file)
+		sum := sha256.Sum256(chunk)
+		if got := req.Header.Get("X-Llama-Checksum"); got != hex.EncodeToString(sum[:]) {
+			t.Errorf("Bad chunk checksum %q", got)
+			http.Error(rw, "Bad checksum", http.StatusBadRequest)
+			return
+		}
+
+		if path := req.FormValue("path"); path != "llamas.txt" {
+			t.Errorf("Bad path content %q", path)
+		}
+
+		ranges = append(ranges, req.Header.Get("Content-Range"))
+		received.Write(chunk)
+	}))
+	defer server.Close()
+
+	temp, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(temp)
+
+	abspath := filepath.Join(temp, "llamas.txt")
+	if err := ioutil.WriteFile(abspath, content, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := NewFormUploader(logger.Discard, FormUploaderConfig{
+		ChunkSize:           8,
+		ChunkChecksumHeader: "X-Llama-Checksum",
+	})
+	artifact := &api.Artifact{
+		ID:           "xxxxx-xxxx-xxxx-xxxx-xxxxxxxxxx",
+		Path:         "llamas.txt",
+		AbsolutePath: abspath,
+		FileSize:     int64(len(content)),
+		UploadInstructions: &api.ArtifactUploadInstructions{
+			Data: map[string]string{
+				"path": "${artifact:path}",
+			},
+			Action: struct {
+				URL       string "json:\"url,omitempty\""
+				Method    string "json:\"method\""
+				Path      string "json:\"path\""
+				FileInput string "json:\"file_input\""
+			}{
+				URL:       server.URL,
+				Method:    "POST",
+				Path:      "buildkiteartifacts.com",
+				FileInput: "file",
+			}},
+	}
+
+	if err := uploader.Upload(artifact); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.String() != string(content) {
+		t.Errorf("Bad reassembled content %q", received.String())
+	}
+
+	expected := []string{"bytes 0-7/30", "bytes 8-15/30", "bytes 16-23/30", "bytes 24-29/30"}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected %d chunks, got %v", len(expected), ranges)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Errorf("Expected chunk %d to have range %q, got %q", i, expected[i], ranges[i])
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+)
+
+// How long each impersonated access token is valid for, which is at most an
+// hour unless the organisation allows longer
+const gsImpersonatedTokenLifetime = time.Hour
+
+// gsImpersonatedTokenSource makes access tokens for a service account with
+// the IAM Credentials API, using the credentials the service was made with.
+// Those credentials need the Service Account Token Creator role on the
+// service account.
+type gsImpersonatedTokenSource struct {
+	ctx            context.Context
+	service        *iamcredentials.Service
+	serviceAccount string
+	scopes         []string
+}
+
+func (s *gsImpersonatedTokenSource) Token() (*oauth2.Token, error) {
+	res, err := s.service.Projects.ServiceAccounts.GenerateAccessToken(
+		"projects/-/serviceAccounts/"+s.serviceAccount,
+		&iamcredentials.GenerateAccessTokenRequest{
+			Scope:    s.scopes,
+			Lifetime: fmt.Sprintf("%ds", int(gsImpersonatedTokenLifetime.Seconds())),
+		},
+	).Context(s.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating the service account %s (%v)", s.serviceAccount, err)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, res.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating the service account %s, the token's expiry %q is invalid (%v)", s.serviceAccount, res.ExpireTime, err)
+	}
+
+	return &oauth2.Token{AccessToken: res.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// impersonatedGSClient returns a client that makes requests as the service
+// account, using the client's credentials to impersonate it. A token is made
+// straight away, so credentials that can't impersonate it fail before
+// anything is uploaded.
+func impersonatedGSClient(ctx context.Context, client *http.Client, serviceAccount string, scope string) (*http.Client, error) {
+	service, err := iamcredentials.New(client)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := oauth2.ReuseTokenSource(nil, &gsImpersonatedTokenSource{
+		ctx:            ctx,
+		service:        service,
+		serviceAccount: serviceAccount,
+		scopes:         []string{scope},
+	})
+	if _, err := tokens.Token(); err != nil {
+		return nil, err
+	}
+
+	return oauth2.NewClient(ctx, tokens), nil
+}
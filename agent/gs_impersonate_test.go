@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func TestGSImpersonatedTokenSource(t *testing.T) {
+	var requested iamcredentials.GenerateAccessTokenRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/-/serviceAccounts/uploader@other-project.iam.gserviceaccount.com:generateAccessToken" {
+			http.Error(w, `{"error": {"code": 403, "message": "Permission denied"}}`, http.StatusForbidden)
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&requested))
+		w.Write([]byte(`{"accessToken": "llamas", "expireTime": "2030-01-02T03:04:05Z"}`))
+	}))
+	defer server.Close()
+
+	service, err := iamcredentials.New(http.DefaultClient)
+	require.NoError(t, err)
+	service.BasePath = server.URL + "/"
+
+	tokens := &gsImpersonatedTokenSource{
+		ctx:            context.Background(),
+		service:        service,
+		serviceAccount: "uploader@other-project.iam.gserviceaccount.com",
+		scopes:         []string{storage.DevstorageFullControlScope},
+	}
+
+	token, err := tokens.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", token.AccessToken)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), token.Expiry)
+	assert.Equal(t, []string{storage.DevstorageFullControlScope}, requested.Scope)
+	assert.Equal(t, "3600s", requested.Lifetime)
+
+	tokens.serviceAccount = "nobody@other-project.iam.gserviceaccount.com"
+	_, err = tokens.Token()
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Error impersonating the service account nobody@other-project.iam.gserviceaccount.com ("), err.Error())
+}
+
+func TestNewGSUploaderWithAMissingCredentialsFile(t *testing.T) {
+	_, err := NewGSUploader(logger.Discard, GSUploaderConfig{
+		Destination:            "gs://my-bucket",
+		ServiceAccountJSONPath: "/does/not/exist.json",
+	})
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Couldn't read the Google Cloud Storage credentials file /does/not/exist.json ("), err.Error())
+}
+
+func TestGSPresignedURLWhileImpersonating(t *testing.T) {
+	u := &GSUploader{BucketName: "my-bucket", conf: GSUploaderConfig{ImpersonateServiceAccount: "uploader@other-project.iam.gserviceaccount.com"}}
+
+	_, err := u.PresignedURL(nil, time.Hour)
+	assert.EqualError(t, err, "Presigned Google Cloud Storage URLs can't be made while impersonating a service account")
+}
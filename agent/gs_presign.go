@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"golang.org/x/oauth2/google"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// V4 signed URLs are valid for at most a week
+var maxGSPresignedExpiry = 7 * 24 * time.Hour
+
+// gsURLSigner makes V4 signed URLs with a service account's private key, see
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually
+type gsURLSigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+// newGSURLSigner reads the service account credentials GS uploads are made
+// with, which have to be from a key file, as other credentials can't sign
+func newGSURLSigner(vault *VaultClient, credentialsFile string) (*gsURLSigner, error) {
+	data, err := gsServiceAccountJSON(vault, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := google.JWTConfigFromJSON(data, storage.DevstorageReadOnlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the service account credentials (%v)", err)
+	}
+
+	block, _ := pem.Decode(conf.PrivateKey)
+	if block == nil {
+		return nil, errors.New("The service account credentials have no private key")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("The service account's private key isn't an RSA key")
+		}
+		key = rsaKey
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("Error parsing the service account's private key (%v)", err)
+	}
+
+	return &gsURLSigner{email: conf.Email, key: key}, nil
+}
+
+// gsServiceAccountJSON returns the service account credentials from Vault, or
+// else from the credentials file, or else from the environment
+func gsServiceAccountJSON(vault *VaultClient, credentialsFile string) ([]byte, error) {
+	if vault != nil {
+		data, err := vault.Get("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON")
+		if err != nil {
+			return nil, err
+		}
+		if data != "" {
+			return []byte(data), nil
+		}
+	}
+
+	if credentialsFile != "" {
+		return ioutil.ReadFile(credentialsFile)
+	}
+	if data := os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON"); data != "" {
+		return []byte(data), nil
+	}
+	for _, env := range []string{"BUILDKITE_GS_APPLICATION_CREDENTIALS", "GOOGLE_APPLICATION_CREDENTIALS"} {
+		if path := os.Getenv(env); path != "" {
+			return ioutil.ReadFile(path)
+		}
+	}
+
+	return nil, errors.New("Presigned Google Cloud Storage URLs need a service account key, from BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON, BUILDKITE_GS_APPLICATION_CREDENTIALS or GOOGLE_APPLICATION_CREDENTIALS")
+}
+
+// sign returns a URL to GET the object with, valid for expires from now
+func (s *gsURLSigner) sign(bucket, object string, now time.Time, expires time.Duration) (string, error) {
+	const host = "storage.googleapis.com"
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	scope := date + "/auto/storage/goog4_request"
+
+	segments := strings.Split(object, "/")
+	for i, segment := range segments {
+		segments[i] = gsEscape(segment)
+	}
+	path := "/" + gsEscape(bucket) + "/" + strings.Join(segments, "/")
+
+	query := url.Values{}
+	query.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	query.Set("X-Goog-Credential", s.email+"/"+scope)
+	query.Set("X-Goog-Date", timestamp)
+	query.Set("X-Goog-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Goog-SignedHeaders", "host")
+	canonicalQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		timestamp,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return "https://" + host + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// gsEscape percent encodes everything but the unreserved characters, as the
+// canonical request needs
+func gsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~", c) != -1 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// PresignedURL signs a URL to download the artifact with, using the service
+// account's private key
+func (u *GSUploader) PresignedURL(artifact *api.Artifact, expires time.Duration) (string, error) {
+	// The key would sign as the service account doing the impersonating
+	if u.conf.ImpersonateServiceAccount != "" {
+		return "", errors.New("Presigned Google Cloud Storage URLs can't be made while impersonating a service account")
+	}
+
+	u.signerMu.Lock()
+	if u.signer == nil {
+		signer, err := newGSURLSigner(u.conf.Vault, u.conf.ServiceAccountJSONPath)
+		if err != nil {
+			u.signerMu.Unlock()
+			return "", err
+		}
+		u.signer = signer
+	}
+	signer := u.signer
+	u.signerMu.Unlock()
+
+	signedURL, err := signer.sign(u.BucketName, u.artifactPath(artifact), time.Now(), expires)
+	if err != nil {
+		return "", fmt.Errorf("Error presigning a URL for %q: %v", artifact.Path, err)
+	}
+	return signedURL, nil
+}
+
+func (u *GSUploader) MaxPresignedExpiry() time.Duration {
+	return maxGSPresignedExpiry
+}
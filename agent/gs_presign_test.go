@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGSURLSignerSigns(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer := &gsURLSigner{email: "uploader@project.iam.gserviceaccount.com", key: key}
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	signedURL, err := signer.sign("my-bucket", "builds/123/log/a b+c.txt", now, 36*time.Hour)
+	require.NoError(t, err)
+
+	u, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	assert.Equal(t, "storage.googleapis.com", u.Host)
+	assert.Equal(t, "/my-bucket/builds/123/log/a%20b%2Bc.txt", u.EscapedPath())
+
+	query := u.Query()
+	assert.Equal(t, "GOOG4-RSA-SHA256", query.Get("X-Goog-Algorithm"))
+	assert.Equal(t, "uploader@project.iam.gserviceaccount.com/20220304/auto/storage/goog4_request", query.Get("X-Goog-Credential"))
+	assert.Equal(t, "20220304T050607Z", query.Get("X-Goog-Date"))
+	assert.Equal(t, "129600", query.Get("X-Goog-Expires"))
+	assert.Equal(t, "host", query.Get("X-Goog-SignedHeaders"))
+
+	// The signature is over the request as it's described in the docs
+	canonicalQuery := strings.SplitN(u.RawQuery, "&X-Goog-Signature=", 2)[0]
+	canonicalRequest := "GET\n/my-bucket/builds/123/log/a%20b%2Bc.txt\n" + canonicalQuery + "\nhost:storage.googleapis.com\n\nhost\nUNSIGNED-PAYLOAD"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	digest := sha256.Sum256([]byte("GOOG4-RSA-SHA256\n20220304T050607Z\n20220304/auto/storage/goog4_request\n" + hex.EncodeToString(requestHash[:])))
+
+	signature, err := hex.DecodeString(query.Get("X-Goog-Signature"))
+	require.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+}
+
+func TestNewGSURLSignerReadsServiceAccountKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "uploader@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	require.NoError(t, err)
+
+	os.Setenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON", string(data))
+	defer os.Unsetenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON")
+
+	signer, err := newGSURLSigner(nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, "uploader@project.iam.gserviceaccount.com", signer.email)
+	assert.Equal(t, key.N, signer.key.N)
+}
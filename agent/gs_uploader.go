@@ -2,20 +2,28 @@ package agent
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
 	storage "google.golang.org/api/storage/v1"
 )
 
@@ -26,6 +34,43 @@ type GSUploaderConfig struct {
 
 	// Whether or not HTTP calls shoud be debugged
 	DebugHTTP bool
+
+	// If set, objects are marked with the time they should be removed
+	ExpireAfter time.Duration
+
+	// If set, credentials are read from Vault before anywhere else
+	Vault *VaultClient
+
+	// If set, sent as a header with every request
+	CorrelationID string
+
+	// If set, used to make requests instead of the default transport
+	Transport http.RoundTripper
+
+	// Whether to place an event-based hold on uploaded objects
+	LegalHold bool
+
+	// Whether to fail the upload of artifacts that already exist, rather
+	// than overwrite them
+	NoOverwrite bool
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
+
+	// If set, the Cache-Control header objects are served with
+	CacheControl string
+
+	// Custom metadata to put on every uploaded object, along with the
+	// artifact's own
+	Metadata map[string]string
+
+	// If set, the service account key file to authenticate with, rather
+	// than the credentials from the environment
+	ServiceAccountJSONPath string
+
+	// If set, the email of a service account to make requests as, which
+	// the credentials are used to impersonate
+	ImpersonateServiceAccount string
 }
 
 type GSUploader struct {
@@ -41,20 +86,53 @@ type GSUploader struct {
 	// The logger instance to use
 	logger logger.Logger
 
-	// The GS service
-	service *storage.Service
+	// The GS service, replaced when the credentials are refreshed
+	service   *storage.Service
+	serviceMu sync.RWMutex
+
+	// Signs presigned URLs, once they're asked for
+	signer   *gsURLSigner
+	signerMu sync.Mutex
+}
+
+func init() {
+	RegisterUploader("gs", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		if c.ExpireAfter > 0 {
+			l.Warn("Google Cloud Storage has no per-object expiry, objects will be given %q metadata but need to be removed by your own tooling", ArtifactExpiryMetadataKey)
+		}
+
+		return NewGSUploader(l, GSUploaderConfig{
+			Destination:   c.Destination,
+			DebugHTTP:     c.DebugHTTP,
+			ExpireAfter:   c.ExpireAfter,
+			Vault:         c.Vault,
+			CorrelationID: c.CorrelationID,
+			Transport:     c.Transport,
+			LegalHold:     c.LegalHold,
+			NoOverwrite:   c.NoOverwrite,
+			Open:          c.Open,
+			CacheControl:  c.GSCacheControl,
+			Metadata:      c.Metadata,
+
+			ServiceAccountJSONPath:    c.GSCredentialsFile,
+			ImpersonateServiceAccount: c.GSImpersonate,
+		})
+	})
 }
 
 func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
-	client, err := newGoogleClient(storage.DevstorageFullControlScope)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
-	}
-	service, err := storage.New(client)
+	service, err := newGSService(c)
 	if err != nil {
 		return nil, err
 	}
 	bucketName, bucketPath := ParseGSDestination(c.Destination)
+
+	if c.LegalHold {
+		if err := checkGSHoldPermission(service, bucketName); err != nil {
+			return nil, err
+		}
+	}
+
 	return &GSUploader{
 		BucketPath: bucketPath,
 		BucketName: bucketName,
@@ -64,6 +142,106 @@ func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
 	}, nil
 }
 
+// newGSService creates a GS service with credentials from Vault, or else
+// from the service account key file, or else from the environment. If
+// ImpersonateServiceAccount is set, the credentials are used to impersonate
+// it, and requests are made as that service account.
+func newGSService(c GSUploaderConfig) (*storage.Service, error) {
+	// The OAuth2 client makes its requests with the client in the context
+	ctx := context.Background()
+	if c.Transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: c.Transport})
+	}
+
+	// Credentials that impersonate a service account only need to be able
+	// to use the IAM Credentials API
+	scope := storage.DevstorageFullControlScope
+	if c.ImpersonateServiceAccount != "" {
+		scope = iamcredentials.CloudPlatformScope
+	}
+
+	var client *http.Client
+	var err error
+	if c.Vault != nil {
+		var data string
+		if data, err = c.Vault.Get("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON"); err != nil {
+			return nil, err
+		} else if data != "" {
+			client, err = clientFromJSON(ctx, []byte(data), scope)
+		}
+	}
+	if client == nil && err == nil && c.ServiceAccountJSONPath != "" {
+		data, readErr := ioutil.ReadFile(c.ServiceAccountJSONPath)
+		if readErr != nil {
+			return nil, fmt.Errorf("Couldn't read the Google Cloud Storage credentials file %s (%v)", c.ServiceAccountJSONPath, readErr)
+		}
+		client, err = clientFromJSON(ctx, data, scope)
+	}
+	if client == nil && err == nil {
+		client, err = newGoogleClient(ctx, scope)
+	}
+	if err == nil && c.ImpersonateServiceAccount != "" {
+		client, err = impersonatedGSClient(ctx, client, c.ImpersonateServiceAccount, storage.DevstorageFullControlScope)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
+	}
+	return storage.New(withCorrelationID(client, c.CorrelationID))
+}
+
+// CredentialsExpired returns whether GS rejected the credentials an upload
+// was made with
+func (u *GSUploader) CredentialsExpired(err error) bool {
+	if uploadErr, ok := err.(*gsUploadError); ok {
+		err = uploadErr.err
+	}
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusUnauthorized
+}
+
+// RefreshCredentials creates the GS service again, reading the credentials
+// from Vault or the environment (including the credentials file)
+func (u *GSUploader) RefreshCredentials() error {
+	if u.conf.Vault != nil {
+		u.conf.Vault.Invalidate()
+	}
+
+	service, err := newGSService(u.conf)
+	if err != nil {
+		return err
+	}
+
+	u.serviceMu.Lock()
+	u.service = service
+	u.serviceMu.Unlock()
+
+	u.signerMu.Lock()
+	u.signer = nil
+	u.signerMu.Unlock()
+	return nil
+}
+
+// The permission needed to place holds on objects
+const gsHoldPermission = "storage.objects.update"
+
+// checkGSHoldPermission returns an error if the credentials can't place holds
+// on objects in the bucket. Any bucket can hold objects, but if it has a
+// default event-based hold then objects are held regardless.
+func checkGSHoldPermission(service *storage.Service, bucket string) error {
+	res, err := service.Buckets.TestIamPermissions(bucket, []string{gsHoldPermission}).Do()
+	if err != nil {
+		return fmt.Errorf("Couldn't check for permission to place holds on objects in %q (%v)", bucket, err)
+	}
+
+	for _, permission := range res.Permissions {
+		if permission == gsHoldPermission {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Holds can't be placed on objects in %q, the credentials need the %s permission", bucket, gsHoldPermission)
+}
+
 func ParseGSDestination(destination string) (name string, path string) {
 	parts := strings.Split(strings.TrimPrefix(string(destination), "gs://"), "/")
 	path = strings.Join(parts[1:len(parts)], "/")
@@ -71,26 +249,26 @@ func ParseGSDestination(destination string) (name string, path string) {
 	return
 }
 
-func clientFromJSON(data []byte, scope string) (*http.Client, error) {
+func clientFromJSON(ctx context.Context, data []byte, scope string) (*http.Client, error) {
 	conf, err := google.JWTConfigFromJSON(data, scope)
 	if err != nil {
 		return nil, err
 	}
-	return conf.Client(oauth2.NoContext), nil
+	return conf.Client(ctx), nil
 }
 
-func newGoogleClient(scope string) (*http.Client, error) {
+func newGoogleClient(ctx context.Context, scope string) (*http.Client, error) {
 	if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON") != "" {
 		data := []byte(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON"))
-		return clientFromJSON(data, scope)
+		return clientFromJSON(ctx, data, scope)
 	} else if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS") != "" {
 		data, err := ioutil.ReadFile(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"))
 		if err != nil {
 			return nil, err
 		}
-		return clientFromJSON(data, scope)
+		return clientFromJSON(ctx, data, scope)
 	}
-	return google.DefaultClient(context.Background(), scope)
+	return google.DefaultClient(ctx, scope)
 }
 
 func (u *GSUploader) URL(artifact *api.Artifact) string {
@@ -120,7 +298,20 @@ func (u *GSUploader) URL(artifact *api.Artifact) string {
 	return artifactURL.String()
 }
 
+// The largest object Google Cloud Storage can store
+var maxGSObjectSize = int64(5 * 1024 * 1024 * 1024 * 1024)
+
+func (u *GSUploader) MaxArtifactSize() int64 {
+	return maxGSObjectSize
+}
+
 func (u *GSUploader) Upload(artifact *api.Artifact) error {
+	return u.UploadWithContext(context.Background(), artifact)
+}
+
+// UploadWithContext uploads the artifact, aborting the request to GS if the
+// context is done before it's finished
+func (u *GSUploader) UploadWithContext(ctx context.Context, artifact *api.Artifact) error {
 	permission := os.Getenv("BUILDKITE_GS_ACL")
 
 	// The dirtiest validation method ever...
@@ -143,22 +334,133 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	object := &storage.Object{
 		Name:               u.artifactPath(artifact),
 		ContentType:        artifact.ContentType,
+		ContentEncoding:    artifact.ContentEncoding,
 		ContentDisposition: u.contentDisposition(artifact),
+		CacheControl:       u.conf.CacheControl,
+		Metadata:           objectMetadata(u.conf.Metadata, artifact),
+	}
+	if u.conf.LegalHold {
+		object.EventBasedHold = true
+	}
+	// GS has no per-object TTL, so we record when the object should expire
+	if u.conf.ExpireAfter > 0 {
+		if object.Metadata == nil {
+			object.Metadata = map[string]string{}
+		}
+		object.Metadata[ArtifactExpiryMetadataKey] = time.Now().Add(u.conf.ExpireAfter).UTC().Format(time.RFC3339)
 	}
-	file, err := os.Open(artifact.AbsolutePath)
+	file, err := openArtifactFile(u.conf.Open, artifact)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
 	}
+	defer file.Close()
+	u.serviceMu.RLock()
 	call := u.service.Objects.Insert(u.BucketName, object)
+	u.serviceMu.RUnlock()
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
 	}
-	if res, err := call.Media(file, googleapi.ContentType("")).Do(); err == nil {
+	// Only creating the object if it has no generation yet makes GS refuse
+	// to overwrite it
+	if u.conf.NoOverwrite {
+		call = call.IfGenerationMatch(0)
+	}
+	if res, err := call.Media(file, googleapi.ContentType("")).Context(ctx).Do(); err == nil {
 		u.logger.Debug("Created object %v at location %v\n\n", res.Name, res.SelfLink)
+	} else if apiErr, ok := err.(*googleapi.Error); ok && u.conf.NoOverwrite && apiErr.Code == http.StatusPreconditionFailed {
+		return &artifactExistsError{Key: u.artifactPath(artifact)}
 	} else {
-		return errors.New(fmt.Sprintf("Failed to PUT file \"%s\" (%v)", u.artifactPath(artifact), err))
+		return &gsUploadError{path: u.artifactPath(artifact), err: err}
+	}
+
+	return nil
+}
+
+// UploadDirectory creates a zero-byte object with the directory's name and a
+// trailing /, which is how the Cloud Console shows a folder
+func (u *GSUploader) UploadDirectory(path string) error {
+	name := u.artifactPath(&api.Artifact{Path: strings.TrimSuffix(path, "/")}) + "/"
+	u.logger.Debug("Creating \"%s\" in bucket \"%s\"", name, u.BucketName)
+
+	u.serviceMu.RLock()
+	call := u.service.Objects.Insert(u.BucketName, &storage.Object{Name: name})
+	u.serviceMu.RUnlock()
+	if permission := os.Getenv("BUILDKITE_GS_ACL"); permission != "" {
+		call = call.PredefinedAcl(permission)
+	}
+
+	if _, err := call.Media(strings.NewReader("")).Do(); err != nil {
+		return &gsUploadError{path: name, err: err}
+	}
+	return nil
+}
+
+// Verify compares the MD5 of the uploaded object with that of the artifact's
+// file, or its CRC32C if it's a composite object without an MD5
+func (u *GSUploader) Verify(artifact *api.Artifact) error {
+	u.serviceMu.RLock()
+	call := u.service.Objects.Get(u.BucketName, u.artifactPath(artifact))
+	u.serviceMu.RUnlock()
+
+	object, err := call.Fields("md5Hash", "crc32c").Do()
+	if err != nil {
+		return &gsUploadError{path: u.artifactPath(artifact), err: err}
+	}
+
+	return u.compareChecksums(artifact, object, false)
+}
+
+// Unchanged returns whether the object for the artifact is the same size as
+// the artifact's file and has the same checksum
+func (u *GSUploader) Unchanged(artifact *api.Artifact) (bool, error) {
+	u.serviceMu.RLock()
+	call := u.service.Objects.Get(u.BucketName, u.artifactPath(artifact))
+	u.serviceMu.RUnlock()
+
+	object, err := call.Fields("size", "md5Hash", "crc32c").Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, &gsUploadError{path: u.artifactPath(artifact), err: err}
+	}
+
+	err = u.compareChecksums(artifact, object, true)
+	if _, ok := err.(*artifactVerifyError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// compareChecksums returns an artifactVerifyError if the object's MD5, or
+// its CRC32C if it has no MD5, (and its size, if checkSize is set) doesn't
+// match the artifact's file
+func (u *GSUploader) compareChecksums(artifact *api.Artifact, object *storage.Object, checkSize bool) error {
+	file, err := openArtifactFile(u.conf.Open, artifact)
+	if err != nil {
+		return fmt.Errorf("Failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer file.Close()
+
+	md5Hash, crc32cHash := md5.New(), crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	size, err := io.Copy(io.MultiWriter(md5Hash, crc32cHash), file)
+	if err != nil {
+		return fmt.Errorf("Failed to read file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	// A partial upload of the file is never the same size as it
+	if checkSize && object.Size != uint64(size) {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: "size", Local: strconv.FormatInt(size, 10), Remote: strconv.FormatUint(object.Size, 10)}
 	}
 
+	// GS has both as base64, with the CRC32C big-endian
+	checksum, local, remote := "MD5", base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)), object.Md5Hash
+	if remote == "" {
+		checksum, local, remote = "CRC32C", base64.StdEncoding.EncodeToString(crc32cHash.Sum(nil)), object.Crc32c
+	}
+
+	if local != remote {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: checksum, Local: local, Remote: remote}
+	}
 	return nil
 }
 
@@ -169,5 +471,23 @@ func (u *GSUploader) artifactPath(artifact *api.Artifact) string {
 }
 
 func (u *GSUploader) contentDisposition(a *api.Artifact) string {
+	if a.ContentDisposition != "" {
+		return a.ContentDisposition
+	}
 	return fmt.Sprintf("inline; filename=\"%s\"", filepath.Base(a.Path))
 }
+
+// gsUploadError is an error from GS uploading an object, keeping the error
+// from GS so it can be checked for expired credentials
+type gsUploadError struct {
+	path string
+	err  error
+}
+
+func (e *gsUploadError) Error() string {
+	return fmt.Sprintf("Failed to PUT file \"%s\" (%v)", e.path, e.err)
+}
+
+func (e *gsUploadError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// What secrets are replaced with in HTTP debug output
+const redacted = "[REDACTED]"
+
+// The headers that carry credentials, which are redacted from HTTP debug
+// output
+var sensitiveHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"X-Amz-Security-Token": true,
+	"X-Jfrog-Art-Api":      true,
+}
+
+// The query parameters of presigned URLs that carry credentials, which are
+// redacted from HTTP debug output
+var sensitiveQueryParams = map[string]bool{
+	"x-amz-signature":      true,
+	"x-amz-security-token": true,
+	"x-goog-signature":     true,
+	"signature":            true,
+}
+
+// httpDebugger dumps requests and responses to the debug log, for
+// DebugHTTP. Credentials in them are redacted, unless unsafe is set.
+type httpDebugger struct {
+	logger logger.Logger
+	unsafe bool
+}
+
+// dumpRequest logs the request, and its body if body is set
+func (d httpDebugger) dumpRequest(req *http.Request, body bool) {
+	dump, err := httputil.DumpRequestOut(req, body)
+	d.log(dump, err)
+}
+
+// dumpResponse logs the response and its body
+func (d httpDebugger) dumpResponse(resp *http.Response) {
+	dump, err := httputil.DumpResponse(resp, true)
+	d.log(dump, err)
+}
+
+func (d httpDebugger) log(dump []byte, err error) {
+	text := string(dump)
+	if !d.unsafe {
+		text = redactHTTPDump(text)
+	}
+
+	if err != nil {
+		d.logger.Debug("\nERR: %s\n%s", err, text)
+	} else {
+		d.logger.Debug("\n%s", text)
+	}
+}
+
+// url returns the URL to be logged
+func (d httpDebugger) url(u *url.URL) string {
+	if d.unsafe {
+		return u.String()
+	}
+	return redactURL(u.String())
+}
+
+// redactHTTPDump redacts the credentials in the request line and headers of
+// a dumped request or response, leaving its body as it is
+func redactHTTPDump(dump string) string {
+	head, body := dump, ""
+	if i := strings.Index(dump, "\r\n\r\n"); i >= 0 {
+		head, body = dump[:i], dump[i:]
+	}
+
+	lines := strings.Split(head, "\r\n")
+	for i, line := range lines {
+		// The request line, e.g. PUT /key?X-Amz-Signature=... HTTP/1.1
+		if i == 0 {
+			fields := strings.Split(line, " ")
+			if len(fields) == 3 {
+				fields[1] = redactURL(fields[1])
+				lines[i] = strings.Join(fields, " ")
+			}
+			continue
+		}
+
+		name := strings.SplitN(line, ":", 2)[0]
+		if sensitiveHeaders[http.CanonicalHeaderKey(strings.TrimSpace(name))] {
+			lines[i] = name + ": " + redacted
+		}
+	}
+
+	return strings.Join(lines, "\r\n") + body
+}
+
+// redactURL redacts the credentials in the query of a presigned URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+
+	query := u.Query()
+	changed := false
+	for name := range query {
+		if sensitiveQueryParams[strings.ToLower(name)] {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return rawURL
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactURL(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{
+			"https://my-bucket.s3.amazonaws.com/a.txt?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Security-Token=token&X-Amz-Signature=abc123",
+			"https://my-bucket.s3.amazonaws.com/a.txt?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Security-Token=%5BREDACTED%5D&X-Amz-Signature=%5BREDACTED%5D",
+		},
+		{
+			"https://storage.googleapis.com/my-bucket/a.txt?X-Goog-Signature=abc123",
+			"https://storage.googleapis.com/my-bucket/a.txt?X-Goog-Signature=%5BREDACTED%5D",
+		},
+		{
+			"https://my-bucket.s3.amazonaws.com/a.txt?partNumber=1&uploadId=xyz",
+			"https://my-bucket.s3.amazonaws.com/a.txt?partNumber=1&uploadId=xyz",
+		},
+		{"/a.txt", "/a.txt"},
+	} {
+		assert.Equal(t, tc.expected, redactURL(tc.url))
+	}
+}
+
+func TestRedactHTTPDump(t *testing.T) {
+	dump := "PUT /a.txt?X-Amz-Signature=abc123 HTTP/1.1\r\n" +
+		"Host: my-bucket.s3.amazonaws.com\r\n" +
+		"Authorization: AWS4-HMAC-SHA256 Credential=AKID/20221015/us-east-1/s3/aws4_request, Signature=abc123\r\n" +
+		"X-Amz-Security-Token: token\r\n" +
+		"X-JFrog-Art-Api: key\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Authorization: this is the body"
+
+	assert.Equal(t, "PUT /a.txt?X-Amz-Signature=%5BREDACTED%5D HTTP/1.1\r\n"+
+		"Host: my-bucket.s3.amazonaws.com\r\n"+
+		"Authorization: [REDACTED]\r\n"+
+		"X-Amz-Security-Token: [REDACTED]\r\n"+
+		"X-JFrog-Art-Api: [REDACTED]\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Authorization: this is the body", redactHTTPDump(dump))
+}
+
+func TestHTTPDebuggerDumpRequest(t *testing.T) {
+	req, err := http.NewRequest("PUT", "https://my-bucket.s3.amazonaws.com/a.txt?X-Amz-Signature=abc123", strings.NewReader("llamas"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	l := logger.NewBuffer()
+	httpDebugger{logger: l}.dumpRequest(req, true)
+	require.Len(t, l.Messages, 1)
+	assert.NotContains(t, l.Messages[0], "secret")
+	assert.NotContains(t, l.Messages[0], "abc123")
+	assert.Contains(t, l.Messages[0], "Authorization: [REDACTED]")
+	assert.Contains(t, l.Messages[0], "llamas")
+
+	l = logger.NewBuffer()
+	httpDebugger{logger: l, unsafe: true}.dumpRequest(req, true)
+	require.Len(t, l.Messages, 1)
+	assert.Contains(t, l.Messages[0], "Authorization: Bearer secret")
+	assert.Contains(t, l.Messages[0], "X-Amz-Signature=abc123")
+}
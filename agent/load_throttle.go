@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// errLoadUnsupported is returned by systemLoad on platforms where the system
+// load can't be measured
+var errLoadUnsupported = errors.New("Measuring system load isn't supported on this platform")
+
+// loadThrottle limits how many uploads run at once based on the system load.
+// When the load per CPU is over the threshold the limit is halved, and while
+// it's under the limit goes back up one at a time.
+type loadThrottle struct {
+	logger    logger.Logger
+	max       int
+	threshold float64
+	interval  time.Duration
+
+	allowed int
+	active  int
+	cond    *sync.Cond
+
+	// Whether the load can't be measured, so nothing is throttled
+	disabled bool
+
+	stop chan struct{}
+
+	// Replaced in tests
+	load func() (float64, error)
+}
+
+func newLoadThrottle(l logger.Logger, max int, threshold float64) *loadThrottle {
+	return &loadThrottle{
+		logger:    l,
+		max:       max,
+		threshold: threshold,
+		interval:  5 * time.Second,
+		allowed:   max,
+		cond:      sync.NewCond(&sync.Mutex{}),
+		stop:      make(chan struct{}),
+		load:      loadPerCPU,
+	}
+}
+
+func loadPerCPU() (float64, error) {
+	load, err := systemLoad()
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// Start measures the load every interval until Stop is called
+func (t *loadThrottle) Start() {
+	load, err := t.load()
+	if err != nil {
+		t.logger.Debug("Couldn't measure the system load (%v), uploads won't be throttled", err)
+		t.cond.L.Lock()
+		t.disabled = true
+		t.cond.L.Unlock()
+		t.cond.Broadcast()
+		return
+	}
+	t.adjust(load)
+
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				load, err := t.load()
+				if err != nil {
+					t.logger.Debug("Couldn't measure the system load (%v)", err)
+					continue
+				}
+				t.adjust(load)
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (t *loadThrottle) Stop() {
+	close(t.stop)
+}
+
+func (t *loadThrottle) adjust(load float64) {
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+
+	previous := t.allowed
+	if load > t.threshold {
+		t.allowed = t.allowed / 2
+		if t.allowed < 1 {
+			t.allowed = 1
+		}
+	} else if t.allowed < t.max {
+		t.allowed++
+	}
+
+	if t.allowed < previous {
+		t.logger.Info("System load is %.2f per CPU, reducing concurrent uploads to %d", load, t.allowed)
+	} else if t.allowed > previous {
+		t.logger.Debug("System load is %.2f per CPU, increasing concurrent uploads to %d", load, t.allowed)
+		t.cond.Broadcast()
+	}
+}
+
+// Acquire blocks until another upload is allowed to run. A nil loadThrottle
+// doesn't throttle.
+func (t *loadThrottle) Acquire() {
+	if t == nil {
+		return
+	}
+
+	t.cond.L.Lock()
+	for !t.disabled && t.active >= t.allowed {
+		t.cond.Wait()
+	}
+	t.active++
+	t.cond.L.Unlock()
+}
+
+// Release marks an upload acquired with Acquire as finished
+func (t *loadThrottle) Release() {
+	if t == nil {
+		return
+	}
+
+	t.cond.L.Lock()
+	t.active--
+	t.cond.L.Unlock()
+	t.cond.Signal()
+}
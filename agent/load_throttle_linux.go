@@ -0,0 +1,25 @@
+// +build linux
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// systemLoad returns the one minute load average
+func systemLoad() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected /proc/loadavg contents %q", data)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,7 @@
+// +build !linux
+
+package agent
+
+func systemLoad() (float64, error) {
+	return 0, errLoadUnsupported
+}
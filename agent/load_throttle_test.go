@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadThrottleAdjustsToLoad(t *testing.T) {
+	throttle := newLoadThrottle(logger.Discard, 8, 1.0)
+
+	throttle.adjust(2.5)
+	assert.Equal(t, 4, throttle.allowed)
+
+	throttle.adjust(1.5)
+	throttle.adjust(1.5)
+	throttle.adjust(1.5)
+	assert.Equal(t, 1, throttle.allowed)
+
+	for i := 0; i < 10; i++ {
+		throttle.adjust(0.5)
+	}
+	assert.Equal(t, 8, throttle.allowed)
+}
+
+func TestLoadThrottleBlocksOverTheLimit(t *testing.T) {
+	throttle := newLoadThrottle(logger.Discard, 2, 1.0)
+	throttle.load = func() (float64, error) { return 0.5, nil }
+	throttle.Start()
+	defer throttle.Stop()
+
+	throttle.Acquire()
+	throttle.Acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		throttle.Acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquired more than the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	throttle.Release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Wasn't acquired after a release")
+	}
+}
+
+func TestLoadThrottleDoesntThrottleWhenLoadIsUnsupported(t *testing.T) {
+	throttle := newLoadThrottle(logger.Discard, 1, 1.0)
+	throttle.load = func() (float64, error) { return 0, errLoadUnsupported }
+	throttle.Start()
+
+	throttle.Acquire()
+	throttle.Acquire()
+	assert.Equal(t, 2, throttle.active)
+}
@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ArtifactMinisignSuffix = ".minisig"
+	ArtifactCosignSuffix   = ".sig"
+
+	// Signing keys starting with this are AWS KMS keys, as cosign names them
+	awsKMSKeyPrefix = "awskms://"
+)
+
+// An ArtifactManifestSigner signs manifests with either a minisign or a
+// cosign key. Minisign keys are secret key files made by minisign -G, and
+// signatures are in minisign's format. Cosign keys are either key files made
+// by cosign generate-key-pair, or AWS KMS keys given as
+// awskms:///<key id, alias or ARN>, and signatures are the base64 ECDSA
+// signatures of cosign sign-blob.
+type ArtifactManifestSigner struct {
+	minisign *minisignKey
+	cosign   crypto.Signer
+}
+
+// NewArtifactManifestSigner loads the signing key from source, which is
+// either an AWS KMS key or the path to a key file. The password decrypts
+// encrypted key files.
+func NewArtifactManifestSigner(source string, password string) (*ArtifactManifestSigner, error) {
+	if strings.HasPrefix(source, awsKMSKeyPrefix) {
+		signer, err := newAWSKMSSigner(source)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading the signing key %s: %v", source, err)
+		}
+		return &ArtifactManifestSigner{cosign: signer}, nil
+	}
+
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the signing key: %v", err)
+	}
+
+	if bytes.HasPrefix(data, []byte("untrusted comment:")) {
+		key, err := parseMinisignKey(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading the minisign key %s: %v", source, err)
+		}
+		return &ArtifactManifestSigner{minisign: key}, nil
+	}
+
+	key, err := parseCosignKey(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading the cosign key %s: %v", source, err)
+	}
+	return &ArtifactManifestSigner{cosign: key}, nil
+}
+
+// Extension returns the suffix added to the manifest's path for its signature
+func (s *ArtifactManifestSigner) Extension() string {
+	if s.minisign != nil {
+		return ArtifactMinisignSuffix
+	}
+	return ArtifactCosignSuffix
+}
+
+// Sign returns the signature of data, named name in minisign's trusted
+// comment
+func (s *ArtifactManifestSigner) Sign(data []byte, name string) ([]byte, error) {
+	if s.minisign != nil {
+		return s.minisign.sign(data, name, time.Now()), nil
+	}
+
+	digest := sha256.Sum256(data)
+	sig, err := s.cosign.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// A minisign secret key
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PrivateKey
+}
+
+// parseMinisignKey parses a minisign secret key file, decrypting it with
+// password unless it was made with minisign -W. The key is encoded as:
+//
+//	sig_alg      2 bytes, "Ed"
+//	kdf_alg      2 bytes, "Sc" for scrypt, or zeros if it's unencrypted
+//	chk_alg      2 bytes, "B2" for BLAKE2b
+//	kdf_salt     32 bytes
+//	kdf_opslimit 8 bytes, little endian
+//	kdf_memlimit 8 bytes, little endian
+//	key_id       8 bytes  \
+//	secret_key   64 bytes  } XORed with the scrypt output if encrypted
+//	checksum     32 bytes /
+func parseMinisignKey(data []byte, password string) (*minisignKey, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return nil, errors.New("it isn't a minisign secret key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 158 || string(raw[:2]) != "Ed" || string(raw[4:6]) != "B2" {
+		return nil, errors.New("it isn't a minisign secret key")
+	}
+
+	keynum := raw[54:]
+	switch string(raw[2:4]) {
+	case "Sc":
+		salt := raw[6:38]
+		opsLimit := binary.LittleEndian.Uint64(raw[38:46])
+		memLimit := binary.LittleEndian.Uint64(raw[46:54])
+
+		n, r, p := scryptParams(opsLimit, memLimit)
+		stream, err := scrypt.Key([]byte(password), salt, n, r, p, len(keynum))
+		if err != nil {
+			return nil, err
+		}
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	case "\x00\x00":
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q", raw[2:4])
+	}
+
+	key := &minisignKey{key: ed25519.PrivateKey(keynum[8:72])}
+	copy(key.id[:], keynum[:8])
+
+	h, _ := blake2b.New256(nil)
+	h.Write(raw[:2])
+	h.Write(keynum[:72])
+	if !bytes.Equal(h.Sum(nil), keynum[72:]) {
+		return nil, errors.New("the password is wrong or the key is corrupt")
+	}
+
+	return key, nil
+}
+
+// scryptParams converts libsodium's opslimit and memlimit into scrypt's N, r
+// and p, the same way as crypto_pwhash_scryptsalsa208sha256
+func scryptParams(opsLimit, memLimit uint64) (n, r, p int) {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	r = 8
+
+	var nLog2 uint
+	if opsLimit < memLimit/32 {
+		p = 1
+		maxN := opsLimit / uint64(r*4)
+		for nLog2 = 1; nLog2 < 63; nLog2++ {
+			if uint64(1)<<nLog2 > maxN/2 {
+				break
+			}
+		}
+	} else {
+		maxN := memLimit / uint64(r*128)
+		for nLog2 = 1; nLog2 < 63; nLog2++ {
+			if uint64(1)<<nLog2 > maxN/2 {
+				break
+			}
+		}
+		maxRP := (opsLimit / 4) / (uint64(1) << nLog2)
+		if maxRP > 0x3fffffff {
+			maxRP = 0x3fffffff
+		}
+		p = int(maxRP) / r
+	}
+
+	return 1 << nLog2, r, p
+}
+
+// sign returns a minisign signature of data, signing its BLAKE2b-512 hash as
+// minisign -H does. The trusted comment records when and what was signed.
+func (k *minisignKey) sign(data []byte, name string, now time.Time) []byte {
+	hash := blake2b.Sum512(data)
+	sig := ed25519.Sign(k.key, hash[:])
+
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", now.Unix(), name)
+	global := ed25519.Sign(k.key, append(append([]byte{}, sig...), trusted...))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "untrusted comment: signature from buildkite-agent\n")
+	fmt.Fprintf(&out, "%s\n", base64.StdEncoding.EncodeToString(append(append([]byte("ED"), k.id[:]...), sig...)))
+	fmt.Fprintf(&out, "trusted comment: %s\n", trusted)
+	fmt.Fprintf(&out, "%s\n", base64.StdEncoding.EncodeToString(global))
+	return out.Bytes()
+}
+
+// An encrypted cosign key, as the JSON in the PEM block of the key file
+type cosignEncryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// parseCosignKey decrypts a cosign private key file with password. The key
+// is a PKCS #8 ECDSA key encrypted with NaCl secretbox, using a key derived
+// from the password with scrypt.
+func parseCosignKey(data []byte, password string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || (block.Type != "ENCRYPTED COSIGN PRIVATE KEY" && block.Type != "ENCRYPTED SIGSTORE PRIVATE KEY") {
+		return nil, errors.New("it isn't a minisign secret key or an encrypted cosign private key")
+	}
+
+	var encrypted cosignEncryptedKey
+	if err := json.Unmarshal(block.Bytes, &encrypted); err != nil {
+		return nil, err
+	}
+	if encrypted.KDF.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported encryption %s with %s", encrypted.Cipher.Name, encrypted.KDF.Name)
+	}
+	if len(encrypted.Cipher.Nonce) != 24 {
+		return nil, errors.New("the key is corrupt")
+	}
+
+	params := encrypted.KDF.Params
+	secret, err := scrypt.Key([]byte(password), encrypted.KDF.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], secret)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+
+	der, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.New("the password is wrong or the key is corrupt")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only ECDSA keys are supported")
+	}
+	return ecKey, nil
+}
+
+// awsKMSSigner signs digests with an asymmetric ECC_NIST_P256 key in AWS KMS
+type awsKMSSigner struct {
+	client kmsiface.KMSAPI
+	keyID  string
+	public crypto.PublicKey
+}
+
+func newAWSKMSSigner(source string) (*awsKMSSigner, error) {
+	// Like cosign, the key is the path of awskms:///<key>, as an empty host
+	// would be a custom KMS endpoint
+	keyID := strings.TrimPrefix(source, awsKMSKeyPrefix)
+	if !strings.HasPrefix(keyID, "/") || len(keyID) == 1 {
+		return nil, errors.New("expected awskms:///<key id, alias or ARN>")
+	}
+	keyID = keyID[1:]
+
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// ARNs name their own region, which may not be the agent's
+	config := aws.NewConfig()
+	if parsed, err := arn.Parse(keyID); err == nil {
+		config = config.WithRegion(parsed.Region)
+	}
+
+	return loadAWSKMSSigner(kms.New(sess, config), keyID)
+}
+
+// loadAWSKMSSigner looks up the key's public key, which also checks the key
+// exists and can be used before anything is uploaded
+func loadAWSKMSSigner(client kmsiface.KMSAPI, keyID string) (*awsKMSSigner, error) {
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(out.KeySpec) != kms.KeySpecEccNistP256 {
+		return nil, fmt.Errorf("the key is %s, but only %s keys are supported", aws.StringValue(out.KeySpec), kms.KeySpecEccNistP256)
+	}
+
+	public, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsKMSSigner{client: client, keyID: keyID, public: public}, nil
+}
+
+func (s *awsKMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *awsKMSSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	out, err := s.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecEcdsaSha256),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error signing with %s: %v", s.keyID, err)
+	}
+	return out.Signature, nil
+}
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestScryptParams(t *testing.T) {
+	// minisign's defaults
+	n, r, p := scryptParams(33554432, 1073741824)
+	assert.Equal(t, []int{1 << 20, 8, 1}, []int{n, r, p})
+}
+
+// writeMinisignKey writes a minisign secret key file, encrypted with password
+// unless it's empty, and returns the public key
+func writeMinisignKey(t *testing.T, path string, password string) ed25519.PublicKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	raw := make([]byte, 158)
+	copy(raw, "Ed")
+	copy(raw[4:], "B2")
+	keynum := raw[54:]
+	copy(keynum, "KEYID123")
+	copy(keynum[8:], private)
+
+	h, _ := blake2b.New256(nil)
+	h.Write(raw[:2])
+	h.Write(keynum[:72])
+	copy(keynum[72:], h.Sum(nil))
+
+	if password != "" {
+		copy(raw[2:], "Sc")
+		_, err := rand.Read(raw[6:38])
+		require.NoError(t, err)
+		binary.LittleEndian.PutUint64(raw[38:], 32768)
+		binary.LittleEndian.PutUint64(raw[46:], 1<<20)
+
+		n, r, p := scryptParams(32768, 1<<20)
+		stream, err := scrypt.Key([]byte(password), raw[6:38], n, r, p, len(keynum))
+		require.NoError(t, err)
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	}
+
+	data := "untrusted comment: minisign encrypted secret key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+
+	return public
+}
+
+// verifyMinisign checks a minisign signature of data as minisign -V does
+func verifyMinisign(t *testing.T, public ed25519.PublicKey, data []byte, signature []byte) {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[2], "trusted comment: "))
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	require.NoError(t, err)
+	require.Len(t, raw, 74)
+	assert.Equal(t, "ED", string(raw[:2]))
+	assert.Equal(t, "KEYID123", string(raw[2:10]))
+
+	hash := blake2b.Sum512(data)
+	assert.True(t, ed25519.Verify(public, hash[:], raw[10:]), "signature")
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	require.NoError(t, err)
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	assert.True(t, ed25519.Verify(public, append(raw[10:], trusted...), global), "global signature")
+}
+
+func TestMinisignManifestSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-signing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, password := range []string{"", "hunter2"} {
+		path := filepath.Join(dir, fmt.Sprintf("minisign-%d.key", len(password)))
+		public := writeMinisignKey(t, path, password)
+
+		signer, err := NewArtifactManifestSigner(path, password)
+		require.NoError(t, err)
+		assert.Equal(t, ".minisig", signer.Extension())
+
+		data := []byte(`{"version": 1}`)
+		sig, err := signer.Sign(data, "artifacts.manifest.json")
+		require.NoError(t, err)
+		verifyMinisign(t, public, data, sig)
+		assert.Contains(t, string(sig), "\tfile:artifacts.manifest.json\thashed")
+	}
+
+	path := filepath.Join(dir, "encrypted.key")
+	writeMinisignKey(t, path, "hunter2")
+	_, err = NewArtifactManifestSigner(path, "wrong")
+	assert.Error(t, err)
+}
+
+func TestMinisignTrustedComment(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key := &minisignKey{key: private}
+	sig := key.sign([]byte("data"), "artifacts.manifest.json", time.Unix(1600000000, 0))
+	assert.Contains(t, string(sig), "trusted comment: timestamp:1600000000\tfile:artifacts.manifest.json\thashed\n")
+}
+
+// writeCosignKey writes an encrypted cosign private key file, as cosign
+// generate-key-pair does
+func writeCosignKey(t *testing.T, path string, password string) *ecdsa.PrivateKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+
+	var encrypted cosignEncryptedKey
+	encrypted.KDF.Name = "scrypt"
+	encrypted.KDF.Params.N = 1024
+	encrypted.KDF.Params.R = 8
+	encrypted.KDF.Params.P = 1
+	encrypted.KDF.Salt = make([]byte, 32)
+	_, err = rand.Read(encrypted.KDF.Salt)
+	require.NoError(t, err)
+	encrypted.Cipher.Name = "nacl/secretbox"
+	encrypted.Cipher.Nonce = make([]byte, 24)
+	_, err = rand.Read(encrypted.Cipher.Nonce)
+	require.NoError(t, err)
+
+	secret, err := scrypt.Key([]byte(password), encrypted.KDF.Salt, 1024, 8, 1, 32)
+	require.NoError(t, err)
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], secret)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	encrypted.Ciphertext = secretbox.Seal(nil, der, &nonce, &key)
+
+	data, err := json.Marshal(encrypted)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: data}), 0600))
+
+	return private
+}
+
+// verifyCosign checks a cosign signature of data as cosign verify-blob does
+func verifyCosign(t *testing.T, public *ecdsa.PublicKey, data []byte, signature []byte) {
+	sig, err := base64.StdEncoding.DecodeString(string(signature))
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(data)
+	assert.True(t, ecdsa.VerifyASN1(public, digest[:], sig))
+}
+
+func TestCosignManifestSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-signing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cosign.key")
+	private := writeCosignKey(t, path, "hunter2")
+
+	signer, err := NewArtifactManifestSigner(path, "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, ".sig", signer.Extension())
+
+	data := []byte(`{"version": 1}`)
+	sig, err := signer.Sign(data, "artifacts.manifest.json")
+	require.NoError(t, err)
+	verifyCosign(t, &private.PublicKey, data, sig)
+
+	_, err = NewArtifactManifestSigner(path, "wrong")
+	assert.Error(t, err)
+
+	notAKey := filepath.Join(dir, "not-a-key")
+	require.NoError(t, ioutil.WriteFile(notAKey, []byte("hello"), 0600))
+	_, err = NewArtifactManifestSigner(notAKey, "")
+	assert.Error(t, err)
+}
+
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	key *ecdsa.PrivateKey
+}
+
+func (f *fakeKMS) GetPublicKey(input *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	der, err := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{
+		KeyId:     input.KeyId,
+		KeySpec:   aws.String(kms.KeySpecEccNistP256),
+		PublicKey: der,
+	}, nil
+}
+
+func (f *fakeKMS) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	if aws.StringValue(input.MessageType) != kms.MessageTypeDigest {
+		return nil, fmt.Errorf("expected a digest")
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, f.key, input.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: input.KeyId, Signature: sig}, nil
+}
+
+func TestAWSKMSManifestSigner(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	kmsSigner, err := loadAWSKMSSigner(&fakeKMS{key: private}, "alias/releases")
+	require.NoError(t, err)
+
+	signer := &ArtifactManifestSigner{cosign: kmsSigner}
+	data := []byte(`{"version": 1}`)
+	sig, err := signer.Sign(data, "artifacts.manifest.json")
+	require.NoError(t, err)
+	verifyCosign(t, &private.PublicKey, data, sig)
+
+	_, err = newAWSKMSSigner("awskms://localhost:4566/alias/releases")
+	assert.Error(t, err)
+}
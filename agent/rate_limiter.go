@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// rateLimiter is a token bucket that limits how many requests are made per
+// second. It's shared by everything making requests, so the limit applies to
+// all of them together.
+type rateLimiter struct {
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+
+	// Replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimiter(qps int) *rateLimiter {
+	return &rateLimiter{
+		qps:    float64(qps),
+		burst:  float64(qps),
+		tokens: float64(qps),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Wait blocks until a request can be made. A nil rateLimiter doesn't limit.
+func (r *rateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	r.tokens += now.Sub(r.last).Seconds() * r.qps
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	// Taking the token before waiting for it queues up concurrent callers,
+	// so each waits for the next token after the ones already taken
+	r.tokens--
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.qps * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if wait > 0 {
+		r.sleep(wait)
+	}
+}
+
+// rateLimitedStore limits the requests a DurableUploader makes to check for
+// artifacts
+type rateLimitedStore struct {
+	store   DurableUploader
+	limiter *rateLimiter
+}
+
+func (s rateLimitedStore) Exists(artifact *api.Artifact) (bool, error) {
+	s.limiter.Wait()
+	return s.store.Exists(artifact)
+}
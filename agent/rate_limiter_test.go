@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterQueuesRequestsOverTheLimit(t *testing.T) {
+	now := time.Now()
+	var waits []time.Duration
+
+	r := newRateLimiter(2)
+	r.last = now
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	for i := 0; i < 5; i++ {
+		r.Wait()
+	}
+
+	// The first two fill the burst, each one after waits another half second
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond}, waits)
+
+	// Tokens come back with time, up to the burst
+	waits = nil
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		r.Wait()
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, waits)
+}
+
+func TestRateLimiterAppliesAcrossGoroutines(t *testing.T) {
+	now := time.Now()
+	var total time.Duration
+	var mu sync.Mutex
+
+	r := newRateLimiter(10)
+	r.last = now
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		mu.Lock()
+		if d > total {
+			total = d
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Wait()
+		}()
+	}
+	wg.Wait()
+
+	// 10 requests are allowed straight away, and the last of the other 20
+	// waits for 2 seconds of tokens
+	assert.Equal(t, 2*time.Second, total)
+}
+
+func TestNilRateLimiterDoesntLimit(t *testing.T) {
+	var r *rateLimiter
+	r.Wait()
+}
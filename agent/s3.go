@@ -3,17 +3,25 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 )
 
@@ -53,7 +61,7 @@ func (e *credentialsProvider) IsExpired() bool {
 	return !e.retrieved
 }
 
-func awsS3Session(region string) (*session.Session, error) {
+func awsS3Session(region string, transport http.RoundTripper, providers ...credentials.Provider) (*session.Session, error) {
 	// Chicken and egg... but this is kinda how they do it in the sdk
 	sess, err := session.NewSession()
 	if err != nil {
@@ -62,14 +70,19 @@ func awsS3Session(region string) (*session.Session, error) {
 
 	sess.Config.Region = aws.String(region)
 
+	if transport != nil {
+		sess.Config.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	// Any explicitly provided credentials take precedence
 	sess.Config.Credentials = credentials.NewChainCredentials(
-		[]credentials.Provider{
+		append(providers,
 			&credentialsProvider{},
 			&credentials.EnvProvider{},
 			webIdentityRoleProvider(sess),
 			// EC2 and ECS meta-data providers
 			defaults.RemoteCredProvider(*sess.Config, sess.Handlers),
-		})
+		))
 
 	return sess, nil
 }
@@ -83,14 +96,168 @@ func webIdentityRoleProvider(sess *session.Session) *stscreds.WebIdentityRolePro
 	)
 }
 
-func newS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
+// s3Endpoint is an S3-compatible endpoint to use instead of AWS. The zero
+// value uses the AWS endpoint for the bucket's region.
+type s3Endpoint struct {
+	URL            string
+	ForcePathStyle bool
+}
+
+// checkS3Endpoint returns an error if the endpoint isn't an http:// or
+// https:// URL
+func checkS3Endpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid S3 endpoint: `%s`, expected a URL like https://minio.example.com:9000", endpoint)
+	}
+	return nil
+}
+
+// s3AssumeRole is an IAM role to assume with the credentials that would
+// otherwise be used, such as for a bucket in another account. The zero value
+// doesn't assume a role.
+type s3AssumeRole struct {
+	ARN         string
+	SessionName string
+	ExternalID  string
+}
+
+// The session name roles are assumed with if one isn't given, which shows in
+// CloudTrail
+const defaultS3RoleSessionName = "buildkite-agent"
+
+// Role session names are 2 to 64 of these characters
+var s3RoleSessionNameRegexp = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// checkS3AssumeRole returns an error if the role can't be assumed, such as
+// when its ARN isn't of an IAM role
+func checkS3AssumeRole(role s3AssumeRole) error {
+	if role.ARN == "" {
+		if role.SessionName != "" || role.ExternalID != "" {
+			return errors.New("An S3 assume role session name or external ID needs the ARN of the role to assume")
+		}
+		return nil
+	}
+
+	parsed, err := arn.Parse(role.ARN)
+	if err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("Invalid S3 assume role ARN: `%s`, expected an IAM role ARN like arn:aws:iam::123456789012:role/artifacts", role.ARN)
+	}
+	if role.SessionName != "" && !s3RoleSessionNameRegexp.MatchString(role.SessionName) {
+		return fmt.Errorf("Invalid S3 assume role session name: `%s`, expected 2 to 64 letters, digits or any of _+=,.@-", role.SessionName)
+	}
+	return nil
+}
+
+// withAssumedRole replaces the session's credentials with those of the role,
+// assumed with the session's existing credentials. The SDK assumes the role
+// again before its credentials expire, so they last however long the upload
+// takes.
+func withAssumedRole(sess *session.Session, role s3AssumeRole) {
+	// STS is always asked at its own endpoint, even when S3 requests go to
+	// an S3-compatible one
+	stsSession := sess.Copy(&aws.Config{Endpoint: aws.String("")})
+
+	sess.Config.Credentials = stscreds.NewCredentials(stsSession, role.ARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = role.SessionName
+		if p.RoleSessionName == "" {
+			p.RoleSessionName = defaultS3RoleSessionName
+		}
+		if role.ExternalID != "" {
+			p.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+}
+
+// The regions buckets were discovered in, so each bucket's region is only
+// looked up once however many clients are made for it
+var (
+	s3BucketRegions   = map[string]string{}
+	s3BucketRegionsMu sync.Mutex
+)
+
+// discoverS3BucketRegion asks the region regionHint where the bucket is
+func discoverS3BucketRegion(sess *session.Session, bucket string, regionHint string) (string, error) {
+	s3BucketRegionsMu.Lock()
+	defer s3BucketRegionsMu.Unlock()
+
+	if region, ok := s3BucketRegions[bucket]; ok {
+		return region, nil
+	}
+
+	region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, regionHint)
+	if err != nil {
+		return "", err
+	}
+	if region != "" {
+		s3BucketRegions[bucket] = region
+	}
+	return region, nil
+}
+
+// isS3RegionError returns whether the request failed because it was made to
+// a different region than the bucket is in
+func isS3RegionError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "BucketRegionError", "PermanentRedirect", "AuthorizationHeaderMalformed":
+			return true
+		}
+	}
+	return false
+}
+
+// newS3Client creates a client for the bucket in region, or else the region
+// in BUILDKITE_S3_DEFAULT_REGION, or else the region the bucket is found in
+func newS3Client(l logger.Logger, bucket string, correlationID string, transport http.RoundTripper, region string, endpoint s3Endpoint, role s3AssumeRole, providers ...credentials.Provider) (*s3.S3, error) {
 	var sess *session.Session
 
-	regionHint := os.Getenv(regionHintEnvVar)
-	if regionHint != "" {
-        l.Debug("Using bucket region %q from environment variable %q", regionHint, regionHintEnvVar)
+	regionHint, regionSource := region, "the S3 region option"
+	if regionHint == "" {
+		regionHint, regionSource = os.Getenv(regionHintEnvVar), fmt.Sprintf("environment variable %q", regionHintEnvVar)
+	}
+	if endpoint.URL != "" {
+		// S3-compatible endpoints mostly ignore the region, but it's still
+		// part of the signature
+		region := regionHint
+		if region == "" {
+			region = "us-east-1"
+		}
+
+		l.Debug("Using S3 endpoint %q in region %q", endpoint.URL, region)
+		session, err := awsS3Session(region, transport, providers...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
+		}
+
+		session.Config.Endpoint = aws.String(endpoint.URL)
+		session.Config.S3ForcePathStyle = aws.Bool(endpoint.ForcePathStyle)
+		sess = session
+	} else if isS3ARN(bucket) {
+		// Access points can't be asked where they are, but their ARN says
+		accessPoint, err := parseS3AccessPointARN(bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		l.Debug("Using access point region %q from its ARN", accessPoint.Region)
+		session, err := awsS3Session(accessPoint.Region, transport, providers...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
+		}
+
+		// Let the SDK sign for the ARN's region, and resolve the Outposts
+		// endpoint from it
+		session.Config.S3UseARNRegion = aws.Bool(true)
+		sess = session
+	} else if regionHint != "" {
+		l.Debug("Using bucket region %q from %s", regionHint, regionSource)
 		// If there is a region hint provided, we use it unconditionally
-		session, err := awsS3Session(regionHint)
+		session, err := awsS3Session(regionHint, transport, providers...)
 		if err != nil {
 			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
 		}
@@ -108,31 +275,64 @@ func newS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 
 		// Using the guess region, construct a session and ask that region where the
 		// bucket lives
-		session, err := awsS3Session(region)
+		session, err := awsS3Session(region, transport, providers...)
 		if err != nil {
 			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
 		}
 
-		bucketRegion, bucketRegionErr := s3manager.GetBucketRegion(aws.BackgroundContext(), session, bucket, region)
+		bucketRegion, bucketRegionErr := discoverS3BucketRegion(session, bucket, region)
 		if bucketRegionErr == nil && bucketRegion != "" {
 			l.Debug("Discovered %q bucket region as %q", bucket, bucketRegion)
 			session.Config.Region = &bucketRegion
 		} else {
-			l.Error("Could not discover region for bucket %q. Using the %q region as a fallback, if this is not correct configure a bucket region using the %q environment variable. (%v)", bucket, *sess.Config.Region, regionHintEnvVar, err)
+			l.Error("Could not discover region for bucket %q. Using the %q region as a fallback, if this is not correct configure a bucket region using the %q environment variable. (%v)", bucket, region, regionHintEnvVar, bucketRegionErr)
 		}
 
 		sess = session
 	}
 
+	if role.ARN != "" {
+		l.Debug("Assuming the role %q for S3 requests", role.ARN)
+		withAssumedRole(sess, role)
+	}
+
 	l.Debug("Testing AWS S3 credentials for bucket %q in region %q...", bucket, *sess.Config.Region)
 
-	s3client := s3.New(sess)
+	newClient := func() *s3.S3 {
+		s3client := s3.New(sess)
+
+		if correlationID != "" {
+			s3client.Handlers.Build.PushBack(func(r *request.Request) {
+				r.HTTPRequest.Header.Set(api.CorrelationIDHeader, correlationID)
+			})
+		}
+		return s3client
+	}
+	s3client := newClient()
 
 	// Test the authentication by trying to list the first 0 objects in the bucket.
-	_, err := s3client.ListObjects(&s3.ListObjectsInput{
-		Bucket:  aws.String(bucket),
-		MaxKeys: aws.Int64(0),
-	})
+	listObjects := func() error {
+		_, err := s3client.ListObjects(&s3.ListObjectsInput{
+			Bucket:  aws.String(bucket),
+			MaxKeys: aws.Int64(0),
+		})
+		return err
+	}
+	err := listObjects()
+
+	// The given region can be wrong, so find where the bucket actually is
+	// and use that instead. Access points and other endpoints say where
+	// they are.
+	if isS3RegionError(err) && endpoint.URL == "" && !isS3ARN(bucket) {
+		wrongRegion := *sess.Config.Region
+		bucketRegion, bucketRegionErr := discoverS3BucketRegion(sess, bucket, wrongRegion)
+		if bucketRegionErr == nil && bucketRegion != "" && bucketRegion != wrongRegion {
+			l.Info("The %q bucket is in the %q region, not %q, so using that instead", bucket, bucketRegion, wrongRegion)
+			sess.Config.Region = aws.String(bucketRegion)
+			s3client = newClient()
+			err = listObjects()
+		}
+	}
 	if err != nil {
 		if err == credentials.ErrNoValidProvidersFoundInChain {
 			hasProxy := os.Getenv("HTTP_PROXY") != "" || os.Getenv("HTTPS_PROXY") != ""
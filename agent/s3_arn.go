@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// s3AccessPoint is an S3 Access Point, or an S3 on Outposts access point,
+// given by its ARN in place of a bucket name
+type s3AccessPoint struct {
+	ARN       string
+	Region    string
+	AccountID string
+	Name      string
+
+	// Only set for S3 on Outposts
+	OutpostID string
+}
+
+var s3AccountIDRegexp = regexp.MustCompile(`^[0-9]{12}$`)
+
+// isS3ARN returns whether the bucket name is really an ARN
+func isS3ARN(bucket string) bool {
+	return strings.HasPrefix(bucket, "arn:")
+}
+
+// splitS3ARNDestination splits the destination (without s3://) into the ARN
+// and the path after it. ARNs have slashes in them, so the number of parts
+// taken depends on the kind of ARN.
+func splitS3ARNDestination(destination string) (name string, path string) {
+	parts := strings.Split(destination, "/")
+
+	// arn:aws:s3:region:account:accesspoint/name
+	n := 2
+	if strings.Contains(parts[0], ":s3-outposts:") {
+		// arn:aws:s3-outposts:region:account:outpost/id/accesspoint/name
+		n = 4
+	} else if strings.Contains(parts[0], ":accesspoint:") {
+		// arn:aws:s3:region:account:accesspoint:name
+		n = 1
+	}
+	if n > len(parts) {
+		n = len(parts)
+	}
+
+	return strings.Join(parts[:n], "/"), strings.Join(parts[n:], "/")
+}
+
+// parseS3AccessPointARN parses and checks an S3 Access Point or S3 on
+// Outposts access point ARN
+func parseS3AccessPointARN(s string) (*s3AccessPoint, error) {
+	parsed, err := arn.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 ARN %q (%v)", s, err)
+	}
+
+	if parsed.Region == "" {
+		return nil, fmt.Errorf("Invalid S3 ARN %q, it has no region", s)
+	}
+	if !s3AccountIDRegexp.MatchString(parsed.AccountID) {
+		return nil, fmt.Errorf("Invalid S3 ARN %q, the account ID should be 12 digits", s)
+	}
+
+	ap := &s3AccessPoint{ARN: s, Region: parsed.Region, AccountID: parsed.AccountID}
+	resource := strings.FieldsFunc(parsed.Resource, func(r rune) bool { return r == '/' || r == ':' })
+
+	switch parsed.Service {
+	case "s3":
+		if len(resource) != 2 || resource[0] != "accesspoint" {
+			return nil, fmt.Errorf("Invalid S3 ARN %q, expected an access point like arn:aws:s3:<region>:<account>:accesspoint/<name>", s)
+		}
+		ap.Name = resource[1]
+
+	case "s3-outposts":
+		if len(resource) != 4 || resource[0] != "outpost" || resource[2] != "accesspoint" {
+			return nil, fmt.Errorf("Invalid S3 on Outposts ARN %q, expected arn:aws:s3-outposts:<region>:<account>:outpost/<outpost-id>/accesspoint/<name>", s)
+		}
+		ap.OutpostID = resource[1]
+		ap.Name = resource[3]
+
+	default:
+		return nil, fmt.Errorf("Invalid S3 ARN %q, only S3 Access Point and S3 on Outposts ARNs can be used in place of a bucket", s)
+	}
+
+	return ap, nil
+}
+
+// baseURL is the endpoint objects in the access point can be reached at
+func (ap *s3AccessPoint) baseURL() string {
+	if ap.OutpostID != "" {
+		return fmt.Sprintf("https://%s-%s.%s.s3-outposts.%s.amazonaws.com", ap.Name, ap.AccountID, ap.OutpostID, ap.Region)
+	}
+	return fmt.Sprintf("https://%s-%s.s3-accesspoint.%s.amazonaws.com", ap.Name, ap.AccountID, ap.Region)
+}
+
+// copySource is the CopySource of an object in the access point, which is
+// the ARN followed by /object/ and the key
+func (ap *s3AccessPoint) copySource(key string) string {
+	return ap.ARN + "/object/" + key
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3AccessPointARN(t *testing.T) {
+	ap, err := parseS3AccessPointARN("arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap")
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", ap.Region)
+	assert.Equal(t, "my-ap", ap.Name)
+	assert.Equal(t, "", ap.OutpostID)
+	assert.Equal(t, "https://my-ap-123456789012.s3-accesspoint.us-west-2.amazonaws.com", ap.baseURL())
+	assert.Equal(t, "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/object/foo/bar.txt", ap.copySource("foo/bar.txt"))
+
+	ap, err = parseS3AccessPointARN("arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap")
+	require.NoError(t, err)
+	assert.Equal(t, "op-01ac5d28a6a232904", ap.OutpostID)
+	assert.Equal(t, "my-ap", ap.Name)
+	assert.Equal(t, "https://my-ap-123456789012.op-01ac5d28a6a232904.s3-outposts.us-west-2.amazonaws.com", ap.baseURL())
+}
+
+func TestParseS3AccessPointARNErrors(t *testing.T) {
+	for _, s := range []string{
+		"arn:aws:s3",
+		"arn:aws:s3::123456789012:accesspoint/my-ap",
+		"arn:aws:s3:us-west-2:1234:accesspoint/my-ap",
+		"arn:aws:s3:us-west-2:123456789012:bucket/my-bucket",
+		"arn:aws:s3:us-west-2:123456789012:accesspoint",
+		"arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904",
+		"arn:aws:iam::123456789012:role/my-role",
+	} {
+		_, err := parseS3AccessPointARN(s)
+		assert.Error(t, err, s)
+	}
+}
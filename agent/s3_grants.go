@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The grantee groups S3 has, and whether granting to them is public access
+var s3GranteeGroups = map[string]bool{
+	"http://acs.amazonaws.com/groups/global/AllUsers":           true,
+	"http://acs.amazonaws.com/groups/global/AuthenticatedUsers": true,
+	"http://acs.amazonaws.com/groups/s3/LogDelivery":            false,
+}
+
+var s3CanonicalIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// s3Grants are explicit grants to put on uploaded objects instead of a
+// canned ACL, as the values of the x-amz-grant-* headers
+type s3Grants struct {
+	read        []string
+	readACP     []string
+	writeACP    []string
+	fullControl []string
+}
+
+// parseS3Grants parses grants in the form permission=type=grantee, e.g.
+// read=id=<canonical user id> or full-control=emailAddress=<address>. The
+// permissions are read, read-acp, write-acp and full-control, and the grantee
+// types are id, emailAddress and uri (for an S3 group).
+func parseS3Grants(grants []string, denyPublic bool) (*s3Grants, error) {
+	if len(grants) == 0 {
+		return nil, nil
+	}
+
+	g := &s3Grants{}
+	for _, grant := range grants {
+		parts := strings.SplitN(grant, "=", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return nil, fmt.Errorf("Invalid S3 grant %q, expected permission=type=grantee, e.g. read=id=<canonical user id>", grant)
+		}
+		permission, granteeType, grantee := parts[0], parts[1], parts[2]
+
+		var header string
+		switch strings.ToLower(granteeType) {
+		case "id":
+			if !s3CanonicalIDRegex.MatchString(grantee) {
+				return nil, fmt.Errorf("Invalid S3 grant %q, %q isn't a canonical user ID", grant, grantee)
+			}
+			header = fmt.Sprintf("id=%q", grantee)
+		case "emailaddress":
+			if address, err := mail.ParseAddress(grantee); err != nil || address.Address != grantee {
+				return nil, fmt.Errorf("Invalid S3 grant %q, %q isn't an email address", grant, grantee)
+			}
+			header = fmt.Sprintf("emailAddress=%q", grantee)
+		case "uri":
+			public, ok := s3GranteeGroups[grantee]
+			if !ok {
+				return nil, fmt.Errorf("Invalid S3 grant %q, %q isn't an S3 group", grant, grantee)
+			}
+			if public && denyPublic {
+				return nil, fmt.Errorf("The S3 grant %q grants public access, which has been denied", grant)
+			}
+			header = fmt.Sprintf("uri=%q", grantee)
+		default:
+			return nil, fmt.Errorf("Invalid S3 grant %q, the grantee type must be id, emailAddress or uri", grant)
+		}
+
+		switch permission {
+		case "read":
+			g.read = append(g.read, header)
+		case "read-acp":
+			g.readACP = append(g.readACP, header)
+		case "write-acp":
+			g.writeACP = append(g.writeACP, header)
+		case "full-control":
+			g.fullControl = append(g.fullControl, header)
+		default:
+			return nil, fmt.Errorf("Invalid S3 grant %q, the permission must be read, read-acp, write-acp or full-control", grant)
+		}
+	}
+
+	return g, nil
+}
+
+// grantHeader joins the grantees of a permission into a header value, or
+// returns nil if there are none
+func grantHeader(grantees []string) *string {
+	if len(grantees) == 0 {
+		return nil
+	}
+	return aws.String(strings.Join(grantees, ", "))
+}
+
+func (g *s3Grants) applyToUpload(params *s3manager.UploadInput) {
+	params.GrantRead = grantHeader(g.read)
+	params.GrantReadACP = grantHeader(g.readACP)
+	params.GrantWriteACP = grantHeader(g.writeACP)
+	params.GrantFullControl = grantHeader(g.fullControl)
+}
+
+func (g *s3Grants) applyToCopy(params *s3.CopyObjectInput) {
+	params.GrantRead = grantHeader(g.read)
+	params.GrantReadACP = grantHeader(g.readACP)
+	params.GrantWriteACP = grantHeader(g.writeACP)
+	params.GrantFullControl = grantHeader(g.fullControl)
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCanonicalID = "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be"
+
+func TestParseS3Grants(t *testing.T) {
+	grants, err := parseS3Grants([]string{
+		"read=id=" + testCanonicalID,
+		"read=uri=http://acs.amazonaws.com/groups/s3/LogDelivery",
+		"full-control=emailAddress=ops@example.com",
+	}, false)
+	require.NoError(t, err)
+
+	params := &s3manager.UploadInput{}
+	grants.applyToUpload(params)
+
+	assert.Equal(t, `id="`+testCanonicalID+`", uri="http://acs.amazonaws.com/groups/s3/LogDelivery"`, aws.StringValue(params.GrantRead))
+	assert.Equal(t, `emailAddress="ops@example.com"`, aws.StringValue(params.GrantFullControl))
+	assert.Nil(t, params.GrantReadACP)
+	assert.Nil(t, params.GrantWriteACP)
+}
+
+func TestParseS3GrantsWithoutGrants(t *testing.T) {
+	grants, err := parseS3Grants(nil, false)
+	require.NoError(t, err)
+	assert.Nil(t, grants)
+}
+
+func TestParseS3GrantsRejectsInvalidGrants(t *testing.T) {
+	for _, grant := range []string{
+		"read",
+		"read=id=",
+		"write=id=" + testCanonicalID,
+		"read=id=not-a-canonical-id",
+		"read=emailAddress=not an email",
+		"read=uri=http://example.com/groups/everyone",
+		"read=arn=arn:aws:iam::123456789012:root",
+	} {
+		_, err := parseS3Grants([]string{grant}, false)
+		assert.Error(t, err, grant)
+	}
+}
+
+func TestParseS3GrantsDeniesPublicGrants(t *testing.T) {
+	grant := "read=uri=http://acs.amazonaws.com/groups/global/AllUsers"
+
+	_, err := parseS3Grants([]string{grant}, false)
+	assert.NoError(t, err)
+
+	_, err = parseS3Grants([]string{grant}, true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// The version of the S3 Inventory manifest format that's written
+	s3InventoryVersion = "2016-11-30"
+
+	// The fields in each row of the inventory's CSV file
+	s3InventorySchema = "Bucket, Key, Size, LastModifiedDate, ETag"
+)
+
+// s3InventoryObject is a row in an S3 Inventory
+type s3InventoryObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+type s3InventoryManifest struct {
+	SourceBucket      string                    `json:"sourceBucket"`
+	DestinationBucket string                    `json:"destinationBucket"`
+	Version           string                    `json:"version"`
+	CreationTimestamp string                    `json:"creationTimestamp"`
+	FileFormat        string                    `json:"fileFormat"`
+	FileSchema        string                    `json:"fileSchema"`
+	Files             []s3InventoryManifestFile `json:"files"`
+}
+
+type s3InventoryManifestFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"MD5checksum"`
+}
+
+// s3Inventory is the set of files that make up an S3 Inventory, keyed by
+// their object key
+type s3Inventory map[string][]byte
+
+// buildS3Inventory lays out an S3 Inventory compatible listing of objects
+// under prefix, so it can be queried with Athena like a native one:
+//
+//	<prefix>/<timestamp>/files/<id>.csv.gz   the gzipped CSV of objects
+//	<prefix>/<timestamp>/manifest.json       the inventory manifest
+//	<prefix>/<timestamp>/manifest.checksum   the MD5 of the manifest
+//	<prefix>/hive/dt=<timestamp>/symlink.txt the data file, for Athena
+func buildS3Inventory(bucket string, prefix string, objects []s3InventoryObject, now time.Time) (s3Inventory, error) {
+	timestamp := now.UTC().Format("2006-01-02T15-04Z")
+	base := strings.TrimPrefix(prefix+"/"+timestamp, "/")
+
+	var csvData bytes.Buffer
+	gz := gzip.NewWriter(&csvData)
+	w := csv.NewWriter(gz)
+	for _, object := range objects {
+		if err := w.Write([]string{
+			bucket,
+			url.QueryEscape(object.Key),
+			strconv.FormatInt(object.Size, 10),
+			object.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			object.ETag,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	dataKey := base + "/files/" + api.NewUUID() + ".csv.gz"
+
+	manifest, err := json.MarshalIndent(s3InventoryManifest{
+		SourceBucket:      bucket,
+		DestinationBucket: "arn:aws:s3:::" + bucket,
+		Version:           s3InventoryVersion,
+		CreationTimestamp: strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		FileFormat:        "CSV",
+		FileSchema:        s3InventorySchema,
+		Files: []s3InventoryManifestFile{{
+			Key:         dataKey,
+			Size:        int64(csvData.Len()),
+			MD5Checksum: fmt.Sprintf("%x", md5.Sum(csvData.Bytes())),
+		}},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	hiveKey := strings.TrimPrefix(prefix+"/hive/dt="+timestamp+"/symlink.txt", "/")
+
+	return s3Inventory{
+		dataKey:                     csvData.Bytes(),
+		base + "/manifest.json":     manifest,
+		base + "/manifest.checksum": []byte(fmt.Sprintf("%x\n", md5.Sum(manifest))),
+		hiveKey:                     []byte(fmt.Sprintf("s3://%s/%s\n", bucket, dataKey)),
+	}, nil
+}
+
+// WriteInventory writes an S3 Inventory of the objects uploaded so far to
+// an inventory/ prefix alongside them in the bucket
+func (u *S3Uploader) WriteInventory() error {
+	u.uploadedMu.Lock()
+	objects := append([]s3InventoryObject{}, u.uploaded...)
+	u.uploadedMu.Unlock()
+
+	prefix := strings.TrimPrefix(u.BucketPath+"/inventory", "/")
+
+	inventory, err := buildS3Inventory(u.BucketName, prefix, objects, time.Now())
+	if err != nil {
+		return fmt.Errorf("Failed to build the S3 inventory (%v)", err)
+	}
+
+	uploader := s3manager.NewUploaderWithClient(u.client)
+
+	for key, data := range inventory {
+		u.logger.Debug("Writing inventory file s3://%s/%s", u.BucketName, key)
+
+		params := &s3manager.UploadInput{
+			Bucket: aws.String(u.BucketName),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		}
+		u.encryptUpload(params)
+
+		if _, err := uploader.Upload(params); err != nil {
+			return fmt.Errorf("Failed to write inventory file %q (%v)", key, err)
+		}
+	}
+
+	u.logger.Info("Wrote an S3 inventory of %d objects to s3://%s/%s", len(objects), u.BucketName, prefix)
+
+	return nil
+}
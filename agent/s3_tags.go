@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// The most tags S3 allows on an object, and the longest their keys and
+	// values can be, in characters
+	s3MaxTags           = 10
+	s3MaxTagKeyLength   = 128
+	s3MaxTagValueLength = 256
+)
+
+// The characters S3 allows in tag keys and values
+var s3TagRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// ParseS3Tag parses a tag for objects uploaded to S3 in the form key=value.
+// The value can be empty.
+func ParseS3Tag(s string) (key string, value string, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("Invalid S3 tag %q, expected key=value", s)
+	}
+
+	key, value = s[:i], s[i+1:]
+	if err := checkS3Tag(key, value); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// checkS3Tag returns an error if S3 wouldn't accept the tag
+func checkS3Tag(key, value string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("Invalid S3 tag %q, the key can't be empty", key+"="+value)
+	case strings.HasPrefix(key, "aws:"):
+		return fmt.Errorf("Invalid S3 tag %q, keys starting with aws: are reserved by AWS", key+"="+value)
+	case utf8.RuneCountInString(key) > s3MaxTagKeyLength:
+		return fmt.Errorf("Invalid S3 tag %q, the key can be at most %d characters", key+"="+value, s3MaxTagKeyLength)
+	case utf8.RuneCountInString(value) > s3MaxTagValueLength:
+		return fmt.Errorf("Invalid S3 tag %q, the value can be at most %d characters", key+"="+value, s3MaxTagValueLength)
+	case !s3TagRegexp.MatchString(key) || !s3TagRegexp.MatchString(value):
+		return fmt.Errorf("Invalid S3 tag %q, tags can only contain letters, digits, spaces and the characters _ . : / = + - @", key+"="+value)
+	}
+	return nil
+}
+
+// checkS3Tags returns an error if S3 wouldn't accept the tags on an object,
+// along with the expiry tag if expiring is set
+func checkS3Tags(tags map[string]string, expiring bool) error {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := checkS3Tag(key, tags[key]); err != nil {
+			return err
+		}
+		if expiring && key == ArtifactExpiryTagKey {
+			return fmt.Errorf("The S3 tag %q is used to expire artifacts, so can't be set along with an expiry", key)
+		}
+	}
+
+	max := s3MaxTags
+	if expiring {
+		max--
+	}
+	if len(tags) > max {
+		return fmt.Errorf("S3 allows at most %d tags on an object, got %d", max, len(tags))
+	}
+	return nil
+}
+
+// objectTagging returns the tagging (in URL query format) to upload objects
+// with, which is the configured tags along with the tag that matches a
+// lifecycle rule for the configured expiry, or an empty string if there are
+// none
+func (u *S3Uploader) objectTagging() string {
+	tags := make(map[string]string, len(u.conf.Tags)+1)
+	for key, value := range u.conf.Tags {
+		tags[key] = value
+	}
+	if u.conf.ExpireAfter > 0 {
+		tags[ArtifactExpiryTagKey] = strconv.Itoa(expiryDays(u.conf.ExpireAfter))
+	}
+	return encodeS3Tagging(tags)
+}
+
+// encodeS3Tagging encodes tags as URL query parameters, sorted by key, with
+// spaces escaped as %20 rather than +
+func encodeS3Tagging(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escape := func(s string) string {
+		return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, escape(key)+"="+escape(tags[key]))
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3Tag(t *testing.T) {
+	for _, tc := range []struct {
+		tag, key, value string
+	}{
+		{"team=web", "team", "web"},
+		{"cost-centre=", "cost-centre", ""},
+		{"path=a/b=c", "path", "a/b=c"},
+		{"Owner Name=José @ Example:1+2", "Owner Name", "José @ Example:1+2"},
+	} {
+		key, value, err := ParseS3Tag(tc.tag)
+		require.NoError(t, err, tc.tag)
+		assert.Equal(t, tc.key, key, tc.tag)
+		assert.Equal(t, tc.value, value, tc.tag)
+	}
+}
+
+func TestParseS3TagRejectsInvalidTags(t *testing.T) {
+	for _, tc := range []struct {
+		tag, err string
+	}{
+		{"team", `Invalid S3 tag "team", expected key=value`},
+		{"=web", `Invalid S3 tag "=web", the key can't be empty`},
+		{"aws:team=web", `Invalid S3 tag "aws:team=web", keys starting with aws: are reserved by AWS`},
+		{"team=web&mobile", `Invalid S3 tag "team=web&mobile", tags can only contain letters, digits, spaces and the characters _ . : / = + - @`},
+		{"team*=web", `Invalid S3 tag "team*=web", tags can only contain letters, digits, spaces and the characters _ . : / = + - @`},
+		{strings.Repeat("k", 129) + "=web", `Invalid S3 tag "` + strings.Repeat("k", 129) + `=web", the key can be at most 128 characters`},
+		{"team=" + strings.Repeat("v", 257), `Invalid S3 tag "team=` + strings.Repeat("v", 257) + `", the value can be at most 256 characters`},
+	} {
+		_, _, err := ParseS3Tag(tc.tag)
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestCheckS3Tags(t *testing.T) {
+	tags := map[string]string{}
+	for i := 0; i < 10; i++ {
+		tags[strings.Repeat("k", i+1)] = "v"
+	}
+	assert.NoError(t, checkS3Tags(tags, false))
+	assert.EqualError(t, checkS3Tags(tags, true), "S3 allows at most 9 tags on an object, got 10")
+
+	assert.NoError(t, checkS3Tags(nil, true))
+	assert.NoError(t, checkS3Tags(map[string]string{ArtifactExpiryTagKey: "2"}, false))
+	assert.EqualError(t, checkS3Tags(map[string]string{ArtifactExpiryTagKey: "2"}, true),
+		`The S3 tag "buildkite-expire-after-days" is used to expire artifacts, so can't be set along with an expiry`)
+}
+
+func TestObjectTagging(t *testing.T) {
+	uploader := &S3Uploader{}
+	assert.Equal(t, "", uploader.objectTagging())
+
+	uploader.conf.Tags = map[string]string{"team": "web", "Owner Name": "José Smith/ops"}
+	assert.Equal(t, "Owner%20Name=Jos%C3%A9%20Smith%2Fops&team=web", uploader.objectTagging())
+
+	uploader.conf.ExpireAfter = 36 * time.Hour
+	assert.Equal(t, "Owner%20Name=Jos%C3%A9%20Smith%2Fops&buildkite-expire-after-days=2&team=web", uploader.objectTagging())
+}
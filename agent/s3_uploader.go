@@ -1,12 +1,25 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildkite/agent/v3/api"
@@ -20,6 +33,88 @@ type S3UploaderConfig struct {
 
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
+
+	// If set, objects are tagged so a bucket lifecycle rule can expire them
+	ExpireAfter time.Duration
+
+	// Refuse to upload with an ACL that grants public access, and default
+	// to a private ACL
+	DenyPublicACL bool
+
+	// If set, AWS credentials are read from Vault before anywhere else
+	Vault *VaultClient
+
+	// If set, sent as a header with every request
+	CorrelationID string
+
+	// Other prefixes in the bucket that artifacts are also copied to
+	AlsoPrefixes []string
+
+	// If set, used to make requests instead of the default transport
+	Transport http.RoundTripper
+
+	// Whether to place an Object Lock legal hold on uploaded objects
+	LegalHold bool
+
+	// Whether to fail the upload of artifacts that already exist, rather
+	// than overwrite them
+	NoOverwrite bool
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
+
+	// Explicit grants to put on uploaded objects instead of a canned ACL,
+	// in the form permission=type=grantee
+	Grants []string
+
+	// If set, objects are encrypted at rest with AES256 or aws:kms
+	ServerSideEncryption string
+
+	// The KMS key to encrypt objects with when ServerSideEncryption is
+	// aws:kms, or the account's default key if it isn't set
+	KMSKeyID string
+
+	// If set, objects at least this big are always uploaded in parts of
+	// exactly this size, so the same content always has the same ETag.
+	// Objects that would need more than 10,000 parts fail to upload rather
+	// than being uploaded with bigger parts.
+	PartSize int64
+
+	// If set, the storage class to upload objects with, such as STANDARD_IA,
+	// instead of STANDARD
+	StorageClass string
+
+	// If set, the region the bucket is in, instead of the one in
+	// BUILDKITE_S3_DEFAULT_REGION. If the bucket turns out to be in another
+	// region, that region is used instead.
+	Region string
+
+	// If set, the S3-compatible endpoint (such as MinIO) to upload to instead
+	// of the AWS endpoint for the bucket's region
+	Endpoint string
+
+	// Whether to put the bucket name in the path instead of the hostname,
+	// which most S3-compatible endpoints need
+	ForcePathStyle bool
+
+	// If set, the Cache-Control header objects are served with
+	CacheControl string
+
+	// User metadata (x-amz-meta-*) to put on every uploaded object, along
+	// with the artifact's own
+	Metadata map[string]string
+
+	// Tags to put on every uploaded object, along with the expiry tag if
+	// ExpireAfter is set
+	Tags map[string]string
+
+	// If set, the IAM role to assume with the credentials that would
+	// otherwise be used, such as to upload to a bucket in another account.
+	// The session name defaults to buildkite-agent, and the external ID is
+	// only sent if it's set.
+	AssumeRoleARN         string
+	AssumeRoleSessionName string
+	ExternalID            string
 }
 
 type S3Uploader struct {
@@ -29,6 +124,9 @@ type S3Uploader struct {
 	// The s3 bucket name set from the destination
 	BucketName string
 
+	// The access point the destination's ARN is of, if it's given by one
+	accessPoint *s3AccessPoint
+
 	// The s3 client to use
 	client *s3.S3
 
@@ -37,37 +135,266 @@ type S3Uploader struct {
 
 	// The logger instance to use
 	logger logger.Logger
+
+	// The explicit grants to put on uploaded objects, if there are any
+	grants *s3Grants
+
+	// The objects that have been uploaded, for writing an inventory
+	uploaded   []s3InventoryObject
+	uploadedMu sync.Mutex
+}
+
+func init() {
+	RegisterUploader("s3", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		return NewS3Uploader(l, S3UploaderConfig{
+			Destination:   c.Destination,
+			DebugHTTP:     c.DebugHTTP,
+			ExpireAfter:   c.ExpireAfter,
+			DenyPublicACL: c.DenyPublicACL,
+			Vault:         c.Vault,
+			CorrelationID: c.CorrelationID,
+			AlsoPrefixes:  c.AlsoPrefixes,
+			Transport:     c.Transport,
+			LegalHold:     c.LegalHold,
+			NoOverwrite:   c.NoOverwrite,
+			Open:          c.Open,
+			Grants:        c.S3Grants,
+
+			ServerSideEncryption: c.S3ServerSideEncryption,
+			KMSKeyID:             c.S3KMSKeyID,
+			PartSize:             c.S3PartSize,
+			StorageClass:         c.S3StorageClass,
+			Endpoint:             c.S3Endpoint,
+			ForcePathStyle:       c.S3ForcePathStyle,
+			CacheControl:         c.S3CacheControl,
+			Metadata:             c.Metadata,
+			Tags:                 c.S3Tags,
+
+			AssumeRoleARN:         c.S3AssumeRoleARN,
+			AssumeRoleSessionName: c.S3AssumeRoleSessionName,
+			ExternalID:            c.S3ExternalID,
+
+			Region: c.S3Region,
+		})
+	})
 }
 
 func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
 	bucketName, bucketPath := ParseS3Destination(c.Destination)
 
+	// Access points are given by their ARN in place of the bucket name
+	var accessPoint *s3AccessPoint
+	if isS3ARN(bucketName) {
+		var err error
+		accessPoint, err = parseS3AccessPointARN(bucketName)
+		if err != nil {
+			return nil, err
+		}
+		l.Debug("Uploading through the %q access point in %q", accessPoint.Name, accessPoint.Region)
+	}
+
+	// Fail before doing anything if the ACL isn't allowed
+	if c.DenyPublicACL {
+		permission, err := (&S3Uploader{conf: c}).resolvePermission()
+		if err != nil {
+			return nil, err
+		}
+		l.Debug("Public S3 ACLs are denied, using the %q ACL", permission)
+	}
+
+	grants, err := parseS3Grants(c.Grants, c.DenyPublicACL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkS3ServerSideEncryption(c.ServerSideEncryption, c.KMSKeyID); err != nil {
+		return nil, err
+	}
+	if err := checkS3StorageClass(c.StorageClass); err != nil {
+		return nil, err
+	}
+	if err := checkS3Tags(c.Tags, c.ExpireAfter > 0); err != nil {
+		return nil, err
+	}
+
+	if err := checkS3Endpoint(c.Endpoint); err != nil {
+		return nil, err
+	}
+	if accessPoint != nil && c.Endpoint != "" {
+		return nil, errors.New("An S3 access point ARN can't be uploaded to through a custom S3 endpoint")
+	}
+
+	role := s3AssumeRole{ARN: c.AssumeRoleARN, SessionName: c.AssumeRoleSessionName, ExternalID: c.ExternalID}
+	if err := checkS3AssumeRole(role); err != nil {
+		return nil, err
+	}
+
+	if c.PartSize > 0 && c.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("The S3 part size must be at least %d bytes, got %d", s3manager.MinUploadPartSize, c.PartSize)
+	}
+
+	if c.ServerSideEncryption == s3.ServerSideEncryptionAwsKms && c.KMSKeyID == "" {
+		l.Debug("No KMS key ID was given, objects will be encrypted with the account's default KMS key")
+	}
+
 	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(l, bucketName)
+	var providers []credentials.Provider
+	if c.Vault != nil {
+		// Surface any Vault errors, rather than falling through to the
+		// other credential providers
+		if _, err := c.Vault.Get(""); err != nil {
+			return nil, err
+		}
+		providers = append(providers, &vaultCredentialsProvider{vault: c.Vault})
+	}
+
+	endpoint := s3Endpoint{URL: c.Endpoint, ForcePathStyle: c.ForcePathStyle}
+	s3Client, err := newS3Client(l, bucketName, c.CorrelationID, c.Transport, c.Region, endpoint, role, providers...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &S3Uploader{
+	u := &S3Uploader{
 		logger:     l,
 		conf:       c,
 		client:     s3Client,
 		BucketName: bucketName,
 		BucketPath: bucketPath,
-	}, nil
+		grants:     grants,
+
+		accessPoint: accessPoint,
+	}
+
+	if c.LegalHold {
+		if err := u.checkObjectLock(); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// The error codes S3 and STS give when credentials have expired or been
+// rotated away
+var s3ExpiredCredentialsCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"TokenRefreshRequired":  true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+}
+
+// CredentialsExpired returns whether S3 rejected the credentials an upload
+// was made with as expired
+func (u *S3Uploader) CredentialsExpired(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && s3ExpiredCredentialsCodes[awsErr.Code()]
+}
+
+// RefreshCredentials expires the client's credentials, so they're retrieved
+// again from Vault, the environment, the web identity token file or the
+// instance metadata before the next request, or the role is assumed again if
+// there is one
+func (u *S3Uploader) RefreshCredentials() error {
+	if u.conf.Vault != nil {
+		u.conf.Vault.Invalidate()
+	}
+
+	u.client.Config.Credentials.Expire()
+	_, err := u.client.Config.Credentials.Get()
+	return err
+}
+
+// checkObjectLock returns an error if legal holds can't be placed on objects
+// in the bucket
+func (u *S3Uploader) checkObjectLock() error {
+	output, err := u.client.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(u.BucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case "ObjectLockConfigurationNotFoundError":
+				return fmt.Errorf("Legal holds can't be placed on objects in %q, as it doesn't have S3 Object Lock enabled", u.BucketName)
+			case "AccessDenied":
+				return fmt.Errorf("Couldn't check %q has S3 Object Lock enabled, the credentials need the s3:GetBucketObjectLockConfiguration permission (%v)", u.BucketName, err)
+			}
+		}
+		return fmt.Errorf("Couldn't check %q has S3 Object Lock enabled (%v)", u.BucketName, err)
+	}
+
+	if output.ObjectLockConfiguration == nil || aws.StringValue(output.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return fmt.Errorf("Legal holds can't be placed on objects in %q, as it doesn't have S3 Object Lock enabled", u.BucketName)
+	}
+
+	u.logger.Debug("Bucket %q has S3 Object Lock enabled, legal holds will be placed on uploaded objects", u.BucketName)
+	return nil
+}
+
+// placeLegalHold places a legal hold on an uploaded object
+func (u *S3Uploader) placeLegalHold(ctx context.Context, key string) error {
+	_, err := u.client.PutObjectLegalHoldWithContext(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(u.BucketName),
+		Key:       aws.String(key),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(s3.ObjectLockLegalHoldStatusOn)},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "AccessDenied" {
+			return fmt.Errorf("Error placing a legal hold on %q, the credentials need the s3:PutObjectLegalHold permission (%v)", key, err)
+		}
+		return fmt.Errorf("Error placing a legal hold on %q (%v)", key, err)
+	}
+
+	u.logger.Debug("Placed a legal hold on %q", key)
+	return nil
 }
 
 func ParseS3Destination(destination string) (name string, path string) {
 	destinationWithNoTrailingSlash := strings.TrimSuffix(string(destination), "/")
 	destinationWithNoProtocol := strings.TrimPrefix(destinationWithNoTrailingSlash, "s3://")
+	if isS3ARN(destinationWithNoProtocol) {
+		return splitS3ARNDestination(destinationWithNoProtocol)
+	}
 	parts := strings.Split(destinationWithNoProtocol, "/")
 	path = strings.Join(parts[1:len(parts)], "/")
 	name = parts[0]
 	return
 }
 
+// copySource is the CopySource of the object at key, for copying it within
+// the bucket or access point
+func (u *S3Uploader) copySource(key string) string {
+	if u.accessPoint != nil {
+		return u.accessPoint.copySource(key)
+	}
+	return url.PathEscape(u.BucketName + "/" + key)
+}
+
+// endpointBaseURL is where objects in the bucket are at the custom endpoint,
+// with the bucket in the path or in the hostname
+func (u *S3Uploader) endpointBaseURL() string {
+	endpoint, err := url.Parse(strings.TrimSuffix(u.conf.Endpoint, "/"))
+	if err != nil {
+		return u.conf.Endpoint
+	}
+
+	if u.conf.ForcePathStyle {
+		endpoint.Path += "/" + u.BucketName + "/"
+	} else {
+		endpoint.Host = u.BucketName + "." + endpoint.Host
+		endpoint.Path += "/"
+	}
+	return endpoint.String()
+}
+
 func (u *S3Uploader) URL(artifact *api.Artifact) string {
 	baseUrl := "https://" + u.BucketName + ".s3.amazonaws.com"
+	if u.accessPoint != nil {
+		baseUrl = u.accessPoint.baseURL()
+	}
+	if u.conf.Endpoint != "" {
+		baseUrl = u.endpointBaseURL()
+	}
 
 	if os.Getenv("BUILDKITE_S3_ACCESS_URL") != "" {
 		baseUrl = os.Getenv("BUILDKITE_S3_ACCESS_URL")
@@ -80,22 +407,44 @@ func (u *S3Uploader) URL(artifact *api.Artifact) string {
 	return url.String()
 }
 
+// The largest object S3 can store, uploaded in parts
+var maxS3ObjectSize = int64(5 * 1024 * 1024 * 1024 * 1024)
+
+func (u *S3Uploader) MaxArtifactSize() int64 {
+	return maxS3ObjectSize
+}
+
+// Artifacts smaller than a part, including empty ones, are always uploaded
+// with a single PutObject rather than as a multipart upload
+var maxS3PutObjectSize = s3manager.DefaultUploadPartSize
+
 func (u *S3Uploader) Upload(artifact *api.Artifact) error {
+	return u.UploadWithContext(context.Background(), artifact)
+}
 
+// UploadWithContext uploads the artifact, aborting the requests to S3 if the
+// context is done before they've finished
+func (u *S3Uploader) UploadWithContext(ctx context.Context, artifact *api.Artifact) error {
 	permission, err := u.resolvePermission()
 	if err != nil {
 		return err
 	}
 
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploaderWithClient(u.client)
+	// Create an uploader with the session and the part size
+	uploader := u.newUploader()
 
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifactFile(u.conf.Open, artifact)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
+
+	size, err := artifactFileSize(f)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q (%v)", artifact.AbsolutePath, err)
+	}
 
 	// Upload the file to S3.
 	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
@@ -107,24 +456,459 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 		ACL:         aws.String(permission),
 		Body:        f,
 	}
-	// if enabled we assign the sse configuration
-	if u.serverSideEncryptionEnabled() {
-		params.ServerSideEncryption = aws.String("AES256")
+	if artifact.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(artifact.ContentEncoding)
+	}
+	if artifact.ContentDisposition != "" {
+		params.ContentDisposition = aws.String(artifact.ContentDisposition)
+	}
+	u.encryptUpload(params)
+	if u.conf.StorageClass != "" {
+		params.StorageClass = aws.String(u.conf.StorageClass)
+	}
+	if u.conf.CacheControl != "" {
+		params.CacheControl = aws.String(u.conf.CacheControl)
+	}
+	if metadata := objectMetadata(u.conf.Metadata, artifact); metadata != nil {
+		params.Metadata = aws.StringMap(metadata)
+	}
+	// S3 doesn't allow a canned ACL along with explicit grants
+	if u.grants != nil {
+		params.ACL = nil
+		u.grants.applyToUpload(params)
+	}
+	// tag the object, including so a lifecycle rule can clean it up
+	if tagging := u.objectTagging(); tagging != "" {
+		params.Tagging = aws.String(tagging)
+	}
+
+	var opts []request.Option
+	if u.conf.NoOverwrite {
+		opts, err = u.noOverwrite(artifact, size)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = uploader.Upload(params)
+	etag, err := u.upload(ctx, uploader, params, f, size, opts...)
+	if reqErr, ok := err.(awserr.RequestFailure); ok && u.conf.NoOverwrite && reqErr.StatusCode() == http.StatusPreconditionFailed {
+		return &artifactExistsError{Key: u.artifactPath(artifact)}
+	} else if err != nil {
+		return err
+	}
+
+	u.recordUploaded(u.artifactPath(artifact), artifact.FileSize, etag)
+
+	if u.conf.LegalHold {
+		if err := u.placeLegalHold(ctx, u.artifactPath(artifact)); err != nil {
+			return err
+		}
+	}
+
+	for _, prefix := range u.conf.AlsoPrefixes {
+		if err := u.copyToPrefix(ctx, artifact, prefix, permission); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UploadDirectory creates a zero-byte object with the directory's key and a
+// trailing /, which is how the S3 console shows a folder
+func (u *S3Uploader) UploadDirectory(path string) error {
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return err
+	}
+
+	key := u.artifactPath(&api.Artifact{Path: strings.TrimSuffix(path, "/")}) + "/"
+	u.logger.Debug("Creating \"%s\" in bucket with permission `%s`", key, permission)
+
+	params := &s3manager.UploadInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(key),
+		ACL:    aws.String(permission),
+	}
+	u.encryptUpload(params)
+	if u.conf.StorageClass != "" {
+		params.StorageClass = aws.String(u.conf.StorageClass)
+	}
+	if u.grants != nil {
+		params.ACL = nil
+		u.grants.applyToUpload(params)
+	}
+	if tagging := u.objectTagging(); tagging != "" {
+		params.Tagging = aws.String(tagging)
+	}
 
+	_, err = u.upload(context.Background(), u.newUploader(), params, bytes.NewReader(nil), 0)
 	return err
 }
 
+// Signature Version 4 presigned URLs are valid for at most a week
+var maxS3PresignedExpiry = 7 * 24 * time.Hour
+
+// PresignedURL signs a GetObject request for the artifact
+func (u *S3Uploader) PresignedURL(artifact *api.Artifact, expires time.Duration) (string, error) {
+	req, _ := u.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(u.artifactPath(artifact)),
+	})
+
+	signedURL, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("Error presigning a URL for %q: %v", artifact.Path, err)
+	}
+	return signedURL, nil
+}
+
+func (u *S3Uploader) MaxPresignedExpiry() time.Duration {
+	return maxS3PresignedExpiry
+}
+
+// newUploader creates an upload manager that uses the configured part size,
+// if there is one
+func (u *S3Uploader) newUploader() *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(u.client, func(m *s3manager.Uploader) {
+		if u.conf.PartSize > 0 {
+			m.PartSize = u.conf.PartSize
+		}
+	})
+}
+
+// checkPartCount returns an error if an object of the size can't be uploaded
+// in parts of the configured size. The upload manager would otherwise make
+// the parts bigger, and the ETag would no longer be reproducible.
+func (u *S3Uploader) checkPartCount(key string, size int64) error {
+	if u.conf.PartSize > 0 && size/u.conf.PartSize >= s3manager.MaxUploadParts {
+		return fmt.Errorf("%q is too big to upload in %d byte parts, as it would need more than %d parts", key, u.conf.PartSize, s3manager.MaxUploadParts-1)
+	}
+	return nil
+}
+
+// noOverwrite returns the request options that stop the artifact's upload
+// from overwriting an existing object. Artifacts uploaded to S3 with a single
+// PutObject are uploaded with If-None-Match: *, so S3 itself refuses to
+// overwrite them. Multipart uploads, and uploads to other endpoints that
+// mightn't support conditional writes, check for the object first instead.
+func (u *S3Uploader) noOverwrite(artifact *api.Artifact, size int64) ([]request.Option, error) {
+	if size < u.putObjectSize() && u.conf.Endpoint == "" {
+		return []request.Option{
+			request.WithSetRequestHeaders(map[string]string{"If-None-Match": "*"}),
+		}, nil
+	}
+
+	exists, err := u.Exists(artifact)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking if %q already exists (%v)", u.artifactPath(artifact), err)
+	}
+	if exists {
+		return nil, &artifactExistsError{Key: u.artifactPath(artifact)}
+	}
+	return nil, nil
+}
+
+// putObjectSize is the size of artifacts that are uploaded in parts, rather
+// than with a single PutObject
+func (u *S3Uploader) putObjectSize() int64 {
+	if u.conf.PartSize > 0 {
+		return u.conf.PartSize
+	}
+	return maxS3PutObjectSize
+}
+
+// upload uploads the file with a single PutObject, with the options, or in
+// parts if it's too big
+func (u *S3Uploader) upload(ctx context.Context, uploader *s3manager.Uploader, params *s3manager.UploadInput, body io.ReadSeeker, size int64, opts ...request.Option) (string, error) {
+	if size >= u.putObjectSize() {
+		if err := u.checkPartCount(aws.StringValue(params.Key), size); err != nil {
+			return "", err
+		}
+
+		output, err := uploader.UploadWithContext(ctx, params)
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(output.ETag), nil
+	}
+
+	// The same fields as the upload manager copies for a single part
+	put := &s3.PutObjectInput{}
+	awsutil.Copy(put, params)
+	put.Body = body
+	put.ContentLength = aws.Int64(size)
+
+	output, err := u.client.PutObjectWithContext(ctx, put, opts...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+// The largest object that can be copied with a single CopyObject
+var maxS3CopyObjectSize = int64(5368709120)
+
+// copyToPrefix puts a copy of the uploaded artifact under another prefix in
+// the bucket. It's copied server side where possible, and uploaded again if
+// the artifact is too big for a single CopyObject.
+func (u *S3Uploader) copyToPrefix(ctx context.Context, artifact *api.Artifact, prefix string, permission string) error {
+	key := u.prefixedArtifactPath(prefix, artifact)
+
+	if artifact.FileSize > maxS3CopyObjectSize {
+		u.logger.Debug("Uploading \"%s\" again to `%s`, as it's too big to copy", artifact.Path, key)
+
+		f, err := openArtifactFile(u.conf.Open, artifact)
+		if err != nil {
+			return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+		}
+		defer f.Close()
+
+		params := &s3manager.UploadInput{
+			Bucket:      aws.String(u.BucketName),
+			Key:         aws.String(key),
+			ContentType: aws.String(artifact.ContentType),
+			ACL:         aws.String(permission),
+			Body:        f,
+		}
+		if artifact.ContentEncoding != "" {
+			params.ContentEncoding = aws.String(artifact.ContentEncoding)
+		}
+		if artifact.ContentDisposition != "" {
+			params.ContentDisposition = aws.String(artifact.ContentDisposition)
+		}
+		u.encryptUpload(params)
+		if u.conf.StorageClass != "" {
+			params.StorageClass = aws.String(u.conf.StorageClass)
+		}
+		if u.conf.CacheControl != "" {
+			params.CacheControl = aws.String(u.conf.CacheControl)
+		}
+		if metadata := objectMetadata(u.conf.Metadata, artifact); metadata != nil {
+			params.Metadata = aws.StringMap(metadata)
+		}
+		if tagging := u.objectTagging(); tagging != "" {
+			params.Tagging = aws.String(tagging)
+		}
+		if u.grants != nil {
+			params.ACL = nil
+			u.grants.applyToUpload(params)
+		}
+
+		if err := u.checkPartCount(key, artifact.FileSize); err != nil {
+			return err
+		}
+
+		output, err := u.newUploader().UploadWithContext(ctx, params)
+		if err != nil {
+			return fmt.Errorf("Error uploading %q to %q: %v", artifact.Path, key, err)
+		}
+		u.recordUploaded(key, artifact.FileSize, aws.StringValue(output.ETag))
+	} else {
+		u.logger.Debug("Copying `%s` to `%s`", u.artifactPath(artifact), key)
+
+		// Metadata and tags are copied along with the object
+		params := &s3.CopyObjectInput{
+			Bucket:     aws.String(u.BucketName),
+			Key:        aws.String(key),
+			CopySource: aws.String(u.copySource(u.artifactPath(artifact))),
+			ACL:        aws.String(permission),
+		}
+		u.encryptCopy(params)
+		if u.conf.StorageClass != "" {
+			params.StorageClass = aws.String(u.conf.StorageClass)
+		}
+		if u.grants != nil {
+			params.ACL = nil
+			u.grants.applyToCopy(params)
+		}
+
+		output, err := u.client.CopyObjectWithContext(ctx, params)
+		if err != nil {
+			return fmt.Errorf("Error copying %q to %q: %v", artifact.Path, key, err)
+		}
+		etag := ""
+		if output.CopyObjectResult != nil {
+			etag = aws.StringValue(output.CopyObjectResult.ETag)
+		}
+		u.recordUploaded(key, artifact.FileSize, etag)
+	}
+
+	if u.conf.LegalHold {
+		if err := u.placeLegalHold(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	u.logger.Info("Also uploaded artifact \"%s\" to s3://%s/%s", artifact.Path, u.BucketName, key)
+	return nil
+}
+
+// recordUploaded keeps track of uploaded objects for the inventory
+func (u *S3Uploader) recordUploaded(key string, size int64, etag string) {
+	u.uploadedMu.Lock()
+	defer u.uploadedMu.Unlock()
+
+	u.uploaded = append(u.uploaded, s3InventoryObject{
+		Key:          key,
+		Size:         size,
+		LastModified: time.Now(),
+		ETag:         strings.Trim(etag, `"`),
+	})
+}
+
+func (u *S3Uploader) Exists(artifact *api.Artifact) (bool, error) {
+	_, err := u.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(u.artifactPath(artifact)),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Verify compares the ETag of the uploaded object with the one S3 gives the
+// artifact's file
+func (u *S3Uploader) Verify(artifact *api.Artifact) error {
+	head, err := u.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(u.artifactPath(artifact)),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The ETags of objects encrypted with KMS aren't checksums of them
+	if strings.HasPrefix(aws.StringValue(head.ServerSideEncryption), s3.ServerSideEncryptionAwsKms) {
+		u.logger.Warn("Not verifying %q, as the ETags of objects encrypted with aws:kms can't be checked", artifact.Path)
+		return nil
+	}
+
+	return u.compareETag(artifact, head, false)
+}
+
+// Unchanged returns whether the object for the artifact is the same size as
+// the artifact's file and has the ETag S3 would give it. Objects encrypted
+// with aws:kms can't be compared, so they're never unchanged.
+func (u *S3Uploader) Unchanged(artifact *api.Artifact) (bool, error) {
+	head, err := u.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(u.artifactPath(artifact)),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(aws.StringValue(head.ServerSideEncryption), s3.ServerSideEncryptionAwsKms) {
+		u.logger.Debug("Can't compare %q with the existing object, as the ETags of objects encrypted with aws:kms aren't checksums", artifact.Path)
+		return false, nil
+	}
+
+	err = u.compareETag(artifact, head, true)
+	if _, ok := err.(*artifactVerifyError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// compareETag returns an artifactVerifyError if the object's ETag (and its
+// size, if checkSize is set) doesn't match the artifact's file
+func (u *S3Uploader) compareETag(artifact *api.Artifact, head *s3.HeadObjectOutput, checkSize bool) error {
+	f, err := openArtifactFile(u.conf.Open, artifact)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	size, err := artifactFileSize(f)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	// A partial upload of the file is never the same size as it
+	if remoteSize := aws.Int64Value(head.ContentLength); checkSize && remoteSize != size {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: "size", Local: strconv.FormatInt(size, 10), Remote: strconv.FormatInt(remoteSize, 10)}
+	}
+
+	// Objects uploaded in parts have the number of parts in their ETag
+	remote := strings.Trim(aws.StringValue(head.ETag), `"`)
+	var partSize int64
+	if strings.Contains(remote, "-") {
+		partSize = u.newUploader().PartSize
+	}
+
+	local, err := s3ETag(f, size, partSize)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	if local != remote {
+		return &artifactVerifyError{Path: artifact.Path, Checksum: "ETag", Local: local, Remote: remote}
+	}
+	return nil
+}
+
+// s3ETag returns the ETag S3 gives an object of size bytes, which is its MD5
+// if it was uploaded in one request. If partSize is set, it was uploaded in
+// parts of that size (made bigger by the upload manager if there'd be too
+// many), and it's the MD5 of the parts' MD5s followed by the number of parts.
+func s3ETag(r io.Reader, size int64, partSize int64) (string, error) {
+	if partSize == 0 {
+		hash := md5.New()
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	}
+
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+
+	sums := md5.New()
+	parts := 0
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, r, partSize)
+		if n > 0 {
+			sums.Write(part.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x-%d", sums.Sum(nil), parts), nil
+}
+
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath, artifact.Path}
 
 	return strings.Join(parts, "/")
 }
 
+// The key of the artifact under another prefix in the bucket
+func (u *S3Uploader) prefixedArtifactPath(prefix string, artifact *api.Artifact) string {
+	parts := []string{strings.Trim(prefix, "/"), artifact.Path}
+
+	return strings.Join(parts, "/")
+}
+
 func (u *S3Uploader) resolvePermission() (string, error) {
 	permission := "public-read"
+	if u.conf.DenyPublicACL {
+		permission = "private"
+	}
+
 	if os.Getenv("BUILDKITE_S3_ACL") != "" {
 		permission = os.Getenv("BUILDKITE_S3_ACL")
 	} else if os.Getenv("AWS_S3_ACL") != "" {
@@ -132,7 +916,12 @@ func (u *S3Uploader) resolvePermission() (string, error) {
 	}
 
 	switch permission {
-	case "private", "public-read", "public-read-write", "authenticated-read", "bucket-owner-read", "bucket-owner-full-control":
+	case "public-read", "public-read-write", "authenticated-read":
+		if u.conf.DenyPublicACL {
+			return "", fmt.Errorf("The S3 ACL `%s` grants public access, which has been denied", permission)
+		}
+		return permission, nil
+	case "private", "bucket-owner-read", "bucket-owner-full-control":
 		return permission, nil
 	default:
 		return "", fmt.Errorf("Invalid S3 ACL value: `%s`", permission)
@@ -149,3 +938,68 @@ func (u *S3Uploader) serverSideEncryptionEnabled() bool {
 		return false
 	}
 }
+
+// checkS3ServerSideEncryption returns an error if objects can't be encrypted
+// at rest with the server-side encryption and KMS key
+func checkS3ServerSideEncryption(sse string, kmsKeyID string) error {
+	switch sse {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("Invalid S3 server-side encryption value: `%s`, expected %s or %s", sse, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if kmsKeyID != "" && sse != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("A KMS key ID can only be given with %s server-side encryption", s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
+}
+
+// checkS3StorageClass returns an error if objects can't be uploaded with the
+// storage class
+func checkS3StorageClass(storageClass string) error {
+	if storageClass == "" {
+		return nil
+	}
+
+	for _, allowed := range s3.StorageClass_Values() {
+		if storageClass == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid S3 storage class: `%s`, expected one of %s", storageClass, strings.Join(s3.StorageClass_Values(), ", "))
+}
+
+// serverSideEncryption returns the server-side encryption to upload objects
+// with, and the KMS key for aws:kms, falling back to AES256 if it's enabled
+// in the environment
+func (u *S3Uploader) serverSideEncryption() (sse string, kmsKeyID string) {
+	if u.conf.ServerSideEncryption != "" {
+		return u.conf.ServerSideEncryption, u.conf.KMSKeyID
+	}
+	if u.serverSideEncryptionEnabled() {
+		return s3.ServerSideEncryptionAes256, ""
+	}
+	return "", ""
+}
+
+// encryptUpload sets the server-side encryption of an upload, if there's any
+func (u *S3Uploader) encryptUpload(params *s3manager.UploadInput) {
+	sse, kmsKeyID := u.serverSideEncryption()
+	if sse != "" {
+		params.ServerSideEncryption = aws.String(sse)
+	}
+	if kmsKeyID != "" {
+		params.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+}
+
+// encryptCopy sets the server-side encryption of a copy, if there's any
+func (u *S3Uploader) encryptCopy(params *s3.CopyObjectInput) {
+	sse, kmsKeyID := u.serverSideEncryption()
+	if sse != "" {
+		params.ServerSideEncryption = aws.String(sse)
+	}
+	if kmsKeyID != "" {
+		params.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+}
@@ -1,9 +1,30 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/stretchr/testify/require"
 )
 
@@ -14,6 +35,8 @@ func TestParseS3DestinationBucketPath(t *testing.T) {
 		{"s3://my-bucket-name/foo/bar", "foo/bar"},
 		{"s3://starts-with-an-s/and-this-is-its/folder", "and-this-is-its/folder"},
 		{"s3://custom-s3-domain/folder/ends-with-a-slash/", "folder/ends-with-a-slash"},
+		{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/foo/bar", "foo/bar"},
+		{"s3://arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap/foo", "foo"},
 	} {
 		_, path := ParseS3Destination(tc.Destination)
 		if path != tc.Path {
@@ -28,6 +51,9 @@ func TestParseS3DestinationBucketName(t *testing.T) {
 	}{
 		{"s3://my-bucket-name/foo/bar", "my-bucket-name"},
 		{"s3://starts-with-an-s", "starts-with-an-s"},
+		{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/foo/bar", "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap"},
+		{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint:my-ap/foo", "arn:aws:s3:us-west-2:123456789012:accesspoint:my-ap"},
+		{"s3://arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap", "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap"},
 	} {
 		bucket, _ := ParseS3Destination(tc.Destination)
 		if bucket != tc.Bucket {
@@ -90,3 +116,558 @@ func TestResolvePermission(t *testing.T) {
 		os.Unsetenv("BUILDKITE_S3_ACL")
 	}
 }
+
+func TestResolvePermissionDenyingPublicACLs(t *testing.T) {
+	assert := require.New(t)
+	for _, tc := range []struct {
+		Permission     string
+		ExpectedResult string
+		ShouldErr      bool
+	}{
+		{"", "private", false},
+		{"private", "private", false},
+		{"bucket-owner-read", "bucket-owner-read", false},
+		{"bucket-owner-full-control", "bucket-owner-full-control", false},
+		{"public-read", "", true},
+		{"public-read-write", "", true},
+		{"authenticated-read", "", true},
+		{"foo", "", true},
+	} {
+		uploader := &S3Uploader{conf: S3UploaderConfig{DenyPublicACL: true}}
+		os.Setenv("BUILDKITE_S3_ACL", tc.Permission)
+		config, err := uploader.resolvePermission()
+
+		if tc.ShouldErr {
+			assert.Error(err)
+		} else {
+			assert.Nil(err)
+			assert.Equal(tc.ExpectedResult, config)
+		}
+
+		os.Unsetenv("BUILDKITE_S3_ACL")
+	}
+}
+
+func TestExpiryTagging(t *testing.T) {
+	uploader := &S3Uploader{conf: S3UploaderConfig{ExpireAfter: 36 * time.Hour}}
+
+	require.Equal(t, "buildkite-expire-after-days=2", uploader.objectTagging())
+}
+
+func TestBuildS3Inventory(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	inventory, err := buildS3Inventory("my-bucket", "builds/123/inventory", []s3InventoryObject{
+		{Key: "builds/123/log/a b.txt", Size: 12, LastModified: now, ETag: "abc"},
+	}, now)
+	require.NoError(t, err)
+	require.Len(t, inventory, 4)
+
+	var manifest s3InventoryManifest
+	require.NoError(t, json.Unmarshal(inventory["builds/123/inventory/2022-03-04T05-06Z/manifest.json"], &manifest))
+	require.Equal(t, "2016-11-30", manifest.Version)
+	require.Equal(t, "my-bucket", manifest.SourceBucket)
+	require.Equal(t, "1646370367000", manifest.CreationTimestamp)
+	require.Len(t, manifest.Files, 1)
+
+	dataKey := manifest.Files[0].Key
+	require.True(t, strings.HasPrefix(dataKey, "builds/123/inventory/2022-03-04T05-06Z/files/"))
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum(inventory[dataKey])), manifest.Files[0].MD5Checksum)
+
+	gz, err := gzip.NewReader(bytes.NewReader(inventory[dataKey]))
+	require.NoError(t, err)
+	rows, err := csv.NewReader(gz).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"my-bucket", "builds%2F123%2Flog%2Fa+b.txt", "12", "2022-03-04T05:06:07.000Z", "abc"},
+	}, rows)
+
+	require.Equal(t, "s3://my-bucket/"+dataKey+"\n",
+		string(inventory["builds/123/inventory/hive/dt=2022-03-04T05-06Z/symlink.txt"]))
+}
+
+func TestPrefixedArtifactPath(t *testing.T) {
+	assert := require.New(t)
+	u := &S3Uploader{BucketName: "my-bucket", BucketPath: "builds/123"}
+	artifact := &api.Artifact{Path: "pkg/llamas.tar.gz"}
+
+	for _, prefix := range []string{"latest", "/latest/", "latest/"} {
+		assert.Equal("latest/pkg/llamas.tar.gz", u.prefixedArtifactPath(prefix, artifact))
+	}
+	assert.Equal("releases/v1/pkg/llamas.tar.gz", u.prefixedArtifactPath("releases/v1", artifact))
+}
+
+func TestS3PresignedURL(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""),
+	}))
+	u := &S3Uploader{BucketName: "my-bucket", BucketPath: "builds/123", client: s3.New(sess)}
+
+	signedURL, err := u.PresignedURL(&api.Artifact{Path: "pkg/llamas.tar.gz"}, 36*time.Hour)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(signedURL, "https://my-bucket.s3.amazonaws.com/builds/123/pkg/llamas.tar.gz?"), signedURL)
+	require.Contains(t, signedURL, "X-Amz-Expires=129600")
+	require.Contains(t, signedURL, "X-Amz-Credential=AKIDEXAMPLE%2F")
+	require.Contains(t, signedURL, "X-Amz-Signature=")
+}
+
+func TestCheckS3ServerSideEncryption(t *testing.T) {
+	for _, tc := range []struct {
+		SSE, KMSKeyID string
+		ShouldErr     bool
+	}{
+		{"", "", false},
+		{"AES256", "", false},
+		{"aws:kms", "", false},
+		{"aws:kms", "alias/artifacts", false},
+		{"AES256", "alias/artifacts", true},
+		{"", "alias/artifacts", true},
+		{"aes256", "", true},
+		{"lol", "", true},
+	} {
+		err := checkS3ServerSideEncryption(tc.SSE, tc.KMSKeyID)
+		if tc.ShouldErr {
+			require.Error(t, err, "%q %q", tc.SSE, tc.KMSKeyID)
+		} else {
+			require.NoError(t, err, "%q %q", tc.SSE, tc.KMSKeyID)
+		}
+	}
+}
+
+func TestEncryptUploadWithKMS(t *testing.T) {
+	uploader := &S3Uploader{conf: S3UploaderConfig{ServerSideEncryption: "aws:kms", KMSKeyID: "alias/artifacts"}}
+
+	params := &s3manager.UploadInput{}
+	uploader.encryptUpload(params)
+	require.Equal(t, "aws:kms", aws.StringValue(params.ServerSideEncryption))
+	require.Equal(t, "alias/artifacts", aws.StringValue(params.SSEKMSKeyId))
+
+	copyParams := &s3.CopyObjectInput{}
+	uploader.encryptCopy(copyParams)
+	require.Equal(t, "aws:kms", aws.StringValue(copyParams.ServerSideEncryption))
+	require.Equal(t, "alias/artifacts", aws.StringValue(copyParams.SSEKMSKeyId))
+}
+
+func TestEncryptUploadWithDefaultKMSKey(t *testing.T) {
+	uploader := &S3Uploader{conf: S3UploaderConfig{ServerSideEncryption: "aws:kms"}}
+
+	params := &s3manager.UploadInput{}
+	uploader.encryptUpload(params)
+	require.Equal(t, "aws:kms", aws.StringValue(params.ServerSideEncryption))
+	require.Nil(t, params.SSEKMSKeyId)
+}
+
+func TestEncryptUploadFromEnvironment(t *testing.T) {
+	os.Setenv("BUILDKITE_S3_SSE_ENABLED", "true")
+	defer os.Unsetenv("BUILDKITE_S3_SSE_ENABLED")
+
+	params := &s3manager.UploadInput{}
+	(&S3Uploader{}).encryptUpload(params)
+	require.Equal(t, "AES256", aws.StringValue(params.ServerSideEncryption))
+	require.Nil(t, params.SSEKMSKeyId)
+}
+
+func TestNewUploaderUsesPartSize(t *testing.T) {
+	uploader := &S3Uploader{client: s3.New(session.Must(session.NewSession()))}
+	require.Equal(t, s3manager.DefaultUploadPartSize, uploader.newUploader().PartSize)
+
+	uploader.conf.PartSize = 8 * 1024 * 1024
+	require.Equal(t, int64(8*1024*1024), uploader.newUploader().PartSize)
+}
+
+func TestCheckPartCount(t *testing.T) {
+	uploader := &S3Uploader{}
+	require.NoError(t, uploader.checkPartCount("a.bin", 1<<40))
+
+	uploader.conf.PartSize = 8 * 1024 * 1024
+	require.NoError(t, uploader.checkPartCount("a.bin", 8*1024*1024*9999))
+	require.Error(t, uploader.checkPartCount("a.bin", 8*1024*1024*10000))
+}
+
+func TestCheckS3StorageClass(t *testing.T) {
+	for _, storageClass := range []string{"", "STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR"} {
+		require.NoError(t, checkS3StorageClass(storageClass), storageClass)
+	}
+
+	err := checkS3StorageClass("standard_ia")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "STANDARD_IA")
+}
+
+func TestCheckS3Endpoint(t *testing.T) {
+	require.NoError(t, checkS3Endpoint(""))
+	require.NoError(t, checkS3Endpoint("https://minio.example.com:9000"))
+	require.NoError(t, checkS3Endpoint("http://127.0.0.1:9000"))
+	require.Error(t, checkS3Endpoint("minio.example.com"))
+	require.Error(t, checkS3Endpoint("ftp://minio.example.com"))
+}
+
+func TestS3EndpointURL(t *testing.T) {
+	artifact := &api.Artifact{Path: "foo/bar.txt"}
+
+	u := &S3Uploader{BucketName: "my-bucket", BucketPath: "builds", conf: S3UploaderConfig{Endpoint: "https://minio.example.com:9000/", ForcePathStyle: true}}
+	require.Equal(t, "https://minio.example.com:9000/my-bucket/builds/foo/bar.txt", u.URL(artifact))
+
+	u.conf.ForcePathStyle = false
+	require.Equal(t, "https://my-bucket.minio.example.com:9000/builds/foo/bar.txt", u.URL(artifact))
+}
+
+func TestS3UploaderWithEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if r.Method == "GET" {
+			fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>my-bucket</Name></ListBucketResult>`)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_S3_ACCESS_KEY_ID":     "minio",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY": "minio123",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "s3-endpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination:    "s3://my-bucket/builds",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	})
+	require.NoError(t, err)
+
+	err = uploader.Upload(&api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath, ContentType: "text/plain", FileSize: 6})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"GET /my-bucket", "PUT /my-bucket/builds/llamas.txt"}, requests)
+}
+
+func TestS3EndpointRejectsAccessPoints(t *testing.T) {
+	_, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination: "s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap",
+		Endpoint:    "https://minio.example.com",
+	})
+	require.Error(t, err)
+}
+
+func TestS3ETag(t *testing.T) {
+	data := []byte("llamas and alpacas")
+	sum := func(b []byte) []byte {
+		s := md5.Sum(b)
+		return s[:]
+	}
+
+	etag, err := s3ETag(bytes.NewReader(data), int64(len(data)), 0)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x", sum(data)), etag)
+
+	// Uploaded in parts of 8 bytes, the last one shorter
+	parts := append(append(sum(data[:8]), sum(data[8:16])...), sum(data[16:])...)
+	etag, err = s3ETag(bytes.NewReader(data), int64(len(data)), 8)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x-3", sum(parts)), etag)
+
+	// Uploaded in parts that divide it exactly
+	parts = append(sum(data[:9]), sum(data[9:])...)
+	etag, err = s3ETag(bytes.NewReader(data), int64(len(data)), 9)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x-2", sum(parts)), etag)
+}
+
+func TestS3UploaderVerify(t *testing.T) {
+	etag := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>my-bucket</Name></ListBucketResult>`)
+			return
+		}
+		w.Header().Set("ETag", etag)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_S3_ACCESS_KEY_ID":     "minio",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY": "minio123",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "s3-verify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination:    "s3://my-bucket/builds",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath}
+
+	etag = fmt.Sprintf(`"%x"`, md5.Sum([]byte("llamas")))
+	require.NoError(t, uploader.Verify(artifact))
+
+	etag = fmt.Sprintf(`"%x"`, md5.Sum([]byte("alpacas")))
+	err = uploader.Verify(artifact)
+	require.IsType(t, &artifactVerifyError{}, err)
+	require.Equal(t, fmt.Sprintf(`"llamas.txt" was corrupted while uploading, as its ETag is %x but the uploaded object's is %x`,
+		md5.Sum([]byte("llamas")), md5.Sum([]byte("alpacas"))), err.Error())
+}
+
+func TestS3UploaderUnchanged(t *testing.T) {
+	var etag, size string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>my-bucket</Name></ListBucketResult>`)
+			return
+		}
+		if etag == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", size)
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_S3_ACCESS_KEY_ID":     "minio",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY": "minio123",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "s3-unchanged")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination:    "s3://my-bucket/builds",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: absolutePath}
+
+	for _, tc := range []struct {
+		name, etag, size string
+		unchanged        bool
+	}{
+		{"missing", "", "", false},
+		{"same", fmt.Sprintf(`"%x"`, md5.Sum([]byte("llamas"))), "6", true},
+		{"different", fmt.Sprintf(`"%x"`, md5.Sum([]byte("alpacas"))), "7", false},
+		{"partial", fmt.Sprintf(`"%x"`, md5.Sum([]byte("lla"))), "3", false},
+	} {
+		etag, size = tc.etag, tc.size
+		unchanged, err := uploader.Unchanged(artifact)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.unchanged, unchanged, tc.name)
+	}
+}
+
+func TestCheckS3AssumeRole(t *testing.T) {
+	for _, role := range []s3AssumeRole{
+		{},
+		{ARN: "arn:aws:iam::123456789012:role/artifacts"},
+		{ARN: "arn:aws:iam::123456789012:role/ci/artifacts", SessionName: "build-1234", ExternalID: "abc"},
+	} {
+		require.NoError(t, checkS3AssumeRole(role), role.ARN)
+	}
+
+	for _, role := range []s3AssumeRole{
+		{ExternalID: "abc"},
+		{ARN: "artifacts"},
+		{ARN: "arn:aws:iam::123456789012:user/artifacts"},
+		{ARN: "arn:aws:s3:::my-bucket"},
+		{ARN: "arn:aws:iam::123456789012:role/artifacts", SessionName: "build 1234"},
+	} {
+		require.Error(t, checkS3AssumeRole(role), role.ARN)
+	}
+}
+
+func TestWithAssumedRole(t *testing.T) {
+	sess, err := awsS3Session("us-east-1", nil)
+	require.NoError(t, err)
+	sess.Config.Endpoint = aws.String("https://minio.example.com")
+	base := sess.Config.Credentials
+
+	withAssumedRole(sess, s3AssumeRole{ARN: "arn:aws:iam::123456789012:role/artifacts"})
+
+	require.NotEqual(t, base, sess.Config.Credentials)
+	require.Equal(t, "https://minio.example.com", aws.StringValue(sess.Config.Endpoint))
+}
+
+// rehostTransport sends every request to host, keeping the host it was
+// meant for in the X-Original-Host header
+type rehostTransport struct {
+	host string
+}
+
+func (t rehostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Original-Host", req.URL.Host)
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewS3ClientFindsTheBucketsRegion(t *testing.T) {
+	var mu sync.Mutex
+	var probes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-2")
+
+		switch {
+		case r.Method == "HEAD":
+			mu.Lock()
+			probes++
+			mu.Unlock()
+		case strings.Contains(r.Header.Get("X-Original-Host"), "eu-west-2"):
+			w.Write([]byte(`<ListBucketResult></ListBucketResult>`))
+		default:
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	}))
+	defer server.Close()
+	defer func() {
+		s3BucketRegionsMu.Lock()
+		delete(s3BucketRegions, "my-elsewhere-bucket")
+		s3BucketRegionsMu.Unlock()
+	}()
+
+	transport := rehostTransport{host: strings.TrimPrefix(server.URL, "http://")}
+	creds := &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}}
+
+	for i := 0; i < 2; i++ {
+		l := logger.NewBuffer()
+		client, err := newS3Client(l, "my-elsewhere-bucket", "", transport, "us-east-1", s3Endpoint{}, s3AssumeRole{}, creds)
+		require.NoError(t, err)
+		require.Equal(t, "eu-west-2", aws.StringValue(client.Config.Region))
+		require.Contains(t, l.Messages, `[info] The "my-elsewhere-bucket" bucket is in the "eu-west-2" region, not "us-east-1", so using that instead`)
+	}
+
+	// The region is only looked up once
+	require.Equal(t, 1, probes)
+}
+
+func TestS3UploaderNoOverwrite(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	exists := map[string]bool{"builds/old.txt": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+
+		request := r.Method + " " + r.URL.Path
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			request += " If-None-Match: " + match
+		}
+		requests = append(requests, request)
+
+		// The bucket is in the path or the host, depending on the style
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/my-bucket"), "/")
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>my-bucket</Name></ListBucketResult>`)
+		case "HEAD":
+			if !exists[key] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "PUT":
+			if exists[key] && r.Header.Get("If-None-Match") == "*" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+				return
+			}
+			w.Header().Set("ETag", `"abc"`)
+		}
+	}))
+	defer server.Close()
+
+	for key, value := range map[string]string{
+		"BUILDKITE_S3_ACCESS_KEY_ID":     "AKID",
+		"BUILDKITE_S3_SECRET_ACCESS_KEY": "SECRET",
+		"BUILDKITE_S3_DEFAULT_REGION":    "us-east-1",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	dir, err := ioutil.TempDir("", "s3-no-overwrite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	absolutePath := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, ioutil.WriteFile(absolutePath, []byte("llamas"), 0600))
+
+	for _, tc := range []struct {
+		name     string
+		conf     S3UploaderConfig
+		requests []string
+	}{
+		{
+			name: "conditional put",
+			conf: S3UploaderConfig{
+				Transport: rehostTransport{host: strings.TrimPrefix(server.URL, "http://")},
+			},
+			requests: []string{
+				"GET /",
+				"PUT /builds/new.txt If-None-Match: *",
+				"PUT /builds/old.txt If-None-Match: *",
+			},
+		},
+		{
+			name: "head then put",
+			conf: S3UploaderConfig{
+				Endpoint:       server.URL,
+				ForcePathStyle: true,
+			},
+			requests: []string{
+				"GET /my-bucket",
+				"HEAD /my-bucket/builds/new.txt",
+				"PUT /my-bucket/builds/new.txt",
+				"HEAD /my-bucket/builds/old.txt",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = nil
+
+			conf := tc.conf
+			conf.Destination = "s3://my-bucket/builds"
+			conf.NoOverwrite = true
+			uploader, err := NewS3Uploader(logger.Discard, conf)
+			require.NoError(t, err)
+
+			err = uploader.Upload(&api.Artifact{Path: "new.txt", AbsolutePath: absolutePath, ContentType: "text/plain", FileSize: 6})
+			require.NoError(t, err)
+
+			err = uploader.Upload(&api.Artifact{Path: "old.txt", AbsolutePath: absolutePath, ContentType: "text/plain", FileSize: 6})
+			require.EqualError(t, err, `Object already exists at "builds/old.txt", and won't be overwritten`)
+
+			require.Equal(t, tc.requests, requests)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// withSOCKS5Proxy returns a transport that makes its connections through the
+// SOCKS5 proxy, based on the transport if there is one, or the default
+// transport if not. Connections to the proxy are made the way the transport
+// made them before, so they still come from each of the SourceIPs in turn.
+// The proxy resolves the hosts being connected to, as networks that need a
+// proxy often can't resolve them from the agent.
+func withSOCKS5Proxy(transport http.RoundTripper, proxyURL *url.URL) (http.RoundTripper, error) {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	forward := t.DialContext
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, contextDialer(forward))
+	if err != nil {
+		return nil, err
+	}
+
+	t.DialContext = dialer.(proxy.ContextDialer).DialContext
+	return t, nil
+}
+
+// contextDialer makes a DialContext func a proxy.Dialer
+type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Server is just enough of a SOCKS5 proxy to CONNECT through, with
+// username and password auth
+type socks5Server struct {
+	listener net.Listener
+	users    chan string
+	targets  chan string
+}
+
+func newSOCKS5Server(t *testing.T) *socks5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &socks5Server{listener: listener, users: make(chan string, 10), targets: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting, picking username and password auth if it's offered
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(0x00)
+	for _, m := range methods {
+		if m == 0x02 {
+			method = 0x02
+		}
+	}
+	conn.Write([]byte{0x05, method})
+
+	user := ""
+	if method == 0x02 {
+		b := make([]byte, 2)
+		io.ReadFull(conn, b)
+		name := make([]byte, b[1])
+		io.ReadFull(conn, name)
+		io.ReadFull(conn, b[:1])
+		password := make([]byte, b[0])
+		io.ReadFull(conn, password)
+		user = string(name) + ":" + string(password)
+		conn.Write([]byte{0x01, 0x00})
+	}
+	s.users <- user
+
+	// CONNECT request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.targets <- target
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestSOCKS5ProxyTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "llamas")
+	}))
+	defer server.Close()
+
+	proxy := newSOCKS5Server(t)
+	defer proxy.listener.Close()
+
+	for _, tc := range []struct {
+		proxyURL string
+		user     string
+	}{
+		{proxyURL: "socks5://" + proxy.listener.Addr().String()},
+		{proxyURL: "socks5://buildkite:secret@" + proxy.listener.Addr().String(), user: "buildkite:secret"},
+	} {
+		proxyURL, err := url.Parse(tc.proxyURL)
+		require.NoError(t, err)
+
+		transport, err := withSOCKS5Proxy(nil, proxyURL)
+		require.NoError(t, err)
+
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, "llamas", string(body))
+		assert.Equal(t, tc.user, <-proxy.users)
+		assert.Equal(t, server.Listener.Addr().String(), <-proxy.targets)
+	}
+}
+
+func TestSOCKS5ProxyKeepsTheTransport(t *testing.T) {
+	proxyURL, err := url.Parse("socks5://127.0.0.1:1080")
+	require.NoError(t, err)
+
+	base := newSourceIPTransport([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")})
+	transport, err := withSOCKS5Proxy(base, proxyURL)
+	require.NoError(t, err)
+
+	assert.Same(t, base, transport)
+	assert.Equal(t, 100, transport.(*http.Transport).MaxIdleConnsPerHost)
+}
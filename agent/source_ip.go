@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sourceIPDialer binds each new connection to the next of a set of local
+// addresses in turn, to spread connections across network interfaces
+type sourceIPDialer struct {
+	dialers []*net.Dialer
+	next    int
+	mu      sync.Mutex
+}
+
+func newSourceIPDialer(ips []net.IP) *sourceIPDialer {
+	d := &sourceIPDialer{}
+	for _, ip := range ips {
+		d.dialers = append(d.dialers, &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: ip},
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		})
+	}
+	return d
+}
+
+func (d *sourceIPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	dialer := d.dialers[d.next]
+	d.next = (d.next + 1) % len(d.dialers)
+	d.mu.Unlock()
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// newSourceIPTransport returns a transport that makes connections from each
+// of the addresses in turn, or nil to use the default transport if there
+// aren't at least two to spread connections across
+func newSourceIPTransport(ips []net.IP) http.RoundTripper {
+	if len(ips) < 2 {
+		return nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newSourceIPDialer(ips).DialContext
+
+	// Connections are reused, so allow enough idle connections to keep
+	// concurrent uploads spread across the addresses
+	t.MaxIdleConnsPerHost = 100
+
+	return t
+}
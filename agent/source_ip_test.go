@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceIPDialerUsesEachAddressInTurn(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Only Linux routes all of 127.0.0.0/8 to the loopback interface")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	sources := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			sources <- host
+			conn.Close()
+		}
+	}()
+
+	dialer := newSourceIPDialer([]net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")})
+	for i := 0; i < 4; i++ {
+		conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.3", "127.0.0.2", "127.0.0.3"},
+		[]string{<-sources, <-sources, <-sources, <-sources})
+}
+
+func TestSourceIPTransportNeedsMoreThanOneAddress(t *testing.T) {
+	assert.Nil(t, newSourceIPTransport(nil))
+	assert.Nil(t, newSourceIPTransport([]net.IP{net.ParseIP("10.0.0.1")}))
+	assert.IsType(t, &http.Transport{}, newSourceIPTransport([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}))
+}
@@ -0,0 +1,9 @@
+// +build !linux,!darwin,!freebsd
+
+package agent
+
+import "os"
+
+func dataExtents(f *os.File, size int64) ([]dataExtent, error) {
+	return nil, errSparseUnsupported
+}
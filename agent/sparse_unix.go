@@ -0,0 +1,52 @@
+// +build linux darwin freebsd
+
+package agent
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents returns the parts of the file that hold data, skipping holes,
+// using SEEK_DATA and SEEK_HOLE. Filesystems that don't track holes report
+// the whole file as data.
+func dataExtents(f *os.File, size int64) ([]dataExtent, error) {
+	var extents []dataExtent
+
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, unix.SEEK_DATA)
+		if isENXIO(err) {
+			// There's no more data, only a hole up to the end
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := f.Seek(start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+
+		extents = append(extents, dataExtent{Offset: start, Length: end - start})
+		offset = end
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return extents, nil
+}
+
+// isENXIO returns whether a seek failed as there's no data after the offset
+func isENXIO(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == unix.ENXIO
+}
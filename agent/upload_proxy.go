@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ParseUploadProxy parses the URL of a proxy to make upload connections
+// through, which is either an HTTP proxy, as http://host:port or
+// https://host:port, or a SOCKS5 proxy, as socks5://host:port. Either can
+// have a username and password in the URL.
+func ParseUploadProxy(s string) (*url.URL, error) {
+	proxyURL, err := url.Parse(s)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid upload proxy %q, expected a URL like http://proxy.internal:3128", s)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return proxyURL, nil
+	}
+	return nil, fmt.Errorf("Unsupported upload proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+}
+
+// withUploadProxy returns a transport that makes upload connections through
+// the proxy, based on the transport if there is one, or the default transport
+// if not. Without an upload proxy, the transport keeps using the proxy from
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func withUploadProxy(transport http.RoundTripper, proxyURL *url.URL) (http.RoundTripper, error) {
+	if proxyURL.Scheme == "socks5" {
+		return withSOCKS5Proxy(transport, proxyURL)
+	}
+	return withCacheProxy(transport, proxyURL), nil
+}
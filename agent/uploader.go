@@ -1,7 +1,17 @@
 package agent
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
 )
 
 type Uploader interface {
@@ -12,3 +22,255 @@ type Uploader interface {
 	// The actual uploading of the file
 	Upload(*api.Artifact) error
 }
+
+// A DurableUploader can check whether an uploaded artifact is retrievable
+// yet, for stores that don't guarantee read-after-write consistency
+type DurableUploader interface {
+	// Whether the artifact can be retrieved from the store
+	Exists(*api.Artifact) (bool, error)
+}
+
+// A SizeLimitedUploader has a maximum size for a single artifact, so that
+// oversized artifacts can fail before anything is uploaded
+type SizeLimitedUploader interface {
+	// The largest artifact in bytes that can be uploaded
+	MaxArtifactSize() int64
+}
+
+// A VerifyingUploader can check an uploaded artifact against the checksum
+// the store has for it, to catch artifacts corrupted while uploading
+type VerifyingUploader interface {
+	// Returns an error if the store's checksum of the uploaded artifact
+	// doesn't match the artifact's file
+	Verify(*api.Artifact) error
+}
+
+// An UnchangedUploader can check whether an artifact is already in the store
+// exactly as it is, so uploading it again can be skipped
+type UnchangedUploader interface {
+	// Whether the store has an object for the artifact with the same size
+	// and checksum as the artifact's file
+	Unchanged(*api.Artifact) (bool, error)
+}
+
+// A RefreshableUploader can read its credentials again from wherever they
+// came from, for when they expire or are rotated part way through an upload
+type RefreshableUploader interface {
+	// Whether an upload failed because the credentials have expired
+	CredentialsExpired(error) bool
+
+	// Read the credentials again, to be used for the uploads that follow
+	RefreshCredentials() error
+}
+
+// A DirectoryUploader can represent an empty directory at the destination,
+// with a zero-byte object whose key ends in /
+type DirectoryUploader interface {
+	// Create the placeholder of the directory, at its path relative to the
+	// destination
+	UploadDirectory(path string) error
+}
+
+// A PresigningUploader can make URLs that anyone can download an uploaded
+// artifact from until they expire, without any credentials of their own
+type PresigningUploader interface {
+	// A URL the artifact can be downloaded from for the next expires
+	PresignedURL(artifact *api.Artifact, expires time.Duration) (string, error)
+
+	// The longest a presigned URL can be valid for
+	MaxPresignedExpiry() time.Duration
+}
+
+// A ContextUploader can abort an upload part way through, when the context
+// is done before it's finished
+type ContextUploader interface {
+	// The uploading of the file, until it's done or the context is
+	UploadWithContext(context.Context, *api.Artifact) error
+}
+
+// uploadWithContext uploads the artifact with the uploader, aborting it when
+// the context is done if the uploader can
+func uploadWithContext(ctx context.Context, uploader Uploader, artifact *api.Artifact) error {
+	if u, ok := uploader.(ContextUploader); ok {
+		return u.UploadWithContext(ctx, artifact)
+	}
+	return uploader.Upload(artifact)
+}
+
+// An ArtifactFile is the content of an artifact, opened for uploading
+type ArtifactFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// An ArtifactOpener opens the content of an artifact for uploading, for
+// when it doesn't have to be read from the artifact's file on disk
+type ArtifactOpener func(*api.Artifact) (ArtifactFile, error)
+
+// openArtifactFile opens the artifact with open, or from its file on disk
+// if open isn't set
+func openArtifactFile(open ArtifactOpener, artifact *api.Artifact) (ArtifactFile, error) {
+	if open != nil {
+		return open(artifact)
+	}
+
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// artifactFileSize returns the size of the opened artifact, leaving it at the
+// start of its content
+func artifactFileSize(f ArtifactFile) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// UploaderConfig is the configuration given to an UploaderFactory
+type UploaderConfig struct {
+	// The destination to upload to, including the scheme, e.g. s3://bucket/path
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// If set, uploaded artifacts should be removed after this long.
+	// Uploaders that can't expire artifacts should log a warning.
+	ExpireAfter time.Duration
+
+	// Whether to refuse ACLs that grant public access
+	DenyPublicACL bool
+
+	// If set, credentials should be read from Vault before anywhere else
+	Vault *VaultClient
+
+	// If set, should be sent as a header with every request
+	CorrelationID string
+
+	// Other prefixes at the destination that artifacts should also be
+	// uploaded to
+	AlsoPrefixes []string
+
+	// If set, should be used to make HTTP requests
+	Transport http.RoundTripper
+
+	// Whether to place a legal hold on uploaded objects, so they can't be
+	// deleted until it's removed
+	LegalHold bool
+
+	// Whether to fail the upload of artifacts that already exist at the
+	// destination, rather than overwrite them
+	NoOverwrite bool
+
+	// If set, should be used to open artifacts for uploading
+	Open ArtifactOpener
+
+	// Explicit grants to put on objects uploaded to s3:// destinations,
+	// in the form permission=type=grantee
+	S3Grants []string
+
+	// The server-side encryption for objects uploaded to s3:// destinations,
+	// and the KMS key to encrypt them with if it's aws:kms
+	S3ServerSideEncryption string
+	S3KMSKeyID             string
+
+	// If set, objects uploaded to s3:// destinations in parts always use
+	// parts of this size, so their ETags are reproducible
+	S3PartSize int64
+
+	// If set, the storage class for objects uploaded to s3:// destinations
+	S3StorageClass string
+
+	// If set, the region of s3:// destinations, instead of the one in
+	// BUILDKITE_S3_DEFAULT_REGION
+	S3Region string
+
+	// If set, the S3-compatible endpoint s3:// destinations are uploaded to,
+	// and whether it needs path-style addressing
+	S3Endpoint       string
+	S3ForcePathStyle bool
+
+	// If set, the IAM role to assume for s3:// destinations, with an
+	// optional session name and external ID
+	S3AssumeRoleARN         string
+	S3AssumeRoleSessionName string
+	S3ExternalID            string
+
+	// If set, the Cache-Control of objects uploaded to s3:// and gs://
+	// destinations
+	S3CacheControl string
+	GSCacheControl string
+
+	// Metadata to put on every uploaded object, for destinations that
+	// support it
+	Metadata map[string]string
+
+	// Tags to put on objects uploaded to s3:// destinations
+	S3Tags map[string]string
+
+	// If set, the service account key file for gs:// destinations, and a
+	// service account to impersonate with the credentials
+	GSCredentialsFile string
+	GSImpersonate     string
+
+	// Whether to try deploying artifacts to rt:// destinations by their
+	// checksums before uploading their files
+	RTChecksumDeploy bool
+}
+
+// An UploaderFactory creates the Uploader for a destination
+type UploaderFactory func(logger.Logger, UploaderConfig) (Uploader, error)
+
+var (
+	uploaderFactories   = map[string]UploaderFactory{}
+	uploaderFactoriesMu sync.RWMutex
+)
+
+// RegisterUploader registers the factory for destinations with the scheme,
+// e.g. "s3" for s3:// destinations. Registering a scheme again replaces the
+// existing factory, including those of the built in uploaders. Programs that
+// wrap the agent can use this to add their own storage backends.
+func RegisterUploader(scheme string, factory UploaderFactory) {
+	uploaderFactoriesMu.Lock()
+	defer uploaderFactoriesMu.Unlock()
+
+	uploaderFactories[scheme] = factory
+}
+
+// uploaderFactoryFor returns the factory registered for the destination's
+// scheme, if there is one
+func uploaderFactoryFor(destination string) (UploaderFactory, bool) {
+	i := strings.Index(destination, "://")
+	if i < 0 {
+		return nil, false
+	}
+
+	uploaderFactoriesMu.RLock()
+	defer uploaderFactoriesMu.RUnlock()
+
+	factory, ok := uploaderFactories[destination[:i]]
+	return factory, ok
+}
+
+// registeredUploaderSchemes returns the registered schemes, sorted
+func registeredUploaderSchemes() []string {
+	uploaderFactoriesMu.RLock()
+	defer uploaderFactoriesMu.RUnlock()
+
+	schemes := []string{}
+	for scheme := range uploaderFactories {
+		schemes = append(schemes, scheme+"://")
+	}
+	sort.Strings(schemes)
+	return schemes
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storage "google.golang.org/api/storage/v1"
+)
+
+type llamaUploader struct {
+	destination string
+}
+
+func (u *llamaUploader) URL(artifact *api.Artifact) string {
+	return u.destination + "/" + artifact.Path
+}
+
+func (u *llamaUploader) Upload(artifact *api.Artifact) error {
+	return nil
+}
+
+func TestRegisterUploader(t *testing.T) {
+	RegisterUploader("llama", func(l logger.Logger, c UploaderConfig) (Uploader, error) {
+		return &llamaUploader{destination: c.Destination}, nil
+	})
+	defer func() {
+		uploaderFactoriesMu.Lock()
+		delete(uploaderFactories, "llama")
+		uploaderFactoriesMu.Unlock()
+	}()
+
+	factory, ok := uploaderFactoryFor("llama://herd/path")
+	if !assert.True(t, ok) {
+		return
+	}
+
+	uploader, err := factory(logger.Discard, UploaderConfig{Destination: "llama://herd/path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "llama://herd/path/llamas.txt", uploader.URL(&api.Artifact{Path: "llamas.txt"}))
+
+	assert.Equal(t, []string{"az://", "gs://", "llama://", "rt://", "s3://"}, registeredUploaderSchemes())
+}
+
+func TestUploaderFactoryForUnknownSchemes(t *testing.T) {
+	_, ok := uploaderFactoryFor("alpaca://herd/path")
+	assert.False(t, ok)
+
+	_, ok = uploaderFactoryFor("llamas.txt")
+	assert.False(t, ok)
+}
+
+// uploadRecorder is a store that records the requests made to it, and the
+// size of what was uploaded by each
+type uploadRecorder struct {
+	mu       sync.Mutex
+	requests []string
+	sizes    []int
+}
+
+func (r *uploadRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	// Files sent as part of a multipart body are the last part of it
+	if mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				break
+			}
+			body, _ = ioutil.ReadAll(part)
+		}
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path+"?"+req.URL.RawQuery)
+	r.sizes = append(r.sizes, len(body))
+	r.mu.Unlock()
+
+	if req.URL.Query().Get("uploadType") != "" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"name": "path/empty.txt"}`))
+	}
+}
+
+func TestUploadersUploadEmptyArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "empty-artifact")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.txt")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0600))
+
+	for _, tc := range []struct {
+		name     string
+		uploader func(server string) Uploader
+		request  string
+	}{
+		{
+			name: "s3",
+			uploader: func(server string) Uploader {
+				sess := session.Must(session.NewSession(&aws.Config{
+					Region:           aws.String("us-east-1"),
+					Endpoint:         aws.String(server),
+					S3ForcePathStyle: aws.Bool(true),
+					Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+				}))
+				return &S3Uploader{BucketName: "bucket", BucketPath: "path", client: s3.New(sess), logger: logger.Discard}
+			},
+			// A single PutObject, rather than creating a multipart upload
+			request: "PUT /bucket/path/empty.txt?",
+		},
+		{
+			name: "gs",
+			uploader: func(server string) Uploader {
+				service, err := storage.New(http.DefaultClient)
+				require.NoError(t, err)
+				service.BasePath = server + "/storage/v1/"
+				return &GSUploader{BucketName: "bucket", BucketPath: "path", service: service, logger: logger.Discard}
+			},
+			request: "POST /storage/v1/b/bucket/o?alt=json&prettyPrint=false&uploadType=multipart",
+		},
+		{
+			name: "rt",
+			uploader: func(server string) Uploader {
+				u, err := url.Parse(server)
+				require.NoError(t, err)
+				return &ArtifactoryUploader{Repository: "repo", Path: "path", iURL: u, client: http.DefaultClient, logger: logger.Discard}
+			},
+			request: "PUT /repo/path/empty.txt?",
+		},
+		{
+			name: "form",
+			uploader: func(server string) Uploader {
+				return NewFormUploader(logger.Discard, FormUploaderConfig{})
+			},
+			request: "POST /upload?",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &uploadRecorder{}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+
+			artifact := &api.Artifact{
+				Path:         "empty.txt",
+				AbsolutePath: empty,
+				ContentType:  "text/plain",
+				UploadInstructions: &api.ArtifactUploadInstructions{
+					Data: map[string]string{"key": "${artifact:path}"},
+				},
+			}
+			artifact.UploadInstructions.Action.URL = server.URL
+			artifact.UploadInstructions.Action.Method = "POST"
+			artifact.UploadInstructions.Action.Path = "upload"
+			artifact.UploadInstructions.Action.FileInput = "file"
+
+			require.NoError(t, tc.uploader(server.URL).Upload(artifact))
+
+			require.Len(t, recorder.requests, 1)
+			assert.Equal(t, tc.request, recorder.requests[0])
+			assert.Equal(t, []int{0}, recorder.sizes)
+		})
+	}
+}
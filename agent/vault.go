@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The secret key that can hold the artifact upload destination
+const VaultDestinationKey = "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"
+
+type VaultConfig struct {
+	// The address of the Vault server, e.g. https://vault.example.com:8200
+	Addr string
+
+	// The API path of the secret, e.g. secret/data/buildkite/artifacts for a
+	// KV v2 secret or aws/creds/artifacts for dynamic AWS credentials
+	Path string
+
+	// The token to authenticate with, defaults to VAULT_TOKEN or the token
+	// stored in ~/.vault-token by the Vault CLI
+	Token string
+}
+
+// VaultClient reads storage credentials from a Vault secret. The secret is read
+// once and cached for the rest of the run, and if it has a lease then the lease
+// is renewed (or the secret read again) when it's close to expiring.
+type VaultClient struct {
+	// The configuration
+	conf VaultConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The HTTP client to use
+	client *http.Client
+
+	mu        sync.Mutex
+	data      map[string]string
+	leaseID   string
+	renewable bool
+	expires   time.Time
+}
+
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+func NewVaultClient(l logger.Logger, c VaultConfig) (*VaultClient, error) {
+	if c.Addr == "" || c.Path == "" {
+		return nil, errors.New("Both a Vault address and a Vault secret path are required")
+	}
+
+	if c.Token == "" {
+		c.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if c.Token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if token, err := ioutil.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				c.Token = strings.TrimSpace(string(token))
+			}
+		}
+	}
+	if c.Token == "" {
+		return nil, errors.New("No Vault token found, set VAULT_TOKEN or log in with the Vault CLI")
+	}
+
+	return &VaultClient{
+		conf:   c,
+		logger: l,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Get returns the value of a key in the secret, or an empty string if the
+// secret doesn't have it
+func (v *VaultClient) Get(key string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.refresh(); err != nil {
+		return "", err
+	}
+
+	return v.data[key], nil
+}
+
+// Expired returns whether the secret's lease has run out, or will shortly
+func (v *VaultClient) Expired() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.expiredLocked()
+}
+
+// Invalidate discards the cached secret, so that it's read from Vault again
+// the next time it's needed, e.g. once its credentials have been rotated
+func (v *VaultClient) Invalidate() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.data = nil
+}
+
+func (v *VaultClient) expiredLocked() bool {
+	if v.data == nil {
+		return true
+	}
+	return !v.expires.IsZero() && time.Now().After(v.expires)
+}
+
+func (v *VaultClient) refresh() error {
+	if !v.expiredLocked() {
+		return nil
+	}
+
+	if v.data != nil && v.renewable {
+		if err := v.renew(); err == nil {
+			return nil
+		} else {
+			v.logger.Debug("Couldn't renew the Vault lease for %q, reading it again: %v", v.conf.Path, err)
+		}
+	}
+
+	return v.read()
+}
+
+func (v *VaultClient) read() error {
+	v.logger.Debug("Reading storage credentials from Vault secret %q", v.conf.Path)
+
+	res, err := v.do("GET", v.conf.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	data := res.Data
+
+	// KV v2 secrets nest the secret's data alongside its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	v.data = map[string]string{}
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			v.data[key] = s
+		} else {
+			v.data[key] = fmt.Sprintf("%v", value)
+		}
+	}
+
+	v.setLease(res)
+	return nil
+}
+
+func (v *VaultClient) renew() error {
+	v.logger.Debug("Renewing the Vault lease for %q", v.conf.Path)
+
+	body, err := json.Marshal(map[string]string{"lease_id": v.leaseID})
+	if err != nil {
+		return err
+	}
+
+	res, err := v.do("PUT", "sys/leases/renew", body)
+	if err != nil {
+		return err
+	}
+
+	v.setLease(res)
+	return nil
+}
+
+func (v *VaultClient) setLease(res *vaultResponse) {
+	v.leaseID = res.LeaseID
+	v.renewable = res.Renewable
+	v.expires = time.Time{}
+
+	// Renew at two thirds of the lease, so credentials don't expire mid upload
+	if res.LeaseDuration > 0 {
+		v.expires = time.Now().Add(time.Duration(res.LeaseDuration) * time.Second * 2 / 3)
+	}
+}
+
+func (v *VaultClient) do(method string, path string, body []byte) (*vaultResponse, error) {
+	u, err := url.Parse(v.conf.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Vault address %q: %v", v.conf.Addr, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.conf.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error contacting Vault at %q: %v", v.conf.Addr, err)
+	}
+	defer res.Body.Close()
+
+	parsed := &vaultResponse{}
+	if err := json.NewDecoder(res.Body).Decode(parsed); err != nil && res.StatusCode/100 == 2 {
+		return nil, fmt.Errorf("Error parsing the Vault response for %q: %v", path, err)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("Vault denied access to %q, check the Vault token is valid and its policy allows reading it (%d %s)", path, res.StatusCode, strings.Join(parsed.Errors, ", "))
+	case res.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("The Vault secret %q doesn't exist", path)
+	case res.StatusCode/100 != 2:
+		return nil, fmt.Errorf("Error reading %q from Vault (%d %s)", path, res.StatusCode, strings.Join(parsed.Errors, ", "))
+	}
+
+	return parsed, nil
+}
+
+// firstVaultValue returns the value of the first key the secret has
+func firstVaultValue(v *VaultClient, keys ...string) (string, error) {
+	for _, key := range keys {
+		value, err := v.Get(key)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// vaultCredentialsProvider provides AWS credentials from a Vault secret, using
+// either the names of the environment variables the agent supports, or the
+// keys returned by Vault's AWS secrets engine
+type vaultCredentialsProvider struct {
+	vault *VaultClient
+}
+
+func (p *vaultCredentialsProvider) Retrieve() (creds credentials.Value, err error) {
+	creds.ProviderName = "VaultProvider"
+
+	if creds.AccessKeyID, err = firstVaultValue(p.vault, "BUILDKITE_S3_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID", "access_key"); err != nil {
+		return
+	}
+	if creds.SecretAccessKey, err = firstVaultValue(p.vault, "BUILDKITE_S3_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "secret_key"); err != nil {
+		return
+	}
+	if creds.SessionToken, err = firstVaultValue(p.vault, "BUILDKITE_S3_SESSION_TOKEN", "AWS_SESSION_TOKEN", "security_token"); err != nil {
+		return
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		err = fmt.Errorf("The Vault secret %q has no AWS access key and secret key", p.vault.conf.Path)
+	}
+	return
+}
+
+func (p *vaultCredentialsProvider) IsExpired() bool {
+	return p.vault.Expired()
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultClientReadsKVv2Secrets(t *testing.T) {
+	reads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "llamas" {
+			http.Error(rw, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/v1/secret/data/artifacts":
+			reads++
+			rw.Write([]byte(`{"data":{"data":{"AWS_ACCESS_KEY_ID":"id","AWS_SECRET_ACCESS_KEY":"secret","BUILDKITE_ARTIFACT_UPLOAD_DESTINATION":"s3://llamas/"},"metadata":{"version":1}}}`))
+		default:
+			http.Error(rw, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vault, err := NewVaultClient(logger.Discard, VaultConfig{Addr: server.URL, Path: "secret/data/artifacts", Token: "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destination, err := vault.Get(VaultDestinationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3://llamas/", destination)
+
+	creds, err := (&vaultCredentialsProvider{vault: vault}).Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "id", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+
+	// The secret has no lease, so it's only read once
+	assert.Equal(t, 1, reads)
+	assert.False(t, vault.Expired())
+}
+
+func TestVaultClientReadsInvalidatedSecretsAgain(t *testing.T) {
+	reads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reads++
+		rw.Write([]byte(`{"data":{"AWS_ACCESS_KEY_ID":"id","AWS_SECRET_ACCESS_KEY":"secret"}}`))
+	}))
+	defer server.Close()
+
+	vault, err := NewVaultClient(logger.Discard, VaultConfig{Addr: server.URL, Path: "secret/artifacts", Token: "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vault.Get("AWS_ACCESS_KEY_ID"); err != nil {
+		t.Fatal(err)
+	}
+	vault.Invalidate()
+	assert.True(t, vault.Expired())
+
+	if _, err := vault.Get("AWS_ACCESS_KEY_ID"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, reads)
+}
+
+func TestVaultClientRenewsLeases(t *testing.T) {
+	renewals := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/aws/creds/artifacts":
+			rw.Write([]byte(`{"lease_id":"aws/creds/artifacts/123","lease_duration":60,"renewable":true,"data":{"access_key":"id","secret_key":"secret","security_token":"token"}}`))
+		case "/v1/sys/leases/renew":
+			renewals++
+			rw.Write([]byte(`{"lease_id":"aws/creds/artifacts/123","lease_duration":60,"renewable":true}`))
+		default:
+			http.Error(rw, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vault, err := NewVaultClient(logger.Discard, VaultConfig{Addr: server.URL, Path: "aws/creds/artifacts", Token: "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := (&vaultCredentialsProvider{vault: vault}).Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "token", creds.SessionToken)
+	assert.Equal(t, 0, renewals)
+
+	// Pretend the lease is about to expire
+	vault.expires = time.Now().Add(-time.Second)
+	assert.True(t, vault.Expired())
+
+	if _, err := vault.Get("access_key"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, renewals)
+	assert.False(t, vault.Expired())
+}
+
+func TestVaultClientPermissionErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"errors":["permission denied"]}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	vault, err := NewVaultClient(logger.Discard, VaultConfig{Addr: server.URL, Path: "secret/data/artifacts", Token: "alpacas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vault.Get(VaultDestinationKey)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	assert.True(t, strings.Contains(err.Error(), "Vault denied access"), err.Error())
+	assert.True(t, strings.Contains(err.Error(), "permission denied"), err.Error())
+}
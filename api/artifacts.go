@@ -26,6 +26,9 @@ type Artifact struct {
 	// A Sha1Sum calculation of the file
 	Sha1Sum string `json:"sha1sum"`
 
+	// A Sha256Sum calculation of the file
+	Sha256Sum string `json:"sha256sum,omitempty"`
+
 	// ID of the job that created this artifact (from API)
 	JobID string `json:"job_id"`
 
@@ -39,17 +42,30 @@ type Artifact struct {
 	// uploaded
 	UploadDestination string `json:"upload_destination,omitempty"`
 
+	// The group the artifact is shown in by the Buildkite UI, e.g. Logs
+	Group string `json:"group,omitempty"`
+
 	// Information on how to upload this artifact.
 	UploadInstructions *ArtifactUploadInstructions `json:"-"`
 
 	// A specific Content-Type to use on upload
 	ContentType string `json:"-"`
+
+	// The Content-Encoding to store the uploaded object with, e.g. gzip
+	ContentEncoding string `json:"-"`
+
+	// If set, the Content-Disposition to store the uploaded object with
+	ContentDisposition string `json:"-"`
+
+	// Metadata to store with the uploaded object, if the store supports it
+	Metadata map[string]string `json:"-"`
 }
 
 type ArtifactBatch struct {
 	ID                string      `json:"id"`
 	Artifacts         []*Artifact `json:"artifacts"`
 	UploadDestination string      `json:"upload_destination"`
+	RetentionDays     int         `json:"retention_days,omitempty"`
 }
 
 type ArtifactUploadInstructions struct {
@@ -66,6 +82,7 @@ type ArtifactBatchCreateResponse struct {
 	ID                 string                      `json:"id"`
 	ArtifactIDs        []string                    `json:"artifact_ids"`
 	UploadInstructions *ArtifactUploadInstructions `json:"upload_instructions"`
+	RetentionDays      int                         `json:"retention_days,omitempty"`
 }
 
 // ArtifactSearchOptions specifies the optional parameters to the
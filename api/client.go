@@ -27,6 +27,10 @@ const (
 	defaultUserAgent = "buildkite-agent/api"
 )
 
+// CorrelationIDHeader is the header used to send a correlation ID, so requests
+// can be traced across systems
+const CorrelationIDHeader = "X-Correlation-ID"
+
 // Config is configuration for the API Client
 type Config struct {
 	// Endpoint for API requests. Defaults to the public Buildkite Agent API.
@@ -47,6 +51,9 @@ type Config struct {
 
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
+
+	// If set, sent in the CorrelationIDHeader of every request
+	CorrelationID string
 }
 
 // A Client manages communication with the Buildkite Agent API.
@@ -162,6 +169,10 @@ func (c *Client) newRequest(method, urlStr string, body interface{}) (*http.Requ
 
 	req.Header.Add("User-Agent", c.conf.UserAgent)
 
+	if c.conf.CorrelationID != "" {
+		req.Header.Add(CorrelationIDHeader, c.conf.CorrelationID)
+	}
+
 	if body != nil {
 		req.Header.Add("Content-Type", "application/json")
 	}
@@ -185,6 +196,10 @@ func (c *Client) newFormRequest(method, urlStr string, body *bytes.Buffer) (*htt
 		req.Header.Add("User-Agent", c.conf.UserAgent)
 	}
 
+	if c.conf.CorrelationID != "" {
+		req.Header.Add(CorrelationIDHeader, c.conf.CorrelationID)
+	}
+
 	return req, nil
 }
 
@@ -418,12 +418,7 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Use Datadog Distributions for Timing metrics",
 			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
 		},
-		cli.StringFlag{
-			Name:   "log-format",
-			Usage:  "The format to use for the logger output",
-			EnvVar: "BUILDKITE_LOG_FORMAT",
-			Value:  "text",
-		},
+		LogFormatFlag,
 		cli.IntFlag{
 			Name:   "spawn",
 			Usage:  "The number of agents to spawn in parallel",
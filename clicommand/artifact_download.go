@@ -42,7 +42,28 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   Files uploaded with --cdc are stored as a <file>.cdc.json chunk list. Use
+   --cdc to download their chunks and reassemble them, verifying each chunk
+   and the file's SHA-1, after which the chunk list is removed:
+
+   $ buildkite-agent artifact download "cache/*" . --cdc
+
+   Files uploaded with --split-size are stored as parts along with a
+   <file>.split.json part list. Download the parts and the part list with a
+   query that matches them all, and use --split to reassemble each file,
+   verifying each part and the file's SHA-1, after which the parts and part
+   list are removed:
+
+   $ buildkite-agent artifact download "pkg/release.tar*" . --split
+
+   Sparse files uploaded with --sparse are stored as <file>.sparse, holding
+   their data, and a <file>.sparse.json extent list. Download both and use
+   --sparse to rebuild each file with its holes, verifying its SHA-1, after
+   which the data and extent list are removed:
+
+   $ buildkite-agent artifact download "disk.img.sparse*" . --sparse`
 
 type ArtifactDownloadConfig struct {
 	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
@@ -50,6 +71,10 @@ type ArtifactDownloadConfig struct {
 	Step               string `cli:"step"`
 	Build              string `cli:"build" validate:"required"`
 	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	RepairFromParity   bool   `cli:"repair-from-parity"`
+	CDC                bool   `cli:"cdc"`
+	Split              bool   `cli:"split"`
+	Sparse             bool   `cli:"sparse"`
 
 	// Global flags
 	Debug   bool         `cli:"debug"`
@@ -85,6 +110,26 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.BoolFlag{
+			Name:   "repair-from-parity",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_REPAIR_FROM_PARITY",
+			Usage:  "Repair downloaded artifacts using their .parity companions, if they were downloaded too",
+		},
+		cli.BoolFlag{
+			Name:   "cdc",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_DOWNLOAD_CDC",
+			Usage:  "Reassemble files that were uploaded with --cdc from their chunks",
+		},
+		cli.BoolFlag{
+			Name:   "split",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_DOWNLOAD_SPLIT",
+			Usage:  "Reassemble files that were uploaded with --split-size from their parts, if they were downloaded too",
+		},
+		cli.BoolFlag{
+			Name:   "sparse",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_DOWNLOAD_SPARSE",
+			Usage:  "Rebuild sparse files that were uploaded with --sparse from their data and extent lists",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -123,6 +168,10 @@ var ArtifactDownloadCommand = cli.Command{
 			BuildID:            cfg.Build,
 			Step:               cfg.Step,
 			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			RepairFromParity:   cfg.RepairFromParity,
+			CDC:                cfg.CDC,
+			Split:              cfg.Split,
+			Sparse:             cfg.Sparse,
 			DebugHTTP:          cfg.DebugHTTP,
 		})
 
@@ -0,0 +1,162 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailJob(t *testing.T) {
+	defer func(interval time.Duration) { failJobRetryInterval = interval }(failJobRetryInterval)
+	failJobRetryInterval = time.Millisecond
+
+	for _, tc := range []struct {
+		Name     string
+		Statuses []int
+		Requests int
+		Err      bool
+	}{
+		{"finished", []int{http.StatusOK}, 1, false},
+		{"retried", []int{http.StatusInternalServerError, http.StatusOK}, 2, false},
+		{"unauthorized", []int{http.StatusUnauthorized}, 1, true},
+		{"not found", []int{http.StatusNotFound}, 1, true},
+		{"already finished", []int{http.StatusUnprocessableEntity}, 1, true},
+		{"gives up", []int{http.StatusInternalServerError}, 10, true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies []map[string]interface{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				assert.Equal(t, "PUT", req.Method)
+				assert.Equal(t, "/jobs/job-1/finish", req.URL.Path)
+
+				var body map[string]interface{}
+				assert.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+				bodies = append(bodies, body)
+
+				status := tc.Statuses[len(tc.Statuses)-1]
+				if len(bodies) <= len(tc.Statuses) {
+					status = tc.Statuses[len(bodies)-1]
+				}
+				rw.WriteHeader(status)
+				rw.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+			err := failJob(logger.Discard, client, "job-1")
+			if tc.Err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			require.Len(t, bodies, tc.Requests)
+			for _, body := range bodies {
+				assert.Equal(t, "1", body["exit_status"])
+
+				finishedAt, ok := body["finished_at"].(string)
+				require.True(t, ok)
+				_, err := time.Parse(time.RFC3339Nano, finishedAt)
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReadUploadPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-patterns")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		Name     string
+		Content  string
+		Patterns []string
+		Err      string
+	}{
+		{"one per line", "log/*.log\nreports/**/*.xml\n", []string{"log/*.log", "reports/**/*.xml"}, ""},
+		{"blank lines", "\nlog/*.log\n\n\nreports/*.xml", []string{"log/*.log", "reports/*.xml"}, ""},
+		{"comments", "# logs\nlog/*.log\n  # reports\n", []string{"log/*.log"}, ""},
+		{"surrounding whitespace", "  log/*.log\t\r\n\treports/*.xml  \n", []string{"log/*.log", "reports/*.xml"}, ""},
+		{"empty", "\n# nothing\n", []string{}, ""},
+		{"delimiter", "log/*.log\nfoo;bar\n", nil, `Pattern "foo;bar" can't contain ";", give each pattern on a line of its own`},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(dir, "patterns")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.Content), 0600))
+
+			patterns, err := readUploadPatterns(path)
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Patterns, patterns)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := readUploadPatterns(filepath.Join(dir, "missing"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestLoneDestination(t *testing.T) {
+	for _, tc := range []struct {
+		Name        string
+		Config      ArtifactUploadConfig
+		Args        int
+		UploadPaths string
+		Destination string
+	}{
+		{
+			Name:        "lone URL with --from-file",
+			Config:      ArtifactUploadConfig{FromFile: "-", UploadPaths: "s3://bucket/path"},
+			Args:        1,
+			UploadPaths: "",
+			Destination: "s3://bucket/path",
+		},
+		{
+			Name:        "lone pattern with --from-file",
+			Config:      ArtifactUploadConfig{FromFile: "-", UploadPaths: "log/*.log"},
+			Args:        1,
+			UploadPaths: "log/*.log",
+		},
+		{
+			Name:        "pattern and destination with --from-file",
+			Config:      ArtifactUploadConfig{FromFile: "-", UploadPaths: "log/*.log", Destination: "s3://bucket/path"},
+			Args:        2,
+			UploadPaths: "log/*.log",
+			Destination: "s3://bucket/path",
+		},
+		{
+			Name:        "lone URL without --from-file",
+			Config:      ArtifactUploadConfig{UploadPaths: "s3://bucket/path"},
+			Args:        1,
+			UploadPaths: "s3://bucket/path",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := tc.Config
+			loneDestination(&cfg, tc.Args)
+			assert.Equal(t, tc.UploadPaths, cfg.UploadPaths)
+			assert.Equal(t, tc.Destination, cfg.Destination)
+		})
+	}
+}
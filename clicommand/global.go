@@ -70,6 +70,13 @@ var NoColorFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_NO_COLOR",
 }
 
+var LogFormatFlag = cli.StringFlag{
+	Name:   "log-format",
+	Usage:  "The format to use for the logger output, either text or json",
+	EnvVar: "BUILDKITE_LOG_FORMAT",
+	Value:  "text",
+}
+
 var ExperimentsFlag = cli.StringSliceFlag{
 	Name:   "experiment",
 	Value:  &cli.StringSlice{},
@@ -208,5 +215,10 @@ func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 		conf.DisableHTTP2 = noHTTP2.(bool)
 	}
 
+	correlationID, err := reflections.GetField(cfg, "CorrelationID")
+	if correlationID != "" && err == nil {
+		conf.CorrelationID = correlationID.(string)
+	}
+
 	return conf
 }
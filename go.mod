@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	cloud.google.com/go v0.0.0-20170217213217-65216237311a
+	filippo.io/age v1.0.0
 	github.com/DataDog/datadog-go v3.7.2+incompatible
 	github.com/aws/aws-sdk-go v1.43.18
 	github.com/buildkite/bintest/v3 v3.1.0
@@ -17,6 +18,7 @@ require (
 	github.com/google/go-querystring v0.0.0-20170111101155-53e6ce116135
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/googleapis/gax-go v0.0.0-20161107002406-da06d194a00e // indirect
+	github.com/klauspost/reedsolomon v1.9.16
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/mattn/go-zglob v0.0.0-20180803001819-2ea3427bfa53
 	github.com/mitchellh/go-homedir v1.0.0
@@ -32,7 +34,8 @@ require (
 	github.com/sergi/go-diff v1.0.0 // indirect
 	github.com/stretchr/testify v1.5.1
 	github.com/urfave/cli v1.22.4
-	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
 	golang.org/x/oauth2 v0.0.0-20181003184128-c57b0facaced
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
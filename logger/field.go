@@ -56,6 +56,14 @@ func IntField(key string, value int) Field {
 	}
 }
 
+func Int64Field(key string, value int64) Field {
+	return GenericField{
+		key:    key,
+		value:  value,
+		format: "%d",
+	}
+}
+
 func DurationField(key string, value time.Duration) Field {
 	return GenericField{
 		key:    key,